@@ -13,7 +13,9 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -24,6 +26,7 @@ import (
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/soheilhy/cmux"
 )
 
@@ -35,8 +38,18 @@ import (
 
 // App is a struct representing the externally-accessible state of the data store
 type App struct {
-	db   dbAccess
-	view viewList
+	db       dbAccess
+	view     viewList
+	ring     *Ring        // Partitions keys across the view, nil means every node stores every key
+	quorum   *Quorum      // Coordinates requests which ask for more than one replica
+	hints    *HintStore   // Writes waiting for replicas which couldn't be reached
+	members  *Membership  // Failure detector's view of which members are alive
+	phi      *PhiDetector // Suspicion level of each peer
+	views    *ViewLog     // Agrees view changes with the other members, nil means they're made locally
+	rebal    *Rebalancer  // Streams keys to their new owners after a view change
+	siblings bool         // Keep concurrent writes as siblings instead of picking one
+	clock    *HLC         // Stamps writes, and is moved past the stamps in session tokens
+	feed     *Feed        // Changes stored in the KVS, streamed to watchers
 }
 
 // Initialize takes a Listener, assigns a Router to it, and then attaches HTTP handler
@@ -52,17 +65,39 @@ func (app *App) Initialize(l net.Listener) {
 	s := r.PathPrefix(rootURL).Subrouter()
 
 	// This is the search handler, which has a different prefix
-	s.HandleFunc(search+keySuffix, app.SearchHandler).Methods(http.MethodGet)
+	s.HandleFunc(search+keySuffix, app.sessions(app.SearchHandler)).Methods(http.MethodGet)
 
 	// These handlers implement the /view endpoint and handle GET, PUT, DELETE
 	r.HandleFunc(view, app.ViewPutHandler).Methods(http.MethodPut)
 	r.HandleFunc(view, app.ViewGetHandler).Methods(http.MethodGet)
 	r.HandleFunc(view, app.ViewDeleteHandler).Methods(http.MethodDelete)
 
+	// These handlers report on the node's internals
+	r.HandleFunc(admin+"/hints", app.HintsHandler).Methods(http.MethodGet)
+	r.HandleFunc(admin+"/metrics", app.MetricsHandler).Methods(http.MethodGet)
+	r.HandleFunc(admin+"/phi", app.PhiHandler).Methods(http.MethodGet)
+
+	// This handler applies a batch of writes to several keys at once
+	s.HandleFunc(batch, app.BatchHandler).Methods(http.MethodPost)
+
+	// This handler reads several keys as one causally consistent cut
+	s.HandleFunc(mget, app.MgetHandler).Methods(http.MethodPost)
+
+	// This handler streams changes to the keys under a prefix
+	s.HandleFunc(watch, app.WatchHandler).Methods(http.MethodGet)
+
+	// This handler lists the keys in a range, in order
+	r.HandleFunc(rootURL, app.ScanHandler).Methods(http.MethodGet)
+
+	// These handlers implement version 2 of the KVS API, which takes and returns JSON
+	r.HandleFunc(apiKey, app.V2PutHandler).Methods(http.MethodPut)
+	r.HandleFunc(apiKey, app.V2GetHandler).Methods(http.MethodGet)
+	r.HandleFunc(apiKey, app.V2DeleteHandler).Methods(http.MethodDelete)
+
 	// These handlers implement the KVS API and handle GET, PUT, DELETE
-	s.HandleFunc(keySuffix, app.PutHandler).Methods(http.MethodPut)
-	s.HandleFunc(keySuffix, app.GetHandler).Methods(http.MethodGet)
-	s.HandleFunc(keySuffix, app.DeleteHandler).Methods(http.MethodDelete)
+	s.HandleFunc(keySuffix, app.sessions(app.PutHandler)).Methods(http.MethodPut)
+	s.HandleFunc(keySuffix, app.sessions(app.GetHandler)).Methods(http.MethodGet)
+	s.HandleFunc(keySuffix, app.sessions(app.DeleteHandler)).Methods(http.MethodDelete)
 
 	// LoggingHandler allows us to log all router activity to our predefined log
 	Logger := handlers.LoggingHandler(MultiLogOutput, r)
@@ -94,26 +129,48 @@ func (app *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Each of these variables is declared here and then defined further down in
 	// the function, depending on how the control structures shake out.
-	var err error                         // Error value if any
-	var value string                      // Value to be stored
-	var payloadString string              // The payload sent by the client
-	var payloadInt map[string]int         // The payload we store
-	var payloadMap map[string]interface{} // Intermediate map
-	var status int                        // Status code returned
-	var body []byte                       // Body of response
+	var err error              // Error value if any
+	var value string           // Value to be stored
+	var payloadString string   // The payload sent by the client
+	var payloadInt VectorClock // The payload we store
+	var context VectorClock    // Causal context the client read, when siblings are on
+	var contextErr error       // Error decoding the context, if any
+	var ttl time.Duration      // How long the value lives, zero if it doesn't expire
+	var ttlErr error           // Error reading the TTL, if any
+	var payloadErr error       // Error decoding the payload, if any
+	var valueMissing bool      // The client sent a form without a value
+	var cond Precondition      // Condition the write puts on the version it replaces
+	var condErr error          // Error reading the condition, if any
+	var storeErr error         // Error from a write which wasn't made, if any
+	var status int             // Status code returned
+	var body []byte            // Body of response
+
+	// A conditional write is checked by the key's coordinator, and keys this node
+	// doesn't store are handled by a node that does
+	relayed, err := app.coordinate(w, r, mux.Vars(r)["subject"])
+	if err != nil {
+		status, body = coordinatorFailure(err)
+		w.WriteHeader(status)
+		w.Write(body)
+		return
+	}
+	if relayed || app.forward(w, r, mux.Vars(r)["subject"]) {
+		return
+	}
 
 	// Safety check - the system will panic if it tries to read a nil body
 	if r.Body != nil {
 		// Parse the form so we can read values in the request
 		r.ParseForm()
 
-		// Create an intermediate map to translate the payload
-		payloadMap = make(map[string]interface{})
-
 		// It's possible to send an empty form
 		if len(r.Form) > 0 {
-			// Read the values from the request body
-			value = r.Form["val"][0]
+			// Read the values from the request body, which had better include one to store
+			if len(r.Form["val"]) > 0 {
+				value = r.Form["val"][0]
+			} else {
+				valueMissing = true
+			}
 
 			// Check to see if the client sends a payload
 			if r.Form["payload"] != nil {
@@ -122,25 +179,28 @@ func (app *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 
 				// And that string might be empty
 				if payloadString != "" {
-					// Decode the payload into the empty map from above
-					err = json.Unmarshal([]byte(payloadString), &payloadMap)
-					if err != nil {
-						log.Fatalln(err)
-					}
+					// Decode the payload into a vector clock
+					payloadErr = json.Unmarshal([]byte(payloadString), &payloadInt)
 				}
 			}
+
+			// With siblings on, the client sends back the context of the siblings it merged
+			if r.Form["context"] != nil && r.Form["context"][0] != "" {
+				contextErr = json.Unmarshal([]byte(r.Form["context"][0]), &context)
+			}
+
+			// The client may ask for the value to expire
+			if r.Form["ttl"] != nil && r.Form["ttl"][0] != "" {
+				ttl, ttlErr = parseTTL(r.Form["ttl"][0])
+			}
 		}
 
-		// Convert the intermediate map into map[string]int as stored by KVS by
-		// iterating over all the keys in the client's payload. Start by creating
-		// the intermediate map.
-		payloadInt = make(map[string]int)
-		for k, v := range payloadMap {
-			// Numbers decoded by JSON are stored as
-			// float64, so we start with a type assertion
-			// To register them that way. We then cast it
-			// to an int and store it in the map.
-			payloadInt[k] = int(v.(float64))
+		// The client may make the write conditional on the version it replaces
+		cond, condErr = requestPrecondition(r, r.Form)
+
+		// A client which sent no payload, or one which can't be read, starts with an empty clock
+		if payloadInt == nil || payloadErr != nil {
+			payloadInt = NewVectorClock()
 		}
 
 		// This pulls the {subject} out of the URL, that forms the key. It's called
@@ -150,7 +210,37 @@ func (app *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 		key := vars["subject"]
 
 		// Check for valid input
-		if len(value) > maxVal {
+		if payloadErr != nil {
+			// The payload isn't a vector clock, so there's no telling what the client has seen
+			log.Println("ERROR: Invalid payload: ", payloadErr)
+
+			status = http.StatusBadRequest // code 400
+
+			resp := map[string]interface{}{
+				"result":  "Error",
+				"msg":     "Invalid payload",
+				"payload": payloadInt,
+			}
+			body, err = json.Marshal(resp)
+			if err != nil {
+				log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+			}
+		} else if valueMissing {
+			// There's nothing to store, so turn the client away rather than guess
+			log.Println("ERROR: No value sent with request")
+
+			status = http.StatusBadRequest // code 400
+
+			resp := map[string]interface{}{
+				"result":  "Error",
+				"msg":     "Value is missing",
+				"payload": payloadInt,
+			}
+			body, err = json.Marshal(resp)
+			if err != nil {
+				log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+			}
+		} else if len(value) > maxVal {
 			// The value is > 1MB so error out
 			log.Println("ERROR: Value length too long")
 
@@ -188,6 +278,51 @@ func (app *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
 			}
+		} else if contextErr != nil {
+			// The context can't be decoded, so we can't tell which siblings it replaces
+			log.Println("ERROR: Invalid causal context: ", contextErr)
+
+			status = http.StatusBadRequest // code 400
+
+			resp := map[string]interface{}{
+				"result":  "Error",
+				"msg":     "Invalid causal context",
+				"payload": payloadInt,
+			}
+			body, err = json.Marshal(resp)
+			if err != nil {
+				log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+			}
+		} else if condErr != nil {
+			// The If-Match or If-None-Match condition can't be read
+			log.Println("ERROR: Invalid precondition: ", condErr)
+
+			status = http.StatusBadRequest // code 400
+
+			resp := map[string]interface{}{
+				"result":  "Error",
+				"msg":     "Invalid precondition",
+				"payload": payloadInt,
+			}
+			body, err = json.Marshal(resp)
+			if err != nil {
+				log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+			}
+		} else if ttlErr != nil {
+			// The TTL isn't a positive number of seconds or a duration
+			log.Println("ERROR: Invalid TTL: ", ttlErr)
+
+			status = http.StatusBadRequest // code 400
+
+			resp := map[string]interface{}{
+				"result":  "Error",
+				"msg":     "Invalid TTL",
+				"payload": payloadInt,
+			}
+			body, err = json.Marshal(resp)
+			if err != nil {
+				log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+			}
 		} else {
 			// key/val are valid inputs, let's insert into the db
 			log.Println("Key and value lengths ok")
@@ -205,11 +340,12 @@ func (app *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 			if alive && payloadInt[key] <= version {
 				log.Println("Key already exists in DB, overwriting...")
 
-				// Set the timestamp for the new version of the key.
-				time := time.Now()
+				// Set the timestamp for the new version of the key. It's stamped by the
+				// clock the KVS stamps writes with, so a TTL runs from the write's timestamp.
+				time := app.clock.Now()
 
 				// Create the payload to be inserted into the db, starting with this key
-				newPayload := map[string]int{key: version + 1}
+				newPayload := VectorClock{key: version + 1}
 
 				// Add each of the client's payload elements
 				for k, v := range payloadInt {
@@ -218,8 +354,8 @@ func (app *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 					}
 				}
 
-				// Put it in the db
-				app.db.Put(key, value, time, newPayload)
+				// Put it in the db, if the client's condition holds
+				storeErr = app.store(key, value, time, newPayload, context, expiresAt(time, ttl), cond)
 
 				// Set status
 				status = http.StatusCreated // code 201
@@ -231,6 +367,7 @@ func (app *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 					"msg":      "Updated successfully",
 					"payload":  payloadInt,
 				}
+				app.addSiblings(resp, key, nil)
 				body, err = json.Marshal(resp)
 				if err != nil {
 					log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
@@ -240,10 +377,10 @@ func (app *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 				// In either case, from the client's perspective, it doesn't exist.
 				log.Println("Key does not exist in DB, inserting...")
 				status = http.StatusOK // code 200
-				time := time.Now()
+				time := app.clock.Now()
 
 				// Create the payload to be inserted into the db, starting with this key
-				newPayload := map[string]int{key: version + 1}
+				newPayload := VectorClock{key: version + 1}
 
 				// Add each of the client's payload elements
 				for k, v := range payloadInt {
@@ -252,8 +389,8 @@ func (app *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 					}
 				}
 
-				// Put it in the db
-				app.db.Put(key, value, time, newPayload)
+				// Put it in the db, if the client's condition holds
+				storeErr = app.store(key, value, time, newPayload, context, expiresAt(time, ttl), cond)
 
 				// And a slightly different response body
 				resp := map[string]interface{}{
@@ -261,11 +398,23 @@ func (app *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 					"msg":      "Added successfully",
 					"payload":  payloadInt,
 				}
+				app.addSiblings(resp, key, nil)
 				body, err = json.Marshal(resp)
 				if err != nil {
 					log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
 				}
 			}
+
+			// A write which wasn't made, or which the client asked W > 1 replicas to hold
+			// and fewer do, fails whatever was built above
+			if storeErr != nil {
+				status, body = app.writeFailure(storeErr, key, payloadInt)
+			} else if want := app.quorum.WriteSize(r); want > 1 {
+				acks, err := app.writeQuorum(key, want)
+				if err != nil {
+					status, body = quorumFailure(err, acks, want, payloadInt)
+				}
+			}
 		}
 	} else {
 		// We only get here in a weird state where the body didn't happen or something.
@@ -302,11 +451,15 @@ func (app *App) GetHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["subject"]
 
+	// Keys this node doesn't store are handled by a node that does
+	if app.forward(w, r, key) {
+		return
+	}
+
 	// These two variables are declared here and assigned further down.
-	var payloadMap map[string]interface{} // Intermediate map for decoding
-	var payloadString string              // Payload sent by the client
-	var err error                         // Error value
-	var body []byte                       // Response body
+	var payloadString string // Payload sent by the client
+	var err error            // Error value
+	var body []byte          // Response body
 
 	// Check that the body isn't nil
 	if r.Body != nil {
@@ -314,34 +467,21 @@ func (app *App) GetHandler(w http.ResponseWriter, r *http.Request) {
 		s, _ := ioutil.ReadAll(r.Body)
 		log.Println(string(s))
 
-		// Python packs the input in Unicode for some reason so we need to convert it
-		sBody, _ := url.QueryUnescape(string(s))
-		if len(sBody) > 0 {
-			// The actual payload we care about comes after the equals sign. This splits the
-			// input into a slice and takes the second element of that slice for the payload.
-			payloadString = strings.Split(sBody, "=")[1]
-			log.Println(payloadString)
-		}
+		// Python packs the input in Unicode for some reason, and bodyField undoes that
+		payloadString = bodyField(s, "payload")
+		log.Println(payloadString)
 	}
 
-	// Create an intermediate map to parse the payload into
-	payloadMap = make(map[string]interface{})
+	// A client which sent no payload starts with an empty clock
+	payloadInt := NewVectorClock()
 
 	if payloadString != "" {
-		// Read the payload into the intermediate map
-		err = json.Unmarshal([]byte(payloadString), &payloadMap)
-		if err != nil {
-			log.Fatalln(err)
+		// Read the payload into the clock, and turn the client away if it can't be
+		if err = json.Unmarshal([]byte(payloadString), &payloadInt); err != nil {
+			invalidPayload(w, err)
+			return
 		}
 	}
-
-	// Convert the intermediate map into map[string]int as needed by KVS. As with PutHandler
-	// we use a type assertion to set the value to float64 in the payloadMap and then typecast
-	// it as an integer to store it in the payloadInt map.
-	payloadInt := make(map[string]int)
-	for k, v := range payloadMap {
-		payloadInt[k] = int(v.(float64))
-	}
 	log.Println(payloadInt)
 
 	// Same content type for everything
@@ -349,6 +489,23 @@ func (app *App) GetHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Here we'll check to see if the requested key exists and get its version.
 	alive, version := app.db.Contains(key)
+
+	// If the client asked for R > 1, answer with the newest version any of the R replicas has
+	var merged KeyEntry
+	if want := app.quorum.ReadSize(r); want > 1 {
+		var replies int
+		merged, replies, err = app.readQuorum(key, want, app.quorum.ReadRepair(r))
+		if err != nil {
+			status, body := quorumFailure(err, replies, want, payloadInt)
+			w.WriteHeader(status)
+			w.Write(body)
+			return
+		}
+		alive, version = false, 0
+		if merged != nil {
+			alive, version = live(merged, time.Now()), merged.GetVersion()
+		}
+	}
 	log.Println("Alive: ", alive)
 	log.Println("Version: ", version)
 	log.Println("Client version: ", payloadInt[key])
@@ -377,8 +534,11 @@ func (app *App) GetHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK) // code 200
 
 		// Get the key and its stored payload from the DB. Get() returns the supremum of the client's and key's
-		// payloads using the function mergeClocks(), and that's what is returned below.
+		// payloads using VectorClock.Merge(), and that's what is returned below.
 		val, payload := app.db.Get(key, payloadInt)
+		if merged != nil {
+			val, payload = merged.GetValue(), payloadInt.Merge(merged.GetClock())
+		}
 		log.Println("Key found in DB")
 
 		// Package it into a map->JSON->[]byte
@@ -387,6 +547,8 @@ func (app *App) GetHandler(w http.ResponseWriter, r *http.Request) {
 			"value":   val,
 			"payload": payload,
 		}
+		app.addSiblings(resp, key, merged)
+		app.addTTL(resp, key, merged)
 		body, err = json.Marshal(resp)
 		if err != nil {
 			log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
@@ -420,11 +582,15 @@ func (app *App) SearchHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["subject"]
 
+	// Keys this node doesn't store are handled by a node that does
+	if app.forward(w, r, key) {
+		return
+	}
+
 	// Declare some variables here and define them below.
 	var body []byte          // Response body
 	var err error            // Error value
 	var payloadString string // Payload sent by the client
-	var payloadMap map[string]interface{}
 
 	// Same content type for everything
 	w.Header().Set("Content-Type", "application/json")
@@ -435,40 +601,42 @@ func (app *App) SearchHandler(w http.ResponseWriter, r *http.Request) {
 		s, _ := ioutil.ReadAll(r.Body)
 		log.Println(string(s))
 
-		// Python packs the input in Unicode for some reason so we need to convert it
-		sBody, _ := url.QueryUnescape(string(s))
-		if len(sBody) > 0 {
-			// The actual payload we care about comes after the equals sign. This splits the
-			// input into a slice and takes the second element of that slice for the payload.
-			payloadString = strings.Split(sBody, "=")[1]
-			log.Println(payloadString)
-		}
+		// Python packs the input in Unicode for some reason, and bodyField undoes that
+		payloadString = bodyField(s, "payload")
+		log.Println(payloadString)
 	}
 
-	// Create an intermediate map to parse the payload into
-	payloadMap = make(map[string]interface{})
+	// A client which sent no payload starts with an empty clock
+	payloadInt := NewVectorClock()
 
 	if payloadString != "" {
-		// Read the payload into the intermediate map
-		err = json.Unmarshal([]byte(payloadString), &payloadMap)
-		if err != nil {
-			log.Fatalln(err)
+		// Read the payload into the clock, and turn the client away if it can't be
+		if err = json.Unmarshal([]byte(payloadString), &payloadInt); err != nil {
+			invalidPayload(w, err)
+			return
 		}
 	}
-
-	// Convert the intermediate map into map[string]int as needed by KVS. As with PutHandler
-	// we use a type assertion to set the value to float64 in the payloadMap and then typecast
-	// it as an integer to store it in the payloadInt map.
-	payloadInt := make(map[string]int)
-	for k, v := range payloadMap {
-		payloadInt[k] = int(v.(float64))
-	}
 	log.Println(payloadInt)
 
 	log.Println("SEARCH with payload ", payloadInt)
 
 	// See if the key exists in the db
 	alive, version := app.db.Contains(key)
+
+	// If the client asked for R > 1, go by the newest version any of the R replicas has
+	if want := app.quorum.ReadSize(r); want > 1 {
+		merged, replies, err := app.readQuorum(key, want, app.quorum.ReadRepair(r))
+		if err != nil {
+			status, body := quorumFailure(err, replies, want, payloadInt)
+			w.WriteHeader(status)
+			w.Write(body)
+			return
+		}
+		alive, version = false, 0
+		if merged != nil {
+			alive, version = live(merged, time.Now()), merged.GetVersion()
+		}
+	}
 	if version < payloadInt[key] {
 		log.Println("Payload out of date error")
 		w.WriteHeader(http.StatusBadRequest) // code 400
@@ -527,11 +695,22 @@ func (app *App) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["subject"]
 
-	// These two variables are declared here and assigned further down.
-	var payloadMap map[string]interface{} // Intermediate map for decoding
-	var payloadString string              // Payload sent by the client
-	var err error                         // Error value
-	var body []byte                       // Response body
+	// A conditional delete is checked by the key's coordinator, and keys this node
+	// doesn't store are handled by a node that does
+	if relayed, err := app.coordinate(w, r, key); err != nil {
+		status, body := coordinatorFailure(err)
+		w.WriteHeader(status)
+		w.Write(body)
+		return
+	} else if relayed || app.forward(w, r, key) {
+		return
+	}
+
+	// These variables are declared here and assigned further down.
+	var payloadString string // Payload sent by the client
+	var form url.Values      // Every field of the body
+	var err error            // Error value
+	var body []byte          // Response body
 
 	w.Header().Set("Content-Type", "application/json")
 
@@ -541,42 +720,46 @@ func (app *App) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		s, _ := ioutil.ReadAll(r.Body)
 		log.Println(string(s))
 
-		// Python packs the input in Unicode for some reason so we need to convert it
-		sBody, _ := url.QueryUnescape(string(s))
-		if len(sBody) > 0 {
-			// The actual payload we care about comes after the equals sign. This splits the
-			// input into a slice and takes the second element of that slice for the payload.
-			payloadString = strings.Split(sBody, "=")[1]
-			log.Println(payloadString)
-		}
+		// Python packs the input in Unicode for some reason, and bodyField undoes that
+		form, _ = url.ParseQuery(string(s))
+		payloadString = bodyField(s, "payload")
+		log.Println(payloadString)
 	}
 
-	// Create an intermediate map to parse the payload into
-	payloadMap = make(map[string]interface{})
+	// The client may make the delete conditional on the version it replaces
+	cond, condErr := requestPrecondition(r, form)
+
+	// A client which sent no payload starts with an empty clock
+	payloadInt := NewVectorClock()
 
 	if payloadString != "" {
-		// Read the payload into the intermediate map
-		err = json.Unmarshal([]byte(payloadString), &payloadMap)
-		if err != nil {
-			log.Fatalln(err)
+		// Read the payload into the clock, and turn the client away if it can't be
+		if err = json.Unmarshal([]byte(payloadString), &payloadInt); err != nil {
+			invalidPayload(w, err)
+			return
 		}
 	}
 
-	// Convert the intermediate map into map[string]int as needed by KVS. As with PutHandler
-	// we use a type assertion to set the value to float64 in the payloadMap and then typecast
-	// it as an integer to store it in the payloadInt map.
-	payloadInt := make(map[string]int)
-	for k, v := range payloadMap {
-		payloadInt[k] = int(v.(float64))
-	}
-
 	// Here we'll check to see if the requested key exists and get its version.
 	alive, version := app.db.Contains(key)
 
 	// If the version of the key stored in the DB is older than the value in the client's payload,
 	// then it would violate causality to show the key to the client. In this case we return an error
 	// message per the spec.
-	if version < payloadInt[key] {
+	if condErr != nil {
+		log.Println("ERROR: Invalid precondition: ", condErr)
+		w.WriteHeader(http.StatusBadRequest) // Code 400
+
+		resp := map[string]interface{}{
+			"result":  "Error",
+			"msg":     "Invalid precondition",
+			"payload": payloadInt,
+		}
+		body, err = json.Marshal(resp)
+		if err != nil {
+			log.Fatalln("FATAL Error: Failed to marshal JSON response")
+		}
+	} else if version < payloadInt[key] {
 		w.WriteHeader(http.StatusBadRequest) // Code 400
 
 		log.Println("Key requested is out of date")
@@ -592,14 +775,30 @@ func (app *App) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 			log.Fatalln("FATAL Error: Failed to marshal JSON response")
 		}
 	} else if alive {
+		// Delete it, if the client's condition holds
+		time := time.Now()
+		if err := app.db.DeleteIf(key, time, payloadInt, cond); err != nil {
+			status, body := app.writeFailure(err, key, payloadInt)
+			w.WriteHeader(status)
+			w.Write(body)
+			return
+		}
+
+		// If the client asked for W > 1, the delete only succeeds once enough replicas have it
+		if want := app.quorum.WriteSize(r); want > 1 {
+			acks, err := app.writeQuorum(key, want)
+			if err != nil {
+				status, body := quorumFailure(err, acks, want, payloadInt)
+				w.WriteHeader(status)
+				w.Write(body)
+				return
+			}
+		}
+
 		// The version is recent enough to show to the client, and the key has not been deleted, so we can
 		// return the values normally.
 		w.WriteHeader(http.StatusOK) // code 200
 
-		// Delete it
-		time := time.Now()
-		app.db.Delete(key, time, payloadInt)
-
 		// Successful response
 		resp := map[string]interface{}{
 			"result":  "Success",
@@ -656,16 +855,15 @@ func (app *App) ViewPutHandler(w http.ResponseWriter, r *http.Request) {
 	// Same content type for everything
 	w.Header().Set("Content-Type", "application/json")
 
-	// Check if the port you want to add new to our view
-	if !app.view.Contains(newPort) {
+	// Add it, unless it's already there
+	err = app.changeView(viewAdd, newPort)
+	switch err {
+	case nil:
 		log.Println("Port to be added is brand new to view: " + newPort)
 
 		// We do
 		w.WriteHeader(http.StatusOK) // code 200
 
-		// Add it
-		app.view.Add(newPort)
-
 		// Successful response
 		resp := map[string]interface{}{
 			"result": "Success",
@@ -676,7 +874,7 @@ func (app *App) ViewPutHandler(w http.ResponseWriter, r *http.Request) {
 			log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
 		}
 
-	} else {
+	case errViewUnchanged:
 		log.Println("Port to be added is already in view")
 
 		// We already have the port
@@ -691,6 +889,14 @@ func (app *App) ViewPutHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
 		}
+
+	default:
+		status, resp := viewChangeFailure(err)
+		w.WriteHeader(status)
+		body, err = json.Marshal(resp)
+		if err != nil {
+			log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+		}
 	}
 	w.Write(body)
 }
@@ -713,7 +919,38 @@ func (app *App) ViewGetHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Package it into a map->JSON->[]byte
 	resp := map[string]interface{}{
-		"view": str,
+		"view":  str,
+		"epoch": app.views.Epoch(),
+	}
+
+	// Show what the failure detector thinks of each member
+	if app.members != nil {
+		states := make(map[string]interface{})
+		for addr, mem := range app.members.States() {
+			state := mem.State.String()
+			if mem.State == stateAlive && app.members.Joining(addr) {
+				// Up, but still being sent its share of the data
+				state = "joining"
+			}
+			states[addr] = map[string]interface{}{
+				"state":       state,
+				"incarnation": mem.Incarnation,
+			}
+		}
+		resp["members"] = states
+	}
+
+	// Show how far along the transfers to new owners are
+	if app.rebal != nil {
+		resp["rebalance"] = app.rebal.Stats()
+	}
+
+	// If the keys are partitioned, show how the ring is carved up between the nodes
+	if app.ring != nil {
+		resp["ring"] = map[string]interface{}{
+			"replicas": app.ring.Replicas(),
+			"tokens":   app.ring.Ranges(),
+		}
 	}
 	body, err = json.Marshal(resp)
 	if err != nil {
@@ -734,23 +971,20 @@ func (app *App) ViewDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	// Read the message body
 	s, _ := ioutil.ReadAll(r.Body)
 	log.Println(string(s))
-	sBody, _ := url.QueryUnescape(string(s))
-	log.Println(sBody)
-	deletePort := strings.Split(sBody, "=")[1]
+	deletePort := bodyField(s, "ip_port")
 
 	// Same content type for everything
 	w.Header().Set("Content-Type", "application/json")
 
-	// Check if the port you want to delete is in view
-	if app.view.Contains(deletePort) {
+	// Delete it, if it's there
+	err = app.changeView(viewRemove, deletePort)
+	switch err {
+	case nil:
 		log.Println("Port to be deleted found in view")
 
 		// We do
 		w.WriteHeader(http.StatusOK) // code 200
 
-		// Delete it
-		app.view.Remove(deletePort)
-
 		// Successful response
 		resp := map[string]interface{}{
 			"result": "Success",
@@ -761,7 +995,7 @@ func (app *App) ViewDeleteHandler(w http.ResponseWriter, r *http.Request) {
 			log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
 		}
 
-	} else {
+	case errViewUnchanged:
 		log.Println("Port to be deleted not found in view")
 
 		// We don't have the port
@@ -776,7 +1010,290 @@ func (app *App) ViewDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
 		}
+
+	default:
+		status, resp := viewChangeFailure(err)
+		w.WriteHeader(status)
+		body, err = json.Marshal(resp)
+		if err != nil {
+			log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+		}
+	}
+
+	w.Write(body)
+}
+
+// changeView adds or removes a member. With a membership log the change is agreed with
+// the other members first. It returns errViewUnchanged if there was nothing to change.
+func (app *App) changeView(op viewOp, node string) error {
+	if app.views != nil {
+		_, err := app.views.Propose(op, node)
+		return err
+	}
+	if (op == viewAdd) == app.view.Contains(node) {
+		return errViewUnchanged
+	}
+	if op == viewAdd {
+		app.view.Add(node)
+	} else {
+		app.view.Remove(node)
+	}
+	return nil
+}
+
+// viewChangeFailure builds the response for a view change the members couldn't agree on
+func viewChangeFailure(err error) (int, map[string]interface{}) {
+	log.Println("View change failed: ", err)
+	return http.StatusServiceUnavailable, map[string]interface{}{
+		"result": "Error",
+		"msg":    "Could not agree on a new view: " + err.Error(),
+	}
+}
+
+// HintsHandler reports how many hints are queued for each peer and how old the oldest is
+func (app *App) HintsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /admin/hints GET request")
+
+	stats := app.hints.Stats()
+	total := 0
+	for _, s := range stats {
+		total += s.Depth
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK) // code 200
+
+	resp := map[string]interface{}{
+		"depth": total,
+		"peers": stats,
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
+
+// MetricsHandler reports the node's counters
+func (app *App) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /admin/metrics GET request")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK) // code 200
+
+	body, err := json.Marshal(metrics.Snapshot())
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
+
+// PhiHandler reports the phi-accrual suspicion level of each peer
+func (app *App) PhiHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling /admin/phi GET request")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK) // code 200
+
+	body, err := json.Marshal(app.phi.Stats())
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
+
+// forward hands a request for a key this node doesn't store to the nodes in the key's
+// preference list, trying each in turn from the least suspicious, and relays the first
+// response back to the client. It returns true if the request was answered that way. If
+// none of the owners can be reached, or the request was already forwarded once, it
+// returns false and the request is served locally.
+func (app *App) forward(w http.ResponseWriter, r *http.Request, key string) bool {
+	if app.ring == nil || r.Header.Get(forwardedHeader) != "" {
+		return false
+	}
+	me := app.view.Primary()
+	if app.ring.Owns(me, key) {
+		return false
+	}
+
+	// The body can only be read once, so hold on to it in case the first owner is down
+	var reqBody []byte
+	if r.Body != nil {
+		reqBody, _ = ioutil.ReadAll(r.Body)
+	}
+
+	for _, node := range app.phi.Rank(app.ring.PreferenceList(key)) {
+		log.Println("Forwarding request for key " + key + " to " + node)
+		if err := relay(w, r, node, reqBody, forwardedHeader, me); err != nil {
+			log.Println("Error forwarding to "+node+": ", err)
+			continue
+		}
+		return true
+	}
+
+	// Nobody who owns the key answered, so put the body back and serve it ourselves
+	log.Println("No owner of key " + key + " reachable, serving locally")
+	if r.Body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+	return false
+}
+
+// forwardClient is used to pass requests on to other nodes
+var forwardClient = &http.Client{Timeout: 5 * time.Second}
+
+// relay sends a request on to another node with the given header set, and copies its
+// response back to the client. Nothing is written to the client if there's an error.
+func relay(w http.ResponseWriter, r *http.Request, node string, reqBody []byte, header string, me string) error {
+	req, err := http.NewRequest(r.Method, "http://"+node+r.URL.RequestURI(), bytes.NewReader(reqBody))
+	if err != nil {
+		return errors.Wrap(err, "Error building relayed request")
+	}
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set(header, me)
+
+	resp, err := forwardClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return nil
+}
+
+// store writes a value for a key, as a new sibling when siblings are on. The value
+// expires at the given time, or never if it's zero, and is only written if the key
+// meets cond.
+func (app *App) store(key string, value string, ts time.Time, payload VectorClock, context VectorClock, expires time.Time, cond Precondition) error {
+	if app.siblings {
+		return app.db.PutSiblingIf(key, value, ts, payload, context, app.view.Primary(), expires, cond)
+	}
+	return app.db.PutIf(key, value, ts, payload, expires, cond)
+}
+
+// addSiblings puts every sibling of a key into a response, along with the causal context
+// a client sends back to replace them. Nothing is added unless siblings are on. The
+// entry is read locally unless one is given.
+func (app *App) addSiblings(resp map[string]interface{}, key string, e KeyEntry) {
+	if !app.siblings {
+		return
+	}
+	if e == nil {
+		if local, ok := app.localEntry(key); ok {
+			e = &local
+		}
+	}
+	values := []string{}
+	context := NewVectorClock()
+	if e != nil {
+		for _, sib := range e.GetSiblings() {
+			values = append(values, sib.Value)
+		}
+		// An entry written before siblings were turned on is its own only sibling
+		if len(values) == 0 && e.Alive() {
+			values = append(values, e.GetValue())
+		}
+		context = siblingContext(e)
+	}
+	resp["siblings"] = values
+	resp["context"] = context
+}
+
+// localEntry returns this node's entry for a key
+func (app *App) localEntry(key string) (Entry, bool) {
+	eg := app.db.GetEntryGlob(timeGlob{List: map[string]time.Time{key: {}}})
+	e, ok := eg.Keys[key]
+	return e, ok
+}
+
+// writeQuorum sends the version of a key just written here to its other replicas and
+// waits for want acks in total
+func (app *App) writeQuorum(key string, want int) (int, error) {
+	e, _ := app.localEntry(key)
+	return app.quorum.Write(key, e, want)
+}
+
+// readQuorum asks want replicas, this one included, for a key and returns the newest
+// version any of them has, or nil if none of them have it. Unless repair is off, stale
+// replicas are brought up to date, this one included.
+func (app *App) readQuorum(key string, want int, repair bool) (KeyEntry, int, error) {
+	// A key whose tombstone was collected here starts from that tombstone, so a replica
+	// still holding a value from before the delete can't bring the key back
+	var local KeyEntry
+	if e, ok := app.localEntry(key); ok {
+		local = &e
+	} else if g, ok := app.db.Grave(key); ok {
+		local = &g
+	}
+	merged, replies, err := app.quorum.Read(key, local, want, repair)
+
+	// The merge only moves off the local entry when another replica has a newer one. A
+	// write may have been made here since the read, so it's merged like gossip rather than
+	// stored over whatever we hold now.
+	if repair && merged != nil && merged != local {
+		log.Println("Read repair of key " + key + " on this node")
+		app.db.MergeEntry(key, merged)
+	}
+	return merged, replies, err
+}
+
+// quorumFailure builds the response for a request which didn't hear from enough
+// replicas. Running out of time is a 504 and anything else a 503, and the client gets
+// its payload back either way.
+func quorumFailure(err error, got int, want int, payload VectorClock) (int, []byte) {
+	log.Println("Quorum not reached: ", err)
+	status := http.StatusServiceUnavailable // code 503
+	if errors.Cause(err) == errQuorumTimeout {
+		status = http.StatusGatewayTimeout // code 504
+	}
+	resp := map[string]interface{}{
+		"result":   "Error",
+		"msg":      "Quorum not reached",
+		"error":    err.Error(),
+		"replicas": got,
+		"required": want,
+		"payload":  payload,
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	return status, body
+}
+
+// bodyField returns a field of a form-encoded body. Some clients send the field as the
+// body's only one under another name, so if it isn't there whatever follows the first
+// equals sign is taken instead, and an empty string if there's no equals sign at all.
+func bodyField(body []byte, name string) string {
+	form, err := url.ParseQuery(string(body))
+	if _, ok := form[name]; ok && err == nil {
+		return form.Get(name)
 	}
+	s, _ := url.QueryUnescape(string(body))
+	if parts := strings.SplitN(s, "=", 2); len(parts) == 2 {
+		return parts[1]
+	}
+	return ""
+}
 
+// invalidPayload turns away a request whose payload can't be read as a vector clock
+func invalidPayload(w http.ResponseWriter, err error) {
+	log.Println("ERROR: Invalid payload: ", err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest) // code 400
+	body, err := json.Marshal(map[string]interface{}{
+		"result":  "Error",
+		"msg":     "Invalid payload",
+		"payload": NewVectorClock(),
+	})
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
 	w.Write(body)
 }
@@ -40,7 +40,7 @@ var testApp App
 type TestKVS struct {
 	dbKey     string
 	dbVal     string
-	dbClock   map[string]int
+	dbClock   VectorClock
 	dbTime    time.Time
 	dbVersion int
 }
@@ -60,15 +60,15 @@ func (kvs *TestKVS) Contains(key string) (bool, int) {
 	return false, 0
 }
 
-func (kvs *TestKVS) GetClock(key string) map[string]int {
+func (kvs *TestKVS) GetClock(key string) VectorClock {
 	if key == kvs.dbKey {
 		return kvs.dbClock
 	}
-	return map[string]int{}
+	return VectorClock{}
 }
 
 // This stub returns the valExistsue associated with the key which exists, and returns nil for the key which doesn't //
-func (kvs *TestKVS) Get(key string, clock map[string]int) (string, map[string]int) {
+func (kvs *TestKVS) Get(key string, clock VectorClock) (string, VectorClock) {
 	if key == kvs.dbKey {
 		return kvs.dbVal, kvs.dbClock
 	}
@@ -76,7 +76,7 @@ func (kvs *TestKVS) Get(key string, clock map[string]int) (string, map[string]in
 }
 
 // This stub returns true for the key which exists and false for the one which doesn't
-func (kvs *TestKVS) Delete(key string, timestamp time.Time, payload map[string]int) bool {
+func (kvs *TestKVS) Delete(key string, timestamp time.Time, payload VectorClock) bool {
 	if key == kvs.dbKey {
 		return true
 	}
@@ -84,7 +84,7 @@ func (kvs *TestKVS) Delete(key string, timestamp time.Time, payload map[string]i
 }
 
 // idk lets try this
-func (kvs *TestKVS) Put(key, valExists string, time time.Time, payload map[string]int) bool {
+func (kvs *TestKVS) Put(key, valExists string, time time.Time, payload VectorClock) bool {
 	for k := range kvs.dbClock {
 		kvs.dbClock[k] = 0
 	}
@@ -94,6 +94,58 @@ func (kvs *TestKVS) Put(key, valExists string, time time.Time, payload map[strin
 	return true
 }
 
+func (kvs *TestKVS) PutExpiring(key, val string, time time.Time, payload VectorClock, expires time.Time) bool {
+	return kvs.Put(key, val, time, payload)
+}
+
+func (kvs *TestKVS) PutSibling(key, val string, time time.Time, payload VectorClock, context VectorClock, node string, expires time.Time) bool {
+	return kvs.Put(key, val, time, payload)
+}
+
+func (kvs *TestKVS) PutIf(key, val string, time time.Time, payload VectorClock, expires time.Time, cond Precondition) error {
+	kvs.Put(key, val, time, payload)
+	return nil
+}
+
+func (kvs *TestKVS) PutSiblingIf(key, val string, time time.Time, payload VectorClock, context VectorClock, node string, expires time.Time, cond Precondition) error {
+	kvs.Put(key, val, time, payload)
+	return nil
+}
+
+func (kvs *TestKVS) DeleteIf(key string, time time.Time, payload VectorClock, cond Precondition) error {
+	kvs.Delete(key, time, payload)
+	return nil
+}
+
+func (kvs *TestKVS) MergeEntries(entries map[string]KeyEntry) {
+	for key, e := range entries {
+		kvs.MergeEntry(key, e)
+	}
+}
+
+func (kvs *TestKVS) WithBatches(eg entryGlob) entryGlob {
+	return eg
+}
+
+func (kvs *TestKVS) Scan(start string, end string, limit int) ([]scanEntry, bool) {
+	return nil, false
+}
+
+func (kvs *TestKVS) ReadCut(keys []string) map[string]Entry {
+	tg := timeGlob{List: make(map[string]time.Time)}
+	for _, key := range keys {
+		tg.List[key] = time.Time{}
+	}
+	return kvs.GetEntryGlob(tg).Keys
+}
+
+func (kvs *TestKVS) Batch(writes []batchWrite, time time.Time, payload VectorClock, node string) (VectorClock, error) {
+	for _, w := range writes {
+		kvs.Put(w.Key, w.Value, time, payload)
+	}
+	return payload, nil
+}
+
 func (kvs *TestKVS) OverwriteEntry(key string, entry KeyEntry) {
 	newClock := entry.GetClock()
 	log.Println(newClock)
@@ -109,6 +161,11 @@ func (kvs *TestKVS) OverwriteEntry(key string, entry KeyEntry) {
 	kvs.dbVersion = entry.GetVersion()
 }
 
+func (kvs *TestKVS) MergeEntry(key string, entry KeyEntry) bool {
+	kvs.OverwriteEntry(key, entry)
+	return true
+}
+
 func (kvs *TestKVS) GetTimeGlob() timeGlob {
 	m := make(map[string]time.Time)
 	m[kvs.dbKey] = kvs.dbTime
@@ -130,16 +187,55 @@ func (kvs *TestKVS) GetEntryGlob(g timeGlob) entryGlob {
 	return j
 }
 
+func (kvs *TestKVS) Seen(key string, e KeyEntry) bool {
+	return false
+}
+
+func (kvs *TestKVS) Grave(key string) (Entry, bool) {
+	return Entry{}, false
+}
+
+func (kvs *TestKVS) MerkleTree() *MerkleTree {
+	t := NewMerkleTree()
+	t.Update(kvs.dbKey, &Entry{Version: kvs.dbVersion, Clock: kvs.dbClock, Timestamp: kvs.dbTime, Value: kvs.dbVal})
+	return t
+}
+
+// appRequest sends a request to an app's client handlers, routed as Initialize routes
+// them, and decodes the response. The body is sent as a form unless the header gives
+// another Content-Type.
+func appRequest(t *testing.T, app *App, method string, target string, body string, header http.Header) (int, map[string]interface{}) {
+	router := mux.NewRouter()
+	router.HandleFunc(rootURL+mget, app.MgetHandler).Methods(http.MethodPost)
+	router.HandleFunc(rootURL, app.ScanHandler).Methods(http.MethodGet)
+	router.HandleFunc(rootURL+keySuffix, app.sessions(app.PutHandler)).Methods(http.MethodPut)
+	router.HandleFunc(rootURL+keySuffix, app.sessions(app.GetHandler)).Methods(http.MethodGet)
+	router.HandleFunc(rootURL+keySuffix, app.sessions(app.DeleteHandler)).Methods(http.MethodDelete)
+
+	req, err := http.NewRequest(method, target, strings.NewReader(body))
+	ok(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+
+	var got map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &got))
+	return recorder.Code, got
+}
+
 // Trying to reduce code repetition
 func setup(key string, val string) (string, *mux.Router) {
-	clock := map[string]int{key: 1}
+	clock := VectorClock{key: 1}
 	testKVS = TestKVS{dbKey: key, dbVal: val, dbClock: clock, dbVersion: 1}
 
 	// This should probably be converted to a mock instance
 	v := NewView(testMain, testView)
 
 	// Stub the app
-	testApp := App{&testKVS, *v}
+	testApp := App{db: &testKVS, view: *v}
 
 	l, err := net.Listen("tcp", "")
 	if err != nil {
@@ -605,7 +701,7 @@ func TestDeleteKeyExistsStalePayload(t *testing.T) {
 
 	// Set up the URL
 	url := serverURL + rootURL + "/" + subject
-	testPayload := map[string]int{keyExists: 2}
+	testPayload := VectorClock{keyExists: 2}
 	testPayloadByte, err := json.Marshal(testPayload)
 	ok(t, err)
 	testPayloadString := string(testPayloadByte[:])
@@ -935,7 +1031,8 @@ func TestViewGetRequestViewExists(t *testing.T) {
 	ok(t, err)
 	// Hard coded View example for testing
 	expectedBody := map[string]interface{}{
-		"view": testView,
+		"view":  testView,
+		"epoch": float64(0),
 	}
 
 	equals(t, expectedBody, gotBody)
@@ -1042,7 +1139,7 @@ func TestPutHandlerStoresPayload(t *testing.T) {
 	url := serverURL + rootURL + "/" + subject
 
 	// Start with a payload map
-	testPayload := map[string]int{
+	testPayload := VectorClock{
 		keyExists:    1,
 		keyNotExists: 2,
 	}
@@ -1091,7 +1188,7 @@ func TestGetHandlerStalePayload(t *testing.T) {
 	// Set up the URL
 	url := serverURL + rootURL + "/" + subject
 
-	testPayload := map[string]int{keyExists: 2}
+	testPayload := VectorClock{keyExists: 2}
 	testPayloadByte, err := json.Marshal(testPayload)
 	ok(t, err)
 	testPayloadString := string(testPayloadByte[:])
@@ -1133,6 +1230,32 @@ func TestGetHandlerStalePayload(t *testing.T) {
 	teardown()
 }
 
+func TestGetHandlerInvalidPayload(t *testing.T) {
+	serverURL, router := setup(keyExists, valExists)
+	recorder := httptest.NewRecorder()
+
+	// A payload which isn't a vector clock is turned away instead of stopping the server
+	req, err := http.NewRequest(http.MethodGet, serverURL+rootURL+"/"+keyExists, strings.NewReader("payload=notaclock"))
+	ok(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusBadRequest, recorder.Code)
+	var gotBody map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	equals(t, "Invalid payload", gotBody["msg"])
+
+	teardown()
+}
+
+func TestBodyField(t *testing.T) {
+	equals(t, `{"a":1}`, bodyField([]byte("payload=%7B%22a%22%3A1%7D"), "payload"))
+	equals(t, "10.0.0.20:8080", bodyField([]byte("ip_port=10.0.0.20:8080"), "ip_port"))
+	equals(t, "{}", bodyField([]byte("clock={}"), "payload"))
+	equals(t, "", bodyField([]byte("nothing"), "payload"))
+	equals(t, "", bodyField([]byte("if_match=2&payload="), "payload"))
+}
+
 // TODO: tests needed
 //
 // Test the initialize() function somehow
@@ -1152,7 +1275,7 @@ func TestSearchHandlerValidPayloadKeyExists(t *testing.T) {
 
 	// Set up the URL
 	url := serverURL + rootURL + search + "/" + subject
-	testPayload := map[string]int{keyExists: 1}
+	testPayload := VectorClock{keyExists: 1}
 	testPayloadByte, err := json.Marshal(testPayload)
 	ok(t, err)
 	testPayloadString := string(testPayloadByte[:])
@@ -1202,7 +1325,7 @@ func TestSearchHandlerStalePayloadKeyExists(t *testing.T) {
 
 	// Set up the URL
 	url := serverURL + rootURL + search + "/" + subject
-	testPayload := map[string]int{keyExists: 2}
+	testPayload := VectorClock{keyExists: 2}
 	testPayloadByte, err := json.Marshal(testPayload)
 	ok(t, err)
 	testPayloadString := string(testPayloadByte[:])
@@ -1240,6 +1363,91 @@ func TestSearchHandlerStalePayloadKeyExists(t *testing.T) {
 
 }
 
+// Finds a key whose coordinator on the ring is the given node
+func keyOwnedBy(r *Ring, node string) string {
+	for i := 0; ; i++ {
+		key := fmt.Sprint("key", i)
+		if r.PreferenceList(key)[0] == node {
+			return key
+		}
+	}
+}
+
+// TestGetHandlerForwardsUnownedKey verifies a GET for a key stored elsewhere is answered by the owner
+func TestGetHandlerForwardsUnownedKey(t *testing.T) {
+	// The owner just reports who forwarded the request to it
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte(r.Header.Get(forwardedHeader)))
+	}))
+	defer owner.Close()
+	ownerAddr := strings.TrimPrefix(owner.URL, "http://")
+
+	testKVS = TestKVS{dbKey: keyExists, dbVal: valExists, dbClock: VectorClock{}, dbVersion: 1}
+	v := NewView(testMain, testMain+","+ownerAddr)
+	r := NewRing(v, defaultVnodes, 1)
+	app := App{db: &testKVS, view: *v, ring: r}
+
+	router := mux.NewRouter()
+	router.HandleFunc(rootURL+keySuffix, app.GetHandler).Methods(http.MethodGet)
+
+	key := keyOwnedBy(r, ownerAddr)
+	req, err := http.NewRequest(http.MethodGet, rootURL+"/"+key, nil)
+	ok(t, err)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusTeapot, recorder.Code)
+	equals(t, testMain, recorder.Body.String())
+}
+
+// TestGetHandlerServesOwnedKeyLocally verifies a GET for a key this node stores isn't forwarded
+func TestGetHandlerServesOwnedKeyLocally(t *testing.T) {
+	v := NewView(testMain, testView)
+	r := NewRing(v, defaultVnodes, 1)
+	key := keyOwnedBy(r, testMain)
+
+	testKVS = TestKVS{dbKey: key, dbVal: valExists, dbClock: VectorClock{key: 1}, dbVersion: 1}
+	app := App{db: &testKVS, view: *v, ring: r}
+
+	router := mux.NewRouter()
+	router.HandleFunc(rootURL+keySuffix, app.GetHandler).Methods(http.MethodGet)
+
+	req, err := http.NewRequest(http.MethodGet, rootURL+"/"+key, nil)
+	ok(t, err)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusOK, recorder.Code)
+}
+
+// TestViewGetReportsRing verifies /view describes the ring when keys are partitioned
+func TestViewGetReportsRing(t *testing.T) {
+	v := NewView(testMain, testView)
+	app := App{db: &testKVS, view: *v, ring: NewRing(v, 4, 2)}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, view, nil)
+	ok(t, err)
+	app.ViewGetHandler(recorder, req)
+
+	var gotBody struct {
+		View string
+		Ring struct {
+			Replicas int
+			Tokens   map[string][]tokenRange
+		}
+	}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	equals(t, testView, gotBody.View)
+	equals(t, 2, gotBody.Ring.Replicas)
+	equals(t, 3, len(gotBody.Ring.Tokens))
+	for node, ranges := range gotBody.Ring.Tokens {
+		assert(t, v.Contains(node), "Ring reported unknown node %s", node)
+		equals(t, 4, len(ranges))
+	}
+}
+
 // These functions were taken from Ben Johnson's post here: https://medium.com/@benbjohnson/structuring-tests-in-go-46ddee7a25c
 
 // assert fails the test if the condition is false.
@@ -1268,3 +1476,16 @@ func equals(tb testing.TB, exp, act interface{}) {
 		tb.FailNow()
 	}
 }
+
+func TestPutHandlerWithoutAValue(t *testing.T) {
+	app := &App{db: NewKVS(), view: *NewView(testMain, testMain)}
+	code, got := appRequest(t, app, http.MethodPut, rootURL+"/"+keyone+"?w=2", "", nil)
+	equals(t, http.StatusBadRequest, code)
+	equals(t, "Value is missing", got["msg"])
+
+	code, got = appRequest(t, app, http.MethodPut, rootURL+"/"+keyone, ifMatchField+"=1", nil)
+	equals(t, http.StatusBadRequest, code)
+	equals(t, "Value is missing", got["msg"])
+	alive, _ := app.db.Contains(keyone)
+	assert(t, !alive, "A write without a value was made")
+}
@@ -0,0 +1,381 @@
+// batch.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines multi-key batch writes. A POST to /keyValue-store/_batch carries a JSON list
+// of puts and deletes, either on its own or as the "ops" of an object which may also
+// hold the client's "payload":
+//
+//     {"ops": [{"op": "put", "key": "a", "val": "1", "ttl": "60s"},
+//              {"op": "delete", "key": "b"}],
+//      "payload": {"a": 2}}
+//
+// The whole batch is applied to the KVS under one lock and goes into the write-ahead
+// log as a single record, so a crash leaves all of it or none of it. Every entry the
+// batch writes is tagged with the batch and the keys in it. Gossip sends the rest of a
+// batch along with any part of it a peer is missing, and the peer stores the batch's
+// winning versions all at once, so no node ever shows half a batch. A key written
+// again after its batch drops out of it.
+//
+// Partitioned by the ring, a batch may only write keys stored on the same nodes, and
+// it's handled by one of them. Quorum writes and hinted handoff still work key by key.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const batchMaxOps = 100 // Writes allowed in one batch
+
+var (
+	// errInvalidBatch is returned for a batch which can't be applied as it stands
+	errInvalidBatch = errors.New("Invalid batch")
+
+	// errSpansPartitions is returned for a request whose keys aren't stored together
+	errSpansPartitions = errors.New("Keys span partitions")
+)
+
+// BatchTag names the batch which wrote an entry, along with every key it wrote
+type BatchTag struct {
+	ID   string
+	Keys []string
+}
+
+// IsZero returns true for an entry which wasn't written by a batch
+func (b BatchTag) IsZero() bool {
+	return b.ID == ""
+}
+
+// A batchWrite is one put or delete in a batch
+type batchWrite struct {
+	Key     string
+	Delete  bool
+	Value   string
+	Expires time.Time   // When a put expires, zero if it doesn't
+	Context VectorClock // The siblings a put replaces, when siblings are on
+}
+
+// validateBatch checks every write in a batch before any of it is applied
+func validateBatch(writes []batchWrite) error {
+	if len(writes) == 0 || len(writes) > batchMaxOps {
+		return errors.Wrapf(errInvalidBatch, "A batch holds 1 to %d writes", batchMaxOps)
+	}
+	seen := make(map[string]bool)
+	for _, w := range writes {
+		if w.Key == "" || len(w.Key) > maxKey || len(w.Value) > maxVal {
+			return errors.Wrap(errInvalidBatch, "Key or value not valid: "+w.Key)
+		}
+		if seen[w.Key] {
+			return errors.Wrap(errInvalidBatch, "Key written twice: "+w.Key)
+		}
+		seen[w.Key] = true
+	}
+	return nil
+}
+
+// Batch applies a group of writes at once. Each put is made as PutExpiring makes it,
+// or as a sibling written by node unless node is empty, and each delete as Delete makes
+// it, skipping keys which aren't live. Nothing is written unless every write is valid.
+// Each write is made on a copy of its entry, and the copies are only stored once the
+// whole batch is in the log, so a batch which can't be logged leaves every key as it
+// was, and so does one with a write the KVS can't make, which fails with errWriteFailed.
+// It returns the client's payload merged with the clocks of the keys written.
+func (k *KVS) Batch(writes []batchWrite, time time.Time, payload VectorClock, node string) (VectorClock, error) {
+	err := validateBatch(writes)
+	if err != nil {
+		return payload, err
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.pending = []walRecord{}
+	made := true
+	for _, w := range writes {
+		if w.Delete {
+			// A key which isn't live is skipped, but one which is has to be deleted
+			if e, ok := k.working(w.Key); ok && live(e, time) {
+				made = k.delete(w.Key, time, payload.Copy())
+			}
+		} else {
+			_, version := k.contains(w.Key)
+			clock := payload.Copy()
+			clock[w.Key] = version + 1
+			if node != "" {
+				made = k.putSibling(w.Key, w.Value, time, clock, w.Context, node, w.Expires)
+			} else {
+				made = k.put(w.Key, w.Value, time, clock, w.Expires)
+			}
+		}
+		if !made {
+			break
+		}
+	}
+	recs := k.pending
+	k.pending = nil
+	if !made {
+		log.Println("ERROR: A write in the batch couldn't be made, dropping the batch")
+		return payload, errWriteFailed
+	}
+
+	tag := BatchTag{ID: fmt.Sprintf("%s@%d", k.clock.Node(), k.clock.Stamp(time).UnixNano())}
+	for _, rec := range recs {
+		tag.Keys = append(tag.Keys, rec.Key)
+	}
+	merged := payload.Copy()
+	for i := range recs {
+		recs[i].Entry.Batch = tag
+		merged = merged.Merge(recs[i].Entry.Clock)
+	}
+	if !k.storeAll(recs) {
+		return payload, errWriteFailed
+	}
+	if len(recs) > 0 {
+		wakeGossip = true
+	}
+	return merged, nil
+}
+
+// MergeEntries is MergeEntry for the versions of a group of keys written by one batch.
+// The ones which win are all stored at once, under the lock they were checked under, so
+// the batch never shows up half applied and no write made here in between is lost.
+func (k *KVS) MergeEntries(entries map[string]KeyEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var recs []walRecord
+	for _, key := range keys {
+		e := entries[key]
+		old, ok := k.db.Get(key)
+		if !ok && !k.beatsGrave(key, e) {
+			log.Println("Ignoring entry for " + key + " older than its collected tombstone")
+			continue
+		}
+		if ok {
+			merged, changed := mergeVersions(e, old)
+			if !changed {
+				continue
+			}
+			e = merged
+		}
+		recs = append(recs, walRecord{Op: walOverwrite, Key: key, Entry: toEntry(e)})
+	}
+	k.storeAll(recs)
+}
+
+// storeAll is store for a group of changes made together. They go into the log as one
+// record and into the storage engine as one batch. It must be called while holding the
+// write lock.
+func (k *KVS) storeAll(recs []walRecord) bool {
+	if len(recs) == 0 {
+		return true
+	}
+	if k.wal != nil {
+		err := k.wal.Append(walRecord{Op: walBatch, Batch: recs})
+		if err != nil {
+			log.Println("Error appending to write-ahead log: ", err)
+			return false
+		}
+	}
+	ops := make([]batchOp, len(recs))
+	for i := range recs {
+		e := recs[i].Entry
+		ops[i] = batchOp{Key: recs[i].Key, Entry: &e}
+	}
+	err := k.db.Batch(ops)
+	if err != nil {
+		log.Println("Error writing to storage engine: ", err)
+		return false
+	}
+	for i, op := range ops {
+		k.tree.Update(op.Key, op.Entry)
+		k.feed.Publish(recs[i].Op, op.Key, op.Entry)
+	}
+	return true
+}
+
+// WithBatches adds to an entryGlob the rest of every batch it holds part of, so that the
+// batch is sent whole. Keys written again since their batch are left out.
+func (k *KVS) WithBatches(eg entryGlob) entryGlob {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	sending := make(map[string]bool)
+	var missing []string
+	for _, e := range eg.Keys {
+		if e.Batch.IsZero() {
+			continue
+		}
+		sending[e.Batch.ID] = true
+		for _, key := range e.Batch.Keys {
+			if _, ok := eg.Keys[key]; !ok {
+				missing = append(missing, key)
+			}
+		}
+	}
+	for _, key := range missing {
+		if e, ok := k.db.Get(key); ok && sending[e.GetBatch().ID] {
+			eg.Keys[key] = toEntry(e)
+		}
+	}
+	return eg
+}
+
+// batchItem is one write in a batch request
+type batchItem struct {
+	Op      string      `json:"op"` // "put" or "delete"
+	Key     string      `json:"key"`
+	Val     string      `json:"val"`
+	TTL     string      `json:"ttl"`
+	Context VectorClock `json:"context"`
+}
+
+// batchRequest is the body of a batch request
+type batchRequest struct {
+	Ops     []batchItem `json:"ops"`
+	Payload VectorClock `json:"payload"`
+}
+
+// parseBatch reads the body of a batch request into the writes it makes
+func parseBatch(body []byte, now time.Time) ([]batchWrite, VectorClock, error) {
+	var req batchRequest
+	var err error
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &req.Ops)
+	} else {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(errInvalidBatch, "Batch isn't JSON")
+	}
+	if req.Payload == nil {
+		req.Payload = NewVectorClock()
+	}
+	writes := make([]batchWrite, 0, len(req.Ops))
+	for _, item := range req.Ops {
+		w := batchWrite{Key: item.Key, Value: item.Val, Context: item.Context}
+		switch strings.ToLower(item.Op) {
+		case "put":
+			if item.TTL != "" {
+				ttl, err := parseTTL(item.TTL)
+				if err != nil {
+					return nil, nil, errors.Wrap(errInvalidBatch, "Invalid TTL for key "+item.Key)
+				}
+				w.Expires = expiresAt(now, ttl)
+			}
+		case "delete":
+			w.Delete = true
+		default:
+			return nil, nil, errors.Wrap(errInvalidBatch, "Unknown op "+item.Op)
+		}
+		writes = append(writes, w)
+	}
+	return writes, req.Payload, validateBatch(writes)
+}
+
+// sameOwners returns an error unless every key in a request is stored on the same nodes
+func (app *App) sameOwners(keys []string) error {
+	if app.ring == nil {
+		return nil
+	}
+	owners := func(key string) string {
+		nodes := append([]string(nil), app.ring.PreferenceList(key)...)
+		sort.Strings(nodes)
+		return strings.Join(nodes, ",")
+	}
+	first := owners(keys[0])
+	for _, key := range keys[1:] {
+		if owners(key) != first {
+			return errSpansPartitions
+		}
+	}
+	return nil
+}
+
+// BatchHandler responds to POST requests on the /keyValue-store/_batch endpoint by
+// applying every write in the request at once
+func (app *App) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling batch request")
+	w.Header().Set("Content-Type", "application/json")
+
+	var reqBody []byte
+	if r.Body != nil {
+		reqBody, _ = ioutil.ReadAll(r.Body)
+	}
+	now := app.clock.Now()
+	writes, payload, err := parseBatch(reqBody, now)
+	if err == nil {
+		keys := make([]string, len(writes))
+		for i, w := range writes {
+			keys[i] = w.Key
+		}
+		err = app.sameOwners(keys)
+	}
+	if payload == nil {
+		payload = NewVectorClock()
+	}
+	if err != nil {
+		log.Println("ERROR: Rejecting batch: ", err)
+		w.WriteHeader(http.StatusBadRequest) // code 400
+		body, _ := json.Marshal(map[string]interface{}{
+			"result":  "Error",
+			"msg":     errors.Cause(err).Error(),
+			"error":   err.Error(),
+			"payload": payload,
+		})
+		w.Write(body)
+		return
+	}
+
+	// A batch for keys this node doesn't store is handled by a node that does
+	r.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	if app.forward(w, r, writes[0].Key) {
+		return
+	}
+
+	node := ""
+	if app.siblings {
+		node = app.view.Primary()
+	}
+	merged, err := app.db.Batch(writes, now, payload, node)
+	if err != nil {
+		status, body := app.writeFailure(err, writes[0].Key, payload)
+		w.WriteHeader(status)
+		w.Write(body)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK) // code 200
+	body, err := json.Marshal(map[string]interface{}{
+		"result":  "Success",
+		"msg":     "Batch applied",
+		"count":   len(writes),
+		"payload": merged,
+	})
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
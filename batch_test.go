@@ -0,0 +1,168 @@
+// batch_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for batch writes
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+func TestBatchIsOneLogRecord(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	w, err := OpenWAL(dir)
+	ok(t, err)
+	k := NewKVS()
+	ok(t, k.Restore(w))
+	k.Put(keyExists, valExists, time.Now(), VectorClock{})
+
+	writes := []batchWrite{
+		{Key: keyone, Value: valone},
+		{Key: keyExists, Delete: true},
+		{Key: keyNotExists, Delete: true},
+	}
+	payload, err := k.Batch(writes, time.Now(), VectorClock{}, "")
+	ok(t, err)
+	equals(t, VectorClock{keyone: 1, keyExists: 2}, payload)
+	w.Close()
+
+	w, err = OpenWAL(dir)
+	ok(t, err)
+	defer w.Close()
+	var recs []walRecord
+	_, err = w.Replay(0, func(rec walRecord) { recs = append(recs, rec) })
+	ok(t, err)
+	equals(t, 2, len(recs))
+	equals(t, walBatch, recs[1].Op)
+	equals(t, 2, len(recs[1].Batch))
+
+	r := NewKVS()
+	ok(t, r.Restore(w))
+	val, _ := r.Get(keyone, VectorClock{})
+	equals(t, valone, val)
+	alive, _ := r.Contains(keyExists)
+	assert(t, !alive, "Delete in the batch wasn't replayed")
+	equals(t, []string{keyone, keyExists}, entryOf(r, keyone).Batch.Keys)
+}
+
+func TestUnloggedBatchIsNeverSeen(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	w, err := OpenWAL(dir)
+	ok(t, err)
+	k := NewKVS()
+	ok(t, k.Restore(w))
+	k.Put(keyExists, valExists, time.Now(), VectorClock{})
+
+	w.Close()
+	writes := []batchWrite{{Key: keyExists, Value: valtwo}, {Key: keyone, Value: valone}}
+	_, err = k.Batch(writes, time.Now(), VectorClock{}, "")
+	equals(t, errWriteFailed, errors.Cause(err))
+	val, _ := k.Get(keyExists, VectorClock{})
+	equals(t, valExists, val)
+	alive, _ := k.Contains(keyone)
+	assert(t, !alive, "Half of a failed batch was seen")
+}
+
+func TestBatchWithAWriteThatFailsWritesNothing(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	w, err := OpenWAL(dir)
+	ok(t, err)
+	defer w.Close()
+	k := nodeKVS(viewExist)
+	ok(t, k.Restore(w))
+	k.Put(keyExists, valExists, time.Now(), VectorClock{})
+
+	// No more dot counters can be reserved, so the batch's writes can't be made
+	k.dots = &DotCounter{path: filepath.Join(dir, "missing", dotsName)}
+	writes := []batchWrite{{Key: keyone, Value: valone}, {Key: keyExists, Delete: true}}
+	_, err = k.Batch(writes, time.Now(), VectorClock{}, "")
+	equals(t, errWriteFailed, errors.Cause(err))
+	alive, _ := k.Contains(keyone)
+	assert(t, !alive, "Part of a failed batch was written")
+	alive, _ = k.Contains(keyExists)
+	assert(t, alive, "Part of a failed batch was written")
+}
+
+func TestInvalidBatchWritesNothing(t *testing.T) {
+	k := NewKVS()
+	writes := []batchWrite{{Key: keyone, Value: valone}, {Key: keyone, Delete: true}}
+	_, err := k.Batch(writes, time.Now(), VectorClock{}, "")
+	equals(t, errInvalidBatch, errors.Cause(err))
+	equals(t, 0, len(k.GetTimeGlob().List))
+
+	_, err = k.Batch(nil, time.Now(), VectorClock{}, "")
+	equals(t, errInvalidBatch, errors.Cause(err))
+}
+
+func TestBatchIsGossipedWhole(t *testing.T) {
+	alice, bob := nodeKVS(testMain), nodeKVS(viewExist)
+	_, err := alice.Batch([]batchWrite{{Key: keyone, Value: valone}, {Key: keyExists, Value: valExists}}, time.Now(), VectorClock{}, "")
+	ok(t, err)
+
+	// Bob only lacks one key of the batch as far as the timeGlob goes, but gets both
+	eg := alice.WithBatches(alice.GetEntryGlob(timeGlob{List: map[string]time.Time{keyone: {}}}))
+	equals(t, 2, len(eg.Keys))
+	v := TestView{view: testView}
+	g := GossipVals{kvs: bob, view: &v}
+	g.UpdateKVS(eg)
+	for _, key := range []string{keyone, keyExists} {
+		alive, _ := bob.Contains(key)
+		assert(t, alive, "Batch only half applied, missing "+key)
+	}
+
+	// Once a key is written again it's no longer sent with its batch
+	alice.Put(keyExists, valtwo, time.Now(), VectorClock{keyExists: 1})
+	eg = alice.WithBatches(alice.GetEntryGlob(timeGlob{List: map[string]time.Time{keyone: {}}}))
+	equals(t, 1, len(eg.Keys))
+}
+
+func TestBatchHandler(t *testing.T) {
+	app := &App{db: NewKVS(), view: *NewView(testMain, testMain)}
+	router := mux.NewRouter()
+	router.HandleFunc(rootURL+batch, app.BatchHandler).Methods(http.MethodPost)
+	post := func(body string) (int, map[string]interface{}) {
+		req, err := http.NewRequest(http.MethodPost, rootURL+batch, strings.NewReader(body))
+		ok(t, err)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		var got map[string]interface{}
+		ok(t, json.Unmarshal(recorder.Body.Bytes(), &got))
+		return recorder.Code, got
+	}
+
+	code, got := post(`{"ops": [{"op": "put", "key": "` + keyone + `", "val": "` + valone + `", "ttl": "60s"},
+		{"op": "put", "key": "` + keyExists + `", "val": "` + valExists + `"}], "payload": {"other": 3}}`)
+	equals(t, http.StatusOK, code)
+	equals(t, map[string]interface{}{keyone: float64(1), keyExists: float64(1), "other": float64(3)}, got["payload"])
+	val, _ := app.db.Get(keyExists, VectorClock{})
+	equals(t, valExists, val)
+
+	// A bare list works too
+	code, _ = post(`[{"op": "delete", "key": "` + keyone + `"}]`)
+	equals(t, http.StatusOK, code)
+	alive, _ := app.db.Contains(keyone)
+	assert(t, !alive, "Batch delete wasn't applied")
+
+	code, got = post(`[{"op": "rename", "key": "` + keyone + `"}]`)
+	equals(t, http.StatusBadRequest, code)
+	equals(t, "Invalid batch", got["msg"])
+}
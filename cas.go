@@ -0,0 +1,326 @@
+// cas.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines conditional writes. A PUT or DELETE may carry an If-Match or If-None-Match
+// header, or the if_match and if_none_match form fields, naming versions of the key:
+// "*" for any live version, a Version such as "3", or a vector clock such as {"k": 3}.
+// With If-Match the write is only made if the key is live at a version it names, and
+// with If-None-Match only if it isn't, so If-None-Match: * creates a key only if it's
+// absent. That is enough for idempotent creates and for locks built out of keys.
+//
+// The check and the write happen under one lock on the KVS, so no other write on this
+// node can come between them. That lock only means something if every conditional write
+// of a key takes the same one, so they are all sent to the key's coordinator: the first
+// node in its preference list, or in the sorted view when every node stores every key,
+// which the failure detector hasn't declared dead. If the coordinator can't be reached
+// the write fails with 503 rather than being checked somewhere it isn't safe to. A write
+// which fails its check is answered with 412, the version which is stored and the
+// client's payload merged with that version's clock.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ifMatchField     = "if_match"      // Form field naming the versions a write may replace
+	ifNoneMatchField = "if_none_match" // Form field naming the versions a write mustn't replace
+)
+
+var (
+	// errPreconditionFailed is returned for a conditional write whose condition doesn't hold
+	errPreconditionFailed = errors.New("Precondition failed")
+
+	// errInvalidPrecondition is returned for a condition which can't be read
+	errInvalidPrecondition = errors.New("Invalid precondition")
+
+	// errWriteFailed is returned for a write the KVS couldn't make
+	errWriteFailed = errors.New("Write failed")
+
+	// errNoCoordinator is returned for a conditional write whose key's coordinator can't be reached
+	errNoCoordinator = errors.New("Coordinator unavailable")
+)
+
+// versionTag names versions of a key in a condition
+type versionTag struct {
+	any     bool        // Any live version
+	version int         // The version with this Version, when there's no clock
+	clock   VectorClock // The version with exactly this clock
+}
+
+// parseVersionTag reads a tag sent by a client. Quotes around it are ignored, so an
+// ETag-style "3" is the same as 3.
+func parseVersionTag(s string) (*versionTag, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if s == "*" {
+		return &versionTag{any: true}, nil
+	}
+	if strings.HasPrefix(s, "{") {
+		var c VectorClock
+		if err := json.Unmarshal([]byte(s), &c); err != nil || c == nil {
+			return nil, errInvalidPrecondition
+		}
+		return &versionTag{clock: c}, nil
+	}
+	n, err := strconv.Atoi(strings.Trim(s, `"`))
+	if err != nil || n < 0 {
+		return nil, errInvalidPrecondition
+	}
+	return &versionTag{version: n}, nil
+}
+
+// matches returns true if a stored entry is a version the tag names. Only live versions
+// are named by a tag.
+func (v *versionTag) matches(e KeyEntry, now time.Time) bool {
+	if !live(e, now) {
+		return false
+	}
+	switch {
+	case v.any:
+		return true
+	case v.clock != nil:
+		return e.GetClock().Compare(v.clock) == ClockEqual
+	default:
+		return e.GetVersion() == v.version
+	}
+}
+
+// Precondition is the condition a write puts on the version of the key it replaces.
+// The zero Precondition always holds.
+type Precondition struct {
+	match     *versionTag // The key must be live at this version, nil for no condition
+	noneMatch *versionTag // The key mustn't be live at this version, nil for no condition
+}
+
+// IfAbsent is the precondition of a write which only creates a key
+var IfAbsent = Precondition{noneMatch: &versionTag{any: true}}
+
+// parsePrecondition reads the If-Match and If-None-Match conditions sent by a client
+func parsePrecondition(match string, noneMatch string) (Precondition, error) {
+	var p Precondition
+	var err error
+	if p.match, err = parseVersionTag(match); err != nil {
+		return Precondition{}, err
+	}
+	if p.noneMatch, err = parseVersionTag(noneMatch); err != nil {
+		return Precondition{}, err
+	}
+	return p, nil
+}
+
+// requestPrecondition reads the precondition of a request from its headers, falling back
+// on its form for any condition the headers don't carry
+func requestPrecondition(r *http.Request, form url.Values) (Precondition, error) {
+	match := r.Header.Get("If-Match")
+	if match == "" {
+		match = form.Get(ifMatchField)
+	}
+	noneMatch := r.Header.Get("If-None-Match")
+	if noneMatch == "" {
+		noneMatch = form.Get(ifNoneMatchField)
+	}
+	return parsePrecondition(match, noneMatch)
+}
+
+// IsZero returns true if the precondition puts no condition on a write
+func (p Precondition) IsZero() bool {
+	return p.match == nil && p.noneMatch == nil
+}
+
+// holds returns true if a write may replace the entry stored, which is nil if there's none
+func (p Precondition) holds(e KeyEntry, now time.Time) bool {
+	if p.match != nil && !p.match.matches(e, now) {
+		return false
+	}
+	if p.noneMatch != nil && p.noneMatch.matches(e, now) {
+		return false
+	}
+	return true
+}
+
+// conditional returns true if a request carries a condition in its headers, its query or
+// its form-encoded body
+func conditional(r *http.Request, body []byte) bool {
+	if r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" {
+		return true
+	}
+	form, _ := url.ParseQuery(string(body))
+	for _, fields := range []url.Values{r.URL.Query(), form} {
+		if fields.Get(ifMatchField) != "" || fields.Get(ifNoneMatchField) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// coordinator returns the node which checks the conditional writes of a key
+func (app *App) coordinator(key string) string {
+	var nodes []string
+	if app.ring != nil {
+		nodes = app.ring.PreferenceList(key)
+	} else {
+		nodes = app.view.List()
+		sort.Strings(nodes)
+	}
+	for _, node := range nodes {
+		if !app.members.IsDead(node) {
+			return node
+		}
+	}
+	return app.view.Primary()
+}
+
+// coordinate sends a conditional write to its key's coordinator, unless that's us or the
+// write was sent to us as the coordinator, and relays the response back to the client.
+// It returns true if the request was answered that way, and errNoCoordinator if the
+// coordinator couldn't be reached.
+func (app *App) coordinate(w http.ResponseWriter, r *http.Request, key string) (bool, error) {
+	if r.Header.Get(coordinatedHeader) != "" {
+		return false, nil
+	}
+
+	// The body is needed to look for a condition, and again by whoever handles the write
+	var reqBody []byte
+	if r.Body != nil {
+		reqBody, _ = ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+	me := app.view.Primary()
+	node := app.coordinator(key)
+	if node == me || !conditional(r, reqBody) {
+		return false, nil
+	}
+
+	log.Println("Sending conditional write of key " + key + " to its coordinator " + node)
+	if err := relay(w, r, node, reqBody, coordinatedHeader, me); err != nil {
+		return false, errors.Wrap(errNoCoordinator, err.Error())
+	}
+	return true, nil
+}
+
+// coordinatorFailure builds the response to a conditional write whose coordinator
+// couldn't be reached
+func coordinatorFailure(err error) (int, []byte) {
+	log.Println("ERROR: Conditional write not coordinated: ", err)
+	resp := map[string]interface{}{
+		"result": "Error",
+		"msg":    "Coordinator unavailable",
+		"error":  err.Error(),
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	return http.StatusServiceUnavailable, body // code 503
+}
+
+// check returns errPreconditionFailed unless a write of key may be made. The lock must be held.
+func (k *KVS) check(key string, cond Precondition, now time.Time) error {
+	if cond.IsZero() {
+		return nil
+	}
+	e, ok := k.db.Get(key)
+	if !ok {
+		e = nil
+	}
+	if !cond.holds(e, now) {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// PutIf is PutExpiring for a write which is only made if the key meets cond
+func (k *KVS) PutIf(key string, val string, time time.Time, payload VectorClock, expires time.Time, cond Precondition) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if err := k.check(key, cond, time); err != nil {
+		return err
+	}
+	if !k.put(key, val, time, payload, expires) {
+		return errWriteFailed
+	}
+	return nil
+}
+
+// PutIfAbsent writes a key only if it isn't live, returning errPreconditionFailed if it is
+func (k *KVS) PutIfAbsent(key string, val string, time time.Time, payload VectorClock) error {
+	return k.PutIf(key, val, time, payload, never, IfAbsent)
+}
+
+// PutSiblingIf is PutSibling for a write which is only made if the key meets cond
+func (k *KVS) PutSiblingIf(key string, val string, time time.Time, payload VectorClock, context VectorClock, node string, expires time.Time, cond Precondition) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if err := k.check(key, cond, time); err != nil {
+		return err
+	}
+	if !k.putSibling(key, val, time, payload, context, node, expires) {
+		return errWriteFailed
+	}
+	return nil
+}
+
+// DeleteIf is Delete for a delete which is only made if the key meets cond
+func (k *KVS) DeleteIf(key string, time time.Time, payload VectorClock, cond Precondition) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if err := k.check(key, cond, time); err != nil {
+		return err
+	}
+	if !k.delete(key, time, payload) {
+		return errWriteFailed
+	}
+	return nil
+}
+
+// writeFailure builds the response to a write the KVS didn't make. A failed condition
+// is answered with the version stored and the client's payload merged with its clock.
+func (app *App) writeFailure(err error, key string, payload VectorClock) (int, []byte) {
+	var resp map[string]interface{}
+	status := http.StatusInternalServerError // code 500
+	if errors.Cause(err) == errPreconditionFailed {
+		log.Println("Precondition failed for key " + key)
+		status = http.StatusPreconditionFailed // code 412
+		_, version := app.db.Contains(key)
+		resp = map[string]interface{}{
+			"result":  "Error",
+			"msg":     "Precondition failed",
+			"version": version,
+			"payload": payload.Merge(app.db.GetClock(key)),
+		}
+	} else {
+		log.Println("ERROR: Write failed: ", err)
+		resp = map[string]interface{}{
+			"result":  "Error",
+			"msg":     "Write failed",
+			"payload": payload,
+		}
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	return status, body
+}
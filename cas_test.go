@@ -0,0 +1,146 @@
+// cas_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for conditional writes
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePrecondition(t *testing.T) {
+	p, err := parsePrecondition("", "")
+	ok(t, err)
+	assert(t, p.IsZero(), "Empty headers made a condition")
+
+	p, err = parsePrecondition(`"3"`, "*")
+	ok(t, err)
+	equals(t, versionTag{version: 3}, *p.match)
+	equals(t, versionTag{any: true}, *p.noneMatch)
+
+	p, err = parsePrecondition(`{"`+keyone+`": 2}`, "")
+	ok(t, err)
+	equals(t, VectorClock{keyone: 2}, p.match.clock)
+
+	for _, bad := range []string{"three", "-1", "{nope"} {
+		_, err = parsePrecondition(bad, "")
+		equals(t, errInvalidPrecondition, err)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	k := NewKVS()
+	ok(t, k.PutIfAbsent(keyone, valone, time.Now(), VectorClock{}))
+	equals(t, errPreconditionFailed, k.PutIfAbsent(keyone, valtwo, time.Now(), VectorClock{}))
+	val, _ := k.Get(keyone, VectorClock{})
+	equals(t, valone, val)
+
+	// Only a write naming the version stored is made
+	stale, _ := parsePrecondition("2", "")
+	equals(t, errPreconditionFailed, k.PutIf(keyone, valtwo, time.Now(), VectorClock{keyone: 2}, never, stale))
+	current, _ := parsePrecondition("1", "")
+	ok(t, k.PutIf(keyone, valtwo, time.Now(), VectorClock{keyone: 2}, never, current))
+	val, _ = k.Get(keyone, VectorClock{})
+	equals(t, valtwo, val)
+
+	// The same goes for a clock, and for deletes
+	byClock, _ := parsePrecondition(`{"`+keyone+`": 1}`, "")
+	equals(t, errPreconditionFailed, k.DeleteIf(keyone, time.Now(), VectorClock{}, byClock))
+	byClock, _ = parsePrecondition(`{"`+keyone+`": 2}`, "")
+	ok(t, k.DeleteIf(keyone, time.Now(), VectorClock{}, byClock))
+
+	// Once deleted the key is absent again
+	ok(t, k.PutIfAbsent(keyone, valone, time.Now(), VectorClock{}))
+}
+
+func TestPutHandlerPreconditionFailed(t *testing.T) {
+	app := &App{db: NewKVS(), view: *NewView(testMain, testMain)}
+	absent := http.Header{"If-None-Match": {"*"}}
+	code, _ := appRequest(t, app, http.MethodPut, rootURL+"/"+keyone, url.Values{"val": {valone}}.Encode(), absent)
+	equals(t, http.StatusOK, code)
+
+	code, got := appRequest(t, app, http.MethodPut, rootURL+"/"+keyone, url.Values{"val": {valtwo}, "payload": {`{"other": 4}`}}.Encode(), absent)
+	equals(t, http.StatusPreconditionFailed, code)
+	equals(t, "Precondition failed", got["msg"])
+	equals(t, float64(1), got["version"])
+	equals(t, map[string]interface{}{keyone: float64(1), "other": float64(4)}, got["payload"])
+
+	// The condition can be sent in the form too
+	code, _ = appRequest(t, app, http.MethodPut, rootURL+"/"+keyone, url.Values{"val": {valtwo}, ifMatchField: {"1"}}.Encode(), nil)
+	equals(t, http.StatusCreated, code)
+
+	code, got = appRequest(t, app, http.MethodPut, rootURL+"/"+keyone, url.Values{"val": {valtwo}}.Encode(), http.Header{"If-Match": {"soon"}})
+	equals(t, http.StatusBadRequest, code)
+	equals(t, "Invalid precondition", got["msg"])
+}
+
+func TestDeleteHandlerPreconditionFailed(t *testing.T) {
+	app := &App{db: NewKVS(), view: *NewView(testMain, testMain)}
+	app.db.Put(keyone, valone, time.Now(), VectorClock{keyone: 1})
+
+	code, got := appRequest(t, app, http.MethodDelete, rootURL+"/"+keyone, url.Values{"payload": {""}, ifMatchField: {"2"}}.Encode(), nil)
+	equals(t, http.StatusPreconditionFailed, code)
+	equals(t, float64(1), got["version"])
+	alive, _ := app.db.Contains(keyone)
+	assert(t, alive, "Key deleted despite its precondition failing")
+
+	code, _ = appRequest(t, app, http.MethodDelete, rootURL+"/"+keyone, url.Values{"payload": {""}}.Encode(), http.Header{"If-Match": {"1"}})
+	equals(t, http.StatusOK, code)
+}
+
+func TestConditionalWriteIsCheckedByTheCoordinator(t *testing.T) {
+	// The coordinator sorts ahead of us in the view, and reports who sent it the write
+	coord := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		w.Write([]byte(`{"msg": "` + r.Header.Get(coordinatedHeader) + `"}`))
+	}))
+	defer coord.Close()
+	coordAddr := strings.TrimPrefix(coord.URL, "http://")
+
+	app := &App{db: NewKVS(), view: *NewView(testMain, testMain+","+coordAddr)}
+	equals(t, coordAddr, app.coordinator(keyone))
+	absent := http.Header{"If-None-Match": {"*"}}
+	code, got := appRequest(t, app, http.MethodPut, rootURL+"/"+keyone, url.Values{"val": {valone}}.Encode(), absent)
+	equals(t, http.StatusPreconditionFailed, code)
+	equals(t, testMain, got["msg"])
+	alive, _ := app.db.Contains(keyone)
+	assert(t, !alive, "Conditional write was checked locally")
+
+	// Writes without a condition are still made here
+	code, _ = appRequest(t, app, http.MethodPut, rootURL+"/"+keyone, url.Values{"val": {valone}}.Encode(), nil)
+	equals(t, http.StatusOK, code)
+
+	// As is a write the coordinator was sent
+	sent := http.Header{"If-Match": {"1"}, coordinatedHeader: {coordAddr}}
+	code, _ = appRequest(t, app, http.MethodDelete, rootURL+"/"+keyone, url.Values{"payload": {""}}.Encode(), sent)
+	equals(t, http.StatusOK, code)
+}
+
+func TestConditionalWriteFailsWithoutItsCoordinator(t *testing.T) {
+	v := NewView(testMain, testMain+",127.0.0.1:1")
+	app := &App{db: NewKVS(), view: *v}
+	code, got := appRequest(t, app, http.MethodPut, rootURL+"/"+keyone, url.Values{"val": {valone}, ifNoneMatchField: {"*"}}.Encode(), nil)
+	equals(t, http.StatusServiceUnavailable, code)
+	equals(t, "Coordinator unavailable", got["msg"])
+	alive, _ := app.db.Contains(keyone)
+	assert(t, !alive, "Conditional write was made without its coordinator")
+
+	// A coordinator the failure detector has declared dead is passed over
+	app.members = NewMembership(v, time.Second, time.Minute, 2)
+	app.members.Receive(swimMessage{From: testMain, Updates: []swimUpdate{{Addr: "127.0.0.1:1", State: stateDead}}})
+	equals(t, testMain, app.coordinator(keyone))
+	code, _ = appRequest(t, app, http.MethodPut, rootURL+"/"+keyone, url.Values{"val": {valone}, ifNoneMatchField: {"*"}}.Encode(), nil)
+	equals(t, http.StatusOK, code)
+}
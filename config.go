@@ -0,0 +1,279 @@
+// config.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Reads the runtime configuration of a node out of its environment. Everything is
+// set through -e flags on the docker command, and anything left out gets a default.
+//
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	engineMemory = "memory" // In-memory engine, made durable by the write-ahead log and snapshots
+	engineLSM    = "lsm"    // On-disk LSM engine, durable on its own
+
+	defaultTombstoneGrace = 24 * time.Hour
+)
+
+// Config holds the settings a node is started with
+type Config struct {
+	IPPort           string        // IP_PORT - this node's address
+	View             string        // VIEW - comma-separated addresses of every node
+	DataDir          string        // DATA_DIR - where anything persistent is kept
+	Engine           string        // STORAGE_ENGINE - "memory" or "lsm"
+	SnapshotInterval time.Duration // SNAPSHOT_INTERVAL - how often the memory engine is snapshotted
+	Replicas         int           // REPLICAS - nodes storing each key, 0 stores every key everywhere
+	Vnodes           int           // VNODES - points on the ring per node
+	ReadQuorum       int           // READ_QUORUM - R for requests which don't send one
+	WriteQuorum      int           // WRITE_QUORUM - W for requests which don't send one
+	QuorumTimeout    time.Duration // QUORUM_TIMEOUT - how long to wait for replicas to answer
+	ProbeInterval    time.Duration // PROBE_INTERVAL - the failure detector's protocol period
+	SuspectTimeout   time.Duration // SUSPECT_TIMEOUT - how long a suspect has before it's dead
+	IndirectProbes   int           // INDIRECT_PROBES - members asked to ping a target which missed a ping
+	PhiThreshold     float64       // PHI_THRESHOLD - suspicion level at which a peer is avoided
+	Siblings         bool          // SIBLINGS - keep concurrent writes as siblings instead of picking one
+	TombstoneGrace   time.Duration // TOMBSTONE_GRACE - age at which a tombstone is collected without every ack
+	WatchBacklog     int           // WATCH_BACKLOG - changes kept for watchers resuming from a cursor
+}
+
+// LoadConfig reads the configuration from the environment
+func LoadConfig() (Config, error) {
+	c := Config{
+		IPPort:  os.Getenv("IP_PORT"),
+		View:    os.Getenv("VIEW"),
+		DataDir: getenvDefault("DATA_DIR", "data"),
+		Engine:  getenvDefault("STORAGE_ENGINE", engineMemory),
+	}
+
+	var err error
+	c.SnapshotInterval, err = getenvDuration("SNAPSHOT_INTERVAL", 5*time.Minute)
+	if err != nil {
+		return c, err
+	}
+	c.QuorumTimeout, err = getenvDuration("QUORUM_TIMEOUT", defaultQuorumTimeout)
+	if err != nil {
+		return c, err
+	}
+	c.ProbeInterval, err = getenvDuration("PROBE_INTERVAL", time.Second)
+	if err != nil {
+		return c, err
+	}
+	c.SuspectTimeout, err = getenvDuration("SUSPECT_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return c, err
+	}
+	c.Replicas, err = getenvInt("REPLICAS", 0)
+	if err != nil {
+		return c, err
+	}
+	c.Vnodes, err = getenvInt("VNODES", defaultVnodes)
+	if err != nil {
+		return c, err
+	}
+	c.ReadQuorum, err = getenvInt("READ_QUORUM", 1)
+	if err != nil {
+		return c, err
+	}
+	c.WriteQuorum, err = getenvInt("WRITE_QUORUM", 1)
+	if err != nil {
+		return c, err
+	}
+	c.IndirectProbes, err = getenvInt("INDIRECT_PROBES", 3)
+	if err != nil {
+		return c, err
+	}
+	c.PhiThreshold, err = getenvFloat("PHI_THRESHOLD", defaultPhiThreshold)
+	if err != nil {
+		return c, err
+	}
+	c.WatchBacklog, err = getenvInt("WATCH_BACKLOG", defaultWatchBacklog)
+	if err != nil {
+		return c, err
+	}
+	c.Siblings, err = getenvBool("SIBLINGS", false)
+	if err != nil {
+		return c, err
+	}
+	c.TombstoneGrace, err = getenvDuration("TOMBSTONE_GRACE", defaultTombstoneGrace)
+	if err != nil {
+		return c, err
+	}
+
+	// A snapshot is taken every interval, so one which isn't positive would take them back to back
+	if c.SnapshotInterval <= 0 {
+		return c, errors.New("SNAPSHOT_INTERVAL must be positive, got " + c.SnapshotInterval.String())
+	}
+	if c.Engine != engineMemory && c.Engine != engineLSM {
+		return c, errors.New("Unknown STORAGE_ENGINE " + c.Engine)
+	}
+	return c, nil
+}
+
+// OpenKVS builds the KVS described by the config. The memory engine is rebuilt from
+// its snapshot and write-ahead log, and snapshots are started in the background.
+func (c Config) OpenKVS() (*KVS, error) {
+	graves, err := OpenGraveyard(c.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	dots, err := OpenDotCounter(c.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Engine == engineLSM {
+		e, err := OpenLSMEngine(filepath.Join(c.DataDir, "lsm"))
+		if err != nil {
+			return nil, err
+		}
+		k := NewKVSWithEngine(e)
+		k.graves = graves
+		k.dots = dots
+		return k, nil
+	}
+
+	k := NewKVS()
+	k.graves = graves
+	k.dots = dots
+	wal, err := OpenWAL(c.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	err = k.Restore(wal)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Taking snapshots every", c.SnapshotInterval)
+	go k.SnapshotLoop(c.SnapshotInterval)
+	return k, nil
+}
+
+// Collector builds the tombstone collector for the KVS
+func (c Config) Collector(v View, ring *Ring, k *KVS) *Collector {
+	return NewCollector(v, ring, k, c.TombstoneGrace, c.QuorumTimeout)
+}
+
+// Ring builds the consistent-hash ring over the view, or returns nil if every node
+// should store every key
+func (c Config) Ring(v View) *Ring {
+	if c.Replicas <= 0 {
+		return nil
+	}
+	return NewRing(v, c.Vnodes, c.Replicas)
+}
+
+// Quorum builds the coordinator for quorum reads and writes over the given view and ring
+func (c Config) Quorum(v View, ring *Ring, hints *HintStore, phi *PhiDetector, views *ViewLog) *Quorum {
+	q := NewQuorum(v, ring, c.ReadQuorum, c.WriteQuorum, c.QuorumTimeout, hints)
+	q.phi = phi
+	q.views = views
+	return q
+}
+
+// OpenHints opens the store of hints waiting for other replicas
+func (c Config) OpenHints(views *ViewLog) (*HintStore, error) {
+	h, err := OpenHintStore(filepath.Join(c.DataDir, "hints"), c.QuorumTimeout)
+	if err != nil {
+		return nil, err
+	}
+	h.views = views
+	if views != nil {
+		// Peers may have left the view while we were down, and may leave it from now on
+		err = h.Forget(views.Current().Members)
+		if err != nil {
+			return nil, err
+		}
+		views.onLearn = func(e viewEntry) {
+			err := h.Forget(e.Members)
+			if err != nil {
+				log.Println("Error dropping hints: ", err)
+			}
+		}
+	}
+	return h, nil
+}
+
+// OpenViews opens the log of agreed views, restoring the latest one into the view
+func (c Config) OpenViews(v View) (*ViewLog, error) {
+	return OpenViewLog(v, c.DataDir, c.QuorumTimeout)
+}
+
+// Membership builds the failure detector over the view
+func (c Config) Membership(v View) *Membership {
+	return NewMembership(v, c.ProbeInterval, c.SuspectTimeout, c.IndirectProbes)
+}
+
+// getenvInt returns the environment variable as an int, or def if it isn't set
+func getenvInt(name string, def int) (int, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "Invalid "+name)
+	}
+	return n, nil
+}
+
+// getenvFloat returns the environment variable as a float64, or def if it isn't set
+func getenvFloat(name string, def float64) (float64, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "Invalid "+name)
+	}
+	return f, nil
+}
+
+// getenvBool returns the environment variable as a bool, or def if it isn't set
+func getenvBool(name string, def bool) (bool, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, errors.Wrap(err, "Invalid "+name)
+	}
+	return b, nil
+}
+
+// getenvDuration returns the environment variable as a duration, or def if it isn't set
+func getenvDuration(name string, def time.Duration) (time.Duration, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "Invalid "+name)
+	}
+	return d, nil
+}
+
+// getenvDefault returns the environment variable, or def if it isn't set
+func getenvDefault(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
@@ -21,16 +21,46 @@ type dbAccess interface {
 	Contains(string) (bool, int)
 
 	// Get returns the value associated with a particular key. If the key does not exist it returns ""
-	Get(string, map[string]int) (string, map[string]int)
+	Get(string, VectorClock) (string, VectorClock)
 
 	// Delete removes a key-value pair from the object. If the key does not exist it returns false.
-	Delete(string, time.Time, map[string]int) bool
+	Delete(string, time.Time, VectorClock) bool
 
 	// Put adds a key-value pair to the data store. If the key already exists, then it overwrites the existing value. If the key does not exist then it is added.
-	Put(string, string, time.Time, map[string]int) bool
+	Put(string, string, time.Time, VectorClock) bool
+
+	// PutExpiring is Put for a value which expires at the given time, or never if it's zero
+	PutExpiring(string, string, time.Time, VectorClock, time.Time) bool
+
+	// Put adds a value as a sibling, replacing the siblings covered by the given context
+	PutSibling(string, string, time.Time, VectorClock, VectorClock, string, time.Time) bool
+
+	// PutIf is PutExpiring for a write which is only made if the key meets a precondition
+	PutIf(string, string, time.Time, VectorClock, time.Time, Precondition) error
+
+	// PutSiblingIf is PutSibling for a write which is only made if the key meets a precondition
+	PutSiblingIf(string, string, time.Time, VectorClock, VectorClock, string, time.Time, Precondition) error
+
+	// DeleteIf is Delete for a delete which is only made if the key meets a precondition
+	DeleteIf(string, time.Time, VectorClock, Precondition) error
+
+	// Batch applies a group of writes at once and returns the payload merged with their clocks
+	Batch([]batchWrite, time.Time, VectorClock, string) (VectorClock, error)
+
+	// Store the versions of a group of keys written by one batch, all at once, where they win over ours
+	MergeEntries(map[string]KeyEntry)
+
+	// Returns the entryGlob with the rest of every batch it holds part of
+	WithBatches(entryGlob) entryGlob
+
+	// Returns the versions held of a group of keys, all read at the same moment
+	ReadCut([]string) map[string]Entry
+
+	// Returns the entries for a range of keys in order, and whether the limit cut it short
+	Scan(string, string, int) ([]scanEntry, bool)
 
 	// Returns an entry's vector clock
-	GetClock(string) map[string]int
+	GetClock(string) VectorClock
 
 	// Returns an entry's timestamp
 	GetTimestamp(string) time.Time
@@ -38,9 +68,21 @@ type dbAccess interface {
 	// Overwrite the existing entry for this key with the one provided
 	OverwriteEntry(string, KeyEntry)
 
+	// Store another replica's version of a key if it wins over ours
+	MergeEntry(string, KeyEntry) bool
+
 	// Returns a timeGlob struct of all of the keys in the db
 	GetTimeGlob() timeGlob
 
 	// Returns an entryGlob struct of all of the keys in the given timeGlob
 	GetEntryGlob(timeGlob) entryGlob
+
+	// Returns the Merkle tree over the keys in the db
+	MerkleTree() *MerkleTree
+
+	// Returns the tombstone collected for a key
+	Grave(string) (Entry, bool)
+
+	// Returns true if the db holds the given version of a key or a newer one
+	Seen(string, KeyEntry) bool
 }
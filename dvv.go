@@ -0,0 +1,194 @@
+// dvv.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines dotted version vectors, which track the history of a key by the replicas that
+// wrote it. The per-key counters in an entry's clock are there for the client's causal
+// payload, and they can't tell replicas apart: two nodes which each overwrite version n
+// both produce version n+1 and look identical. A dotted version vector names every write
+// with a dot, the replica which made it and that replica's own counter for the key, and
+// carries a version vector over the replicas whose writes it replaced. One version
+// descends another when its vector covers the other's dot, and two versions neither of
+// which covers the other are concurrent.
+//
+// A dot only names one write if its replica never uses the same counter twice for the
+// key. The version a write replaces isn't enough to go by, since another replica's
+// version may have won over an earlier write of ours it never saw, so each replica
+// takes its counters from one DotCounter kept in its data directory.
+//
+// Entries stored before dots existed have none, and a replica writing without a node ID
+// doesn't make them either. Whenever either side of a comparison is missing a dot, the
+// two are compared by their per-key clocks as they always were. An old entry picks up a
+// dot the first time it's written again, with the dot descending the old version, so a
+// cluster moves over one key at a time without any downtime or rewrite of its data.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	dotsName    = "dots" // File the highest dot counter reserved is saved in
+	dotsReserve = 1024   // Counters reserved on disk at a time
+)
+
+// A Dot names one write of a key: the replica which made it and that replica's counter
+type Dot struct {
+	Node    string
+	Counter int
+}
+
+// String returns the dot as node:counter
+func (d Dot) String() string {
+	return fmt.Sprintf("%s:%d", d.Node, d.Counter)
+}
+
+// DVV is a dotted version vector: the dot of the write which made a version and the
+// replicas' writes it had seen when it was made
+type DVV struct {
+	Dot     Dot
+	Context VectorClock
+}
+
+// IsZero returns true for a version written before dots, which has none
+func (d DVV) IsZero() bool {
+	return d.Dot.Node == ""
+}
+
+// Vector returns every write the version covers, its own dot included
+func (d DVV) Vector() VectorClock {
+	v := d.Context.Copy()
+	if !d.IsZero() && v[d.Dot.Node] < d.Dot.Counter {
+		v[d.Dot.Node] = d.Dot.Counter
+	}
+	return v
+}
+
+// Covers returns true if the version has seen the write named by dot
+func (d DVV) Covers(dot Dot) bool {
+	return d.Vector()[dot.Node] >= dot.Counter
+}
+
+// Advance returns the version for a write by node replacing this one, with its dot
+// taking the given counter. The counter has to be one node has never given a dot before,
+// which the version replaced can't vouch for: it may be another node's which won over a
+// write of node's it never saw. A replica takes its counters from its DotCounter.
+func (d DVV) Advance(node string, counter int) DVV {
+	return DVV{Dot: Dot{Node: node, Counter: counter}, Context: d.Vector()}
+}
+
+// Compare returns how d is ordered against other
+func (d DVV) Compare(other DVV) Ordering {
+	if d.Dot == other.Dot {
+		return ClockEqual
+	}
+	seesOther, otherSees := d.Covers(other.Dot), other.Covers(d.Dot)
+	switch {
+	case seesOther && !otherSees:
+		return ClockAfter
+	case otherSees && !seesOther:
+		return ClockBefore
+	}
+	return ClockConcurrent
+}
+
+// compareVersions returns how Alice's version of a key is ordered against Bob's, by
+// their dots if both have them and otherwise by their per-key clocks
+func compareVersions(alice KeyEntry, bob KeyEntry) Ordering {
+	a, b := alice.GetDVV(), bob.GetDVV()
+	if a.IsZero() || b.IsZero() {
+		return alice.GetClock().Compare(bob.GetClock())
+	}
+	return a.Compare(b)
+}
+
+// DotCounter hands out the counters for the dots of the writes made on this node. Each
+// is above the highest it has handed out before, for any key, and above the counter the
+// version being replaced has for this node. Counters are reserved on disk a block at a
+// time before they're handed out, so a restarted node carries on past any it used.
+type DotCounter struct {
+	path     string // Where the reservation is saved, empty if it's only kept in memory
+	issued   int    // Highest counter handed out
+	reserved int    // Highest counter reserved on disk
+	mutex    sync.Mutex
+}
+
+// NewDotCounter creates a counter which is only kept in memory
+func NewDotCounter() *DotCounter {
+	return &DotCounter{}
+}
+
+// OpenDotCounter opens the counter saved in dir, creating the directory if needed
+func OpenDotCounter(dir string) (*DotCounter, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "Creating data directory failed")
+	}
+	c := &DotCounter{path: filepath.Join(dir, dotsName)}
+	data, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Reading dot counter failed")
+	}
+	c.reserved, err = strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.Wrap(err, "Decoding dot counter failed")
+	}
+	// Anything up to the reservation may have been handed out before a restart
+	c.issued = c.reserved
+	return c, nil
+}
+
+// Next returns the counter for a write replacing a version whose vector has seen for
+// this node
+func (c *DotCounter) Next(seen int) (int, error) {
+	if c == nil {
+		return seen + 1, nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	n := c.issued
+	if seen > n {
+		n = seen
+	}
+	n++
+	if c.path != "" && n > c.reserved {
+		err := c.reserve(n + dotsReserve)
+		if err != nil {
+			return 0, err
+		}
+	}
+	c.issued = n
+	return n, nil
+}
+
+// reserve saves a new reservation to disk. The lock must be held.
+func (c *DotCounter) reserve(upTo int) error {
+	err := writeFileSync(c.path+".tmp", []byte(strconv.Itoa(upTo)))
+	if err != nil {
+		return err
+	}
+	err = os.Rename(c.path+".tmp", c.path)
+	if err != nil {
+		return errors.Wrap(err, "Renaming dot counter failed")
+	}
+	c.reserved = upTo
+	return nil
+}
@@ -0,0 +1,147 @@
+// dvv_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for dotted version vectors
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Creates a KVS which writes as node
+func nodeKVS(node string) *KVS {
+	k := NewKVS()
+	k.clock = NewHLC(node)
+	return k
+}
+
+// Returns a KVS's entry for a key
+func entryOf(k *KVS, key string) *Entry {
+	e := k.GetEntryGlob(timeGlob{List: map[string]time.Time{key: {}}}).Keys[key]
+	return &e
+}
+
+func TestDVVCompare(t *testing.T) {
+	first := DVV{}.Advance(viewExist, 1)
+	equals(t, Dot{Node: viewExist, Counter: 1}, first.Dot)
+
+	second := first.Advance(viewNotExist, 1)
+	equals(t, ClockAfter, second.Compare(first))
+	equals(t, ClockBefore, first.Compare(second))
+	equals(t, ClockEqual, second.Compare(second))
+
+	// Two replicas writing over the same version haven't seen each other
+	other := first.Advance(testMain, 1)
+	equals(t, ClockConcurrent, second.Compare(other))
+	equals(t, VectorClock{viewExist: 1, viewNotExist: 1, testMain: 1}, second.Vector().Merge(other.Vector()))
+}
+
+func TestConcurrentWritesOnTwoNodesAreConcurrent(t *testing.T) {
+	alice, bob := nodeKVS(viewExist), nodeKVS(viewNotExist)
+	alice.Put(keyone, valone, time.Now(), VectorClock{})
+	bob.OverwriteEntry(keyone, entryOf(alice, keyone))
+
+	// Both overwrite version 1, and the per-key clocks can't tell them apart
+	alice.Put(keyone, valtwo, time.Now(), VectorClock{keyone: 2})
+	bob.Put(keyone, "three", time.Now(), VectorClock{keyone: 2})
+	a, b := entryOf(alice, keyone), entryOf(bob, keyone)
+	equals(t, ClockEqual, a.GetClock().Compare(b.GetClock()))
+	equals(t, ClockConcurrent, compareVersions(a, b))
+
+	// Once Bob has Alice's version, his next write descends it
+	seen := *a
+	bob.OverwriteEntry(keyone, &seen)
+	bob.Put(keyone, "four", time.Now(), VectorClock{keyone: 3})
+	equals(t, ClockAfter, compareVersions(entryOf(bob, keyone), a))
+}
+
+func TestDeleteAndRewriteKeepDescending(t *testing.T) {
+	k := nodeKVS(viewExist)
+	k.Put(keyone, valone, time.Now(), VectorClock{})
+	first := entryOf(k, keyone)
+	k.Delete(keyone, time.Now(), VectorClock{keyone: 1})
+	tombstone := entryOf(k, keyone)
+	equals(t, ClockAfter, compareVersions(tombstone, first))
+
+	// Writing over the tombstone must beat it, or the key would stay deleted
+	k.Put(keyone, valtwo, time.Now(), VectorClock{keyone: 3})
+	equals(t, ClockAfter, compareVersions(entryOf(k, keyone), tombstone))
+}
+
+func TestEntriesWithoutDotsUseClocks(t *testing.T) {
+	ts := time.Now()
+	legacy := NewEntry(ts, VectorClock{keyone: 2}, valone, 2)
+	dotted := NewEntry(ts, VectorClock{keyone: 1}, valtwo, 1)
+	dotted.DVV = DVV{}.Advance(viewExist, 1)
+	equals(t, ClockAfter, compareVersions(legacy, dotted))
+
+	// An old entry written again picks up a dot which beats the old version
+	k := nodeKVS(viewExist)
+	stored := *legacy
+	k.OverwriteEntry(keyone, &stored)
+	k.Put(keyone, valtwo, ts, VectorClock{keyone: 3})
+	e := entryOf(k, keyone)
+	equals(t, Dot{Node: viewExist, Counter: 1}, e.DVV.Dot)
+	assert(t, resolveConflict(e, legacy), "Rewritten entry lost to the version it replaced")
+}
+
+func TestGossipAndQuorumReadsPickTheSameWinner(t *testing.T) {
+	ts := time.Now()
+	local := NewEntry(ts, VectorClock{keyone: 2}, valone, 2)
+	local.DVV = DVV{}.Advance(viewExist, 1)
+	remote := NewEntry(ts.Add(-time.Second), VectorClock{keyone: 3}, valtwo, 3)
+	remote.DVV = DVV{}.Advance(viewNotExist, 2)
+
+	// The dots are concurrent, so the later local write wins even with a smaller clock
+	k := nodeKVS(viewExist)
+	stored := *local
+	k.OverwriteEntry(keyone, &stored)
+	g := GossipVals{kvs: k}
+	equals(t, resolveConflict(remote, local), g.ConflictResolution(keyone, remote))
+	assert(t, !g.ConflictResolution(keyone, remote), "Gossip picked the remote entry over a later concurrent write")
+}
+
+func TestDotsStayUniqueAfterAnotherNodeWins(t *testing.T) {
+	alice, bob := nodeKVS(viewExist), nodeKVS(viewNotExist)
+	alice.Put(keyone, valone, time.Now(), VectorClock{})
+	first := entryOf(alice, keyone)
+
+	// Bob's write never saw Alice's, and wins at Alice anyway
+	bob.Put(keyone, valtwo, time.Now().Add(time.Second), VectorClock{})
+	alice.OverwriteEntry(keyone, entryOf(bob, keyone))
+
+	// Alice's next write can't reuse the dot of the one Bob's replaced
+	alice.Put(keyone, "three", time.Now(), VectorClock{keyone: 1})
+	e := entryOf(alice, keyone)
+	assert(t, e.DVV.Dot != first.DVV.Dot, "Dot %v handed out twice", e.DVV.Dot)
+	equals(t, ClockAfter, compareVersions(e, first))
+}
+
+func TestDotCounterPersists(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	c, err := OpenDotCounter(dir)
+	ok(t, err)
+	n, err := c.Next(0)
+	ok(t, err)
+	equals(t, 1, n)
+	n, err = c.Next(5)
+	ok(t, err)
+	equals(t, 6, n)
+
+	// A restarted node carries on past every counter it may have handed out
+	c, err = OpenDotCounter(dir)
+	ok(t, err)
+	n, err = c.Next(0)
+	ok(t, err)
+	assert(t, n > 6, "Counter %d may have been handed out before the restart", n)
+}
@@ -16,15 +16,28 @@ package main
 import (
 	"log"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 // GossipVals is a struct which implements the Gossip
 type GossipVals struct {
-	view View
-	kvs  dbAccess
+	view    View
+	kvs     dbAccess
+	ring    *Ring                // Decides which keys each peer stores, nil means all of them
+	hints   *HintStore           // Entries waiting for peers which couldn't be reached
+	members *Membership          // Failure detector, used to leave dead peers out
+	phi     *PhiDetector         // Suspicion level of each peer, used to avoid flaky ones
+	views   *ViewLog             // Agreed views by epoch, nil means the view is whatever arrived last
+	clock   *HLC                 // Moved past every timestamp we receive
+	covered map[string]time.Time // Stamp up to which each peer has had our writes, by sync or by hints
 	// tcp?
 }
 
+// gossipStarted is when the node started. A peer which has never been reached is handed
+// the writes made since then; anything older is left for anti-entropy once it's back.
+var gossipStarted = time.Now()
+
 // Global variable for easier time tracking
 var now time.Time
 var goalTime time.Time
@@ -52,10 +65,10 @@ func (g *GossipVals) GossipHeartbeat() {
 	setTime()
 
 	for {
-		if wakeGossip || viewChange || timesUp() {
+		if wakeGossip || viewChange.Load() || timesUp() {
 			log.Println("Gossip initiated. Ringing TCP")
 
-			gossipee := g.view.Random(2)
+			gossipee := g.gossipees(2)
 
 			if needHelp {
 				for _, bob := range gossipee {
@@ -64,27 +77,15 @@ func (g *GossipVals) GossipHeartbeat() {
 				needHelp = false
 			} else {
 				for _, bob := range gossipee {
-					// Get timeglob
-					t := g.kvs.GetTimeGlob()
-					//Send our timeglob to gossipee and return back their pruned timeglob
-					rt, err := sendTimeGlob(bob, t)
-					if err != nil {
-						log.Println("Error sending timeglob: ", err)
-						continue
-					}
-					// turn the pruned timeglob into and entry glob for gossipee
-					re := g.kvs.GetEntryGlob(*rt)
-					//send the entryglob needed to update gosipee kvs
-					err = sendEntryGlob(bob, re)
+					err := g.antiEntropy(bob)
 					if err != nil {
-						log.Println("Error sending entryglob: ", err)
+						log.Println("Error gossiping with "+bob+": ", err)
 						continue
 					}
 
-					if viewChange {
+					if viewChange.Load() {
 						// Propagate views
-						v := g.view.List()
-						sendViewList(bob, v)
+						sendViewList(bob, g.currentView())
 					}
 				}
 			}
@@ -96,9 +97,138 @@ func (g *GossipVals) GossipHeartbeat() {
 	}
 }
 
+// ownedBy removes the keys from a timeGlob which the given node doesn't store
+func (g *GossipVals) ownedBy(node string, tg timeGlob) timeGlob {
+	if g.ring == nil {
+		return tg
+	}
+	for k := range tg.List {
+		if !g.ring.Owns(node, k) {
+			delete(tg.List, k)
+		}
+	}
+	return tg
+}
+
+// gossipees picks up to n peers to gossip with, leaving out any the failure detector has
+// declared dead and any the phi-accrual detector suspects
+func (g *GossipVals) gossipees(n int) []string {
+	var peers []string
+	if g.members == nil {
+		peers = g.view.Random(g.view.Count())
+	} else {
+		peers = g.members.Random(g.view.Count())
+	}
+	return g.phi.Healthy(peers, n)
+}
+
+// antiEntropy brings a peer up to date with us. The Merkle trees are compared first, and
+// only the keys in the leaves where they differ go through the timeGlob and entryGlob
+// exchange.
+func (g *GossipVals) antiEntropy(bob string) error {
+	// Every write stamped up to here is either sent to Bob or kept as a hint for it
+	round := g.clock.Last()
+
+	leaves, err := sendMerkleDiff(bob, g.kvs.MerkleTree(), g.views)
+	if errors.Cause(err) == errStaleEpoch {
+		// One of us was behind. If it was us we've caught up already, and if it was Bob
+		// this brings it up to date.
+		sendViewList(bob, g.currentView())
+		return err
+	}
+	if err != nil {
+		// We can't tell what Bob is missing, so it's handed what changed since it last
+		// heard from us
+		g.handOffSince(bob, round)
+		return err
+	}
+	g.phi.Heartbeat(bob, time.Now())
+	// Bob is up, so hand over anything it missed while it was down
+	g.hints.PeerUp(bob)
+	if len(leaves) == 0 {
+		log.Println("Already in sync with " + bob)
+		g.cover(bob, round)
+		return nil
+	}
+
+	// Get timeglob for the differing leaves, keeping only the keys the gossipee stores
+	t := g.ownedBy(bob, g.leafTimeGlob(leaves))
+	t.Epoch = g.views.Epoch()
+	//Send our timeglob to gossipee and return back their pruned timeglob
+	rt, err := sendTimeGlob(bob, t)
+	if errors.Cause(err) == errStaleEpoch {
+		// Bob's view moved on since the Merkle exchange, and the gossip that brings
+		// ours up to date will pick this up again
+		return err
+	}
+	if err != nil {
+		g.handOff(bob, g.kvs.WithBatches(g.kvs.GetEntryGlob(t)))
+		g.cover(bob, round)
+		return err
+	}
+	// turn the pruned timeglob into and entry glob for gossipee, sending batches whole
+	re := g.kvs.WithBatches(g.kvs.GetEntryGlob(*rt))
+	re.Epoch = t.Epoch
+	//send the entryglob needed to update gosipee kvs
+	err = sendEntryGlob(bob, re)
+	if err != nil {
+		g.handOff(bob, re)
+	}
+	g.cover(bob, round)
+	return err
+}
+
+// cover records that a peer has had every write stamped up to round
+func (g *GossipVals) cover(peer string, round time.Time) {
+	if g.covered == nil {
+		g.covered = make(map[string]time.Time)
+	}
+	g.covered[peer] = round
+}
+
+// handOffSince keeps as hints for a peer which couldn't be reached the entries it stores
+// which were stamped after it last had our writes. Each failed round moves that on, so
+// a peer which stays down isn't handed the same writes over and over.
+func (g *GossipVals) handOffSince(peer string, round time.Time) {
+	since, ok := g.covered[peer]
+	if !ok {
+		since = gossipStarted
+	}
+	tg := timeGlob{List: make(map[string]time.Time)}
+	for key, ts := range g.kvs.GetTimeGlob().List {
+		if ts.After(since) {
+			tg.List[key] = ts
+		}
+	}
+	g.handOff(peer, g.kvs.WithBatches(g.kvs.GetEntryGlob(g.ownedBy(peer, tg))))
+	g.cover(peer, round)
+}
+
+// leafTimeGlob builds a timeGlob of just the keys in the given Merkle leaves
+func (g *GossipVals) leafTimeGlob(leaves []int) timeGlob {
+	tg := timeGlob{List: make(map[string]time.Time)}
+	for _, key := range g.kvs.MerkleTree().Keys(leaves) {
+		tg.List[key] = g.kvs.GetTimestamp(key)
+	}
+	return tg
+}
+
+// handOff keeps the entries which couldn't be sent to a peer as hints for it
+func (g *GossipVals) handOff(peer string, eg entryGlob) {
+	for key, e := range eg.Keys {
+		err := g.hints.Add(peer, key, e)
+		if err != nil {
+			log.Println("Error storing hint: ", err)
+		}
+	}
+}
+
 // ClockPrune returns a pruned map that only contains the keys that the gossipee needs updating
 func (g *GossipVals) ClockPrune(input timeGlob) timeGlob {
 	own := g.kvs.GetTimeGlob() // getTimeGlob() is in glob branch
+	for _, t := range input.List {
+		g.clock.Observe(t)
+	}
 
 	// Find and delete duplicates between two maps
 	for k := range own.List {
@@ -122,59 +252,90 @@ func (g *GossipVals) BuildEntryGlob(inglob timeGlob) entryGlob {
 
 // UpdateKVS takes entryGlob and update its own KVS. End of Gossip protocol
 func (g *GossipVals) UpdateKVS(inglob entryGlob) {
+	// Entries written by a batch are merged along with the rest of their batch
+	batches := make(map[string]map[string]Entry)
+
 	// Loop through all keys, check for conflicts, and update KVS when necessary.
 	for key, aliceEntry := range inglob.Keys {
-		if g.ConflictResolution(key, &aliceEntry) {
-			g.kvs.OverwriteEntry(key, &aliceEntry)
+		if id := aliceEntry.Batch.ID; id != "" {
+			if batches[id] == nil {
+				batches[id] = make(map[string]Entry)
+			}
+			batches[id][key] = aliceEntry
+			continue
 		}
+		g.MergeEntry(key, &aliceEntry)
 	}
+	for _, entries := range batches {
+		g.MergeBatch(entries)
+	}
+}
+
+// MergeEntry stores Alice's version of a key if it wins. If both versions hold
+// siblings, the union of them is stored instead. The KVS compares and stores under one
+// lock, so a client's write landing in between is never overwritten by an older version.
+func (g *GossipVals) MergeEntry(key string, aliceEntry *Entry) {
+	g.clock.Observe(aliceEntry.Timestamp)
+	g.kvs.MergeEntry(key, aliceEntry)
+}
+
+// MergeBatch is MergeEntry for the entries written by one batch. The winners are all
+// stored at once, so the batch never shows up half applied.
+func (g *GossipVals) MergeBatch(entries map[string]Entry) {
+	aliceEntries := make(map[string]KeyEntry, len(entries))
+	for key, aliceEntry := range entries {
+		aliceEntry := aliceEntry
+		g.clock.Observe(aliceEntry.Timestamp)
+		aliceEntries[key] = &aliceEntry
+	}
+	g.kvs.MergeEntries(aliceEntries)
 }
 
-// ConflictResolution returns true if Bob should update with Alice's key
+// ConflictResolution returns true if Bob should update with Alice's key. Bob's whole
+// entry is compared, dots and writer included, so the winner is the one resolveConflict
+// picks everywhere else.
 func (g *GossipVals) ConflictResolution(key string, aliceEntry KeyEntry) bool {
 	log.Println("Resolving a conflict")
-	isSmaller := false
-	isLarger := false
-	incomparable := false
+	eg := g.kvs.GetEntryGlob(timeGlob{List: map[string]time.Time{key: {}}})
+	bobEntry, ok := eg.Keys[key]
+	if !ok {
+		return true // Bob doesn't have the key at all
+	}
+	return resolveConflict(aliceEntry, &bobEntry)
+}
 
+// resolveConflict returns true if Alice's entry should replace Bob's. It's used both by
+// gossip, where Bob is our own KVS, and to merge the replies from several replicas.
+func resolveConflict(aliceEntry KeyEntry, bobEntry KeyEntry) bool {
 	log.Printf("Comparing Alice's version '%#v'\n", aliceEntry)
 	aMap := aliceEntry.GetClock()
-	bMap := g.kvs.GetClock(key)
+	bMap := bobEntry.GetClock()
 	log.Println("aMap: ", aMap)
 	log.Println("bMap: ", bMap)
 
 	// if bob does NOT have the key, we definitely update w/ Alice's stuff
 	if len(bMap) == 0 {
-		log.Println("Bob doesn't have the entry: ", key)
+		log.Println("Bob doesn't have the entry")
 		return true // Bob can't possibly beat Alice's key with no corresponding key of it's own
 	}
 	// else if Bob DOES have the key, we compare causal history & timestamps
-	for k, v := range bMap {
-		if aMap[k] < v {
-			isSmaller = true
-		} else if aMap[k] > v {
-			isLarger = true
-		}
-	}
-	for k := range aMap {
-		if _, exist := bMap[k]; !exist {
-			incomparable = true
-		}
+	switch compareVersions(aliceEntry, bobEntry) {
+	case ClockAfter:
+		log.Println("Alice wins with a larger clock")
+		return true // alice wins
+	case ClockBefore:
+		log.Println("Bob wins with a larger clock")
+		return false // bob wins
+	case ClockConcurrent:
+		metrics.Inc(metricConcurrent)
 	}
 
-	if (isSmaller && isLarger) || (!isSmaller && !isLarger) || incomparable {
-		// incomparable or identical clocks, later timestamp wins
-		if aliceEntry.GetTimestamp().After(g.kvs.GetTimestamp(key)) {
-			log.Println("Alice wins with the later timestamp")
-			return true // alice wins
-		}
-		log.Println("Bob wins with a later timestamp")
-		return false // bob wins
-	} else if isSmaller == false && isLarger == true {
-		log.Println("Alice wins with a larger clock")
+	// incomparable or identical clocks, later timestamp wins
+	if hlcLater(aliceEntry, bobEntry) {
+		log.Println("Alice wins with the later timestamp")
 		return true // alice wins
 	}
-	log.Println("Bob wins with a larger clock")
+	log.Println("Bob wins with a later timestamp")
 	return false // bob wins
 }
 
@@ -184,3 +345,24 @@ func (g *GossipVals) UpdateViews(v []string) {
 		g.view.Overwrite(v)
 	}
 }
+
+// currentView returns the view to gossip, with its epoch if there is a membership log
+func (g *GossipVals) currentView() viewEntry {
+	if g.views == nil {
+		return viewEntry{Members: g.view.List()}
+	}
+	return g.views.Current()
+}
+
+// LearnView takes a view gossiped by a peer. With a membership log, a view from an epoch
+// no newer than ours is ignored.
+func (g *GossipVals) LearnView(e viewEntry) {
+	if g.views == nil {
+		log.Println("Updating viewList - old views: " + g.view.String())
+		g.UpdateViews(e.Members)
+		return
+	}
+	if !g.views.Learn(e) {
+		log.Println("Ignoring view from epoch", e.Epoch)
+	}
+}
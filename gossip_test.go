@@ -94,7 +94,7 @@ func TestClockPrunePrunesClocks(t *testing.T) {
 	// Mock a KVS
 	timeExists := time.Now()
 	k := TestKVS{
-		dbClock: map[string]int{keyExists: 1},
+		dbClock: VectorClock{keyExists: 1},
 		dbKey:   keyExists,
 		dbTime:  timeExists,
 		dbVal:   valExists,
@@ -126,7 +126,7 @@ func TestBuildEntryGlobBuildsGlob(t *testing.T) {
 	// Mock a KVS
 	timeExists := time.Now()
 	k := TestKVS{
-		dbClock:   map[string]int{keyExists: 1},
+		dbClock:   VectorClock{keyExists: 1},
 		dbKey:     keyExists,
 		dbTime:    timeExists,
 		dbVal:     valExists,
@@ -168,7 +168,7 @@ func TestUpdateViewsUpdatesViews(t *testing.T) {
 	// Mock a KVS
 	timeExists := time.Now()
 	k := TestKVS{
-		dbClock: map[string]int{keyExists: 1},
+		dbClock: VectorClock{keyExists: 1},
 		dbKey:   keyExists,
 		dbTime:  timeExists,
 		dbVal:   valExists,
@@ -193,7 +193,7 @@ func TestUpdateViewsEmptyInputDoesntUpdate(t *testing.T) {
 	// Mock a KVS
 	timeExists := time.Now()
 	k := TestKVS{
-		dbClock: map[string]int{keyExists: 1},
+		dbClock: VectorClock{keyExists: 1},
 		dbKey:   keyExists,
 		dbTime:  timeExists,
 		dbVal:   valExists,
@@ -217,7 +217,7 @@ func TestConflictResolutionKeyNotExist(t *testing.T) {
 	// Mock a KVS
 	timeExists := time.Now()
 	k := TestKVS{
-		dbClock: map[string]int{keyExists: 1},
+		dbClock: VectorClock{keyExists: 1},
 		dbKey:   keyExists,
 		dbTime:  timeExists,
 		dbVal:   valExists,
@@ -234,7 +234,7 @@ func TestConflictResolutionKeyNotExist(t *testing.T) {
 		Version:   1,
 		Value:     valNotExists,
 		Timestamp: timeExists,
-		Clock:     map[string]int{keyNotExists: 1},
+		Clock:     VectorClock{keyNotExists: 1},
 		Tombstone: false,
 	}
 
@@ -246,7 +246,7 @@ func TestConflictResolutionKeyExistAliceBigger(t *testing.T) {
 	// Mock a KVS
 	timeExists := time.Now()
 	k := TestKVS{
-		dbClock: map[string]int{keyExists: 1},
+		dbClock: VectorClock{keyExists: 1},
 		dbKey:   keyExists,
 		dbTime:  timeExists,
 		dbVal:   valExists,
@@ -263,7 +263,7 @@ func TestConflictResolutionKeyExistAliceBigger(t *testing.T) {
 		Version:   2,
 		Value:     valNotExists,
 		Timestamp: timeExists,
-		Clock:     map[string]int{keyExists: 2},
+		Clock:     VectorClock{keyExists: 2},
 		Tombstone: false,
 	}
 
@@ -275,7 +275,7 @@ func TestConflictResolutionKeyExistBobBigger(t *testing.T) {
 	// Mock a KVS
 	timeExists := time.Now()
 	k := TestKVS{
-		dbClock: map[string]int{keyExists: 2},
+		dbClock: VectorClock{keyExists: 2},
 		dbKey:   keyExists,
 		dbTime:  timeExists,
 		dbVal:   valExists,
@@ -292,7 +292,7 @@ func TestConflictResolutionKeyExistBobBigger(t *testing.T) {
 		Version:   1,
 		Value:     valNotExists,
 		Timestamp: timeExists,
-		Clock:     map[string]int{keyExists: 1},
+		Clock:     VectorClock{keyExists: 1},
 		Tombstone: false,
 	}
 
@@ -304,7 +304,7 @@ func TestConflictResolutionKeyExistAliceLater(t *testing.T) {
 	// Mock a KVS
 	timeExists := time.Now()
 	k := TestKVS{
-		dbClock: map[string]int{keyExists: 2, "someKey": 1},
+		dbClock: VectorClock{keyExists: 2, "someKey": 1},
 		dbKey:   keyExists,
 		dbTime:  timeExists,
 		dbVal:   valExists,
@@ -324,7 +324,7 @@ func TestConflictResolutionKeyExistAliceLater(t *testing.T) {
 		Version:   2,
 		Value:     valNotExists,
 		Timestamp: aliceTime,
-		Clock:     map[string]int{keyExists: 2, "someOtherKey": 1},
+		Clock:     VectorClock{keyExists: 2, "someOtherKey": 1},
 		Tombstone: false,
 	}
 
@@ -338,7 +338,7 @@ func TestConflictResolutionKeyExistBobLater(t *testing.T) {
 	time.Sleep(1 * time.Second)
 	bobTime := time.Now()
 	k := TestKVS{
-		dbClock: map[string]int{keyExists: 2, "someKey": 2},
+		dbClock: VectorClock{keyExists: 2, "someKey": 2},
 		dbKey:   keyExists,
 		dbTime:  bobTime,
 		dbVal:   valExists,
@@ -355,7 +355,7 @@ func TestConflictResolutionKeyExistBobLater(t *testing.T) {
 		Version:   2,
 		Value:     valNotExists,
 		Timestamp: aliceTime,
-		Clock:     map[string]int{keyExists: 2, "someOtherKey": 2},
+		Clock:     VectorClock{keyExists: 2, "someOtherKey": 2},
 		Tombstone: false,
 	}
 
@@ -367,7 +367,7 @@ func TestUpdateKVSUpdatesKVS(t *testing.T) {
 	// Mock a KVS
 	timeExists := time.Now()
 	k := TestKVS{
-		dbClock: map[string]int{keyExists: 1},
+		dbClock: VectorClock{keyExists: 1},
 		dbKey:   keyExists,
 		dbTime:  timeExists,
 		dbVal:   valExists,
@@ -384,7 +384,7 @@ func TestUpdateKVSUpdatesKVS(t *testing.T) {
 		Version:   2,
 		Value:     valNotExists,
 		Timestamp: timeExists,
-		Clock:     map[string]int{keyExists: 2},
+		Clock:     VectorClock{keyExists: 2},
 		Tombstone: false,
 	}
 	teg := entryGlob{Keys: map[string]Entry{keyExists: newKeyExistsEntry}}
@@ -411,3 +411,40 @@ func TestUpdateKVSUpdatesKVS(t *testing.T) {
 // Test nil stuff
 //   - we should not have any panics because of nil entries or objects
 //   - log.fatalln instead or failthrough or something
+
+func TestOwnedByKeepsOnlyPeersKeys(t *testing.T) {
+	v := NewView(testMain, testView)
+	r := NewRing(v, defaultVnodes, 1)
+	g := GossipVals{view: v, ring: r}
+
+	tg := timeGlob{List: map[string]time.Time{}}
+	for i := 0; i < 100; i++ {
+		tg.List[fmt.Sprint("key", i)] = time.Now()
+	}
+	out := g.ownedBy(viewExist, tg)
+	assert(t, len(out.List) > 0 && len(out.List) < 100, "ownedBy kept %d of 100 keys", len(out.List))
+	for k := range out.List {
+		assert(t, r.Owns(viewExist, k), "ownedBy kept a key the peer doesn't store")
+	}
+}
+
+// A KVS which fails the test if an entry is stored without being compared under its lock
+type mergeOnlyKVS struct {
+	*TestKVS
+	t *testing.T
+}
+
+func (k mergeOnlyKVS) OverwriteEntry(key string, entry KeyEntry) {
+	k.t.Errorf("Entry for %s stored apart from the comparison", key)
+}
+
+func TestGossipComparesAndStoresUnderTheKVSLock(t *testing.T) {
+	k := mergeOnlyKVS{TestKVS: &TestKVS{dbClock: VectorClock{}}, t: t}
+	g := GossipVals{kvs: k, view: &TestView{view: testView}}
+	batch := BatchTag{ID: "b", Keys: []string{keyone, keyNotHere}}
+	g.UpdateKVS(entryGlob{Keys: map[string]Entry{
+		keyExists:  {Version: 1, Value: valExists, Clock: VectorClock{keyExists: 1}, Timestamp: time.Now()},
+		keyone:     {Version: 1, Value: valone, Clock: VectorClock{keyone: 1}, Timestamp: time.Now(), Batch: batch},
+		keyNotHere: {Version: 1, Value: valtwo, Clock: VectorClock{keyNotHere: 1}, Timestamp: time.Now(), Batch: batch},
+	}})
+}
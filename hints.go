@@ -0,0 +1,342 @@
+// hints.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines the hint store used for hinted handoff. When a write meant for another
+// replica can't be delivered, either by gossip or by a quorum write, the entry is kept
+// here as a hint for that peer instead of being dropped. Hints are written to disk
+// before they are acknowledged, so they survive a restart, and are replayed to the
+// peer through the TCP endpoint as soon as it is seen to be back up.
+//
+// The hints live in a single file of frames in the same format as the write-ahead log.
+// New hints are appended, and the file is rewritten with whatever is left once a peer's
+// hints have been delivered, or once the view log drops the peer they were meant for.
+//
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const hintFile = "hints.log" // Name of the hint file inside the hint directory
+
+// A hint is an entry waiting to be handed to a replica that missed it
+type hint struct {
+	Peer    string
+	Key     string
+	Entry   Entry
+	Created time.Time
+}
+
+// hintStats describes the hints waiting for one peer
+type hintStats struct {
+	Depth  int       `json:"depth"`  // Number of hints queued
+	Oldest time.Time `json:"oldest"` // When the oldest of them was created
+	Age    float64   `json:"age"`    // How long ago that was, in seconds
+}
+
+// HintStore holds the hints for every peer, keeping only the newest entry for each key
+type HintStore struct {
+	dir       string
+	file      *os.File                   // The hint file, positioned at the end
+	hints     map[string]map[string]hint // Peer -> key -> hint
+	replaying map[string]bool            // Peers whose hints are being delivered right now
+	deliver   func(ip string, key string, e Entry) error
+	views     *ViewLog // Gives the view epoch sent with each hint, nil means 0
+	mutex     sync.Mutex
+}
+
+// OpenHintStore opens the hints kept in dir, creating it if needed. Hints are
+// delivered with the replicate command, giving up on a peer after timeout.
+func OpenHintStore(dir string, timeout time.Duration) (*HintStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "Creating hint directory "+dir+" failed")
+	}
+	h := &HintStore{
+		dir:       dir,
+		hints:     make(map[string]map[string]hint),
+		replaying: make(map[string]bool),
+	}
+	h.deliver = func(ip string, key string, e Entry) error {
+		return sendReplica(ip, key, e, h.views.Epoch(), timeout)
+	}
+	err = h.load()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// load reads the hint file back into memory, dropping a torn frame at the end, and
+// leaves the file open for appending
+func (h *HintStore) load() error {
+	path := filepath.Join(h.dir, hintFile)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Opening hints "+path+" failed")
+	}
+
+	r := bufio.NewReader(f)
+	var offset int64 // End of the last good hint
+	for {
+		var hn hint
+		n, err := readFrame(r, &hn)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Println("Bad hint at offset", offset, ":", err)
+			break
+		}
+		normalizeEntry(&hn.Entry)
+		h.keep(hn)
+		offset += n
+	}
+
+	err = f.Truncate(offset)
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "Truncating hints failed")
+	}
+	h.file = f
+	log.Println("Loaded hints for", len(h.hints), "peers")
+	return nil
+}
+
+// keep adds a hint to the in-memory queue, unless there's already a newer one for the key
+func (h *HintStore) keep(hn hint) {
+	queue, ok := h.hints[hn.Peer]
+	if !ok {
+		queue = make(map[string]hint)
+		h.hints[hn.Peer] = queue
+	}
+	if old, ok := queue[hn.Key]; ok {
+		if !resolveConflict(&hn.Entry, &old.Entry) {
+			return
+		}
+		// The peer has been missing this key since the first hint, so that's its age
+		hn.Created = old.Created
+	}
+	queue[hn.Key] = hn
+}
+
+// Add stores an entry which couldn't be delivered to peer. The hint is on disk by the
+// time Add returns.
+func (h *HintStore) Add(peer string, key string, e Entry) error {
+	if h == nil {
+		return nil
+	}
+	if h.views != nil && !isMember(h.views.Current().Members, peer) {
+		log.Println("Not storing hint for " + peer + " on key " + key + ", it has left the view")
+		return nil
+	}
+	hn := hint{Peer: peer, Key: key, Entry: e, Created: time.Now()}
+	frame, err := encodeFrame(hn)
+	if err != nil {
+		return errors.Wrapf(err, "Encode failed for hint: %#v", hn)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	_, err = h.file.Write(frame)
+	if err != nil {
+		return errors.Wrap(err, "Writing hint failed")
+	}
+	err = h.file.Sync()
+	if err != nil {
+		return errors.Wrap(err, "Syncing hints failed")
+	}
+	h.keep(hn)
+	log.Println("Stored hint for " + peer + " on key " + key)
+	return nil
+}
+
+// Forget drops the hints for every peer which isn't in members, on disk as well as in
+// memory. It's called whenever the view log moves on, since a removed peer will never
+// come back for them.
+func (h *HintStore) Forget(members []string) error {
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	dropped := 0
+	for peer, queue := range h.hints {
+		if !isMember(members, peer) {
+			log.Println("Dropping", len(queue), "hints for", peer, "which has left the view")
+			delete(h.hints, peer)
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		return nil
+	}
+	return h.rewrite()
+}
+
+// isMember returns true if node is one of members
+func isMember(members []string, node string) bool {
+	for _, m := range members {
+		if m == node {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerUp is called whenever a peer is seen to be alive, and hands it any hints it has
+// waiting in the background
+func (h *HintStore) PeerUp(peer string) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	pending := len(h.hints[peer]) > 0 && !h.replaying[peer]
+	h.mutex.Unlock()
+	if pending {
+		go h.Replay(peer)
+	}
+}
+
+// Replay delivers the hints waiting for a peer and drops the ones it accepted. It
+// returns the number delivered, stopping at the first failure since that means the
+// peer is down again.
+func (h *HintStore) Replay(peer string) (int, error) {
+	if h == nil {
+		return 0, nil
+	}
+	h.mutex.Lock()
+	if h.replaying[peer] {
+		h.mutex.Unlock()
+		return 0, nil
+	}
+	h.replaying[peer] = true
+	var queue []hint
+	for _, hn := range h.hints[peer] {
+		queue = append(queue, hn)
+	}
+	h.mutex.Unlock()
+
+	defer func() {
+		h.mutex.Lock()
+		delete(h.replaying, peer)
+		h.mutex.Unlock()
+	}()
+
+	log.Println("Replaying", len(queue), "hints to", peer)
+	var delivered []hint
+	var err error
+	for _, hn := range queue {
+		err = h.deliver(peer, hn.Key, hn.Entry)
+		if err != nil {
+			err = errors.Wrap(err, "Replaying hints to "+peer+" failed")
+			break
+		}
+		delivered = append(delivered, hn)
+	}
+	if len(delivered) == 0 {
+		return 0, err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, hn := range delivered {
+		// A newer hint may have arrived for the key while we were busy, so keep that one
+		cur, ok := h.hints[peer][hn.Key]
+		if ok && cur.Entry.Timestamp.Equal(hn.Entry.Timestamp) && cur.Entry.Version == hn.Entry.Version {
+			delete(h.hints[peer], hn.Key)
+		}
+	}
+	if len(h.hints[peer]) == 0 {
+		delete(h.hints, peer)
+	}
+	rerr := h.rewrite()
+	if err == nil {
+		err = rerr
+	}
+	return len(delivered), err
+}
+
+// rewrite atomically replaces the hint file with the hints still pending. The lock
+// must be held.
+func (h *HintStore) rewrite() error {
+	var data []byte
+	for _, queue := range h.hints {
+		for _, hn := range queue {
+			frame, err := encodeFrame(hn)
+			if err != nil {
+				return errors.Wrapf(err, "Encode failed for hint: %#v", hn)
+			}
+			data = append(data, frame...)
+		}
+	}
+
+	path := filepath.Join(h.dir, hintFile)
+	err := writeFileSync(path+".tmp", data)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return errors.Wrap(err, "Renaming hints failed")
+	}
+
+	// Appends have to go to the new file from now on
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Reopening hints failed")
+	}
+	h.file.Close()
+	h.file = f
+	return nil
+}
+
+// Stats returns the depth and age of the hint queue for every peer that has one
+func (h *HintStore) Stats() map[string]hintStats {
+	stats := make(map[string]hintStats)
+	if h == nil {
+		return stats
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for peer, queue := range h.hints {
+		var s hintStats
+		for _, hn := range queue {
+			if s.Depth == 0 || hn.Created.Before(s.Oldest) {
+				s.Oldest = hn.Created
+			}
+			s.Depth++
+		}
+		s.Age = time.Since(s.Oldest).Seconds()
+		stats[peer] = s
+	}
+	return stats
+}
+
+// Close closes the hint file
+func (h *HintStore) Close() error {
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.file.Close()
+}
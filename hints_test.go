@@ -0,0 +1,212 @@
+// hints_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for hinted handoff
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Opens a hint store whose deliveries are recorded in the returned map
+func recordingHints(t *testing.T, dir string) (*HintStore, map[string]Entry) {
+	h, err := OpenHintStore(dir, time.Second)
+	ok(t, err)
+	got := make(map[string]Entry)
+	h.deliver = func(ip string, key string, e Entry) error {
+		got[ip+"/"+key] = e
+		return nil
+	}
+	return h, got
+}
+
+func TestHintsSurviveRestart(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	h, _ := recordingHints(t, dir)
+	ok(t, h.Add(viewExist, keyone, *NewEntry(time.Now(), VectorClock{keyone: 1}, valone, 1)))
+	ok(t, h.Add(viewExist, keyExists, *NewEntry(time.Now(), VectorClock{keyExists: 1}, valtwo, 1)))
+	ok(t, h.Add(viewNotExist, keyone, *NewEntry(time.Now(), VectorClock{keyone: 1}, valone, 1)))
+	ok(t, h.Close())
+
+	r, _ := recordingHints(t, dir)
+	defer r.Close()
+	stats := r.Stats()
+	equals(t, 2, len(stats))
+	equals(t, 2, stats[viewExist].Depth)
+	equals(t, 1, stats[viewNotExist].Depth)
+}
+
+func TestHintsKeepNewestEntryPerKey(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	h, got := recordingHints(t, dir)
+	defer h.Close()
+	ok(t, h.Add(viewExist, keyone, *NewEntry(time.Now(), VectorClock{keyone: 2}, valtwo, 2)))
+	ok(t, h.Add(viewExist, keyone, *NewEntry(time.Now(), VectorClock{keyone: 1}, valone, 1)))
+	equals(t, 1, h.Stats()[viewExist].Depth)
+
+	n, err := h.Replay(viewExist)
+	ok(t, err)
+	equals(t, 1, n)
+	equals(t, valtwo, got[viewExist+"/"+keyone].Value)
+}
+
+func TestHintsReplayClearsDelivered(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	h, got := recordingHints(t, dir)
+	ok(t, h.Add(viewExist, keyone, *NewEntry(time.Now(), VectorClock{keyone: 1}, valone, 1)))
+	ok(t, h.Add(viewNotExist, keyone, *NewEntry(time.Now(), VectorClock{keyone: 1}, valone, 1)))
+
+	n, err := h.Replay(viewExist)
+	ok(t, err)
+	equals(t, 1, n)
+	equals(t, 1, len(got))
+	_, waiting := h.Stats()[viewExist]
+	assert(t, !waiting, "Delivered hints still queued")
+
+	// Hints added after the rewrite still make it to disk
+	ok(t, h.Add(viewNotExist, keyExists, *NewEntry(time.Now(), VectorClock{keyExists: 1}, valtwo, 1)))
+	ok(t, h.Close())
+
+	r, _ := recordingHints(t, dir)
+	defer r.Close()
+	stats := r.Stats()
+	equals(t, 1, len(stats))
+	equals(t, 2, stats[viewNotExist].Depth)
+}
+
+func TestHintsReplayKeepsUndelivered(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	h, _ := recordingHints(t, dir)
+	defer h.Close()
+	h.deliver = func(ip string, key string, e Entry) error {
+		return errors.New("Peer down")
+	}
+	ok(t, h.Add(viewExist, keyone, *NewEntry(time.Now(), VectorClock{keyone: 1}, valone, 1)))
+
+	n, err := h.Replay(viewExist)
+	assert(t, err != nil, "Failed replay reported success")
+	equals(t, 0, n)
+	equals(t, 1, h.Stats()[viewExist].Depth)
+}
+
+func TestHintsForPeerLeavingTheViewAreDropped(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	c := newViewLogCluster(t, dir)
+	views := c.logs[viewLogNodes[0]]
+	config := Config{DataDir: filepath.Join(dir, "node"), QuorumTimeout: time.Second}
+
+	h, err := config.OpenHints(views)
+	ok(t, err)
+	ok(t, h.Add(viewLogNodes[1], keyone, *NewEntry(time.Now(), VectorClock{keyone: 1}, valone, 1)))
+	ok(t, h.Add(viewLogNodes[2], keyone, *NewEntry(time.Now(), VectorClock{keyone: 1}, valone, 1)))
+
+	_, err = views.Propose(viewRemove, viewLogNodes[2])
+	ok(t, err)
+	stats := h.Stats()
+	equals(t, 1, len(stats))
+	equals(t, 1, stats[viewLogNodes[1]].Depth)
+
+	// Nor are new hints kept for it, and the dropped ones stay gone after a restart
+	ok(t, h.Add(viewLogNodes[2], keyExists, *NewEntry(time.Now(), VectorClock{keyExists: 1}, valtwo, 1)))
+	ok(t, h.Close())
+	r, err := config.OpenHints(views)
+	ok(t, err)
+	defer r.Close()
+	stats = r.Stats()
+	equals(t, 1, len(stats))
+	equals(t, 1, stats[viewLogNodes[1]].Depth)
+}
+
+func TestHintsForPeerWhichLeftWhileDownAreDropped(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	c := newViewLogCluster(t, dir)
+	config := Config{DataDir: filepath.Join(dir, "node"), QuorumTimeout: time.Second}
+
+	h, err := config.OpenHints(nil)
+	ok(t, err)
+	ok(t, h.Add(viewLogNodes[1], keyone, *NewEntry(time.Now(), VectorClock{keyone: 1}, valone, 1)))
+	ok(t, h.Add("10.0.0.23:8080", keyone, *NewEntry(time.Now(), VectorClock{keyone: 1}, valone, 1)))
+	ok(t, h.Close())
+
+	r, err := config.OpenHints(c.logs[viewLogNodes[0]])
+	ok(t, err)
+	defer r.Close()
+	stats := r.Stats()
+	equals(t, 1, len(stats))
+	equals(t, 1, stats[viewLogNodes[1]].Depth)
+}
+
+func TestHintsHandlerReportsQueues(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	h, _ := recordingHints(t, dir)
+	defer h.Close()
+	ok(t, h.Add(viewExist, keyone, *NewEntry(time.Now(), VectorClock{keyone: 1}, valone, 1)))
+	app := App{db: &testKVS, view: *NewView(testMain, testView), hints: h}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, admin+"/hints", nil)
+	ok(t, err)
+	app.HintsHandler(recorder, req)
+
+	equals(t, http.StatusOK, recorder.Code)
+	var gotBody struct {
+		Depth int
+		Peers map[string]hintStats
+	}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	equals(t, 1, gotBody.Depth)
+	equals(t, 1, gotBody.Peers[viewExist].Depth)
+}
+
+func TestGossipToUnreachablePeerLeavesHints(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	h, _ := recordingHints(t, dir)
+	defer h.Close()
+
+	down := "127.0.0.1:1" // Nothing listens here
+	k := nodeKVS(testMain)
+	g := GossipVals{kvs: k, view: NewView(testMain, testMain+","+down), hints: h, clock: k.clock}
+	k.Put(keyone, valone, time.Now(), VectorClock{})
+	assert(t, g.antiEntropy(down) != nil, "Gossip reached a peer which is down")
+	equals(t, 1, h.Stats()[down].Depth)
+
+	// A peer which stays down isn't handed the same write again every round
+	info, err := h.file.Stat()
+	ok(t, err)
+	assert(t, g.antiEntropy(down) != nil, "Gossip reached a peer which is down")
+	again, err := h.file.Stat()
+	ok(t, err)
+	equals(t, info.Size(), again.Size())
+
+	// but it is handed the writes made since
+	k.Put(keyExists, valExists, time.Now(), VectorClock{})
+	g.antiEntropy(down)
+	equals(t, 2, h.Stats()[down].Depth)
+}
@@ -0,0 +1,145 @@
+// hlc.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines a hybrid logical clock, which stamps writes with timestamps that stay close to
+// wall-clock time but never go backwards and never come before anything the node has
+// already seen. Each stamp is the largest of the local clock and every timestamp which
+// has arrived from other nodes, plus a logical counter to order stamps that land on the
+// same instant. A write made after seeing another is therefore always stamped later,
+// however far apart the two nodes' clocks are.
+//
+// Stamps are kept in an ordinary time.Time so they fit everywhere a timestamp already
+// goes. The clock ticks in microseconds and the logical counter lives in the nanoseconds
+// below that; a counter which runs past them carries into the next microsecond. When two
+// entries still end up with the same stamp, the node which wrote them breaks the tie.
+//
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	hlcTick     = int64(time.Microsecond) // Resolution of the physical part of a stamp
+	hlcMaxDrift = time.Minute             // Stamps further ahead of our clock than this are ignored
+)
+
+// HLC is a hybrid logical clock for one node
+type HLC struct {
+	node    string
+	wall    int64 // Physical part of the latest stamp, in nanoseconds, a multiple of hlcTick
+	logical int64 // Logical part of the latest stamp, below hlcTick
+	mutex   sync.Mutex
+	now     func() time.Time
+}
+
+// NewHLC creates a clock for the given node
+func NewHLC(node string) *HLC {
+	return &HLC{node: node, now: time.Now}
+}
+
+// Node returns the node the clock stamps writes for
+func (c *HLC) Node() string {
+	if c == nil {
+		return ""
+	}
+	return c.node
+}
+
+// split breaks a stamp into its physical and logical parts
+func hlcSplit(t time.Time) (int64, int64) {
+	n := t.UnixNano()
+	return n - n%hlcTick, n % hlcTick
+}
+
+// stamp builds the current timestamp. The lock must be held.
+func (c *HLC) stamp() time.Time {
+	if c.logical >= hlcTick {
+		c.wall += hlcTick
+		c.logical = 0
+	}
+	return time.Unix(0, c.wall+c.logical)
+}
+
+// Stamp returns a timestamp for a write happening at physical time pt, later than every
+// timestamp the clock has produced or observed. A nil clock returns pt unchanged.
+func (c *HLC) Stamp(pt time.Time) time.Time {
+	if c == nil {
+		return pt
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	p, _ := hlcSplit(pt)
+	if p > c.wall {
+		c.wall = p
+		c.logical = 0
+	} else {
+		c.logical++
+	}
+	return c.stamp()
+}
+
+// Now returns a timestamp for a write happening now
+func (c *HLC) Now() time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c.Stamp(c.now())
+}
+
+// Last returns the latest timestamp the clock has produced or observed, without moving it
+func (c *HLC) Last() time.Time {
+	if c == nil {
+		return time.Time{}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.wall == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, c.wall+c.logical)
+}
+
+// Observe moves the clock past a timestamp received from another node
+func (c *HLC) Observe(t time.Time) {
+	if c == nil || t.IsZero() {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	pt := c.now()
+	if t.Sub(pt) > hlcMaxDrift {
+		log.Println("Ignoring timestamp", t, "too far ahead of our clock")
+		return
+	}
+	p, _ := hlcSplit(pt)
+	rw, rl := hlcSplit(t)
+	switch {
+	case p > c.wall && p > rw:
+		c.wall, c.logical = p, 0
+	case rw > c.wall:
+		c.wall, c.logical = rw, rl+1
+	case rw == c.wall && rl >= c.logical:
+		c.logical = rl + 1
+	}
+	c.stamp()
+}
+
+// hlcLater returns true if Alice's timestamp comes after Bob's, with the node which wrote
+// each entry breaking a tie
+func hlcLater(alice KeyEntry, bob KeyEntry) bool {
+	at, bt := alice.GetTimestamp(), bob.GetTimestamp()
+	if !at.Equal(bt) {
+		return at.After(bt)
+	}
+	return alice.GetNode() > bob.GetNode()
+}
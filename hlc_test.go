@@ -0,0 +1,113 @@
+// hlc_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for the hybrid logical clock
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Creates a clock whose physical time is read from *now
+func fixedHLC(node string, now *time.Time) *HLC {
+	c := NewHLC(node)
+	c.now = func() time.Time { return *now }
+	return c
+}
+
+func TestHLCNeverGoesBackwards(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := fixedHLC(viewExist, &now)
+	first := c.Now()
+	now = now.Add(-time.Second)
+	second := c.Now()
+	third := c.Now()
+	assert(t, second.After(first), "Clock went backwards with the wall clock")
+	assert(t, third.After(second), "Two stamps at the same instant weren't ordered")
+}
+
+func TestHLCStampsAfterObservedTimestamps(t *testing.T) {
+	now := time.Unix(1000, 0)
+	alice := fixedHLC(viewExist, &now)
+	bobNow := now.Add(-10 * time.Second)
+	bob := fixedHLC(viewNotExist, &bobNow)
+
+	// Bob's clock is behind, but a write made after seeing Alice's is still later
+	written := alice.Now()
+	bob.Observe(written)
+	assert(t, bob.Now().After(written), "Write after observing a timestamp was stamped before it")
+}
+
+func TestHLCLogicalCarriesIntoNextTick(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := fixedHLC(viewExist, &now)
+	var last time.Time
+	for i := int64(0); i < 2*hlcTick; i++ {
+		next := c.Now()
+		assert(t, next.After(last), "Stamps stopped increasing")
+		last = next
+	}
+}
+
+func TestHLCIgnoresFarFutureTimestamps(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := fixedHLC(viewExist, &now)
+	c.Observe(now.Add(time.Hour))
+	assert(t, c.Now().Before(now.Add(time.Second)), "Clock jumped to a timestamp from far in the future")
+}
+
+func TestConflictResolutionBreaksTiesByNode(t *testing.T) {
+	ts := time.Now()
+	alice := NewEntry(ts, VectorClock{keyone: 1}, valone, 1)
+	alice.Node = viewNotExist
+	bob := NewEntry(ts, VectorClock{keyone: 1}, valtwo, 1)
+	bob.Node = viewExist
+
+	// Whichever way round they meet, the same entry wins
+	equals(t, viewNotExist > viewExist, resolveConflict(alice, bob))
+	equals(t, viewExist > viewNotExist, resolveConflict(bob, alice))
+}
+
+func TestGossipConvergesOnATimestampTie(t *testing.T) {
+	ts := time.Now()
+	alice := NewEntry(ts, VectorClock{keyone: 1}, valone, 1)
+	alice.Node = viewNotExist
+	bob := NewEntry(ts, VectorClock{keyone: 1}, valtwo, 1)
+	bob.Node = viewExist
+
+	// Each node holds its own entry and hears about the other's
+	atAlice, atBob := NewKVS(), NewKVS()
+	atAlice.OverwriteEntry(keyone, alice)
+	atBob.OverwriteEntry(keyone, bob)
+	aliceTakes := (&GossipVals{kvs: atAlice}).ConflictResolution(keyone, bob)
+	bobTakes := (&GossipVals{kvs: atBob}).ConflictResolution(keyone, alice)
+
+	// Only one side swaps, so both end up holding the same entry
+	assert(t, aliceTakes != bobTakes, "Both nodes kept or both swapped on a tie")
+	equals(t, viewExist > viewNotExist, aliceTakes)
+}
+
+func TestKVSStampsWritesWithClock(t *testing.T) {
+	k := NewKVS()
+	k.clock = NewHLC(viewExist)
+	past := time.Now().Add(-time.Hour)
+	k.clock.Observe(time.Now())
+
+	k.Put(keyone, valone, past, VectorClock{})
+	e := k.GetEntryGlob(timeGlob{List: map[string]time.Time{keyone: {}}}).Keys[keyone]
+	assert(t, e.Timestamp.After(past), "Put kept the time it was given instead of stamping it")
+	equals(t, viewExist, e.Node)
+
+	before := e.Timestamp
+	k.Delete(keyone, past, VectorClock{})
+	e = k.GetEntryGlob(timeGlob{List: map[string]time.Time{keyone: {}}}).Keys[keyone]
+	assert(t, e.Timestamp.After(before), "Delete wasn't stamped after the write it replaced")
+}
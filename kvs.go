@@ -8,8 +8,9 @@
 // Victoria Tran              vilatran
 //
 // This source file defines the KVS object used for a local data store. The struct
-// implements a map to store key-value pairs, and implements the dbAccess interface
-// defined in dbAccess.go in order to serve as a db object for the REST API.
+// keeps its key-value pairs in a StorageEngine (see storage.go), and implements the
+// dbAccess interface defined in dbAccess.go in order to serve as a db object for the
+// REST API.
 //
 
 package main
@@ -22,8 +23,16 @@ import (
 
 // KVS represents a key-value store and implements the dbAccess interface
 type KVS struct {
-	db    map[string]KeyEntry
-	mutex *sync.RWMutex
+	db     StorageEngine
+	mutex  *sync.RWMutex
+	wal    *WAL        // Write-ahead log, nil if the store isn't persisted
+	tree   *MerkleTree // Hashes of every key, kept up to date for anti-entropy
+	clock  *HLC        // Stamps writes, nil keeps the times they're given
+	graves *Graveyard  // Tombstones which have been collected, nil if they never are
+	feed   *Feed       // Tells watchers about each change, nil if no one can watch
+	dots   *DotCounter // Counters for the dots of the writes made here
+
+	pending []walRecord // Changes held back by a batch until it's complete, nil outside one
 }
 
 // KeyEntry interface defines methods to get the info associated with a key, and to update them accordingly
@@ -36,31 +45,63 @@ type KeyEntry interface {
 	GetTimestamp() time.Time
 
 	// Return the map representing the causal history
-	GetClock() map[string]int
+	GetClock() VectorClock
 
 	// Return the actual value
 	GetValue() string
 
 	// Write a new value - this needs to update the version and overwrite the clock
-	Update(string, time.Time, map[string]int, string)
+	Update(string, time.Time, VectorClock, string)
 
 	// Write tombstone
-	Delete(string, time.Time, map[string]int)
+	Delete(string, time.Time, VectorClock)
 
 	// Returns true if it hasn't been tombstone
 	Alive() bool
 
 	// Set the version
 	SetVersion(int)
+
+	// Return the concurrent values kept when siblings are on
+	GetSiblings() []Sibling
+
+	// Return the node which wrote the entry, used to break ties between equal timestamps
+	GetNode() string
+
+	// Set the node which wrote the entry
+	SetNode(string)
+
+	// Return the dotted version vector naming the replica write which made the entry
+	GetDVV() DVV
+
+	// Set the dotted version vector
+	SetDVV(DVV)
+
+	// Return when the entry expires, zero if it doesn't
+	GetExpires() time.Time
+
+	// Set when the entry expires
+	SetExpires(time.Time)
+
+	// Return the batch which wrote the entry, zero if it was written alone
+	GetBatch() BatchTag
+
+	// Set the batch which wrote the entry
+	SetBatch(BatchTag)
 }
 
 // Entry is the thing in the KVS and implements all the methods
 type Entry struct {
-	Version   int            // Monotonically increasing version numbers starting at 1
-	Timestamp time.Time      // this is set on writes
-	Clock     map[string]int // This is captured from the client payload on write
-	Value     string         // This is the actual value
-	Tombstone bool           // Tombstone value showing that it was deleted
+	Version   int         // Monotonically increasing version numbers starting at 1
+	Timestamp time.Time   // this is set on writes
+	Clock     VectorClock // This is captured from the client payload on write
+	Value     string      // This is the actual value
+	Tombstone bool        // Tombstone value showing that it was deleted
+	Siblings  []Sibling   // Concurrent values, only kept when siblings are on
+	Node      string      // The node whose clock stamped the entry
+	DVV       DVV         // The replica write which made the entry, zero for entries from before dots
+	Expires   time.Time   // When the value expires, zero if it never does
+	Batch     BatchTag    // The batch which wrote the entry, zero if it was written alone
 }
 
 // SetVersion the version
@@ -71,7 +112,7 @@ func (e *Entry) SetVersion(v int) {
 }
 
 // NewEntry creates a new entry
-func NewEntry(time time.Time, clock map[string]int, val string, version int) *Entry {
+func NewEntry(time time.Time, clock VectorClock, val string, version int) *Entry {
 
 	// Make a new entry
 	var e Entry
@@ -82,13 +123,8 @@ func NewEntry(time time.Time, clock map[string]int, val string, version int) *En
 	// The timestamp is set at creation
 	e.Timestamp = time
 
-	// There might be no causal history initially but we still need to create the map
-	e.Clock = make(map[string]int)
-	if clock != nil && len(clock) > 0 {
-		for k, v := range clock {
-			e.Clock[k] = v
-		}
-	}
+	// There might be no causal history initially but we still need to create the clock
+	e.Clock = clock.Copy()
 
 	// Tombstone obviously should be false
 	e.Tombstone = false
@@ -119,13 +155,12 @@ func (e *Entry) GetTimestamp() time.Time {
 }
 
 // GetClock returns the map representing the causal history
-func (e *Entry) GetClock() map[string]int {
+func (e *Entry) GetClock() VectorClock {
 	if e != nil {
 		return e.Clock
 	}
-	// The clock of a non-existing key is an empty map
-	empty := make(map[string]int)
-	return empty
+	// The clock of a non-existing key is empty
+	return NewVectorClock()
 }
 
 // GetValue returns the string stored in the entry
@@ -137,13 +172,83 @@ func (e *Entry) GetValue() string {
 	return ""
 }
 
+// GetNode returns the node which wrote the entry
+func (e *Entry) GetNode() string {
+	if e != nil {
+		return e.Node
+	}
+	return ""
+}
+
+// SetNode sets the node which wrote the entry
+func (e *Entry) SetNode(node string) {
+	if e != nil {
+		e.Node = node
+	}
+}
+
+// GetDVV returns the dotted version vector of the entry
+func (e *Entry) GetDVV() DVV {
+	if e != nil {
+		return e.DVV
+	}
+	return DVV{}
+}
+
+// SetDVV sets the dotted version vector of the entry
+func (e *Entry) SetDVV(d DVV) {
+	if e != nil {
+		e.DVV = d
+	}
+}
+
+// GetExpires returns when the entry expires
+func (e *Entry) GetExpires() time.Time {
+	if e != nil {
+		return e.Expires
+	}
+	return time.Time{}
+}
+
+// SetExpires sets when the entry expires
+func (e *Entry) SetExpires(t time.Time) {
+	if e != nil {
+		e.Expires = t
+	}
+}
+
+// GetBatch returns the batch which wrote the entry
+func (e *Entry) GetBatch() BatchTag {
+	if e != nil {
+		return e.Batch
+	}
+	return BatchTag{}
+}
+
+// SetBatch sets the batch which wrote the entry
+func (e *Entry) SetBatch(b BatchTag) {
+	if e != nil {
+		e.Batch = b
+	}
+}
+
+// GetSiblings returns the concurrent values of the entry, if it has any
+func (e *Entry) GetSiblings() []Sibling {
+	if e != nil {
+		return e.Siblings
+	}
+	return nil
+}
+
 // Update writes a new value for the entry and updates the clock and version info
-func (e *Entry) Update(key string, newTime time.Time, newClock map[string]int, newVal string) {
+func (e *Entry) Update(key string, newTime time.Time, newClock VectorClock, newVal string) {
 	log.Println("Updating entry - old version: ", e)
 	e.Timestamp = newTime
 	e.Value = newVal
-	e.Clock = newClock
+	e.Clock = newClock.Copy()
 	e.Tombstone = false
+	e.Siblings = nil
+	e.Batch = BatchTag{}
 	e.Version++
 	e.Clock[key] = e.Version
 	log.Println("Updated entry: ", e)
@@ -152,12 +257,15 @@ func (e *Entry) Update(key string, newTime time.Time, newClock map[string]int, n
 }
 
 // Delete sets a tombstone that the key has been tombstone
-func (e *Entry) Delete(key string, newTime time.Time, payload map[string]int) {
+func (e *Entry) Delete(key string, newTime time.Time, payload VectorClock) {
 	log.Println("Deleting entry: ", e)
 	e.Timestamp = newTime
 	e.Value = ""
-	e.Clock = payload
+	e.Clock = payload.Copy()
 	e.Tombstone = true
+	e.Siblings = nil
+	e.Expires = time.Time{}
+	e.Batch = BatchTag{}
 	e.Version++
 	e.Clock[key] = e.Version
 
@@ -172,15 +280,40 @@ func (e *Entry) Alive() bool {
 	return false
 }
 
-// NewKVS initializes a KVS object and returns a pointer to it
+// NewKVS initializes a KVS object backed by an in-memory engine and returns a pointer to it
 func NewKVS() *KVS {
+	return NewKVSWithEngine(NewMemoryEngine())
+}
+
+// NewKVSWithEngine initializes a KVS object on top of the given storage engine
+func NewKVSWithEngine(e StorageEngine) *KVS {
 	var k KVS
-	k.db = make(map[string]KeyEntry)
+	k.db = e
 	var m sync.RWMutex
 	k.mutex = &m
+	k.dots = NewDotCounter()
+	k.rebuildTree()
 	return &k
 }
 
+// rebuildTree rehashes every key in the storage engine into a new Merkle tree
+func (k *KVS) rebuildTree() {
+	t := NewMerkleTree()
+	err := k.db.Ascend("", "", func(key string, e KeyEntry) bool {
+		t.Update(key, e)
+		return true
+	})
+	if err != nil {
+		log.Println("Error building Merkle tree: ", err)
+	}
+	k.tree = t
+}
+
+// MerkleTree returns the tree of hashes over the keys in the KVS
+func (k *KVS) MerkleTree() *MerkleTree {
+	return k.tree
+}
+
 // Contains returns true if the dbAccess object contains an object with key equal to the input, it checks the input payload to ensure proper version
 func (k *KVS) Contains(key string) (bool, int) {
 	log.Println("Checking to see if db contains key ")
@@ -195,32 +328,37 @@ func (k *KVS) Contains(key string) (bool, int) {
 
 // contains is the unexported version of Contains() and does not hold a read lock
 func (k *KVS) contains(key string) (bool, int) {
-	t := k.db[key]
-	if t != nil {
-		return t.Alive(), t.GetVersion()
+	t, ok := k.db.Get(key)
+	if ok && t != nil {
+		return live(t, time.Now()), t.GetVersion()
+	}
+	// A key whose tombstone was collected still has the version it was deleted at
+	if g, ok := k.graves.Get(key); ok {
+		return false, g.GetVersion()
 	}
 	return false, 0
 }
 
 // Get returns the value associated with a particular key. If the key does not exist it returns ""
-func (k *KVS) Get(key string, payload map[string]int) (val string, clock map[string]int) {
+func (k *KVS) Get(key string, payload VectorClock) (val string, clock VectorClock) {
 	log.Println("Getting value associated with key ")
 	// Grab a read lock
 	k.mutex.RLock()
 	defer k.mutex.RUnlock()
 
-	_, version := k.contains(key)
+	e, ok := k.db.Get(key)
 
-	// Call the non-locking contains() method, use the version from above with default value 0
-	if version != 0 {
+	// Only keys which have been written at least once have a version above 0, and an
+	// expired key reads as if it had been deleted
+	if ok && e.GetVersion() != 0 && !expired(e, time.Now()) {
 		log.Println("Value found")
 
 		// Get the key and clock from the db
-		val = k.db[key].GetValue()
-		clock = k.db[key].GetClock()
+		val = e.GetValue()
+		clock = e.GetClock()
 
 		// Add this key's causal history to the client's payload
-		clock = mergeClocks(payload, clock)
+		clock = payload.Merge(clock)
 
 		// Return
 		return val, clock
@@ -232,18 +370,32 @@ func (k *KVS) Get(key string, payload map[string]int) (val string, clock map[str
 }
 
 // Delete sets the tombstone associated with a particular key, updates its version and timestamp, so it appears dead
-func (k *KVS) Delete(key string, time time.Time, payload map[string]int) bool {
+func (k *KVS) Delete(key string, time time.Time, payload VectorClock) bool {
 	log.Println("Attempting to delete key ")
 	// Grab a write lock
 	k.mutex.Lock()
 	defer k.mutex.Unlock()
+	return k.delete(key, time, payload)
+}
 
-	doesExist, _ := k.contains(key)
+// delete is the unexported version of Delete() and does not hold a write lock
+func (k *KVS) delete(key string, time time.Time, payload VectorClock) bool {
+	e, ok := k.working(key)
 
-	// Call the nonlocking contains method
-	if doesExist {
+	// Only a live key can be deleted
+	if ok && live(e, time) {
 		log.Println("Key found, deleting key-value pair")
-		k.db[key].Delete(key, time, payload)
+		prev := e.GetDVV()
+		e.Delete(key, k.clock.Stamp(time), payload)
+		e.SetNode(k.clock.Node())
+		if !k.advance(e, prev) {
+			return false
+		}
+
+		// Record the tombstone before acknowledging the delete
+		if !k.store(walDelete, key, e) {
+			return false
+		}
 
 		// Initiate Gossip
 		wakeGossip = true
@@ -254,7 +406,20 @@ func (k *KVS) Delete(key string, time time.Time, payload map[string]int) bool {
 }
 
 // Put adds a key-value pair to the DB. If the key already exists, then it overwrites the existing value. If the key does not exist then it is added.
-func (k *KVS) Put(key string, val string, time time.Time, payload map[string]int) bool {
+func (k *KVS) Put(key string, val string, time time.Time, payload VectorClock) bool {
+	return k.PutExpiring(key, val, time, payload, never)
+}
+
+// PutExpiring is Put for a value which expires at the given time, or never if it's zero
+func (k *KVS) PutExpiring(key string, val string, time time.Time, payload VectorClock, expires time.Time) bool {
+	// Grab a write lock
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.put(key, val, time, payload, expires)
+}
+
+// put is the unexported version of PutExpiring() and does not hold a write lock
+func (k *KVS) put(key string, val string, time time.Time, payload VectorClock, expires time.Time) bool {
 	maxVal := 1048576 // 1 megabyte
 	maxKey := 200     // 200 characters
 	keyLen := len(key)
@@ -264,24 +429,40 @@ func (k *KVS) Put(key string, val string, time time.Time, payload map[string]int
 
 	if keyLen <= maxKey && valLen <= maxVal {
 		log.Println("Key and value OK, inserting to DB")
-		// Grab a write lock
-		k.mutex.Lock()
-		defer k.mutex.Unlock()
+		e, ok := k.working(key)
+		time = k.clock.Stamp(time)
 
-		doesExist, _ := k.contains(key)
+		// The write replaces whatever version we hold, even a tombstone
+		prev := k.previous(key, e, ok)
 
 		// Check to see if the key exists
-		if doesExist {
+		if ok && live(e, time) {
 			// Update it
-			k.db[key].Update(key, time, payload, val)
+			e.Update(key, time, payload, val)
+			e.SetNode(k.clock.Node())
+			e.SetExpires(expires)
+			if !k.advance(e, prev) {
+				return false
+			}
 			log.Println("Overwriting existing key")
+			if !k.store(walPut, key, e) {
+				return false
+			}
 			// Initiate Gossip
 			wakeGossip = true
 			return true
 		}
 		log.Println("Inserting new key")
 		// Use the constructor
-		k.db[key] = NewEntry(time, payload, val, 1)
+		e = NewEntry(time, payload, val, 1)
+		e.SetNode(k.clock.Node())
+		e.SetExpires(expires)
+		if !k.advance(e, prev) {
+			return false
+		}
+		if !k.store(walPut, key, e) {
+			return false
+		}
 		// Initiate Gossip
 		wakeGossip = true
 		return true
@@ -290,33 +471,96 @@ func (k *KVS) Put(key string, val string, time time.Time, payload map[string]int
 	return false
 }
 
-// Add the server's keys to the clock if they don't already exist
-func mergeClocks(client map[string]int, server map[string]int) map[string]int {
-	log.Println("Merging clocks. Client: ", client, " Server: ", server)
-	if len(server) < 1 {
-		return client
+// PutSibling writes a value as node, keeping it alongside any siblings the client's
+// context doesn't cover. The payload is handled as it is by Put, and the key expires
+// as it does for PutExpiring.
+func (k *KVS) PutSibling(key string, val string, time time.Time, payload VectorClock, context VectorClock, node string, expires time.Time) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.putSibling(key, val, time, payload, context, node, expires)
+}
+
+// putSibling is the unexported version of PutSibling() and does not hold a write lock
+func (k *KVS) putSibling(key string, val string, time time.Time, payload VectorClock, context VectorClock, node string, expires time.Time) bool {
+	if len(key) > maxKey || len(val) > maxVal {
+		log.Println("Invalid entry for key or value")
+		return false
 	}
-	if len(client) < 1 {
-		return server
+
+	var e Entry
+	old, ok := k.db.Get(key)
+	prev := k.previous(key, old, ok)
+	if ok && live(old, time) {
+		e = toEntry(old)
+		e.Batch = BatchTag{}
 	}
-	for k, v := range server {
-		if client[k] < v {
-			client[k] = v
-		}
+	e.Version++
+	e.Clock = payload.Copy()
+	e.Clock[key] = e.Version
+	e.Node = k.clock.Node()
+	e.Expires = expires
+	addSibling(&e, node, context, val, k.clock.Stamp(time))
+	if !k.advance(&e, prev) {
+		return false
 	}
+	log.Println("Stored sibling, key now has", len(e.Siblings))
 
-	return client
+	if !k.store(walPut, key, &e) {
+		return false
+	}
+	// Initiate Gossip
+	wakeGossip = true
+	return true
+}
+
+// working returns a copy of the entry stored for a key for a write to change. The
+// storage engine may hand back the entry it holds, and a change made to that would be
+// seen before it's in the log, so a change only reaches the engine through store.
+func (k *KVS) working(key string) (KeyEntry, bool) {
+	e, ok := k.db.Get(key)
+	if !ok {
+		return nil, false
+	}
+	c := copyEntry(toEntry(e))
+	return &c, true
+}
+
+// previous returns the version a write of key replaces: the entry we hold, or the
+// tombstone we collected if we hold none
+func (k *KVS) previous(key string, e KeyEntry, ok bool) DVV {
+	if ok {
+		return e.GetDVV()
+	}
+	g, _ := k.graves.Get(key)
+	return g.DVV
+}
+
+// advance gives an entry written here a new dot, descending from the version it replaced.
+// Without a node ID there's nothing to name the write by, so the entry is left without one.
+// It returns false if no counter could be reserved for the dot.
+func (k *KVS) advance(e KeyEntry, prev DVV) bool {
+	node := k.clock.Node()
+	if node == "" {
+		return true
+	}
+	counter, err := k.dots.Next(prev.Vector()[node])
+	if err != nil {
+		log.Println("ERROR: Reserving a dot counter failed: ", err)
+		return false
+	}
+	e.SetDVV(prev.Advance(node, counter))
+	return true
 }
 
 // GetClock returns the clock associated with a key, it'll return an empty map for one that doesn't exist
-func (k *KVS) GetClock(key string) map[string]int {
+func (k *KVS) GetClock(key string) VectorClock {
 	k.mutex.RLock()
 	defer k.mutex.RUnlock()
 	// Check to see if we have the key
-	if _, ok := k.db[key]; ok {
-		return k.db[key].GetClock()
+	if e, ok := k.db.Get(key); ok {
+		return e.GetClock().Copy()
 	}
-	return map[string]int{}
+	return NewVectorClock()
 }
 
 // GetTimestamp returns the timestamp associated witha  key, otherwise an empty struct
@@ -324,8 +568,8 @@ func (k *KVS) GetTimestamp(key string) time.Time {
 	k.mutex.RLock()
 	defer k.mutex.RUnlock()
 	// Check to see if we have the key
-	if _, ok := k.db[key]; ok {
-		return k.db[key].GetTimestamp()
+	if e, ok := k.db.Get(key); ok {
+		return e.GetTimestamp()
 	}
 	return time.Time{}
 }
@@ -333,14 +577,216 @@ func (k *KVS) GetTimestamp(key string) time.Time {
 // OverwriteEntry overwrites the entry associated with the given key using the given entry
 func (k *KVS) OverwriteEntry(key string, entry KeyEntry) {
 	if entry != nil {
-		log.Println("Overwriting entry: ", k.db[key])
 		k.mutex.Lock()
 		defer k.mutex.Unlock()
-		k.db[key] = entry
+		old, ok := k.db.Get(key)
+		if !ok && !k.beatsGrave(key, entry) {
+			log.Println("Ignoring entry for " + key + " older than its collected tombstone")
+			return
+		}
+		log.Println("Overwriting entry: ", old)
+		k.store(walOverwrite, key, entry)
 		log.Println("New entry: ", entry)
 	}
 }
 
+// MergeEntry stores a version of a key received from another replica if it wins over the
+// one held, checking and storing under the same lock so a write made here in between is
+// never lost. It returns true if the stored version changed.
+func (k *KVS) MergeEntry(key string, entry KeyEntry) bool {
+	if entry == nil {
+		return false
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	old, ok := k.db.Get(key)
+	if !ok {
+		if !k.beatsGrave(key, entry) {
+			return false
+		}
+		return k.store(walOverwrite, key, entry)
+	}
+	merged, changed := mergeVersions(entry, old)
+	if !changed {
+		return false
+	}
+	return k.store(walOverwrite, key, merged)
+}
+
+// beatsGrave returns true unless key's tombstone was collected and the entry is no newer
+func (k *KVS) beatsGrave(key string, e KeyEntry) bool {
+	g, ok := k.graves.Get(key)
+	return !ok || resolveConflict(e, &g)
+}
+
+// Grave returns the tombstone collected for a key, if it was
+func (k *KVS) Grave(key string) (Entry, bool) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.graves.Get(key)
+}
+
+// Seen returns true if we hold the given version of a key or a newer one, counting a
+// tombstone we've collected
+func (k *KVS) Seen(key string, e KeyEntry) bool {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	if local, ok := k.db.Get(key); ok {
+		return !resolveConflict(e, local)
+	}
+	return !k.beatsGrave(key, e)
+}
+
+// Tombstones returns every tombstone in the db
+func (k *KVS) Tombstones() map[string]Entry {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	out := make(map[string]Entry)
+	k.db.Ascend("", "", func(key string, e KeyEntry) bool {
+		if !e.Alive() {
+			out[key] = toEntry(e)
+		}
+		return true
+	})
+	return out
+}
+
+// Collect removes tombstones from the db, burying them in the graveyard first. A key
+// which has been written since its tombstone was read is left alone. It returns the
+// number of tombstones removed.
+func (k *KVS) Collect(tombs map[string]Entry, now time.Time) int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	ready := make(map[string]Entry)
+	for key, e := range tombs {
+		if cur, ok := k.db.Get(key); ok && !cur.Alive() && cur.GetTimestamp().Equal(e.Timestamp) {
+			ready[key] = e
+		}
+	}
+	err := k.graves.Bury(ready, now)
+	if err != nil {
+		log.Println("Error burying tombstones: ", err)
+		return 0
+	}
+	n := 0
+	for key, e := range ready {
+		if k.wal != nil {
+			err = k.wal.Append(walRecord{Op: walCollect, Key: key, Entry: e})
+			if err != nil {
+				log.Println("Error appending to write-ahead log: ", err)
+				break
+			}
+		}
+		err = k.db.Remove(key)
+		if err != nil {
+			log.Println("Error removing tombstone from storage engine: ", err)
+			break
+		}
+		k.tree.Remove(key)
+		n++
+	}
+	return n
+}
+
+// store appends the new state of a key to the write-ahead log, if there is one, and
+// then writes it to the storage engine. It must be called while holding the write
+// lock. It returns false if the change could not be made durable. Inside a batch the
+// change is only held until the batch is stored. Once stored, the change is published
+// to the feed.
+func (k *KVS) store(op walOp, key string, e KeyEntry) bool {
+	if k.pending != nil {
+		k.pending = append(k.pending, walRecord{Op: op, Key: key, Entry: toEntry(e)})
+		return true
+	}
+	if k.wal != nil {
+		err := k.wal.Append(walRecord{Op: op, Key: key, Entry: toEntry(e)})
+		if err != nil {
+			log.Println("Error appending to write-ahead log: ", err)
+			return false
+		}
+	}
+	err := k.db.Put(key, e)
+	if err != nil {
+		log.Println("Error writing to storage engine: ", err)
+		return false
+	}
+	k.tree.Update(key, e)
+	k.feed.Publish(op, key, e)
+	return true
+}
+
+// Restore rebuilds the db from the newest snapshot and the log segments written after
+// it, then attaches the log so that further changes are appended to it. This is done
+// at startup before any servers run.
+func (k *KVS) Restore(w *WAL) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	seq, entries, err := loadLatestSnapshot(w.dir)
+	if err != nil {
+		return err
+	}
+	ops := make([]batchOp, 0, len(entries))
+	for key, e := range entries {
+		e := e
+		ops = append(ops, batchOp{Key: key, Entry: &e})
+	}
+	err = k.db.Batch(ops)
+	if err != nil {
+		return err
+	}
+
+	n, err := w.Replay(seq, k.replay)
+	if err != nil {
+		return err
+	}
+	log.Println("Replayed", n, "records from the write-ahead log")
+
+	k.wal = w
+	k.rebuildTree()
+
+	// Anything we recovered may be news to the other replicas
+	wakeGossip = true
+	return nil
+}
+
+// replay applies a record from the log to the storage engine
+func (k *KVS) replay(rec walRecord) {
+	switch rec.Op {
+	case walCollect:
+		err := k.db.Remove(rec.Key)
+		if err != nil {
+			log.Println("Error replaying removal of key", rec.Key, ":", err)
+		}
+	case walBatch:
+		for _, r := range rec.Batch {
+			k.replay(r)
+		}
+	default:
+		e := rec.Entry
+		err := k.db.Put(rec.Key, &e)
+		if err != nil {
+			log.Println("Error replaying record for key", rec.Key, ":", err)
+		}
+	}
+}
+
+// toEntry copies the fields of a KeyEntry into an Entry value
+func toEntry(e KeyEntry) Entry {
+	return Entry{
+		Timestamp: e.GetTimestamp(),
+		Clock:     e.GetClock(),
+		Value:     e.GetValue(),
+		Version:   e.GetVersion(),
+		Tombstone: !e.Alive(),
+		Siblings:  e.GetSiblings(),
+		Node:      e.GetNode(),
+		DVV:       e.GetDVV(),
+		Expires:   e.GetExpires(),
+		Batch:     e.GetBatch(),
+	}
+}
+
 // GetTimeGlob returns a struct containing a map of keys to their timestamps
 func (k *KVS) GetTimeGlob() timeGlob {
 	if k != nil {
@@ -348,9 +794,10 @@ func (k *KVS) GetTimeGlob() timeGlob {
 		defer k.mutex.RUnlock()
 		m := make(map[string]time.Time)
 		if k.db != nil {
-			for key, v := range k.db {
+			k.db.Ascend("", "", func(key string, v KeyEntry) bool {
 				m[key] = v.GetTimestamp()
-			}
+				return true
+			})
 		}
 		g := timeGlob{List: m}
 
@@ -367,19 +814,9 @@ func (k *KVS) GetEntryGlob(tg timeGlob) entryGlob {
 		entries := make(map[string]Entry)
 		eg := entryGlob{Keys: entries}
 		for n := range tg.List {
-			time := k.db[n].GetTimestamp()
-			clock := k.db[n].GetClock()
-			value := k.db[n].GetValue()
-			version := k.db[n].GetVersion()
-			tombstone := !k.db[n].Alive()
-			e := Entry{
-				Timestamp: time,
-				Clock:     clock,
-				Value:     value,
-				Version:   version,
-				Tombstone: tombstone,
+			if e, ok := k.db.Get(n); ok {
+				eg.Keys[n] = toEntry(e)
 			}
-			eg.Keys[n] = e
 		}
 		log.Println("Built entryGlob: ", eg)
 		return eg
@@ -2,14 +2,13 @@ package main
 
 import (
 	"strings"
-	"sync"
 	"testing"
 	"time"
 )
 
 type testEntry struct {
 	time    time.Time
-	clock   map[string]int
+	clock   VectorClock
 	value   string
 	version int
 }
@@ -30,11 +29,11 @@ func (e *testEntry) GetTimestamp() time.Time {
 	return e.time
 }
 
-func (e *testEntry) GetClock() map[string]int {
+func (e *testEntry) GetClock() VectorClock {
 	return e.clock
 }
 
-func (e *testEntry) Update(key string, time time.Time, clock map[string]int, val string) {
+func (e *testEntry) Update(key string, time time.Time, clock VectorClock, val string) {
 	// goes nowhere does nothing
 }
 
@@ -43,20 +42,85 @@ func (e *testEntry) Alive() bool {
 	return true
 }
 
-func (e *testEntry) Delete(key string, time time.Time, payload map[string]int) {
+func (e *testEntry) Delete(key string, time time.Time, payload VectorClock) {
 	// goes nowhere does nothing
 }
 
+func (e *testEntry) GetSiblings() []Sibling {
+	return nil
+}
+
+func (e *testEntry) GetNode() string {
+	return ""
+}
+
+func (e *testEntry) SetNode(node string) {
+	// goes nowhere does nothing
+}
+
+func (e *testEntry) GetDVV() DVV {
+	return DVV{}
+}
+
+func (e *testEntry) SetDVV(d DVV) {
+	// goes nowhere does nothing
+}
+
+func (e *testEntry) GetExpires() time.Time {
+	return time.Time{}
+}
+
+func (e *testEntry) SetExpires(t time.Time) {
+	// goes nowhere does nothing
+}
+
+func (e *testEntry) GetBatch() BatchTag {
+	return BatchTag{}
+}
+
+func (e *testEntry) SetBatch(b BatchTag) {
+	// goes nowhere does nothing
+}
+
+// testEngines builds each storage engine the KVS tests are run against, along with a func to clean it up
+var testEngines = map[string]func(*testing.T) (StorageEngine, func()){
+	engineMemory: func(t *testing.T) (StorageEngine, func()) {
+		return NewMemoryEngine(), func() {}
+	},
+	engineLSM: func(t *testing.T) (StorageEngine, func()) {
+		dir, cleanup := tempDataDir(t)
+		// A tiny memtable makes sure the tests reach the on-disk tables too
+		e, err := openLSMEngine(dir, 2)
+		ok(t, err)
+		return e, func() {
+			e.Close()
+			cleanup()
+		}
+	},
+}
+
+// forEachEngine runs a test once per storage engine, each time with a KVS holding the given entries
+func forEachEngine(t *testing.T, db map[string]KeyEntry, test func(*testing.T, *KVS)) {
+	for name, newEngine := range testEngines {
+		t.Run(name, func(t *testing.T) {
+			e, cleanup := newEngine(t)
+			defer cleanup()
+			for key, entry := range db {
+				ok(t, e.Put(key, entry))
+			}
+			test(t, NewKVSWithEngine(e))
+		})
+	}
+}
+
 // This tests for a key that does not exist in the db, the KVS should return version -1 and alive == false
 func TestKVSContainsCheckIfDoesntExist(t *testing.T) {
-	db := map[string]KeyEntry{}
-	var m sync.RWMutex
-	k := KVS{db: db, mutex: &m}
-
-	alive, version := k.Contains(keyNotHere)
+	forEachEngine(t, map[string]KeyEntry{}, func(t *testing.T, k *KVS) {
+		alive, version := k.Contains(keyNotHere)
 
-	assert(t, version == 0, "Key found that does not exist.")
-	assert(t, !alive, "Contains returned alive for nonexistent key.")
+		assert(t, version == 0, "Key found that does not exist.")
+		assert(t, !alive, "Contains returned alive for nonexistent key.")
+	})
 }
 
 // If the key does exist, the KVS should return alive == true and its version
@@ -70,12 +134,11 @@ func TestKVSContainsCheckIfDoesExist(t *testing.T) {
 	db := map[string]KeyEntry{
 		keyExists: &entryExists,
 	}
-	var m sync.RWMutex
-	k := KVS{db: db, mutex: &m}
-	alive, version := k.Contains(keyExists)
-	assert(t, alive, "Contains() returned !alive for existing key.")
-	assert(t, version == 1, "Contains() returned incorrect version.")
-
+	forEachEngine(t, db, func(t *testing.T, k *KVS) {
+		alive, version := k.Contains(keyExists)
+		assert(t, alive, "Contains() returned !alive for existing key.")
+		assert(t, version == 1, "Contains() returned incorrect version.")
+	})
 }
 
 // Get() on an existing key/value pair should return the value for the key
@@ -90,19 +153,18 @@ func TestKVSGetExistingVal(t *testing.T) {
 		keyExists: &entryExists,
 	}
 
-	var m sync.RWMutex
-	k := KVS{db: db, mutex: &m}
-	returned, _ := k.Get(keyExists, nil)
-	equals(t, valExists, returned)
+	forEachEngine(t, db, func(t *testing.T, k *KVS) {
+		returned, _ := k.Get(keyExists, nil)
+		equals(t, valExists, returned)
+	})
 }
 
 // Get on a non-existing key should return an empty string
 func TestKVSGetValDoesntExist(t *testing.T) {
-	db := map[string]KeyEntry{}
-	var m sync.RWMutex
-	k := KVS{db: db, mutex: &m}
-	returned, _ := k.Get(keyone, nil)
-	equals(t, "", returned)
+	forEachEngine(t, map[string]KeyEntry{}, func(t *testing.T, k *KVS) {
+		returned, _ := k.Get(keyone, nil)
+		equals(t, "", returned)
+	})
 }
 
 // Delete on an existing key/value pair should return true and further Gets() should fail
@@ -117,25 +179,23 @@ func TestKVSDeleteExistingKeyValPair(t *testing.T) {
 		keyExists: &entryExists,
 	}
 
-	var m sync.RWMutex
-	k := KVS{db: db, mutex: &m}
-	assert(t, k.Delete(keyExists, time.Now(), map[string]int{}), "Did not delete Key Val Pair")
+	forEachEngine(t, db, func(t *testing.T, k *KVS) {
+		assert(t, k.Delete(keyExists, time.Now(), VectorClock{}), "Did not delete Key Val Pair")
+	})
 }
 
 // Delete on a key that doesn't exist should return false
 func TestKVSDeleteKeyDoesntExist(t *testing.T) {
-	db := map[string]KeyEntry{}
-	var m sync.RWMutex
-	k := KVS{db: db, mutex: &m}
-	assert(t, !k.Delete(keyNotHere, time.Now(), map[string]int{}), "Deleted a keyvalue pair not in data store prior")
+	forEachEngine(t, map[string]KeyEntry{}, func(t *testing.T, k *KVS) {
+		assert(t, !k.Delete(keyNotHere, time.Now(), VectorClock{}), "Deleted a keyvalue pair not in data store prior")
+	})
 }
 
 // Put() with a new key should return true
 func TestKVSPutNewKeyNewVal(t *testing.T) {
-	db := map[string]KeyEntry{}
-	var m sync.RWMutex
-	k := KVS{db: db, mutex: &m}
-	assert(t, k.Put(keyone, valone, time.Now(), nil), "New key and value were not added")
+	forEachEngine(t, map[string]KeyEntry{}, func(t *testing.T, k *KVS) {
+		assert(t, k.Put(keyone, valone, time.Now(), nil), "New key and value were not added")
+	})
 }
 
 // Overwriting a value should return true
@@ -149,30 +209,29 @@ func TestKVSPutExistKeyOverwriteVal(t *testing.T) {
 	db := map[string]KeyEntry{
 		keyExists: &entryExists,
 	}
-	var m sync.RWMutex
-	k := KVS{db: db, mutex: &m}
-	assert(t, k.Put(keyone, valtwo, time.Now(), nil), "Did not overwrite existing key's value")
-
+	forEachEngine(t, db, func(t *testing.T, k *KVS) {
+		assert(t, k.Put(keyone, valtwo, time.Now(), nil), "Did not overwrite existing key's value")
+	})
 }
 
 // Put() with an invalid key should return failure
 func TestKVSPutInvalidkey(t *testing.T) {
-	db := map[string]KeyEntry{}
-	var m sync.RWMutex
-	k := KVS{db: db, mutex: &m}
-	assert(t, !k.Put(invalidKey, valtwo, time.Now(), nil), "Invalid key added")
+	forEachEngine(t, map[string]KeyEntry{}, func(t *testing.T, k *KVS) {
+		assert(t, !k.Put(invalidKey, valtwo, time.Now(), nil), "Invalid key added")
+	})
 }
 
 // Put() with an invalid value should fail
 func TestKVSPutInvalidVal(t *testing.T) {
-	k := NewKVS()
 	var b strings.Builder
 	b.Grow(1048577)
 	for i := 0; i < 1048577; i++ {
 		b.WriteByte(0)
 	}
 	invalidVal := b.String()
-	assert(t, !k.Put(keyone, invalidVal, time.Now(), nil), "Invalid value added")
+	forEachEngine(t, map[string]KeyEntry{}, func(t *testing.T, k *KVS) {
+		assert(t, !k.Put(keyone, invalidVal, time.Now(), nil), "Invalid value added")
+	})
 }
 
 // GetVersion of an existing entry should return the version
@@ -180,7 +239,7 @@ func TestEntryGetVersionKeyExists(t *testing.T) {
 	e := Entry{
 		Version:   1,
 		Timestamp: time.Now(),
-		Clock: map[string]int{
+		Clock: VectorClock{
 			keyExists: 1,
 		},
 		Value:     valExists,
@@ -203,7 +262,7 @@ func TestEntryGetTimestampKeyExists(t *testing.T) {
 	e := Entry{
 		Version:   1,
 		Timestamp: timestamp,
-		Clock: map[string]int{
+		Clock: VectorClock{
 			keyExists: 1,
 		},
 		Value:     valExists,
@@ -220,7 +279,7 @@ func TestEntryGetTimestampKeyNotExists(t *testing.T) {
 
 // GetClock should return the key's clock map if it exists
 func TestEntryGetClockKeyExists(t *testing.T) {
-	expectedClock := map[string]int{
+	expectedClock := VectorClock{
 		keyExists: 1,
 	}
 	e := Entry{
@@ -245,7 +304,7 @@ func TestEntryGetValueKeyExists(t *testing.T) {
 	e := Entry{
 		Version:   1,
 		Timestamp: time.Now(),
-		Clock:     map[string]int{keyExists: 1},
+		Clock:     VectorClock{keyExists: 1},
 		Value:     valExists,
 		Tombstone: false,
 	}
@@ -267,12 +326,12 @@ func TestUpdateChangesTimestamp(t *testing.T) {
 	e := Entry{
 		Version:   1,
 		Timestamp: start,
-		Clock:     map[string]int{keyExists: 1},
+		Clock:     VectorClock{keyExists: 1},
 		Value:     valExists,
 		Tombstone: false,
 	}
 
-	e.Update(keyExists, finish, map[string]int{}, valExists)
+	e.Update(keyExists, finish, VectorClock{}, valExists)
 	equals(t, e.GetTimestamp(), finish)
 }
 
@@ -285,12 +344,12 @@ func TestUpdateIncrementsVersion(t *testing.T) {
 	e := Entry{
 		Version:   1,
 		Timestamp: start,
-		Clock:     map[string]int{keyExists: 1},
+		Clock:     VectorClock{keyExists: 1},
 		Value:     valExists,
 		Tombstone: false,
 	}
 
-	e.Update(keyExists, finish, map[string]int{}, valExists)
+	e.Update(keyExists, finish, VectorClock{}, valExists)
 	equals(t, e.GetVersion(), 2)
 }
 
@@ -303,12 +362,12 @@ func TestUpdateClearsTombstone(t *testing.T) {
 	e := Entry{
 		Version:   1,
 		Timestamp: start,
-		Clock:     map[string]int{keyExists: 1},
+		Clock:     VectorClock{keyExists: 1},
 		Value:     valExists,
 		Tombstone: true,
 	}
 
-	e.Update(keyExists, finish, map[string]int{}, valExists)
+	e.Update(keyExists, finish, VectorClock{}, valExists)
 	equals(t, e.Alive(), true)
 }
 
@@ -321,12 +380,12 @@ func TestUpdateChangesValue(t *testing.T) {
 	e := Entry{
 		Version:   1,
 		Timestamp: start,
-		Clock:     map[string]int{keyExists: 1},
+		Clock:     VectorClock{keyExists: 1},
 		Value:     valone,
 		Tombstone: true,
 	}
 
-	e.Update(keyExists, finish, map[string]int{}, valtwo)
+	e.Update(keyExists, finish, VectorClock{}, valtwo)
 	equals(t, valtwo, e.GetValue())
 }
 
@@ -335,7 +394,7 @@ func TestAliveKeyExistsReturnsTrue(t *testing.T) {
 	e := Entry{
 		Version:   1,
 		Timestamp: time.Now(),
-		Clock:     map[string]int{keyExists: 1},
+		Clock:     VectorClock{keyExists: 1},
 		Value:     valone,
 		Tombstone: false,
 	}
@@ -358,12 +417,12 @@ func TestDeleteSetsNewTimestamp(t *testing.T) {
 	e := Entry{
 		Version:   1,
 		Timestamp: start,
-		Clock:     map[string]int{keyExists: 1},
+		Clock:     VectorClock{keyExists: 1},
 		Value:     valone,
 		Tombstone: false,
 	}
 
-	e.Delete(keyExists, finish, map[string]int{})
+	e.Delete(keyExists, finish, VectorClock{})
 	equals(t, finish, e.GetTimestamp())
 }
 
@@ -376,12 +435,12 @@ func TestDeleteUpdatesVersion(t *testing.T) {
 	e := Entry{
 		Version:   1,
 		Timestamp: start,
-		Clock:     map[string]int{keyExists: 1},
+		Clock:     VectorClock{keyExists: 1},
 		Value:     valone,
 		Tombstone: false,
 	}
 
-	e.Delete(keyExists, finish, map[string]int{})
+	e.Delete(keyExists, finish, VectorClock{})
 	equals(t, 2, e.GetVersion())
 }
 
@@ -394,12 +453,12 @@ func TestDeleteSetsTombstone(t *testing.T) {
 	e := Entry{
 		Version:   1,
 		Timestamp: start,
-		Clock:     map[string]int{keyExists: 1},
+		Clock:     VectorClock{keyExists: 1},
 		Value:     valone,
 		Tombstone: false,
 	}
 
-	e.Delete(keyExists, finish, map[string]int{})
+	e.Delete(keyExists, finish, VectorClock{})
 	equals(t, false, e.Alive())
 }
 
@@ -412,12 +471,12 @@ func TestDeleteClearsValue(t *testing.T) {
 	e := Entry{
 		Version:   1,
 		Timestamp: start,
-		Clock:     map[string]int{keyExists: 1},
+		Clock:     VectorClock{keyExists: 1},
 		Value:     valone,
 		Tombstone: false,
 	}
 
-	e.Delete(keyExists, finish, map[string]int{})
+	e.Delete(keyExists, finish, VectorClock{})
 	equals(t, "", e.GetValue())
 }
 
@@ -430,13 +489,13 @@ func TestDeleteUpdatesClock(t *testing.T) {
 	e := Entry{
 		Version:   1,
 		Timestamp: start,
-		Clock:     map[string]int{keyExists: 1},
+		Clock:     VectorClock{keyExists: 1},
 		Value:     valone,
 		Tombstone: false,
 	}
 
-	e.Delete(keyExists, finish, map[string]int{})
-	equals(t, map[string]int{keyExists: 2}, e.GetClock())
+	e.Delete(keyExists, finish, VectorClock{})
+	equals(t, VectorClock{keyExists: 2}, e.GetClock())
 }
 
 // Update should set the clock to include the key you've updated
@@ -444,20 +503,31 @@ func TestUpdateSetsInitialClock(t *testing.T) {
 	e := Entry{
 		Version:   1,
 		Timestamp: time.Now(),
-		Clock:     map[string]int{},
+		Clock:     VectorClock{},
 		Value:     valone,
 		Tombstone: false,
 	}
-	initialClock := map[string]int{
+	initialClock := VectorClock{
 		keyExists: 2,
 	}
 	e.Update(keyExists, time.Now(), initialClock, valtwo)
 	equals(t, initialClock, e.GetClock())
 }
 
+// Update and Delete should keep their own copy of the clock they're given
+func TestUpdateAndDeleteLeaveClockAlone(t *testing.T) {
+	e := Entry{Version: 1, Timestamp: time.Now(), Clock: VectorClock{}, Value: valone}
+	payload := VectorClock{"other": 3}
+	e.Update(keyExists, time.Now(), payload, valtwo)
+	equals(t, VectorClock{"other": 3}, payload)
+	e.Delete(keyExists, time.Now(), payload)
+	equals(t, VectorClock{"other": 3}, payload)
+	equals(t, VectorClock{"other": 3, keyExists: 3}, e.GetClock())
+}
+
 // NewEntry should set an initial clock value
 func TestNewEntrySetsInitialClock(t *testing.T) {
-	initialClock := map[string]int{
+	initialClock := VectorClock{
 		keyExists:        1,
 		keyNotExists:     2,
 		"some other key": 1,
@@ -468,47 +538,48 @@ func TestNewEntrySetsInitialClock(t *testing.T) {
 }
 
 func TestGetClockKeyExistsReturnsClock(t *testing.T) {
-	initialClock := map[string]int{
+	initialClock := VectorClock{
 		keyExists:        1,
 		keyNotExists:     2,
 		"some other key": 1,
 	}
-	var m sync.RWMutex
 	e := NewEntry(time.Now(), initialClock, valExists, 1)
 	d := map[string]KeyEntry{keyExists: e}
-	k := KVS{db: d, mutex: &m}
-
-	equals(t, initialClock, k.GetClock(keyExists))
+	forEachEngine(t, d, func(t *testing.T, k *KVS) {
+		equals(t, initialClock, k.GetClock(keyExists))
+	})
 }
 
 func TestGetClockKeyNotExistsReturnsEmpty(t *testing.T) {
-	k := NewKVS()
-	equals(t, map[string]int{}, k.GetClock(keyExists))
+	forEachEngine(t, map[string]KeyEntry{}, func(t *testing.T, k *KVS) {
+		equals(t, VectorClock{}, k.GetClock(keyExists))
+	})
 }
 func TestGetTimestampReturnsTimestamp(t *testing.T) {
-	time := time.Now()
-	initialClock := map[string]int{
+	// Engines which keep entries on disk can't keep the monotonic clock reading
+	time := time.Now().Round(0)
+	initialClock := VectorClock{
 		keyExists:        1,
 		keyNotExists:     2,
 		"some other key": 1,
 	}
-	var m sync.RWMutex
 	e := NewEntry(time, initialClock, valExists, 1)
 	d := map[string]KeyEntry{keyExists: e}
-	k := KVS{db: d, mutex: &m}
-
-	equals(t, time, k.GetTimestamp(keyExists))
+	forEachEngine(t, d, func(t *testing.T, k *KVS) {
+		equals(t, time, k.GetTimestamp(keyExists))
+	})
 }
 
 func TestGetTimestampKeyNotExistsReturnsEmpty(t *testing.T) {
-	k := NewKVS()
-	equals(t, time.Time{}, k.GetTimestamp(keyExists))
+	forEachEngine(t, map[string]KeyEntry{}, func(t *testing.T, k *KVS) {
+		equals(t, time.Time{}, k.GetTimestamp(keyExists))
+	})
 }
 
 func TestOverwriteKeyExists(t *testing.T) {
 	// Define a starter entry
-	firstTime := time.Now()
-	firstClock := map[string]int{}
+	firstTime := time.Now().Round(0)
+	firstClock := VectorClock{}
 	firstVal := valExists
 	firstVersion := 1
 
@@ -521,9 +592,9 @@ func TestOverwriteKeyExists(t *testing.T) {
 	}
 
 	// Define a second entry to overwrite the first
-	secondTime := time.Now()
+	secondTime := time.Now().Round(0)
 	secondVal := valNotExists
-	secondClock := map[string]int{keyExists: 2}
+	secondClock := VectorClock{keyExists: 2}
 	secondVersion := 3
 	second := Entry{
 		Value:     secondVal,
@@ -534,24 +605,23 @@ func TestOverwriteKeyExists(t *testing.T) {
 	}
 
 	// Make a KVS
-	var m sync.RWMutex
-	k := KVS{
-		db: map[string]KeyEntry{
-			keyExists: &first,
-		},
-		mutex: &m,
+	db := map[string]KeyEntry{
+		keyExists: &first,
 	}
 
 	// Overwrite the entry and verify result
-	k.OverwriteEntry(keyExists, &second)
-	equals(t, &second, k.db[keyExists])
+	forEachEngine(t, db, func(t *testing.T, k *KVS) {
+		k.OverwriteEntry(keyExists, &second)
+		got, _ := k.db.Get(keyExists)
+		equals(t, &second, got)
+	})
 }
 
 func TestOverwriteEntryNotExists(t *testing.T) {
 	// Define a second entry to overwrite the first
-	secondTime := time.Now()
+	secondTime := time.Now().Round(0)
 	secondVal := valNotExists
-	secondClock := map[string]int{keyExists: 2}
+	secondClock := VectorClock{keyExists: 2}
 	secondVersion := 3
 	second := Entry{
 		Value:     secondVal,
@@ -561,73 +631,69 @@ func TestOverwriteEntryNotExists(t *testing.T) {
 		Version:   secondVersion,
 	}
 
-	// Make a KVS
-	var m sync.RWMutex
-	k := KVS{
-		db:    map[string]KeyEntry{},
-		mutex: &m,
-	}
-
 	// Overwrite the entry and verify result
-	k.OverwriteEntry(keyExists, &second)
-	equals(t, &second, k.db[keyExists])
+	forEachEngine(t, map[string]KeyEntry{}, func(t *testing.T, k *KVS) {
+		k.OverwriteEntry(keyExists, &second)
+		got, _ := k.db.Get(keyExists)
+		equals(t, &second, got)
+	})
 }
 func TestGetTimeGlobKeyExists(t *testing.T) {
-	timestamp := time.Now()
-	initialClock := map[string]int{
+	timestamp := time.Now().Round(0)
+	initialClock := VectorClock{
 		keyExists:        1,
 		keyNotExists:     2,
 		"some other key": 1,
 	}
-	var m sync.RWMutex
 	e := NewEntry(timestamp, initialClock, valExists, 1)
 	d := map[string]KeyEntry{keyExists: e}
-	k := KVS{db: d, mutex: &m}
-
-	g := k.GetTimeGlob()
-	h := make(map[string]time.Time)
-	h[keyExists] = timestamp
-	j := timeGlob{List: h}
-	equals(t, j, g)
+	forEachEngine(t, d, func(t *testing.T, k *KVS) {
+		g := k.GetTimeGlob()
+		h := make(map[string]time.Time)
+		h[keyExists] = timestamp
+		j := timeGlob{List: h}
+		equals(t, j, g)
+	})
 }
 
 func TestGetTimeGlobKeyNotExists(t *testing.T) {
-	k := NewKVS()
-	h := make(map[string]time.Time)
-	j := timeGlob{List: h}
-	equals(t, j, k.GetTimeGlob())
+	forEachEngine(t, map[string]KeyEntry{}, func(t *testing.T, k *KVS) {
+		h := make(map[string]time.Time)
+		j := timeGlob{List: h}
+		equals(t, j, k.GetTimeGlob())
+	})
 }
 
 func TestGetEntryGlobEmptyTimeGlob(t *testing.T) {
-	k := NewKVS()
-	g := timeGlob{}
-	h := k.GetEntryGlob(g)
-	j := entryGlob{Keys: map[string]Entry{}}
-	equals(t, j, h)
+	forEachEngine(t, map[string]KeyEntry{}, func(t *testing.T, k *KVS) {
+		g := timeGlob{}
+		h := k.GetEntryGlob(g)
+		j := entryGlob{Keys: map[string]Entry{}}
+		equals(t, j, h)
+	})
 }
 
 func TestGetEntryGlobKeyExist(t *testing.T) {
-	timestamp := time.Now()
-	initialClock := map[string]int{
+	timestamp := time.Now().Round(0)
+	initialClock := VectorClock{
 		keyExists:        1,
 		keyNotExists:     2,
 		"some other key": 1,
 	}
-	var m sync.RWMutex
 	e := NewEntry(timestamp, initialClock, valExists, 1)
 	d := map[string]KeyEntry{keyExists: e}
-	k := KVS{db: d, mutex: &m}
-
-	g := k.GetTimeGlob()
-	h := k.GetEntryGlob(g)
-	j := make(map[string]Entry)
-	j[keyExists] = *e
-	l := entryGlob{Keys: j}
-	equals(t, l, h)
+	forEachEngine(t, d, func(t *testing.T, k *KVS) {
+		g := k.GetTimeGlob()
+		h := k.GetEntryGlob(g)
+		j := make(map[string]Entry)
+		j[keyExists] = *e
+		l := entryGlob{Keys: j}
+		equals(t, l, h)
+	})
 }
 
 func TestSetVersionSetsVersion(t *testing.T) {
-	e := NewEntry(time.Now(), map[string]int{}, valExists, 1)
+	e := NewEntry(time.Now(), VectorClock{}, valExists, 1)
 	e.SetVersion(2)
 	assert(t, e.Version == 2, "SetVersion didn't work")
 }
@@ -641,8 +707,6 @@ func TestSetVersionEntryNilDoesntExplode(t *testing.T) {
 // TODO: TESTS NEEDED
 // Need a test that runs Put on a key which does exist so it tests lines 274-280
 //
-// Need to test mergeClocks with no client clock
-// Need to test mergeClocks iwth no server clock
 // Need to test GetTimeGlob with a nil key
 // Need to test GetEntryGlob with a nil key
 
@@ -674,3 +738,20 @@ func TestSetVersionEntryNilDoesntExplode(t *testing.T) {
 // 		tb.FailNow()
 // 	}
 // }
+
+func TestMergeEntryKeepsNewerLocalWrite(t *testing.T) {
+	k := NewKVS()
+	k.Put(keyone, valone, time.Now(), VectorClock{})
+	k.Put(keyone, valtwo, time.Now(), VectorClock{keyone: 1})
+	old := NewEntry(time.Now().Add(-time.Second), VectorClock{keyone: 1}, valone, 1)
+
+	// A read which saw the older version doesn't put it back over the newer write
+	assert(t, !k.MergeEntry(keyone, old), "Older version merged over a newer one")
+	val, _ := k.Get(keyone, VectorClock{})
+	equals(t, valtwo, val)
+
+	newer := NewEntry(time.Now(), VectorClock{keyone: 5}, valExists, 5)
+	assert(t, k.MergeEntry(keyone, newer), "Newer version wasn't merged")
+	val, _ = k.Get(keyone, VectorClock{})
+	equals(t, valExists, val)
+}
@@ -0,0 +1,629 @@
+// lsm.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines an on-disk StorageEngine built as a small log-structured merge tree.
+//
+// Writes go to an in-memory memtable and to an fsync'd memtable log, so nothing is
+// lost if the process dies. When the memtable fills up it is written out as an
+// immutable, sorted table file (sst-00000001.sst, ...) and the memtable log is
+// emptied. Once there are too many tables they are all merged into one. A MANIFEST
+// file names the tables which are live, so a crash part way through a flush or a
+// merge never exposes a half-finished set of tables.
+//
+// A table file is laid out as:
+//
+//     [8 byte magic and format version]
+//     [frame: lsmRecord] ... one per key, sorted
+//     [frame: sstIndex]
+//     [8 byte offset of the index frame]
+//
+// using the same length and checksum framing as the write-ahead log.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	lsmTableFormat = "sst-%08d.sst" // Table file names inside the engine directory
+	lsmMemLogName  = "memtable.log" // Log backing the memtable
+	lsmManifest    = "MANIFEST"     // Lists the live tables
+	lsmMemLimit    = 4096           // Keys held in the memtable before it is flushed
+	lsmMaxTables   = 4              // Tables allowed before they are merged
+	lsmVersion     = 1              // Bumped whenever the table layout changes
+)
+
+// lsmMagic starts every table file; the last byte is the format version
+var lsmMagic = []byte{'K', 'V', 'S', 'S', 'S', 'T', 0, lsmVersion}
+
+// An lsmRecord is a key and its entry, or a marker that the key was removed
+type lsmRecord struct {
+	Key     string
+	Entry   Entry
+	Removed bool
+}
+
+// An lsmBatch is a group of records written to the memtable log as one frame, so that
+// either all of them survive a crash or none do
+type lsmBatch struct {
+	Records []lsmRecord
+}
+
+// sstIndex lists the keys in a table and where each one's record starts
+type sstIndex struct {
+	Keys    []string
+	Offsets []int64
+}
+
+// sstable is an open, immutable table file
+type sstable struct {
+	seq   uint64
+	file  *os.File
+	index sstIndex
+}
+
+// lsmEngine is a StorageEngine which keeps its entries on disk
+type lsmEngine struct {
+	dir      string
+	memLimit int                  // Flush the memtable once it holds this many keys
+	mem      map[string]lsmRecord // The memtable
+	memKeys  []string             // Sorted keys of the memtable
+	memLog   *os.File             // Log of everything in the memtable
+	tables   []*sstable           // Live tables, oldest first
+	nextSeq  uint64               // Number for the next table written
+	mutex    sync.RWMutex
+}
+
+// OpenLSMEngine opens (or creates) an engine in the given directory and loads the
+// live tables and anything left in the memtable log
+func OpenLSMEngine(dir string) (*lsmEngine, error) {
+	return openLSMEngine(dir, lsmMemLimit)
+}
+
+// openLSMEngine does the work for OpenLSMEngine with a chosen memtable size
+func openLSMEngine(dir string, memLimit int) (*lsmEngine, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "Creating engine directory "+dir+" failed")
+	}
+	l := &lsmEngine{
+		dir:      dir,
+		memLimit: memLimit,
+		mem:      make(map[string]lsmRecord),
+		nextSeq:  1,
+	}
+
+	live, err := l.readManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, seq := range live {
+		t, err := openSSTable(l.tablePath(seq), seq)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.tables = append(l.tables, t)
+		if seq >= l.nextSeq {
+			l.nextSeq = seq + 1
+		}
+	}
+	l.removeOrphans(live)
+
+	err = l.replayMemLog()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	log.Println("Opened LSM engine with", len(l.tables), "tables and", len(l.mem), "memtable keys")
+	return l, nil
+}
+
+// tablePath returns the file name for a table number
+func (l *lsmEngine) tablePath(seq uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf(lsmTableFormat, seq))
+}
+
+// Get checks the memtable and then each table from newest to oldest
+func (l *lsmEngine) Get(key string) (KeyEntry, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	rec, ok := l.lookup(key)
+	if !ok || rec.Removed {
+		return nil, false
+	}
+	e := copyEntry(rec.Entry)
+	return &e, true
+}
+
+// lookup finds the newest record for a key, which may be a removal marker
+func (l *lsmEngine) lookup(key string) (lsmRecord, bool) {
+	if rec, ok := l.mem[key]; ok {
+		return rec, true
+	}
+	for i := len(l.tables) - 1; i >= 0; i-- {
+		rec, ok, err := l.tables[i].get(key)
+		if err != nil {
+			log.Println("Error reading table", l.tables[i].seq, ":", err)
+			continue
+		}
+		if ok {
+			return rec, true
+		}
+	}
+	return lsmRecord{}, false
+}
+
+// Put stores a copy of the entry
+func (l *lsmEngine) Put(key string, e KeyEntry) error {
+	return l.write([]lsmRecord{{Key: key, Entry: copyEntry(toEntry(e))}})
+}
+
+// Remove writes a removal marker for the key
+func (l *lsmEngine) Remove(key string) error {
+	return l.write([]lsmRecord{{Key: key, Removed: true}})
+}
+
+// Batch writes every op as a single memtable log frame
+func (l *lsmEngine) Batch(ops []batchOp) error {
+	recs := make([]lsmRecord, 0, len(ops))
+	for _, op := range ops {
+		if op.Remove {
+			recs = append(recs, lsmRecord{Key: op.Key, Removed: true})
+		} else {
+			recs = append(recs, lsmRecord{Key: op.Key, Entry: copyEntry(toEntry(op.Entry))})
+		}
+	}
+	return l.write(recs)
+}
+
+// write logs the records, applies them to the memtable and flushes it if it's full
+func (l *lsmEngine) write(recs []lsmRecord) error {
+	frame, err := encodeFrame(lsmBatch{Records: recs})
+	if err != nil {
+		return errors.Wrap(err, "Encode failed for memtable batch")
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	_, err = l.memLog.Write(frame)
+	if err != nil {
+		return errors.Wrap(err, "Writing memtable log failed")
+	}
+	err = l.memLog.Sync()
+	if err != nil {
+		return errors.Wrap(err, "Syncing memtable log failed")
+	}
+	for _, rec := range recs {
+		l.applyMem(rec)
+	}
+
+	// The records are in the memtable log and the memtable now, so the write has been
+	// made even if the flush fails. The next write tries the flush again.
+	if len(l.mem) >= l.memLimit {
+		err = l.flush()
+		if err != nil {
+			log.Println("Error flushing memtable: ", err)
+		}
+	}
+	return nil
+}
+
+// applyMem puts a record into the memtable
+func (l *lsmEngine) applyMem(rec lsmRecord) {
+	if _, ok := l.mem[rec.Key]; !ok {
+		i := sort.SearchStrings(l.memKeys, rec.Key)
+		l.memKeys = append(l.memKeys, "")
+		copy(l.memKeys[i+1:], l.memKeys[i:])
+		l.memKeys[i] = rec.Key
+	}
+	l.mem[rec.Key] = rec
+}
+
+// Ascend merges the memtable and every table in key order. Where a key appears in
+// more than one place the newest record wins, and removed keys are skipped.
+func (l *lsmEngine) Ascend(start string, end string, fn func(string, KeyEntry) bool) error {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	// Each source is a sorted list of keys; the memtable is the newest so it goes last
+	sources := make([][]string, 0, len(l.tables)+1)
+	for _, t := range l.tables {
+		sources = append(sources, t.index.Keys)
+	}
+	sources = append(sources, l.memKeys)
+
+	pos := make([]int, len(sources))
+	for i, keys := range sources {
+		pos[i] = sort.SearchStrings(keys, start)
+	}
+
+	for {
+		// Find the smallest key at the head of any source
+		key := ""
+		found := false
+		for i, keys := range sources {
+			if pos[i] < len(keys) && (!found || keys[pos[i]] < key) {
+				key = keys[pos[i]]
+				found = true
+			}
+		}
+		if !found || (end != "" && key >= end) {
+			return nil
+		}
+		for i, keys := range sources {
+			if pos[i] < len(keys) && keys[pos[i]] == key {
+				pos[i]++
+			}
+		}
+
+		rec, ok := l.lookup(key)
+		if !ok || rec.Removed {
+			continue
+		}
+		e := copyEntry(rec.Entry)
+		if !fn(key, &e) {
+			return nil
+		}
+	}
+}
+
+// Len counts the keys which haven't been removed
+func (l *lsmEngine) Len() int {
+	n := 0
+	l.Ascend("", "", func(string, KeyEntry) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// Close closes the memtable log and every table
+func (l *lsmEngine) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.memLog != nil {
+		l.memLog.Close()
+	}
+	for _, t := range l.tables {
+		t.file.Close()
+	}
+	return nil
+}
+
+// replayMemLog loads the memtable from its log, truncating any torn tail
+func (l *lsmEngine) replayMemLog() error {
+	path := filepath.Join(l.dir, lsmMemLogName)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Opening memtable log failed")
+	}
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		var b lsmBatch
+		n, err := readFrame(r, &b)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Println("Bad record in memtable log at offset", offset, ":", err)
+			break
+		}
+		for _, rec := range b.Records {
+			normalizeEntry(&rec.Entry)
+			l.applyMem(rec)
+		}
+		offset += n
+	}
+	err = f.Truncate(offset)
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "Truncating memtable log failed")
+	}
+	l.memLog = f
+	return nil
+}
+
+// flush writes the memtable out as a new table and empties it. It must be called
+// with the write lock held.
+func (l *lsmEngine) flush() error {
+	if len(l.mem) == 0 {
+		return nil
+	}
+	recs := make([]lsmRecord, 0, len(l.memKeys))
+	for _, key := range l.memKeys {
+		recs = append(recs, l.mem[key])
+	}
+	t, err := l.writeTable(recs)
+	if err != nil {
+		return err
+	}
+	l.tables = append(l.tables, t)
+	err = l.writeManifest()
+	if err != nil {
+		// The memtable and its log still hold everything, so forget the table
+		l.tables = l.tables[:len(l.tables)-1]
+		t.file.Close()
+		os.Remove(l.tablePath(t.seq))
+		return err
+	}
+
+	// The memtable is safely in a table now, so start its log over
+	err = l.memLog.Truncate(0)
+	if err == nil {
+		_, err = l.memLog.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Truncating memtable log failed")
+	}
+	l.mem = make(map[string]lsmRecord)
+	l.memKeys = nil
+
+	if len(l.tables) > lsmMaxTables {
+		return l.compact()
+	}
+	return nil
+}
+
+// compact merges every table into one. Since the result covers all of the history,
+// removal markers have nothing left to hide and are dropped. It must be called with
+// the write lock held.
+func (l *lsmEngine) compact() error {
+	log.Println("Compacting", len(l.tables), "tables")
+	merged := make(map[string]lsmRecord)
+	for _, t := range l.tables {
+		err := t.scan(func(rec lsmRecord) {
+			merged[rec.Key] = rec
+		})
+		if err != nil {
+			return err
+		}
+	}
+	keys := make([]string, 0, len(merged))
+	for key, rec := range merged {
+		if !rec.Removed {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	recs := make([]lsmRecord, 0, len(keys))
+	for _, key := range keys {
+		recs = append(recs, merged[key])
+	}
+
+	t, err := l.writeTable(recs)
+	if err != nil {
+		return err
+	}
+	old := l.tables
+	l.tables = []*sstable{t}
+	err = l.writeManifest()
+	if err != nil {
+		l.tables = old
+		t.file.Close()
+		os.Remove(l.tablePath(t.seq))
+		return err
+	}
+	for _, o := range old {
+		o.file.Close()
+		os.Remove(l.tablePath(o.seq))
+	}
+	return nil
+}
+
+// writeTable writes sorted records to a new table file and opens it
+func (l *lsmEngine) writeTable(recs []lsmRecord) (*sstable, error) {
+	seq := l.nextSeq
+	l.nextSeq++
+	path := l.tablePath(seq)
+	tmp := path + ".tmp"
+
+	var buf bytes.Buffer
+	buf.Write(lsmMagic)
+	index := sstIndex{Keys: make([]string, 0, len(recs)), Offsets: make([]int64, 0, len(recs))}
+	for _, rec := range recs {
+		index.Keys = append(index.Keys, rec.Key)
+		index.Offsets = append(index.Offsets, int64(buf.Len()))
+		err := writeFrame(&buf, rec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	indexOffset := buf.Len()
+	err := writeFrame(&buf, index)
+	if err != nil {
+		return nil, err
+	}
+	footer := make([]byte, 8)
+	binary.BigEndian.PutUint64(footer, uint64(indexOffset))
+	buf.Write(footer)
+
+	err = writeFileSync(tmp, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Renaming table failed")
+	}
+	err = syncDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	return openSSTable(path, seq)
+}
+
+// readManifest returns the numbers of the live tables
+func (l *lsmEngine) readManifest() ([]uint64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(l.dir, lsmManifest))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Reading manifest failed")
+	}
+	var live []uint64
+	for _, line := range strings.Fields(string(b)) {
+		seq, err := strconv.ParseUint(line, 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "Manifest is corrupt")
+		}
+		live = append(live, seq)
+	}
+	return live, nil
+}
+
+// writeManifest atomically replaces the manifest with the current table list
+func (l *lsmEngine) writeManifest() error {
+	var b strings.Builder
+	for _, t := range l.tables {
+		b.WriteString(strconv.FormatUint(t.seq, 10) + "\n")
+	}
+	path := filepath.Join(l.dir, lsmManifest)
+	err := writeFileSync(path+".tmp", []byte(b.String()))
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return errors.Wrap(err, "Renaming manifest failed")
+	}
+	return syncDir(l.dir)
+}
+
+// removeOrphans deletes table files left behind by a flush or merge that didn't finish
+func (l *lsmEngine) removeOrphans(live []uint64) {
+	seqs, err := listSegments(l.dir, lsmTableFormat)
+	if err != nil {
+		return
+	}
+	keep := make(map[uint64]bool)
+	for _, s := range live {
+		keep[s] = true
+	}
+	for _, s := range seqs {
+		if !keep[s] {
+			log.Println("Removing orphaned table", s)
+			os.Remove(l.tablePath(s))
+		}
+		if s >= l.nextSeq {
+			l.nextSeq = s + 1
+		}
+	}
+}
+
+// openSSTable opens a table file and reads its index
+func openSSTable(path string, seq uint64) (*sstable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Opening table "+path+" failed")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "Reading table "+path+" failed")
+	}
+	size := info.Size()
+	if size < int64(len(lsmMagic)+8) {
+		f.Close()
+		return nil, errors.New("Table " + path + " is too short")
+	}
+
+	head := make([]byte, len(lsmMagic))
+	_, err = f.ReadAt(head, 0)
+	if err != nil || !bytes.Equal(head, lsmMagic) {
+		f.Close()
+		return nil, errors.New("Table " + path + " has an unknown format")
+	}
+
+	footer := make([]byte, 8)
+	_, err = f.ReadAt(footer, size-8)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "Reading table footer failed")
+	}
+	indexOffset := int64(binary.BigEndian.Uint64(footer))
+
+	t := &sstable{seq: seq, file: f}
+	_, err = readFrame(io.NewSectionReader(f, indexOffset, size-8-indexOffset), &t.index)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "Reading table index failed")
+	}
+	return t, nil
+}
+
+// get looks a key up in the table's index and reads its record
+func (t *sstable) get(key string) (lsmRecord, bool, error) {
+	i := sort.SearchStrings(t.index.Keys, key)
+	if i >= len(t.index.Keys) || t.index.Keys[i] != key {
+		return lsmRecord{}, false, nil
+	}
+	var rec lsmRecord
+	_, err := readFrame(io.NewSectionReader(t.file, t.index.Offsets[i], 1<<62), &rec)
+	if err != nil {
+		return lsmRecord{}, false, err
+	}
+	normalizeEntry(&rec.Entry)
+	return rec, true, nil
+}
+
+// scan reads every record in the table in key order
+func (t *sstable) scan(fn func(lsmRecord)) error {
+	for i := range t.index.Keys {
+		var rec lsmRecord
+		_, err := readFrame(io.NewSectionReader(t.file, t.index.Offsets[i], 1<<62), &rec)
+		if err != nil {
+			return err
+		}
+		normalizeEntry(&rec.Entry)
+		fn(rec)
+	}
+	return nil
+}
+
+// writeFileSync writes a whole file and syncs it to disk
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Creating "+path+" failed")
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	if err != nil {
+		return errors.Wrap(err, "Writing "+path+" failed")
+	}
+	err = f.Sync()
+	if err != nil {
+		return errors.Wrap(err, "Syncing "+path+" failed")
+	}
+	return nil
+}
@@ -23,6 +23,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"time"
 )
 
 // Versioning info defined via linker flags at compile time
@@ -49,34 +50,103 @@ func main() {
 	version := branch + "." + hash + "." + build
 	log.Println("Running version " + version)
 
-	// IP_PORT is defined at runtime in the docker command
-	myIP = os.Getenv("IP_PORT")
+	// Everything else is defined at runtime in the docker command
+	config, err := LoadConfig()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// IP_PORT is this node's address
+	myIP = config.IPPort
 
 	log.Println("My IP is " + myIP)
 
-	// VIEW is defined at runtime in the docker command as a string
-	str := os.Getenv("VIEW")
-	log.Println("My view is: " + str)
+	// VIEW is the list of every node as a string
+	log.Println("My view is: " + config.View)
 
 	// Create a viewlist and load the view into it
-	MyView := NewView(myIP, str)
+	MyView := NewView(myIP, config.View)
+
+	// View changes are agreed in numbered epochs, and a restarted node picks up where it left off
+	views, err := config.OpenViews(MyView)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-	// Make a KVS to use as the db
-	k := NewKVS()
+	// Make a KVS to use as the db, rebuilding it from disk before anyone can talk to us
+	log.Println("Using the " + config.Engine + " storage engine in " + config.DataDir)
+	k, err := config.OpenKVS()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// Writes are stamped by a hybrid logical clock, so clock skew between nodes can't reorder them
+	clock := NewHLC(myIP)
+	for _, t := range k.GetTimeGlob().List {
+		clock.Observe(t)
+	}
+	k.clock = clock
+
+	// Every change stored from here on is published to anyone watching
+	feed := NewFeed(config.WatchBacklog)
+	k.feed = feed
 
-	// The App object is the front end and has references to the KVS and viewList
-	a := App{db: k, view: *MyView}
+	// The ring partitions the keys across the view when REPLICAS is set
+	ring := config.Ring(MyView)
+
+	// Writes which can't reach a replica are kept as hints until it comes back
+	hints, err := config.OpenHints(views)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// The phi-accrual detector judges how flaky each peer is from how often we hear from it
+	phi := NewPhiDetector(config.PhiThreshold)
+
+	// The failure detector tracks which members are up, and hands hints to the ones it hears from
+	members := config.Membership(MyView)
+	members.onAlive = func(peer string) {
+		phi.Heartbeat(peer, time.Now())
+		hints.PeerUp(peer)
+	}
+
+	// The rebalancer streams keys to their new owners whenever the view changes
+	rebal := NewRebalancer(MyView, ring, k, config.QuorumTimeout)
+	rebal.views = views
+	members.streaming = rebal.Streaming
+
+	// The App object is the front end and has references to the KVS, the viewList and the
+	// quorum coordinator
+	a := App{db: k, view: *MyView, ring: ring, quorum: config.Quorum(MyView, ring, hints, phi, views), hints: hints, members: members, phi: phi, views: views, rebal: rebal, siblings: config.Siblings, clock: clock, feed: feed}
 
 	log.Println("Starting server...")
 
 	// The gossip object controls communicating with other servers and has references to the viewlist and the kvs
 	gossip := GossipVals{
-		view: MyView,
-		kvs:  k,
+		view:    MyView,
+		kvs:     k,
+		ring:    ring,
+		hints:   hints,
+		members: members,
+		phi:     phi,
+		views:   views,
+		clock:   clock,
 	}
 	// Start the heartbeat loop
 	go gossip.GossipHeartbeat() // goroutines
 
+	// Start probing the other members
+	go members.Run()
+
+	// Start watching for view changes
+	go rebal.Run()
+
+	// Start collecting tombstones once every replica has them
+	go config.Collector(MyView, ring, k).Run()
+
+	// Start turning expired keys into tombstones
+	go k.ExpiryLoop(expirySweepInterval)
+
 	// Start the servers with references to the REST app and the gossip module
 	server(a, gossip)
 }
@@ -0,0 +1,197 @@
+// merkle.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines the Merkle tree each node keeps over its keys for anti-entropy. Keys are
+// bucketed into leaves by the top bits of their position on the ring, so each subtree
+// covers one contiguous slice of the hash space. A leaf's hash is the XOR of a digest
+// of every key in it, which lets a write update its leaf without rereading the others,
+// and each inner node hashes its two children. Two replicas holding the same versions
+// of the same keys end up with the same root, and when they don't, walking down the
+// trees from the root finds the leaves they disagree on without sending anything about
+// the keys they agree on.
+//
+// Inner hashes are only brought up to date when they are read, so a burst of writes
+// costs one pass up the tree rather than one per write.
+//
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	merkleDepth  = 16               // Levels below the root
+	merkleLeaves = 1 << merkleDepth // Number of leaves
+)
+
+// MerkleTree hashes the versions of every key a node stores
+type MerkleTree struct {
+	nodes []uint64            // Heap layout: 1 is the root, node i has children 2i and 2i+1
+	keys  []map[string]uint64 // Digest of each key, per leaf
+	dirty map[int]bool        // Leaves changed since the inner nodes were last rehashed
+	mutex sync.Mutex
+}
+
+// NewMerkleTree creates an empty tree
+func NewMerkleTree() *MerkleTree {
+	t := &MerkleTree{
+		nodes: make([]uint64, 2*merkleLeaves),
+		keys:  make([]map[string]uint64, merkleLeaves),
+		dirty: make(map[int]bool),
+	}
+	// Every leaf starts out empty, so the inner nodes need hashing once
+	for i := 0; i < merkleLeaves; i++ {
+		t.dirty[i] = true
+	}
+	return t
+}
+
+// merkleLeaf returns the leaf a key belongs in
+func merkleLeaf(key string) int {
+	return int(ringHash(key) >> (32 - merkleDepth))
+}
+
+// merkleNode returns the heap index of the i'th node on a level, the root being level 0
+func merkleNode(level int, i int) int {
+	return (1 << uint(level)) + i
+}
+
+// entryDigest sums up the version of a key which is stored. Two replicas agree on a
+// key exactly when their digests match.
+func entryDigest(key string, e KeyEntry) uint64 {
+	var buf [17]byte
+	binary.BigEndian.PutUint64(buf[0:8], uint64(e.GetTimestamp().UnixNano()))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(e.GetVersion()))
+	if !e.Alive() {
+		buf[16] = 1
+	}
+	h := md5.New()
+	h.Write([]byte(key))
+	h.Write(buf[:])
+	h.Write([]byte(e.GetNode()))
+	h.Write([]byte(e.GetDVV().Dot.String()))
+	if exp := e.GetExpires(); !exp.IsZero() {
+		binary.BigEndian.PutUint64(buf[0:8], uint64(exp.UnixNano()))
+		h.Write(buf[0:8])
+	}
+	// Siblings are kept in a fixed order, so replicas holding the same ones agree
+	for _, sib := range e.GetSiblings() {
+		binary.BigEndian.PutUint64(buf[0:8], uint64(sib.Timestamp.UnixNano()))
+		h.Write(buf[0:8])
+		h.Write([]byte(fmt.Sprint(sib.Clock)))
+	}
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+// Update records the version of a key which is now stored
+func (t *MerkleTree) Update(key string, e KeyEntry) {
+	d := entryDigest(key, e)
+	leaf := merkleLeaf(key)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.keys[leaf] == nil {
+		t.keys[leaf] = make(map[string]uint64)
+	}
+	old, ok := t.keys[leaf][key]
+	if ok && old == d {
+		return
+	}
+	// XOR the old digest out and the new one in
+	t.nodes[merkleLeaves+leaf] ^= old ^ d
+	t.keys[leaf][key] = d
+	t.dirty[leaf] = true
+}
+
+// Remove forgets a key
+func (t *MerkleTree) Remove(key string) {
+	leaf := merkleLeaf(key)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	old, ok := t.keys[leaf][key]
+	if !ok {
+		return
+	}
+	t.nodes[merkleLeaves+leaf] ^= old
+	delete(t.keys[leaf], key)
+	t.dirty[leaf] = true
+}
+
+// rehash brings the inner nodes above every dirty leaf up to date. The lock must be held.
+func (t *MerkleTree) rehash() {
+	if len(t.dirty) == 0 {
+		return
+	}
+	level := make(map[int]bool, len(t.dirty))
+	for leaf := range t.dirty {
+		level[(merkleLeaves+leaf)/2] = true
+	}
+	t.dirty = make(map[int]bool)
+
+	// Work up a level at a time so each parent is hashed after both its children
+	var buf [16]byte
+	for len(level) > 0 {
+		parents := make(map[int]bool, len(level))
+		for n := range level {
+			binary.BigEndian.PutUint64(buf[0:8], t.nodes[2*n])
+			binary.BigEndian.PutUint64(buf[8:16], t.nodes[2*n+1])
+			sum := md5.Sum(buf[:])
+			t.nodes[n] = binary.BigEndian.Uint64(sum[0:8])
+			if n > 1 {
+				parents[n/2] = true
+			}
+		}
+		level = parents
+	}
+}
+
+// Root returns the hash of the whole tree
+func (t *MerkleTree) Root() uint64 {
+	return t.Hashes(0, []int{0})[0]
+}
+
+// Hashes returns the hashes of the given nodes on a level
+func (t *MerkleTree) Hashes(level int, nodes []int) []uint64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rehash()
+
+	hashes := make([]uint64, len(nodes))
+	for i, n := range nodes {
+		if level < 0 || level > merkleDepth || n < 0 || n >= 1<<uint(level) {
+			continue
+		}
+		hashes[i] = t.nodes[merkleNode(level, n)]
+	}
+	return hashes
+}
+
+// Keys returns every key in the given leaves, sorted
+func (t *MerkleTree) Keys(leaves []int) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var keys []string
+	for _, leaf := range leaves {
+		if leaf < 0 || leaf >= merkleLeaves {
+			continue
+		}
+		for k := range t.keys[leaf] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
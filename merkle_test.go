@@ -0,0 +1,162 @@
+// merkle_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests and benchmarks for Merkle-tree anti-entropy
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// countingConn counts the bytes passing through a connection in both directions
+type countingConn struct {
+	net.Conn
+	bytes int
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytes += n
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytes += n
+	return n, err
+}
+
+// Connects to an endpoint serving the given KVS's Merkle tree over an in-memory pipe
+func merklePeer(kvs dbAccess) (*bufio.ReadWriter, *countingConn) {
+	return merklePeerWithViews(kvs, nil)
+}
+
+// Like merklePeer, but the endpoint checks the asker's view epoch against views
+func merklePeerWithViews(kvs dbAccess, views *ViewLog) (*bufio.ReadWriter, *countingConn) {
+	client, server := net.Pipe()
+	e := NewEndpoint()
+	e.gossip = GossipVals{kvs: kvs, views: views}
+	e.AddHandleFunc("merkle", e.handleMerkle)
+	go e.handleMessages(server)
+
+	conn := &countingConn{Conn: client}
+	return bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), conn
+}
+
+// Builds a KVS holding n keys, straight through the engine to keep the logs quiet
+func filledKVS(n int, ts time.Time) *KVS {
+	e := NewMemoryEngine()
+	for i := 0; i < n; i++ {
+		key := fmt.Sprint("key", i)
+		e.Put(key, NewEntry(ts, VectorClock{key: 1}, valone, 1))
+	}
+	return NewKVSWithEngine(e)
+}
+
+func TestMerkleRootIgnoresInsertionOrder(t *testing.T) {
+	ts := time.Now()
+	a := NewMerkleTree()
+	b := NewMerkleTree()
+	for i := 0; i < 100; i++ {
+		a.Update(fmt.Sprint("key", i), NewEntry(ts, nil, valone, 1))
+		b.Update(fmt.Sprint("key", 99-i), NewEntry(ts, nil, valone, 1))
+	}
+	equals(t, a.Root(), b.Root())
+}
+
+func TestMerkleRootTracksChanges(t *testing.T) {
+	ts := time.Now()
+	tree := NewMerkleTree()
+	tree.Update(keyone, NewEntry(ts, nil, valone, 1))
+	before := tree.Root()
+
+	tree.Update(keyExists, NewEntry(ts, nil, valtwo, 1))
+	assert(t, tree.Root() != before, "Adding a key didn't change the root")
+	tree.Remove(keyExists)
+	equals(t, before, tree.Root())
+
+	// A tombstone is a different version of the key
+	dead := NewEntry(ts, nil, valone, 1)
+	dead.Tombstone = true
+	tree.Update(keyone, dead)
+	assert(t, tree.Root() != before, "Deleting a key didn't change the root")
+}
+
+func TestKVSKeepsMerkleTreeCurrent(t *testing.T) {
+	k := filledKVS(50, time.Now())
+	k.Put(keyone, valone, time.Now(), VectorClock{})
+	k.Delete("key7", time.Now(), VectorClock{})
+
+	incremental := k.MerkleTree().Root()
+	k.rebuildTree()
+	equals(t, k.MerkleTree().Root(), incremental)
+}
+
+func TestMerkleDiffFindsDivergentLeaves(t *testing.T) {
+	ts := time.Now()
+	alice := filledKVS(1000, ts)
+	bob := filledKVS(1000, ts)
+
+	rw, _ := merklePeer(bob)
+	leaves, err := merkleDiff(rw, alice.MerkleTree(), nil)
+	ok(t, err)
+	equals(t, 0, len(leaves))
+
+	bob.OverwriteEntry("key42", NewEntry(ts, VectorClock{"key42": 2}, valtwo, 2))
+	leaves, err = merkleDiff(rw, alice.MerkleTree(), nil)
+	ok(t, err)
+	equals(t, []int{merkleLeaf("key42")}, leaves)
+	equals(t, []string{"key42"}, alice.MerkleTree().Keys(leaves))
+}
+
+// gobSize returns the number of bytes v takes on the wire
+func gobSize(v interface{}) int {
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(v)
+	return buf.Len()
+}
+
+// BenchmarkMerkleAntiEntropy measures the bytes one gossip round sends to bring a peer
+// holding 100k keys up to date when 1% of them differ, against sending the whole timeGlob
+func BenchmarkMerkleAntiEntropy(b *testing.B) {
+	const keys = 100000
+	ts := time.Now()
+	alice := filledKVS(keys, ts)
+	bob := filledKVS(keys, ts)
+	for i := 0; i < keys/100; i++ {
+		key := fmt.Sprint("key", i*100)
+		bob.db.Put(key, NewEntry(ts, VectorClock{key: 2}, valtwo, 2))
+	}
+	bob.rebuildTree()
+	g := GossipVals{kvs: alice}
+
+	b.ResetTimer()
+	var merkleBytes, globBytes int
+	for i := 0; i < b.N; i++ {
+		rw, conn := merklePeer(bob)
+		leaves, err := merkleDiff(rw, alice.MerkleTree(), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn.Close()
+		merkleBytes = conn.bytes
+		globBytes = gobSize(g.leafTimeGlob(leaves))
+	}
+	b.ReportMetric(float64(merkleBytes), "tree-bytes/op")
+	b.ReportMetric(float64(globBytes), "timeglob-bytes/op")
+	b.ReportMetric(float64(merkleBytes+globBytes), "total-bytes/op")
+	b.ReportMetric(float64(gobSize(alice.GetTimeGlob())), "full-timeglob-bytes/op")
+}
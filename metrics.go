@@ -0,0 +1,71 @@
+// metrics.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines a small set of named counters describing what a node has been doing, such as
+// how often reads find replicas that disagree. They are reported on /admin/metrics.
+//
+
+package main
+
+import "sync"
+
+// Names of the counters kept by the node
+const (
+	metricReadDivergence      = "read_divergence"      // Quorum reads where the replicas disagreed
+	metricStaleReplicas       = "read_stale_replicas"  // Replicas found holding an old version on a read
+	metricRepairsSent         = "read_repairs_sent"    // Winning entries pushed to stale replicas
+	metricRepairsFailed       = "read_repairs_failed"  // Pushes which didn't reach the replica
+	metricRebalanceKeys       = "rebalance_keys_sent"  // Keys streamed to new owners after a view change
+	metricConcurrent          = "concurrent_versions"  // Conflicts between versions neither of which had seen the other
+	metricTombstonesCollected = "tombstones_collected" // Tombstones removed once they were safe to drop
+)
+
+// Metrics is a set of counters which can be bumped from anywhere in the node
+type Metrics struct {
+	counters map[string]int64
+	mutex    sync.Mutex
+}
+
+// metrics holds the counters for this node
+var metrics = NewMetrics()
+
+// NewMetrics creates an empty set of counters
+func NewMetrics() *Metrics {
+	return &Metrics{counters: make(map[string]int64)}
+}
+
+// Add increases a counter by n
+func (m *Metrics) Add(name string, n int64) {
+	m.mutex.Lock()
+	m.counters[name] += n
+	m.mutex.Unlock()
+}
+
+// Inc increases a counter by one
+func (m *Metrics) Inc(name string) {
+	m.Add(name, 1)
+}
+
+// Get returns the current value of a counter
+func (m *Metrics) Get(name string) int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.counters[name]
+}
+
+// Snapshot returns a copy of every counter
+func (m *Metrics) Snapshot() map[string]int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	out := make(map[string]int64, len(m.counters))
+	for k, v := range m.counters {
+		out[k] = v
+	}
+	return out
+}
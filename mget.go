@@ -0,0 +1,192 @@
+// mget.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines multi-key reads. A POST to /keyValue-store/_mget carries a JSON list of keys,
+// either on its own or as the "keys" of an object which may also hold the client's
+// "payload":
+//
+//     {"keys": ["a", "b", "c"], "payload": {"a": 2}}
+//
+// Every key is read under one lock on the KVS, so the versions returned are the ones
+// this node held at a single moment. They're then checked as a cut: each key must be at
+// least as new as the client's payload says it has seen, and at least as new as the
+// clock of every other version returned says its writer had seen. A version written by
+// someone who had read b at version 3 isn't shown next to b at version 2. If any key
+// falls short, nothing is returned and the request fails with the stale keys listed,
+// so a dashboard reading related keys never sees a torn state while gossip spreads.
+//
+// Partitioned by the ring, the keys must be stored on the same nodes, as for a batch.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const mgetMaxKeys = 500 // Keys allowed in one read
+
+// errInvalidRead is returned for a multi-key read which can't be served as it stands
+var errInvalidRead = errors.New("Invalid read")
+
+// ReadCut returns the versions held of a group of keys, all read at the same moment.
+// A key whose tombstone was collected is returned as its grave.
+func (k *KVS) ReadCut(keys []string) map[string]Entry {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	out := make(map[string]Entry, len(keys))
+	for _, key := range keys {
+		if e, ok := k.db.Get(key); ok {
+			out[key] = toEntry(e)
+		} else if g, ok := k.graves.Get(key); ok {
+			out[key] = g
+		}
+	}
+	return out
+}
+
+// staleKeys returns the keys, in order, whose versions are older than the client's
+// payload or another version in the cut depends on
+func staleKeys(keys []string, cut map[string]Entry, payload VectorClock, now time.Time) []string {
+	need := payload.Copy()
+	for _, e := range cut {
+		if live(&e, now) {
+			need = need.Merge(e.Clock)
+		}
+	}
+	var stale []string
+	for _, key := range keys {
+		if cut[key].Version < need[key] {
+			stale = append(stale, key)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// mgetRequest is the body of a multi-key read
+type mgetRequest struct {
+	Keys    []string    `json:"keys"`
+	Payload VectorClock `json:"payload"`
+}
+
+// parseMget reads the body of a multi-key read
+func parseMget(body []byte) ([]string, VectorClock, error) {
+	var req mgetRequest
+	var err error
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &req.Keys)
+	} else {
+		err = json.Unmarshal(body, &req)
+	}
+	if req.Payload == nil {
+		req.Payload = NewVectorClock()
+	}
+	if err != nil {
+		return nil, req.Payload, errors.Wrap(errInvalidRead, "Request isn't JSON")
+	}
+	if len(req.Keys) == 0 || len(req.Keys) > mgetMaxKeys {
+		return nil, req.Payload, errors.Wrapf(errInvalidRead, "A read asks for 1 to %d keys", mgetMaxKeys)
+	}
+	seen := make(map[string]bool)
+	var keys []string
+	for _, key := range req.Keys {
+		if key == "" || len(key) > maxKey {
+			return nil, req.Payload, errors.Wrap(errInvalidRead, "Key not valid: "+key)
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, req.Payload, nil
+}
+
+// MgetHandler responds to POST requests on the /keyValue-store/_mget endpoint by
+// returning several keys as one causally consistent cut
+func (app *App) MgetHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling multi-key read")
+	w.Header().Set("Content-Type", "application/json")
+
+	var reqBody []byte
+	if r.Body != nil {
+		reqBody, _ = ioutil.ReadAll(r.Body)
+	}
+	keys, payload, err := parseMget(reqBody)
+	if err == nil {
+		err = app.sameOwners(keys)
+	}
+	if err != nil {
+		log.Println("ERROR: Rejecting read: ", err)
+		w.WriteHeader(http.StatusBadRequest) // code 400
+		body, _ := json.Marshal(map[string]interface{}{
+			"result":  "Error",
+			"msg":     errors.Cause(err).Error(),
+			"error":   err.Error(),
+			"payload": payload,
+		})
+		w.Write(body)
+		return
+	}
+
+	// Keys this node doesn't store are read from a node that does
+	r.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	if app.forward(w, r, keys[0]) {
+		return
+	}
+
+	now := time.Now()
+	cut := app.db.ReadCut(keys)
+	if stale := staleKeys(keys, cut, payload, now); len(stale) > 0 {
+		log.Println("Keys requested are out of date: ", stale)
+		w.WriteHeader(http.StatusBadRequest) // code 400
+		body, err := json.Marshal(map[string]interface{}{
+			"result":  "Error",
+			"msg":     "Payload out of date",
+			"stale":   stale,
+			"payload": payload,
+		})
+		if err != nil {
+			log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+		}
+		w.Write(body)
+		return
+	}
+
+	// The client's payload takes in the history of every value it's shown
+	values := make(map[string]string)
+	missing := []string{}
+	for _, key := range keys {
+		if e, ok := cut[key]; ok && live(&e, now) {
+			values[key] = e.Value
+			payload = payload.Merge(e.Clock)
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	w.WriteHeader(http.StatusOK) // code 200
+	body, err := json.Marshal(map[string]interface{}{
+		"result":  "Success",
+		"values":  values,
+		"missing": missing,
+		"payload": payload,
+	})
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
@@ -0,0 +1,56 @@
+// mget_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for multi-key reads
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStaleKeys(t *testing.T) {
+	k := NewKVS()
+	k.Put(keyone, valone, time.Now(), VectorClock{})
+	k.Put(keyExists, valExists, time.Now(), VectorClock{})
+	keys := []string{keyone, keyExists, keyNotExists}
+
+	cut := k.ReadCut(keys)
+	equals(t, 0, len(staleKeys(keys, cut, VectorClock{keyone: 1}, time.Now())))
+	equals(t, []string{keyNotExists, keyone}, staleKeys(keys, cut, VectorClock{keyone: 2, keyNotExists: 1}, time.Now()))
+
+	// A write made by someone who had seen a newer keyExists than we hold can't be shown with ours
+	k.Put(keyone, valtwo, time.Now(), VectorClock{keyone: 2, keyExists: 3})
+	cut = k.ReadCut(keys)
+	equals(t, []string{keyExists}, staleKeys(keys, cut, VectorClock{}, time.Now()))
+}
+
+func TestMgetHandler(t *testing.T) {
+	app := &App{db: NewKVS(), view: *NewView(testMain, testMain)}
+	app.db.Put(keyone, valone, time.Now(), VectorClock{keyone: 1})
+	app.db.Put(keyExists, valExists, time.Now(), VectorClock{keyExists: 1, "other": 2})
+
+	code, got := appRequest(t, app, http.MethodPost, rootURL+mget, `["`+keyone+`", "`+keyExists+`", "`+keyNotExists+`"]`, nil)
+	equals(t, http.StatusOK, code)
+	equals(t, map[string]interface{}{keyone: valone, keyExists: valExists}, got["values"])
+	equals(t, []interface{}{keyNotExists}, got["missing"])
+	equals(t, map[string]interface{}{keyone: float64(1), keyExists: float64(1), "other": float64(2)}, got["payload"])
+
+	code, got = appRequest(t, app, http.MethodPost, rootURL+mget, `{"keys": ["`+keyone+`", "`+keyExists+`"], "payload": {"`+keyExists+`": 4}}`, nil)
+	equals(t, http.StatusBadRequest, code)
+	equals(t, "Payload out of date", got["msg"])
+	equals(t, []interface{}{keyExists}, got["stale"])
+	assert(t, got["values"] == nil, "Values returned from a torn read")
+
+	code, got = appRequest(t, app, http.MethodPost, rootURL+mget, `{"keys": []}`, nil)
+	equals(t, http.StatusBadRequest, code)
+	equals(t, "Invalid read", got["msg"])
+}
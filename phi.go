@@ -0,0 +1,201 @@
+// phi.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines a phi-accrual failure detector. Rather than calling a peer up or down, it
+// keeps a window of the gaps between the times we've heard from each peer, through
+// failure detector acks and gossip replies, and turns the time since the last one into
+// a suspicion level phi. A phi of 1 means there's about a 10% chance we'd have heard
+// from the peer by now if it were fine, a phi of 2 about 1%, and so on. Because the
+// window adapts to how regular each peer usually is, a slow or jittery link raises its
+// own bar instead of flapping between up and down.
+//
+
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	phiWindowSize = 100                    // Gaps remembered per peer
+	phiMinStdDev  = 100 * time.Millisecond // Floor on the spread, so a very regular peer isn't suspected after one late beat
+	phiMax        = 1000                   // Cap on phi, which would otherwise reach infinity and couldn't be reported
+)
+
+// phiStats describes what the detector knows about a peer
+type phiStats struct {
+	Phi     float64 `json:"phi"`      // Current suspicion level
+	Suspect bool    `json:"suspect"`  // Whether phi is over the threshold
+	Samples int     `json:"samples"`  // Gaps in the window
+	Mean    float64 `json:"mean_ms"`  // Average gap
+	Last    float64 `json:"last_ago"` // Seconds since we last heard from the peer
+}
+
+// phiWindow holds the recent gaps between heartbeats from one peer
+type phiWindow struct {
+	gaps  []float64 // In milliseconds, oldest first
+	last  time.Time
+	sum   float64
+	sumSq float64
+}
+
+// PhiDetector estimates how likely it is that each peer has failed
+type PhiDetector struct {
+	threshold float64
+	peers     map[string]*phiWindow
+	mutex     sync.Mutex
+}
+
+// NewPhiDetector creates a detector which suspects peers once phi reaches threshold
+func NewPhiDetector(threshold float64) *PhiDetector {
+	return &PhiDetector{threshold: threshold, peers: make(map[string]*phiWindow)}
+}
+
+// Heartbeat records that we heard from a peer at the given time
+func (d *PhiDetector) Heartbeat(peer string, now time.Time) {
+	if d == nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	w, ok := d.peers[peer]
+	if !ok {
+		d.peers[peer] = &phiWindow{last: now}
+		return
+	}
+	gap := float64(now.Sub(w.last)) / float64(time.Millisecond)
+	if gap <= 0 {
+		return
+	}
+	w.last = now
+	w.gaps = append(w.gaps, gap)
+	w.sum += gap
+	w.sumSq += gap * gap
+	if len(w.gaps) > phiWindowSize {
+		old := w.gaps[0]
+		w.gaps = w.gaps[1:]
+		w.sum -= old
+		w.sumSq -= old * old
+	}
+}
+
+// phi works out the suspicion level of a window at the given time
+func (w *phiWindow) phi(now time.Time) float64 {
+	if len(w.gaps) == 0 {
+		// Nothing to compare against yet
+		return 0
+	}
+	n := float64(len(w.gaps))
+	mean := w.sum / n
+	stdDev := math.Sqrt(math.Max(w.sumSq/n-mean*mean, 0))
+	stdDev = math.Max(stdDev, float64(phiMinStdDev)/float64(time.Millisecond))
+
+	// The chance of a gap at least this long, using the logistic approximation of the
+	// normal distribution's tail
+	since := float64(now.Sub(w.last)) / float64(time.Millisecond)
+	y := (since - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if since > mean {
+		return math.Min(-math.Log10(e/(1+e)), phiMax)
+	}
+	return math.Min(-math.Log10(1-1/(1+e)), phiMax)
+}
+
+// Phi returns a peer's suspicion level at the given time. A peer we've not heard from
+// enough to judge has a phi of 0.
+func (d *PhiDetector) Phi(peer string, now time.Time) float64 {
+	if d == nil {
+		return 0
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	w, ok := d.peers[peer]
+	if !ok {
+		return 0
+	}
+	return w.phi(now)
+}
+
+// Suspect returns true if a peer's phi has reached the threshold
+func (d *PhiDetector) Suspect(peer string) bool {
+	if d == nil {
+		return false
+	}
+	return d.Phi(peer, time.Now()) >= d.threshold
+}
+
+// Healthy returns up to n of the peers which aren't suspected, in the order given. If
+// every peer is suspected it returns the least suspicious one, so there is always
+// somebody to try.
+func (d *PhiDetector) Healthy(peers []string, n int) []string {
+	if d == nil {
+		if len(peers) > n {
+			return peers[:n]
+		}
+		return peers
+	}
+	var healthy []string
+	for _, p := range peers {
+		if len(healthy) == n {
+			break
+		}
+		if !d.Suspect(p) {
+			healthy = append(healthy, p)
+		}
+	}
+	if len(healthy) == 0 && len(peers) > 0 && n > 0 {
+		healthy = d.Rank(peers)[:1]
+	}
+	return healthy
+}
+
+// Rank returns the peers sorted from least to most suspicious. Peers with the same phi
+// keep their order.
+func (d *PhiDetector) Rank(peers []string) []string {
+	ranked := append([]string(nil), peers...)
+	if d == nil {
+		return ranked
+	}
+	now := time.Now()
+	phis := make(map[string]float64, len(peers))
+	for _, p := range peers {
+		phis[p] = d.Phi(p, now)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return phis[ranked[i]] < phis[ranked[j]]
+	})
+	return ranked
+}
+
+// Stats reports the suspicion level of every peer we've heard from
+func (d *PhiDetector) Stats() map[string]phiStats {
+	stats := make(map[string]phiStats)
+	if d == nil {
+		return stats
+	}
+	now := time.Now()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for peer, w := range d.peers {
+		s := phiStats{
+			Phi:     w.phi(now),
+			Samples: len(w.gaps),
+			Last:    now.Sub(w.last).Seconds(),
+		}
+		if s.Samples > 0 {
+			s.Mean = w.sum / float64(s.Samples)
+		}
+		s.Suspect = s.Phi >= d.threshold
+		stats[peer] = s
+	}
+	return stats
+}
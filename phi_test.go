@@ -0,0 +1,92 @@
+// phi_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for the phi-accrual failure detector
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Feeds a detector n heartbeats from peer, one every gap, ending at the returned time
+func beat(d *PhiDetector, peer string, n int, gap time.Duration) time.Time {
+	t := time.Now().Add(-time.Duration(n) * gap)
+	for i := 0; i < n; i++ {
+		d.Heartbeat(peer, t)
+		t = t.Add(gap)
+	}
+	return t.Add(-gap)
+}
+
+func TestPhiRisesWithSilence(t *testing.T) {
+	d := NewPhiDetector(defaultPhiThreshold)
+	last := beat(d, viewExist, 20, time.Second)
+
+	onTime := d.Phi(viewExist, last.Add(time.Second))
+	late := d.Phi(viewExist, last.Add(3*time.Second))
+	gone := d.Phi(viewExist, last.Add(time.Minute))
+	assert(t, onTime < 1, "Peer on schedule has phi %v", onTime)
+	assert(t, late > onTime, "Phi didn't rise as the peer went quiet")
+	assert(t, gone >= defaultPhiThreshold, "Silent peer only has phi %v", gone)
+}
+
+func TestPhiToleratesJitteryPeers(t *testing.T) {
+	d := NewPhiDetector(defaultPhiThreshold)
+	// Gaps swinging between half a second and three seconds
+	ts := time.Now().Add(-time.Minute)
+	for i := 0; i < 30; i++ {
+		d.Heartbeat(viewExist, ts)
+		ts = ts.Add(time.Duration(500+2500*(i%2)) * time.Millisecond)
+	}
+	regular := NewPhiDetector(defaultPhiThreshold)
+	last := beat(regular, viewExist, 30, 1750*time.Millisecond)
+
+	// The same silence worries us far less about the jittery peer
+	jittery := d.Phi(viewExist, ts.Add(4*time.Second))
+	steady := regular.Phi(viewExist, last.Add(4*time.Second+250*time.Millisecond))
+	assert(t, jittery < steady, "Jittery peer (%v) judged more harshly than steady one (%v)", jittery, steady)
+	assert(t, jittery < defaultPhiThreshold, "Jittery peer suspected with phi %v", jittery)
+}
+
+func TestPhiHealthySkipsSuspects(t *testing.T) {
+	d := NewPhiDetector(defaultPhiThreshold)
+	// A peer which used to answer every 10ms and has been quiet for a second
+	ts := time.Now().Add(-time.Second)
+	for i := 0; i < 20; i++ {
+		d.Heartbeat(viewExist, ts.Add(time.Duration(i-20)*10*time.Millisecond))
+	}
+
+	peers := []string{viewExist, viewNotExist}
+	equals(t, []string{viewNotExist}, d.Healthy(peers, 2))
+	equals(t, []string{viewNotExist, viewExist}, d.Rank(peers))
+
+	// With nobody else to pick, the suspect is still tried
+	equals(t, []string{viewExist}, d.Healthy([]string{viewExist}, 2))
+}
+
+func TestPhiHandlerReportsPeers(t *testing.T) {
+	d := NewPhiDetector(defaultPhiThreshold)
+	beat(d, viewExist, 5, time.Second)
+	app := App{db: &testKVS, view: *NewView(testMain, testView), phi: d}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, admin+"/phi", nil)
+	ok(t, err)
+	app.PhiHandler(recorder, req)
+
+	var gotBody map[string]phiStats
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	equals(t, 4, gotBody[viewExist].Samples)
+	equals(t, 1000.0, gotBody[viewExist].Mean)
+}
@@ -0,0 +1,281 @@
+// quorum.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines the coordinator for quorum reads and writes. Normally a write only lands in
+// the local KVS and reaches the other replicas by gossip. A client can ask for more by
+// sending W (or R) with the request, in which case the node handling it sends the
+// entry to every other replica of the key over TCP and waits until W of them, itself
+// included, have it. Reads work the same way, and the replies are merged using the
+// same conflict resolution gossip uses, so the client sees the newest version any of
+// the R replicas knows about.
+//
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errQuorumTimeout is returned when the replicas are too slow to answer
+var errQuorumTimeout = errors.New("Timed out waiting for replicas")
+
+// Quorum coordinates reads and writes which have to reach more than one replica
+type Quorum struct {
+	view    View
+	ring    *Ring         // Which nodes store each key, nil means every node
+	r       int           // Replies needed for a read when the client doesn't say
+	w       int           // Acks needed for a write when the client doesn't say
+	timeout time.Duration // How long to wait for the replicas
+	hints   *HintStore    // Where writes for unreachable replicas are kept
+	phi     *PhiDetector  // Orders the replicas from least to most suspicious
+	views   *ViewLog      // Gives the view epoch sent with each write, nil means 0
+
+	write func(ip string, key string, e Entry) error  // Sends an entry to a replica
+	read  func(ip string, key string) (*Entry, error) // Fetches a replica's entry, nil if it has none
+}
+
+// readReply is the result of asking one replica for a key
+type readReply struct {
+	node  string
+	entry KeyEntry
+	err   error
+}
+
+// NewQuorum creates a coordinator talking to the other replicas over the TCP endpoint.
+// Writes which don't reach a replica are left as hints for it.
+func NewQuorum(v View, ring *Ring, r int, w int, timeout time.Duration, hints *HintStore) *Quorum {
+	q := &Quorum{
+		view:    v,
+		ring:    ring,
+		r:       r,
+		w:       w,
+		timeout: timeout,
+		hints:   hints,
+		read: func(ip string, key string) (*Entry, error) {
+			return readReplica(ip, key, timeout)
+		},
+	}
+	q.write = func(ip string, key string, e Entry) error {
+		return sendReplica(ip, key, e, q.views.Epoch(), timeout)
+	}
+	return q
+}
+
+// ReadSize returns R for a request, taken from the "r" parameter if the client sent one
+func (q *Quorum) ReadSize(req *http.Request) int {
+	if q == nil {
+		return 1
+	}
+	return quorumParam(req, "r", q.r)
+}
+
+// WriteSize returns W for a request, taken from the "w" parameter if the client sent one
+func (q *Quorum) WriteSize(req *http.Request) int {
+	if q == nil {
+		return 1
+	}
+	return quorumParam(req, "w", q.w)
+}
+
+// ReadRepair returns false if the client turned read repair off with "repair=false"
+func (q *Quorum) ReadRepair(req *http.Request) bool {
+	s := req.URL.Query().Get("repair")
+	if s == "" {
+		return true
+	}
+	repair, err := strconv.ParseBool(s)
+	if err != nil {
+		log.Println("Ignoring invalid repair=" + s)
+		return true
+	}
+	return repair
+}
+
+// quorumParam reads a quorum size out of the request's query string
+func quorumParam(req *http.Request, name string, def int) int {
+	s := req.URL.Query().Get(name)
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		log.Println("Ignoring invalid quorum size " + name + "=" + s)
+		return def
+	}
+	return n
+}
+
+// replicas returns the other nodes which store the key, the least suspicious first
+func (q *Quorum) replicas(key string) []string {
+	nodes := q.view.List()
+	if q.ring != nil {
+		nodes = q.ring.PreferenceList(key)
+	}
+	me := q.view.Primary()
+	var peers []string
+	for _, n := range nodes {
+		if n != me {
+			peers = append(peers, n)
+		}
+	}
+	return q.phi.Rank(peers)
+}
+
+// Write sends an entry this node has already stored to the key's other replicas, and
+// waits until w nodes, counting this one, have acknowledged it. It returns the number
+// of acks and an error if there weren't enough of them.
+func (q *Quorum) Write(key string, e Entry, w int) (int, error) {
+	acks := 1
+	if w <= acks {
+		return acks, nil
+	}
+
+	peers := q.replicas(key)
+	results := make(chan error, len(peers))
+	for _, p := range peers {
+		go func(p string) {
+			err := q.write(p, key, e)
+			if err != nil {
+				// Hand the write off to the peer once it's back
+				herr := q.hints.Add(p, key, e)
+				if herr != nil {
+					log.Println("Error storing hint: ", herr)
+				}
+			}
+			results <- err
+		}(p)
+	}
+
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	for replied := 0; replied < len(peers) && acks < w; replied++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				log.Println("Replica write failed: ", err)
+				continue
+			}
+			acks++
+		case <-timer.C:
+			return acks, errors.Wrapf(errQuorumTimeout, "%d of %d acks", acks, w)
+		}
+	}
+	if acks < w {
+		return acks, errors.Errorf("Only %d of %d replicas acknowledged the write", acks, w)
+	}
+	return acks, nil
+}
+
+// Read asks the key's other replicas for their entry and waits until r nodes, counting
+// this one, have answered. It returns the newest entry among the replies and the local
+// one, or nil if nobody has the key, along with the number of replies. With repair set,
+// any replica which answered with an older version is sent the newest in the background.
+// The local entry is left for the caller to repair.
+func (q *Quorum) Read(key string, local KeyEntry, r int, repair bool) (KeyEntry, int, error) {
+	merged := local
+	replies := 1
+	if r <= replies {
+		return merged, replies, nil
+	}
+
+	peers := q.replicas(key)
+	results := make(chan readReply, len(peers))
+	for _, p := range peers {
+		go func(p string) {
+			e, err := q.read(p, key)
+			reply := readReply{node: p, err: err}
+			// Keep the interface nil when the replica has no entry
+			if e != nil {
+				reply.entry = e
+			}
+			results <- reply
+		}(p)
+	}
+
+	seen := []readReply{{node: q.view.Primary(), entry: local}}
+	defer func() {
+		q.repair(key, merged, seen, repair)
+	}()
+
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	for replied := 0; replied < len(peers) && replies < r; replied++ {
+		select {
+		case reply := <-results:
+			if reply.err != nil {
+				log.Println("Replica read failed: ", reply.err)
+				continue
+			}
+			replies++
+			seen = append(seen, reply)
+			// Keep whichever version wins, exactly as gossip would decide it
+			if reply.entry != nil {
+				merged, _ = mergeVersions(reply.entry, merged)
+			}
+		case <-timer.C:
+			return merged, replies, errors.Wrapf(errQuorumTimeout, "%d of %d replies", replies, r)
+		}
+	}
+	if replies < r {
+		return merged, replies, errors.Errorf("Only %d of %d replicas answered the read", replies, r)
+	}
+	return merged, replies, nil
+}
+
+// older returns true if a replica's reply is strictly older than the winning version. A
+// replica holding a version concurrent with the winner is left for gossip to settle,
+// which resolves the conflict on its side rather than having it overwritten.
+func older(reply KeyEntry, winner KeyEntry) bool {
+	return reply == nil || compareVersions(winner, reply) == ClockAfter
+}
+
+// repair counts the replicas which answered a read with an older version than the
+// winner, and unless repair is off, pushes the winner to the remote ones in the background
+func (q *Quorum) repair(key string, winner KeyEntry, seen []readReply, repair bool) {
+	if winner == nil {
+		return
+	}
+	me := q.view.Primary()
+	var stale []string
+	for _, reply := range seen {
+		if older(reply.entry, winner) {
+			stale = append(stale, reply.node)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	metrics.Inc(metricReadDivergence)
+	metrics.Add(metricStaleReplicas, int64(len(stale)))
+	if !repair {
+		return
+	}
+
+	e := toEntry(winner)
+	for _, node := range stale {
+		if node == me {
+			continue
+		}
+		go func(node string) {
+			log.Println("Read repair of key " + key + " on " + node)
+			err := q.write(node, key, e)
+			if err != nil {
+				log.Println("Read repair failed: ", err)
+				metrics.Inc(metricRepairsFailed)
+				return
+			}
+			metrics.Inc(metricRepairsSent)
+		}(node)
+	}
+}
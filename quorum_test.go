@@ -0,0 +1,202 @@
+// quorum_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for the quorum coordinator
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Builds a coordinator over the test view whose replicas are answered by the given stubs
+func stubQuorum(write func(string, string, Entry) error, read func(string, string) (*Entry, error)) *Quorum {
+	q := NewQuorum(NewView(testMain, testView), nil, 1, 1, 100*time.Millisecond, nil)
+	q.write = write
+	q.read = read
+	return q
+}
+
+func TestQuorumWriteWaitsForAcks(t *testing.T) {
+	sent := make(chan string, 2)
+	q := stubQuorum(func(ip string, key string, e Entry) error {
+		sent <- ip
+		return nil
+	}, nil)
+
+	acks, err := q.Write(keyone, Entry{Value: valone}, 3)
+	ok(t, err)
+	equals(t, 3, acks)
+	for i := 0; i < 2; i++ {
+		ip := <-sent
+		assert(t, ip != testMain, "Coordinator sent the write to itself")
+	}
+}
+
+func TestQuorumWriteTooFewAcks(t *testing.T) {
+	q := stubQuorum(func(ip string, key string, e Entry) error {
+		if ip == viewExist {
+			return nil
+		}
+		return errors.New("Replica down")
+	}, nil)
+
+	acks, err := q.Write(keyone, Entry{Value: valone}, 3)
+	assert(t, err != nil, "Write succeeded without a quorum")
+	assert(t, errors.Cause(err) != errQuorumTimeout, "Failed replicas reported as a timeout")
+	equals(t, 2, acks)
+}
+
+func TestQuorumWriteTimesOut(t *testing.T) {
+	q := stubQuorum(func(ip string, key string, e Entry) error {
+		time.Sleep(time.Second)
+		return nil
+	}, nil)
+
+	acks, err := q.Write(keyone, Entry{Value: valone}, 2)
+	equals(t, errQuorumTimeout, errors.Cause(err))
+	equals(t, 1, acks)
+}
+
+func TestQuorumReadReturnsNewestVersion(t *testing.T) {
+	now := time.Now()
+	local := &Entry{Value: valone, Version: 1, Timestamp: now, Clock: VectorClock{keyone: 1}}
+	q := stubQuorum(nil, func(ip string, key string) (*Entry, error) {
+		if ip == viewExist {
+			return &Entry{Value: valtwo, Version: 2, Timestamp: now, Clock: VectorClock{keyone: 2}}, nil
+		}
+		return nil, nil
+	})
+
+	merged, replies, err := q.Read(keyone, local, 3, false)
+	ok(t, err)
+	equals(t, 3, replies)
+	equals(t, valtwo, merged.GetValue())
+	equals(t, 2, merged.GetVersion())
+}
+
+func TestQuorumReadOfMissingKey(t *testing.T) {
+	q := stubQuorum(nil, func(ip string, key string) (*Entry, error) {
+		return nil, nil
+	})
+
+	merged, replies, err := q.Read(keyone, nil, 2, true)
+	ok(t, err)
+	equals(t, 2, replies)
+	assert(t, merged == nil, "Read found a key nobody has")
+}
+
+func TestGetHandlerQuorumNotReached(t *testing.T) {
+	testKVS = TestKVS{dbKey: keyExists, dbVal: valExists, dbClock: VectorClock{keyExists: 1}, dbVersion: 1}
+	q := stubQuorum(nil, func(ip string, key string) (*Entry, error) {
+		return nil, errors.New("Replica down")
+	})
+	app := App{db: &testKVS, view: *NewView(testMain, testView), quorum: q}
+
+	router := mux.NewRouter()
+	router.HandleFunc(rootURL+keySuffix, app.GetHandler).Methods(http.MethodGet)
+
+	req, err := http.NewRequest(http.MethodGet, rootURL+"/"+keyExists+"?r=2", nil)
+	ok(t, err)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+
+	equals(t, http.StatusServiceUnavailable, recorder.Code)
+	var gotBody map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	equals(t, "Error", gotBody["result"])
+	equals(t, map[string]interface{}{}, gotBody["payload"])
+}
+
+// Builds a coordinator whose replica at viewExist holds an old version of keyone and
+// whose other replica doesn't have it at all. Repairs are sent down the returned channel.
+func staleQuorum(now time.Time) (*Quorum, chan string) {
+	repaired := make(chan string, 2)
+	q := stubQuorum(func(ip string, key string, e Entry) error {
+		repaired <- ip
+		return nil
+	}, func(ip string, key string) (*Entry, error) {
+		if ip == viewExist {
+			return &Entry{Value: valone, Version: 1, Timestamp: now, Clock: VectorClock{keyone: 1}}, nil
+		}
+		return nil, nil
+	})
+	return q, repaired
+}
+
+func TestQuorumReadRepairsStaleReplicas(t *testing.T) {
+	now := time.Now()
+	local := &Entry{Value: valtwo, Version: 2, Timestamp: now, Clock: VectorClock{keyone: 2}}
+	q, repaired := staleQuorum(now)
+	divergence := metrics.Get(metricReadDivergence)
+
+	merged, _, err := q.Read(keyone, local, 3, true)
+	ok(t, err)
+	equals(t, valtwo, merged.GetValue())
+
+	// Both other replicas are behind, one with an old version and one with none
+	got := map[string]bool{<-repaired: true, <-repaired: true}
+	equals(t, 2, len(got))
+	assert(t, got[viewExist], "Stale replica wasn't repaired")
+	assert(t, !got[testMain], "Coordinator sent a repair to itself")
+	equals(t, divergence+1, metrics.Get(metricReadDivergence))
+}
+
+func TestQuorumReadRepairCanBeTurnedOff(t *testing.T) {
+	now := time.Now()
+	local := &Entry{Value: valtwo, Version: 2, Timestamp: now, Clock: VectorClock{keyone: 2}}
+	q, repaired := staleQuorum(now)
+	stale := metrics.Get(metricStaleReplicas)
+
+	_, _, err := q.Read(keyone, local, 3, false)
+	ok(t, err)
+	equals(t, stale+2, metrics.Get(metricStaleReplicas))
+	select {
+	case ip := <-repaired:
+		t.Fatalf("Repair sent to %s with read repair off", ip)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	req, err := http.NewRequest(http.MethodGet, rootURL+"/"+keyone+"?repair=false", nil)
+	ok(t, err)
+	assert(t, !q.ReadRepair(req), "repair=false didn't turn read repair off")
+}
+
+func TestQuorumReadOnlyRepairsOlderReplicas(t *testing.T) {
+	now := time.Now()
+	local := &Entry{Value: valtwo, Version: 2, Timestamp: now, Clock: VectorClock{keyone: 2}}
+	repaired := make(chan string, 2)
+	q := stubQuorum(func(ip string, key string, e Entry) error {
+		repaired <- ip
+		return nil
+	}, func(ip string, key string) (*Entry, error) {
+		if ip == viewExist {
+			// Concurrent with ours, and older by its timestamp
+			return &Entry{Value: valone, Version: 1, Timestamp: now.Add(-time.Second), Clock: VectorClock{keyExists: 1}}, nil
+		}
+		return nil, nil
+	})
+
+	merged, _, err := q.Read(keyone, local, 3, true)
+	ok(t, err)
+	equals(t, valtwo, merged.GetValue())
+	assert(t, <-repaired != viewExist, "Replica with a concurrent version was overwritten")
+	select {
+	case ip := <-repaired:
+		t.Fatalf("Repair sent to %s with a concurrent version", ip)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,300 @@
+// rebalance.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines the rebalancer, which moves data when the view changes instead of waiting for
+// gossip to come across it. Whenever the member list changes, each node works out which
+// of its keys now belong to a node that didn't store them before and streams them there
+// in batches, walking the ring in order. While every node stores every key that's the
+// whole data set going to each new member. When the ring partitions the keys it's only
+// the ranges that changed hands, which also covers the keys a removed node was holding,
+// since the nodes still holding copies push them to whoever took over.
+//
+// A member being sent its share for the first time is joining until the transfer has
+// caught up. Transfers to a member which leaves the view are dropped.
+//
+
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rebalanceInterval = 250 * time.Millisecond // How often the view is checked for changes
+	rebalanceBatch    = 500                    // Keys sent in one message
+	rebalanceRetry    = time.Second            // Pause before resending a batch which failed
+)
+
+// transferStats describes the progress of a transfer to one member
+type transferStats struct {
+	Keys      int       `json:"keys"`       // Keys to send
+	Sent      int       `json:"sent"`       // Keys sent so far
+	Joining   bool      `json:"joining"`    // The member is new to the view
+	Done      bool      `json:"done"`       // Every key has been sent
+	Failures  int       `json:"failures"`   // Batches which had to be resent
+	LastError string    `json:"last_error"` // Why the last failed batch failed
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+}
+
+// A transfer is the keys waiting to be streamed to one member
+type transfer struct {
+	target string
+	keys   []string // Left to send, in ring order
+	stats  transferStats
+}
+
+// Rebalancer moves keys to their new owners when the view changes
+type Rebalancer struct {
+	me        string
+	view      View
+	ring      *Ring // nil means every node stores every key
+	kvs       dbAccess
+	members   []string // The sorted member list we last rebalanced for
+	transfers map[string]*transfer
+	views     *ViewLog // Gives the view epoch sent with each batch, nil means 0
+	mutex     sync.Mutex
+
+	send func(ip string, eg entryGlob) error // Delivers a batch and waits for it to be applied
+}
+
+// NewRebalancer creates a rebalancer for our keys, starting from the current view
+func NewRebalancer(v View, ring *Ring, kvs dbAccess, timeout time.Duration) *Rebalancer {
+	return &Rebalancer{
+		me:        v.Primary(),
+		view:      v,
+		ring:      ring,
+		kvs:       kvs,
+		members:   sortedMembers(v.List()),
+		transfers: make(map[string]*transfer),
+		send: func(ip string, eg entryGlob) error {
+			return sendTransfer(ip, eg, timeout)
+		},
+	}
+}
+
+// Run checks for view changes forever
+func (r *Rebalancer) Run() {
+	for {
+		time.Sleep(rebalanceInterval)
+		r.check()
+	}
+}
+
+// check starts transfers for the keys which moved if the member list has changed since
+// the last time it was called
+func (r *Rebalancer) check() {
+	members := sortedMembers(r.view.List())
+	r.mutex.Lock()
+	old := r.members
+	r.members = members
+	r.mutex.Unlock()
+	if strings.Join(old, ",") == strings.Join(members, ",") {
+		return
+	}
+	log.Println("View changed from", old, "to", members, "- rebalancing")
+
+	joined := make(map[string]bool)
+	for _, m := range members {
+		joined[m] = true
+	}
+	for _, m := range old {
+		delete(joined, m)
+	}
+	for target, keys := range r.plan(old, members) {
+		r.start(target, keys, joined[target])
+	}
+}
+
+// staticRing builds a ring like ours over a fixed member list, or returns nil if keys
+// aren't partitioned
+func (r *Rebalancer) staticRing(members []string) *Ring {
+	if r.ring == nil {
+		return nil
+	}
+	return NewRing(NewView(r.me, strings.Join(members, ",")), r.ring.vnodes, r.ring.replicas)
+}
+
+// plan works out which of our keys each member needs after the view went from old to
+// members. A member needs a key if it's a replica of the key now but wasn't before.
+func (r *Rebalancer) plan(old []string, members []string) map[string][]string {
+	before := r.staticRing(old)
+	after := r.staticRing(members)
+	wasMember := make(map[string]bool)
+	for _, m := range old {
+		wasMember[m] = true
+	}
+
+	plan := make(map[string][]string)
+	for key := range r.kvs.GetTimeGlob().List {
+		var owners []string
+		if after == nil {
+			owners = members
+		} else {
+			owners = after.PreferenceList(key)
+		}
+		for _, node := range owners {
+			if node == r.me {
+				continue
+			}
+			if after == nil && wasMember[node] {
+				// With full replication an existing member already has everything
+				continue
+			}
+			if after != nil && before.Owns(node, key) {
+				continue
+			}
+			plan[node] = append(plan[node], key)
+		}
+	}
+	return plan
+}
+
+// inRingOrder sorts keys by their position on the ring, so a transfer sweeps through
+// each range in turn
+func inRingOrder(keys []string) {
+	sort.Slice(keys, func(i, j int) bool {
+		hi, hj := ringHash(keys[i]), ringHash(keys[j])
+		if hi != hj {
+			return hi < hj
+		}
+		return keys[i] < keys[j]
+	})
+}
+
+// start begins streaming keys to a member. If a transfer to it is already under way,
+// the keys it hasn't sent yet are folded into the new one.
+func (r *Rebalancer) start(target string, keys []string, joining bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	t := &transfer{target: target, stats: transferStats{Joining: joining, Started: time.Now()}}
+	if prev, ok := r.transfers[target]; ok && !prev.stats.Done {
+		seen := make(map[string]bool, len(keys))
+		for _, k := range keys {
+			seen[k] = true
+		}
+		for _, k := range prev.keys {
+			if !seen[k] {
+				keys = append(keys, k)
+			}
+		}
+		t.stats.Joining = t.stats.Joining || prev.stats.Joining
+	}
+	inRingOrder(keys)
+	t.keys = keys
+	t.stats.Keys = len(keys)
+	r.transfers[target] = t
+	log.Println("Streaming", len(keys), "keys to", target)
+	go r.stream(t)
+}
+
+// stream sends a transfer's keys a batch at a time until they're all through, the
+// transfer is replaced by a newer one, or the target leaves the view
+func (r *Rebalancer) stream(t *transfer) {
+	for {
+		r.mutex.Lock()
+		if r.transfers[t.target] != t {
+			r.mutex.Unlock()
+			return
+		}
+		if len(t.keys) == 0 {
+			t.stats.Done = true
+			t.stats.Finished = time.Now()
+			r.mutex.Unlock()
+			log.Println("Finished streaming", t.stats.Sent, "keys to", t.target)
+			return
+		}
+		n := rebalanceBatch
+		if n > len(t.keys) {
+			n = len(t.keys)
+		}
+		batch := t.keys[:n]
+		r.mutex.Unlock()
+
+		if !r.view.Contains(t.target) {
+			log.Println("Dropping transfer to " + t.target + ", which has left the view")
+			r.mutex.Lock()
+			if r.transfers[t.target] == t {
+				delete(r.transfers, t.target)
+			}
+			r.mutex.Unlock()
+			return
+		}
+
+		tg := timeGlob{List: make(map[string]time.Time, n)}
+		for _, k := range batch {
+			tg.List[k] = time.Time{}
+		}
+		eg := r.kvs.GetEntryGlob(tg)
+		eg.Epoch = r.views.Epoch()
+		err := r.send(t.target, eg)
+
+		r.mutex.Lock()
+		if err != nil {
+			t.stats.Failures++
+			t.stats.LastError = err.Error()
+			r.mutex.Unlock()
+			log.Println("Error streaming keys to "+t.target+": ", err)
+			time.Sleep(rebalanceRetry)
+			continue
+		}
+		t.keys = t.keys[n:]
+		t.stats.Sent += n
+		r.mutex.Unlock()
+		metrics.Add(metricRebalanceKeys, int64(n))
+	}
+}
+
+// Joining returns true if a member is new to the view and we're still sending it its share
+func (r *Rebalancer) Joining(addr string) bool {
+	if r == nil {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	t, ok := r.transfers[addr]
+	return ok && t.stats.Joining && !t.stats.Done
+}
+
+// Streaming returns every member which is new to the view and still being sent its
+// share by us. The failure detector spreads this so the whole view can see who's joining.
+func (r *Rebalancer) Streaming() []string {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var out []string
+	for target, t := range r.transfers {
+		if t.stats.Joining && !t.stats.Done {
+			out = append(out, target)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Stats reports the progress of the transfer to each member
+func (r *Rebalancer) Stats() map[string]transferStats {
+	stats := make(map[string]transferStats)
+	if r == nil {
+		return stats
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for target, t := range r.transfers {
+		stats[target] = t.stats
+	}
+	return stats
+}
@@ -0,0 +1,142 @@
+// rebalance_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for rebalancing after view changes
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Creates a rebalancer over a KVS of n keys whose batches are passed to deliver
+func testRebalancer(v View, ring *Ring, n int, deliver func(ip string, eg entryGlob) error) (*Rebalancer, *KVS) {
+	k := filledKVS(n, time.Now())
+	r := NewRebalancer(v, ring, k, time.Second)
+	r.send = deliver
+	return r, k
+}
+
+// Waits for the transfer to a member to finish and returns its progress
+func waitForTransfer(t *testing.T, r *Rebalancer, target string) transferStats {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if s, ok := r.Stats()[target]; ok && s.Done {
+			return s
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Transfer to " + target + " never finished")
+	return transferStats{}
+}
+
+func TestRebalanceSendsEverythingToJoinerWithFullReplication(t *testing.T) {
+	v := NewView(testMain, testMain+","+viewExist)
+	var mutex sync.Mutex
+	got := make(map[string]int)
+	r, _ := testRebalancer(v, nil, 1200, func(ip string, eg entryGlob) error {
+		mutex.Lock()
+		got[ip] += len(eg.Keys)
+		mutex.Unlock()
+		return nil
+	})
+
+	v.Add(viewNotExist)
+	r.check()
+	s := waitForTransfer(t, r, viewNotExist)
+	equals(t, 1200, s.Keys)
+	equals(t, 1200, s.Sent)
+	assert(t, s.Joining, "New member wasn't marked as joining")
+	assert(t, !r.Joining(viewNotExist), "Member still joining after its transfer finished")
+
+	// The member which was already there has everything
+	mutex.Lock()
+	defer mutex.Unlock()
+	equals(t, map[string]int{viewNotExist: 1200}, got)
+}
+
+func TestRebalanceSendsOnlyMovedRangesWithRing(t *testing.T) {
+	v := NewView(testMain, testMain+","+viewExist+","+viewNotExist)
+	ring := NewRing(v, 16, 2)
+	r, k := testRebalancer(v, ring, 500, func(string, entryGlob) error { return nil })
+
+	newNode := "10.0.0.9:8080"
+	old := sortedMembers(v.List())
+	v.Add(newNode)
+	plan := r.plan(old, sortedMembers(v.List()))
+
+	before := NewRing(NewView(testMain, testMain+","+viewExist+","+viewNotExist), 16, 2)
+	for target, keys := range plan {
+		assert(t, target != testMain, "Planned a transfer to ourselves")
+		for _, key := range keys {
+			assert(t, ring.Owns(target, key), target+" was sent "+key+" which it doesn't own")
+			assert(t, !before.Owns(target, key), target+" was sent "+key+" which it already had")
+		}
+	}
+	assert(t, len(plan[newNode]) > 0, "New member was sent nothing")
+	assert(t, len(plan[newNode]) < len(k.GetTimeGlob().List), "New member was sent every key")
+}
+
+func TestRebalanceRetriesFailedBatches(t *testing.T) {
+	v := NewView(testMain, testMain)
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	calls := 0
+	r, _ := testRebalancer(v, nil, 10, func(ip string, eg entryGlob) error {
+		mutex.Lock()
+		calls++
+		first := calls == 1
+		mutex.Unlock()
+		if first {
+			<-release
+			return errors.New("Connection refused")
+		}
+		return nil
+	})
+
+	v.Add(viewExist)
+	r.check()
+	assert(t, r.Joining(viewExist), "Member being sent data isn't joining")
+	close(release)
+
+	s := waitForTransfer(t, r, viewExist)
+	equals(t, 1, s.Failures)
+	equals(t, 10, s.Sent)
+}
+
+func TestRebalanceDropsTransferToRemovedMember(t *testing.T) {
+	v := NewView(testMain, testMain)
+	r, _ := testRebalancer(v, nil, 10, func(string, entryGlob) error {
+		return errors.New("Connection refused")
+	})
+
+	v.Add(viewExist)
+	r.check()
+	v.Remove(viewExist)
+	r.check()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.Stats()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	equals(t, 0, len(r.Stats()))
+}
+
+func TestInRingOrder(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	inRingOrder(keys)
+	assert(t, sort.SliceIsSorted(keys, func(i, j int) bool {
+		return ringHash(keys[i]) < ringHash(keys[j])
+	}), "Keys aren't in ring order")
+}
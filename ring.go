@@ -0,0 +1,189 @@
+// ring.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines a consistent-hash ring which partitions the key space across the nodes in
+// the view. Each node is placed on the ring at several points (virtual nodes), and a
+// key belongs to the first N distinct nodes found walking clockwise from the key's
+// hash. Those N nodes are the key's preference list. The ring is rebuilt from the
+// View whenever the view changes.
+//
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tokenRange is an arc of the ring, running from just after Start up to and including End
+type tokenRange struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+}
+
+// Ring maps keys to the nodes which store them
+type Ring struct {
+	view     View              // The view the ring is built from
+	vnodes   int               // Points on the ring per node
+	replicas int               // N, the length of each preference list; 0 means every node
+	tokens   []uint32          // Sorted positions of every virtual node
+	owners   map[uint32]string // Which node each token belongs to
+	members  string            // The member list the ring was last built from
+	mutex    sync.RWMutex
+}
+
+// NewRing creates a ring over the given view with vnodes points per node and
+// replicas nodes in each preference list
+func NewRing(v View, vnodes int, replicas int) *Ring {
+	if vnodes < 1 {
+		vnodes = 1
+	}
+	r := &Ring{view: v, vnodes: vnodes, replicas: replicas}
+	r.refresh()
+	return r
+}
+
+// ringHash places a string on the ring
+func ringHash(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[0:4])
+}
+
+// refresh rebuilds the ring if the view has changed since it was last built
+func (r *Ring) refresh() {
+	members := r.view.List()
+	sort.Strings(members)
+	joined := strings.Join(members, ",")
+
+	r.mutex.RLock()
+	same := joined == r.members && r.owners != nil
+	r.mutex.RUnlock()
+	if same {
+		return
+	}
+
+	tokens := make([]uint32, 0, len(members)*r.vnodes)
+	owners := make(map[uint32]string, len(members)*r.vnodes)
+	for _, m := range members {
+		for i := 0; i < r.vnodes; i++ {
+			t := ringHash(m + "#" + strconv.Itoa(i))
+			// On the off chance two points collide, the first node keeps it
+			if _, taken := owners[t]; taken {
+				continue
+			}
+			owners[t] = m
+			tokens = append(tokens, t)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i] < tokens[j] })
+
+	r.mutex.Lock()
+	r.tokens = tokens
+	r.owners = owners
+	r.members = joined
+	r.mutex.Unlock()
+}
+
+// Replicas returns N, capped at the number of nodes in the view
+func (r *Ring) Replicas() int {
+	n := r.view.Count()
+	if r.replicas > 0 && r.replicas < n {
+		return r.replicas
+	}
+	return n
+}
+
+// PreferenceList returns the nodes which store a key, the first being its coordinator
+func (r *Ring) PreferenceList(key string) []string {
+	if r == nil {
+		return nil
+	}
+	r.refresh()
+	n := r.Replicas()
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if len(r.tokens) == 0 {
+		return nil
+	}
+
+	h := ringHash(key)
+	i := sort.Search(len(r.tokens), func(i int) bool { return r.tokens[i] >= h })
+	return r.walk(i, n)
+}
+
+// walk returns the first n distinct nodes clockwise from the token at i. It must be
+// called while holding the ring's lock.
+func (r *Ring) walk(i int, n int) []string {
+	var nodes []string
+	seen := make(map[string]bool)
+	for j := 0; j < len(r.tokens) && len(nodes) < n; j++ {
+		owner := r.owners[r.tokens[(i+j)%len(r.tokens)]]
+		if !seen[owner] {
+			seen[owner] = true
+			nodes = append(nodes, owner)
+		}
+	}
+	return nodes
+}
+
+// ReplicaSets returns the preference list of every arc of the ring. Each key is stored
+// by exactly one of them.
+func (r *Ring) ReplicaSets() [][]string {
+	if r == nil {
+		return nil
+	}
+	r.refresh()
+	n := r.Replicas()
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	sets := make([][]string, len(r.tokens))
+	for i := range r.tokens {
+		sets[i] = r.walk(i, n)
+	}
+	return sets
+}
+
+// Owns returns true if the node is in the key's preference list. A nil ring means
+// full replication, so every node owns every key.
+func (r *Ring) Owns(node string, key string) bool {
+	if r == nil {
+		return true
+	}
+	for _, n := range r.PreferenceList(key) {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Ranges returns the arcs of the ring each node is the coordinator for
+func (r *Ring) Ranges() map[string][]tokenRange {
+	ranges := make(map[string][]tokenRange)
+	if r == nil {
+		return ranges
+	}
+	r.refresh()
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for i, t := range r.tokens {
+		// Each token owns the arc back to the token before it, wrapping around at the start
+		prev := r.tokens[(i+len(r.tokens)-1)%len(r.tokens)]
+		owner := r.owners[t]
+		ranges[owner] = append(ranges[owner], tokenRange{Start: prev, End: t})
+	}
+	return ranges
+}
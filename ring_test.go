@@ -0,0 +1,94 @@
+// ring_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for the consistent-hash ring
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPreferenceListHasNDistinctNodes(t *testing.T) {
+	r := NewRing(NewView(testMain, testView), defaultVnodes, 2)
+	for i := 0; i < 100; i++ {
+		nodes := r.PreferenceList(fmt.Sprint("key", i))
+		equals(t, 2, len(nodes))
+		assert(t, nodes[0] != nodes[1], "Preference list repeated a node: %v", nodes)
+	}
+}
+
+func TestPreferenceListCappedAtViewSize(t *testing.T) {
+	r := NewRing(NewView(testMain, testView), defaultVnodes, 10)
+	equals(t, 3, len(r.PreferenceList(keyone)))
+	equals(t, 3, r.Replicas())
+}
+
+func TestPreferenceListIsStable(t *testing.T) {
+	a := NewRing(NewView(testMain, testView), defaultVnodes, 2)
+	b := NewRing(NewView(viewExist, testView), defaultVnodes, 2)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("key", i)
+		equals(t, a.PreferenceList(key), b.PreferenceList(key))
+	}
+}
+
+func TestOwnsSpreadsKeysAcrossNodes(t *testing.T) {
+	v := NewView(testMain, testView)
+	r := NewRing(v, defaultVnodes, 1)
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprint("key", i)
+		for _, node := range v.List() {
+			if r.Owns(node, key) {
+				counts[node]++
+			}
+		}
+	}
+	// Every key has exactly one owner, and nobody is left out
+	total := 0
+	for _, node := range v.List() {
+		assert(t, counts[node] > 500, "Node %s only owns %d keys", node, counts[node])
+		total += counts[node]
+	}
+	equals(t, 3000, total)
+}
+
+func TestRingRebuildsOnViewChange(t *testing.T) {
+	v := NewView(testMain, testView)
+	r := NewRing(v, defaultVnodes, 1)
+	v.Add(viewNotExist)
+	seen := false
+	for i := 0; i < 1000 && !seen; i++ {
+		seen = r.Owns(viewNotExist, fmt.Sprint("key", i))
+	}
+	assert(t, seen, "New node never given any keys")
+}
+
+func TestRangesCoverWholeRing(t *testing.T) {
+	r := NewRing(NewView(testMain, testView), 8, 1)
+	var total uint64
+	count := 0
+	for _, ranges := range r.Ranges() {
+		for _, tr := range ranges {
+			// The arcs wrap around, so the subtraction does too
+			total += uint64(tr.End - tr.Start)
+			count++
+		}
+	}
+	equals(t, 24, count)
+	equals(t, uint64(1)<<32, total)
+}
+
+func TestNilRingOwnsEverything(t *testing.T) {
+	var r *Ring
+	assert(t, r.Owns(testMain, keyone), "Nil ring should mean full replication")
+	assert(t, r.PreferenceList(keyone) == nil, "Nil ring returned a preference list")
+}
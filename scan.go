@@ -0,0 +1,361 @@
+// scan.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines ordered range and prefix scans. A GET on /keyValue-store itself lists the
+// live keys in order, narrowed by the query parameters:
+//
+//     prefix  only keys starting with it
+//     start   only keys from it on
+//     end     only keys before it
+//     limit   at most this many keys, defaultScanLimit if it isn't given
+//     cursor  carry on from where the last page stopped
+//
+// A page which isn't the last comes with a cursor for the next one. The storage engine
+// already keeps keys in order, so a scan is a walk over it.
+//
+// Each node only holds the keys it stores, and may be behind the others, so the scan
+// is run on every node holding part of the range and the replies are merged: the
+// winning version of each key is kept, and only then are tombstones hidden. A node
+// which filled its page may have more keys beyond its last one, so the merged page
+// stops at the smallest such key. Each returned key is checked against the client's
+// payload, and one older than the client has seen is listed as stale instead.
+//
+// A node which doesn't answer can only be done without if, for every arc of the ring it
+// stores, another replica of the arc did. Otherwise some keys in the range went unread,
+// and rather than hand back a page which quietly leaves them out the scan fails with a
+// 503 the client can retry.
+//
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultScanLimit = 100  // Keys returned by a scan which doesn't set a limit
+	maxScanLimit     = 1000 // Most keys a scan may ask for
+)
+
+var (
+	// errInvalidScan is returned for a scan with parameters which can't be read
+	errInvalidScan = errors.New("Invalid scan")
+
+	// errScanIncomplete is returned when some keys in the range are on no node which answered
+	errScanIncomplete = errors.New("Scan incomplete")
+)
+
+// scanEntry is one key found by a scan
+type scanEntry struct {
+	Key   string
+	Entry Entry
+}
+
+// scanRequest asks a node for the keys it holds in [Start, End)
+type scanRequest struct {
+	Start string
+	End   string
+	Limit int
+}
+
+// scanReply is a node's answer to a scanRequest
+type scanReply struct {
+	Entries []scanEntry
+	More    bool   // The node stopped at the limit with keys left in the range
+	node    string // The node which answered, not sent over the wire
+}
+
+// Scan returns up to limit entries, tombstones included, for the keys in [start, end)
+// in order. An empty end means there's no upper bound.
+func (k *KVS) Scan(start string, end string, limit int) ([]scanEntry, bool) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	var out []scanEntry
+	more := false
+	err := k.db.Ascend(start, end, func(key string, e KeyEntry) bool {
+		if len(out) == limit {
+			more = true
+			return false
+		}
+		out = append(out, scanEntry{Key: key, Entry: toEntry(e)})
+		return true
+	})
+	if err != nil {
+		log.Println("Error scanning storage engine: ", err)
+	}
+	return out, more
+}
+
+// prefixEnd returns the first key after every key starting with prefix, or the empty
+// string if there's none
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// successor returns the first key after key
+func successor(key string) string {
+	return key + "\x00"
+}
+
+// encodeCursor and decodeCursor turn the key a page starts at into the opaque cursor
+// given to clients and back
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", errors.Wrap(errInvalidScan, "Invalid cursor")
+	}
+	return string(b), nil
+}
+
+// scanRange reads the range and page size of a scan from its query parameters
+func scanRange(q url.Values) (scanRequest, error) {
+	req := scanRequest{Start: q.Get("start"), End: q.Get("end"), Limit: defaultScanLimit}
+	if prefix := q.Get("prefix"); prefix != "" {
+		if prefix > req.Start {
+			req.Start = prefix
+		}
+		if pe := prefixEnd(prefix); pe != "" && (req.End == "" || pe < req.End) {
+			req.End = pe
+		}
+	}
+	if cursor := q.Get("cursor"); cursor != "" {
+		key, err := decodeCursor(cursor)
+		if err != nil {
+			return req, err
+		}
+		if key > req.Start {
+			req.Start = key
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxScanLimit {
+			return req, errors.Wrapf(errInvalidScan, "Limit must be 1 to %d", maxScanLimit)
+		}
+		req.Limit = n
+	}
+	return req, nil
+}
+
+// mergeScans merges the replies from the nodes scanned. It returns the winning version
+// of each key up to the point every node has answered for, in order, and the key the
+// next page starts at, which is empty if the range is done.
+func mergeScans(replies []scanReply) ([]scanEntry, string) {
+	frontier := ""
+	best := make(map[string]Entry)
+	for _, reply := range replies {
+		if reply.More && len(reply.Entries) > 0 {
+			last := reply.Entries[len(reply.Entries)-1].Key
+			if frontier == "" || last < frontier {
+				frontier = last
+			}
+		}
+		for _, se := range reply.Entries {
+			e := se.Entry
+			if cur, ok := best[se.Key]; !ok || resolveConflict(&e, &cur) {
+				best[se.Key] = e
+			}
+		}
+	}
+	var out []scanEntry
+	for key, e := range best {
+		if frontier == "" || key <= frontier {
+			out = append(out, scanEntry{Key: key, Entry: e})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	next := ""
+	if frontier != "" {
+		next = successor(frontier)
+	}
+	return out, next
+}
+
+// scanNodes runs a scan on every node holding part of it: just this one unless the keys
+// are partitioned, and otherwise every member which answers
+func (app *App) scanNodes(req scanRequest) ([]scanReply, error) {
+	entries, more := app.db.Scan(req.Start, req.End, req.Limit)
+	replies := []scanReply{{Entries: entries, More: more}}
+	if app.ring == nil {
+		return replies, nil
+	}
+	timeout := defaultQuorumTimeout
+	if app.quorum != nil {
+		timeout = app.quorum.timeout
+	}
+	me := app.view.Primary()
+	results := make(chan scanReply)
+	errs := make(chan error)
+	peers := 0
+	for _, node := range app.view.List() {
+		if node == me {
+			continue
+		}
+		peers++
+		go func(node string) {
+			reply, err := sendScan(node, req, timeout)
+			if err != nil {
+				errs <- errors.Wrap(err, "Scanning "+node+" failed")
+				return
+			}
+			reply.node = node
+			results <- reply
+		}(node)
+	}
+	answered := map[string]bool{me: true}
+	var err error
+	for i := 0; i < peers; i++ {
+		select {
+		case reply := <-results:
+			replies = append(replies, reply)
+			answered[reply.node] = true
+		case err = <-errs:
+			log.Println("Node failed to answer scan: ", err)
+		}
+	}
+
+	// A failed node's keys are only covered if another replica of each arc it stores
+	// answered. Otherwise the page would silently leave out keys in the range.
+	for _, set := range app.ring.ReplicaSets() {
+		if !anyAnswered(set, answered) {
+			return replies, errors.Wrapf(errScanIncomplete, "No replica of %v answered: %v", set, err)
+		}
+	}
+	return replies, nil
+}
+
+// anyAnswered returns true if any of the nodes answered
+func anyAnswered(nodes []string, answered map[string]bool) bool {
+	for _, n := range nodes {
+		if answered[n] {
+			return true
+		}
+	}
+	return false
+}
+
+// ScanHandler responds to GET requests on /keyValue-store by listing the live keys in
+// a range, in order, a page at a time
+func (app *App) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling scan request")
+	w.Header().Set("Content-Type", "application/json")
+
+	// The payload may come in the query string or in a form body, as it does for a GET
+	payload := NewVectorClock()
+	p := r.URL.Query().Get("payload")
+	if p == "" && r.Body != nil {
+		b, _ := ioutil.ReadAll(r.Body)
+		form, _ := url.ParseQuery(string(b))
+		p = form.Get("payload")
+	}
+	var err error
+	if p != "" && json.Unmarshal([]byte(p), &payload) != nil {
+		err = errors.Wrap(errInvalidScan, "Invalid payload")
+	}
+	var req scanRequest
+	if err == nil {
+		req, err = scanRange(r.URL.Query())
+	}
+	if err != nil {
+		log.Println("ERROR: Rejecting scan: ", err)
+		w.WriteHeader(http.StatusBadRequest) // code 400
+		body, _ := json.Marshal(map[string]interface{}{
+			"result":  "Error",
+			"msg":     errors.Cause(err).Error(),
+			"error":   err.Error(),
+			"payload": payload,
+		})
+		w.Write(body)
+		return
+	}
+
+	// One more than the page is asked for, so a page which ends exactly at the limit
+	// still finds out whether anything follows it
+	ask := req
+	ask.Limit = req.Limit + 1
+	replies, err := app.scanNodes(ask)
+	if err != nil {
+		log.Println("ERROR: Part of the scan went unanswered: ", err)
+		w.WriteHeader(http.StatusServiceUnavailable) // code 503
+		body, _ := json.Marshal(map[string]interface{}{
+			"result":  "Error",
+			"msg":     errors.Cause(err).Error(),
+			"error":   err.Error(),
+			"payload": payload,
+		})
+		w.Write(body)
+		return
+	}
+	merged, next := mergeScans(replies)
+
+	now := time.Now()
+	keys := []map[string]interface{}{}
+	stale := []string{}
+	for _, se := range merged {
+		if len(keys) == req.Limit {
+			next = se.Key
+			break
+		}
+		e := se.Entry
+		if e.Version < payload[se.Key] {
+			stale = append(stale, se.Key)
+			continue
+		}
+		if !live(&e, now) {
+			continue
+		}
+		item := map[string]interface{}{
+			"key":     se.Key,
+			"value":   e.Value,
+			"version": e.Version,
+		}
+		if left, ok := remainingTTL(&e, now); ok {
+			item["ttl"] = left
+		}
+		keys = append(keys, item)
+		payload = payload.Merge(e.Clock)
+	}
+
+	resp := map[string]interface{}{
+		"result":  "Success",
+		"keys":    keys,
+		"stale":   stale,
+		"payload": payload,
+	}
+	if next != "" && (req.End == "" || next < req.End) {
+		resp["cursor"] = encodeCursor(next)
+	}
+	w.WriteHeader(http.StatusOK) // code 200
+	body, err := json.Marshal(resp)
+	if err != nil {
+		log.Fatalln("FATAL ERROR: Failed to marshal JSON response")
+	}
+	w.Write(body)
+}
@@ -0,0 +1,105 @@
+// scan_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for range and prefix scans
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestScanRange(t *testing.T) {
+	equals(t, "user;", prefixEnd("user:"))
+	equals(t, "b", prefixEnd("a\xff"))
+	equals(t, "", prefixEnd("\xff"))
+
+	req, err := scanRange(url.Values{"prefix": {"user:"}, "end": {"user:m"}, "limit": {"5"}})
+	ok(t, err)
+	equals(t, scanRequest{Start: "user:", End: "user:m", Limit: 5}, req)
+
+	req, err = scanRange(url.Values{"prefix": {"user:"}, "cursor": {encodeCursor("user:c")}})
+	ok(t, err)
+	equals(t, scanRequest{Start: "user:c", End: "user;", Limit: defaultScanLimit}, req)
+
+	for _, bad := range []url.Values{{"limit": {"0"}}, {"limit": {"lots"}}, {"cursor": {"!!"}}} {
+		_, err = scanRange(bad)
+		assert(t, err != nil, "Invalid scan parameters accepted: %v", bad)
+	}
+}
+
+func TestMergeScansKeepsWinners(t *testing.T) {
+	old := *NewEntry(time.Now(), VectorClock{"b": 1}, valone, 1)
+	tomb := *NewEntry(time.Now().Add(time.Second), VectorClock{"b": 2}, "", 2)
+	tomb.Tombstone = true
+	alice := scanReply{Entries: []scanEntry{{"a", old}, {"b", old}, {"c", old}}, More: true}
+	bob := scanReply{Entries: []scanEntry{{"b", tomb}, {"d", old}}}
+
+	merged, next := mergeScans([]scanReply{alice, bob})
+	// Alice may have more keys before d, so the page stops at her last key
+	equals(t, successor("c"), next)
+	equals(t, 3, len(merged))
+	equals(t, "b", merged[1].Key)
+	assert(t, !merged[1].Entry.Alive(), "Older value beat the newer tombstone")
+}
+
+// scanKeys lists the keys in a scan response
+func scanKeys(got map[string]interface{}) []string {
+	var keys []string
+	for _, item := range got["keys"].([]interface{}) {
+		keys = append(keys, item.(map[string]interface{})["key"].(string))
+	}
+	return keys
+}
+
+func TestScanHandlerPages(t *testing.T) {
+	app := &App{db: NewKVS(), view: *NewView(testMain, testMain)}
+	for _, key := range []string{"user:a", "user:b", "user:c", "user:d", "other"} {
+		app.db.Put(key, valone, time.Now(), VectorClock{})
+	}
+	app.db.Delete("user:b", time.Now(), VectorClock{})
+
+	code, got := appRequest(t, app, http.MethodGet, rootURL+"?"+url.Values{"prefix": {"user:"}, "limit": {"2"}}.Encode(), "", nil)
+	equals(t, http.StatusOK, code)
+	equals(t, []string{"user:a", "user:c"}, scanKeys(got))
+	cursor, _ := got["cursor"].(string)
+	assert(t, cursor != "", "No cursor on a page which isn't the last")
+
+	code, got = appRequest(t, app, http.MethodGet, rootURL+"?"+url.Values{"prefix": {"user:"}, "limit": {"2"}, "cursor": {cursor}}.Encode(), "", nil)
+	equals(t, http.StatusOK, code)
+	equals(t, []string{"user:d"}, scanKeys(got))
+	assert(t, got["cursor"] == nil, "Cursor on the last page")
+
+	// A key older than the client has seen is listed as stale instead
+	code, got = appRequest(t, app, http.MethodGet, rootURL+"?"+url.Values{"start": {"user:c"}, "payload": {`{"user:d": 5}`}}.Encode(), "", nil)
+	equals(t, http.StatusOK, code)
+	equals(t, []string{"user:c"}, scanKeys(got))
+	equals(t, []interface{}{"user:d"}, got["stale"])
+}
+
+func TestScanFailsWhenARangeGoesUnanswered(t *testing.T) {
+	down := "127.0.0.1:1" // Nothing listens here
+	v := NewView(testMain, testMain+","+down)
+	app := &App{db: NewKVS(), view: *v, ring: NewRing(v, defaultVnodes, 1)}
+	app.db.Put("user:a", valone, time.Now(), VectorClock{})
+
+	// The keys on the node which is down aren't stored anywhere else
+	code, got := appRequest(t, app, http.MethodGet, rootURL+"?prefix=user:", "", nil)
+	equals(t, http.StatusServiceUnavailable, code)
+	equals(t, errScanIncomplete.Error(), got["msg"])
+
+	// With every key on both nodes, this one answers for the whole range
+	app.ring = NewRing(v, defaultVnodes, 2)
+	code, got = appRequest(t, app, http.MethodGet, rootURL+"?prefix=user:", "", nil)
+	equals(t, http.StatusOK, code)
+	equals(t, []string{"user:a"}, scanKeys(got))
+}
@@ -0,0 +1,248 @@
+// session.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines session tokens, a bounded replacement for the causal payload. A client which
+// echoes the payload map sends back every key it has ever touched. A token instead holds
+// the versions of the keys the client used most recently, up to sessionMaxKeys of them,
+// along with the latest hybrid logical clock stamp the client has been shown. It's handed
+// out as an opaque string in the "token" field of every response carrying a payload, and
+// accepted in a "token" form field on every key request.
+//
+// A token is checked exactly like the payload it stands for. Keys which fall out of it
+// are no longer checked, which is the price of keeping it small; the stamp still moves
+// the clock of any node the client talks to past everything the client has seen, so its
+// later writes are always ordered after the ones it read. Clients still sending the
+// payload map are served as before, and a request carrying both is checked against both.
+// A client which sent a token is only given a token back, not the payload map, so what
+// it carries around stays bounded.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const (
+	sessionMaxKeys = 64 // Keys remembered by a token
+	sessionFormat  = 1  // Version of the token encoding
+)
+
+// errInvalidToken is returned for a token which can't be decoded
+var errInvalidToken = errors.New("Invalid session token")
+
+// sessionKey is the version of one key a client has seen
+type sessionKey struct {
+	Key     string
+	Version int
+}
+
+// sessionToken is the causal history of a client session
+type sessionToken struct {
+	Seen time.Time    // Latest stamp the client has been shown
+	Keys []sessionKey // Most recently used first
+}
+
+// Clock returns the token as a causal payload
+func (s sessionToken) Clock() VectorClock {
+	c := NewVectorClock()
+	for _, k := range s.Keys {
+		c[k.Key] = k.Version
+	}
+	return c
+}
+
+// next returns the token for a client which has just used key and been given payload.
+// The key moves to the front, followed by the keys the token already held and then any
+// others in the payload, and whatever doesn't fit is dropped.
+func (s sessionToken) next(key string, payload VectorClock, seen time.Time) sessionToken {
+	out := sessionToken{Seen: s.Seen}
+	if seen.After(out.Seen) {
+		out.Seen = seen
+	}
+	added := make(map[string]bool)
+	add := func(k string) {
+		if added[k] || len(out.Keys) >= sessionMaxKeys {
+			return
+		}
+		added[k] = true
+		out.Keys = append(out.Keys, sessionKey{Key: k, Version: payload[k]})
+	}
+	if _, ok := payload[key]; ok {
+		add(key)
+	}
+	for _, k := range s.Keys {
+		if _, ok := payload[k.Key]; ok {
+			add(k.Key)
+		}
+	}
+	for _, k := range payload.keys() {
+		add(k)
+	}
+	return out
+}
+
+// Encode returns the token as the opaque string given to clients
+func (s sessionToken) Encode() string {
+	var buf bytes.Buffer
+	scratch := make([]byte, binary.MaxVarintLen64)
+	put := func(n int64) {
+		buf.Write(scratch[:binary.PutVarint(scratch, n)])
+	}
+	put(sessionFormat)
+	seen := int64(0)
+	if !s.Seen.IsZero() {
+		seen = s.Seen.UnixNano()
+	}
+	put(seen)
+	put(int64(len(s.Keys)))
+	for _, k := range s.Keys {
+		put(int64(len(k.Key)))
+		buf.WriteString(k.Key)
+		put(int64(k.Version))
+	}
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+// decodeSessionToken reads a token given out by Encode. The empty string is an empty token.
+func decodeSessionToken(token string) (sessionToken, error) {
+	var s sessionToken
+	if token == "" {
+		return s, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return s, errInvalidToken
+	}
+	r := bytes.NewReader(data)
+	var fields []int64
+	read := func() bool {
+		n, err := binary.ReadVarint(r)
+		fields = append(fields, n)
+		return err == nil
+	}
+	if !read() || fields[0] != sessionFormat || !read() || !read() {
+		return s, errInvalidToken
+	}
+	if fields[1] != 0 {
+		s.Seen = time.Unix(0, fields[1])
+	}
+	n := fields[2]
+	if n < 0 || n > sessionMaxKeys {
+		return s, errInvalidToken
+	}
+	for i := int64(0); i < n; i++ {
+		fields = fields[:0]
+		if !read() || fields[0] < 0 || fields[0] > int64(r.Len()) {
+			return s, errInvalidToken
+		}
+		key := make([]byte, fields[0])
+		r.Read(key)
+		if !read() {
+			return s, errInvalidToken
+		}
+		s.Keys = append(s.Keys, sessionKey{Key: string(key), Version: int(fields[1])})
+	}
+	if r.Len() > 0 {
+		return s, errInvalidToken
+	}
+	return s, nil
+}
+
+// sessionResponse holds a handler's response so a token can be added before it's sent
+type sessionResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (s *sessionResponse) Header() http.Header         { return s.header }
+func (s *sessionResponse) Write(b []byte) (int, error) { return s.body.Write(b) }
+func (s *sessionResponse) WriteHeader(status int)      { s.status = status }
+
+// sessions wraps a key handler so it takes and gives out session tokens. A token in the
+// request is turned into the payload the handler expects, merged with any payload sent
+// alongside it, and the payload in the handler's response is turned into a new token.
+func (app *App) sessions(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var reqBody []byte
+		if r.Body != nil {
+			reqBody, _ = ioutil.ReadAll(r.Body)
+		}
+		form, _ := url.ParseQuery(string(reqBody))
+		session, err := decodeSessionToken(form.Get("token"))
+		if err != nil {
+			log.Println("Rejecting request: ", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest) // code 400
+			body, _ := json.Marshal(map[string]interface{}{
+				"result": "Error",
+				"msg":    "Invalid session token",
+			})
+			w.Write(body)
+			return
+		}
+
+		// Only a request with a token is rewritten, so older clients see no change at all
+		tokened := len(session.Keys) > 0 || !session.Seen.IsZero()
+		if tokened {
+			app.clock.Observe(session.Seen)
+			payload := session.Clock()
+			if p := form.Get("payload"); p != "" {
+				var sent VectorClock
+				if err := json.Unmarshal([]byte(p), &sent); err != nil {
+					invalidPayload(w, err)
+					return
+				}
+				payload = payload.Merge(sent)
+			}
+			encoded, _ := json.Marshal(payload)
+			form.Set("payload", string(encoded))
+			form.Del("token")
+			reqBody = []byte(form.Encode())
+			r.ContentLength = int64(len(reqBody))
+		}
+		if r.Body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+		}
+
+		resp := &sessionResponse{header: w.Header(), status: http.StatusOK}
+		h(resp, r)
+
+		body := resp.body.Bytes()
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(body, &fields) == nil && fields["payload"] != nil {
+			var payload VectorClock
+			if json.Unmarshal(fields["payload"], &payload) == nil {
+				token := session.next(mux.Vars(r)["subject"], payload, app.clock.Last())
+				fields["token"], _ = json.Marshal(token.Encode())
+				if tokened {
+					delete(fields, "payload")
+				}
+				if b, err := json.Marshal(fields); err == nil {
+					body = b
+					w.Header().Del("Content-Length")
+				}
+			}
+		}
+		w.WriteHeader(resp.status)
+		w.Write(body)
+	}
+}
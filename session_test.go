@@ -0,0 +1,96 @@
+// session_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for session tokens
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSessionTokenRoundTrip(t *testing.T) {
+	s := sessionToken{Seen: time.Unix(0, 1234567890), Keys: []sessionKey{{keyone, 3}, {keyExists, 1}}}
+	got, err := decodeSessionToken(s.Encode())
+	ok(t, err)
+	equals(t, s.Keys, got.Keys)
+	assert(t, s.Seen.Equal(got.Seen), "Stamp changed in the round trip")
+
+	for _, bad := range []string{"!!!", "AA", s.Encode() + "AA"} {
+		_, err = decodeSessionToken(bad)
+		equals(t, errInvalidToken, err)
+	}
+}
+
+func TestSessionTokenStaysBounded(t *testing.T) {
+	payload := NewVectorClock()
+	for i := 0; i < 3*sessionMaxKeys; i++ {
+		payload[fmt.Sprintf("key%03d", i)] = i
+	}
+	s := sessionToken{}.next("key150", payload, time.Now())
+	equals(t, sessionMaxKeys, len(s.Keys))
+	equals(t, sessionKey{"key150", 150}, s.Keys[0])
+
+	// The key used last comes first, ahead of the ones the token already had
+	s = s.next("key001", payload, time.Time{})
+	equals(t, []sessionKey{{"key001", 1}, {"key150", 150}}, s.Keys[:2])
+}
+
+func TestSessionTokenReplacesPayload(t *testing.T) {
+	app := &App{db: NewKVS(), view: *NewView(testMain, testMain), clock: NewHLC(testMain)}
+	app.db.Put(keyone, valone, time.Now(), VectorClock{keyone: 1})
+
+	// An old client gets a token alongside its payload
+	code, got := appRequest(t, app, http.MethodGet, rootURL+"/"+keyone, url.Values{"payload": {`{"` + keyone + `": 1}`}}.Encode(), nil)
+	equals(t, http.StatusOK, code)
+	equals(t, valone, got["value"])
+	token, _ := got["token"].(string)
+	assert(t, token != "", "No token in the response")
+
+	// Sending the token alone is the same as sending the payload, and only a token comes back
+	code, got = appRequest(t, app, http.MethodGet, rootURL+"/"+keyone, url.Values{"token": {token}}.Encode(), nil)
+	equals(t, http.StatusOK, code)
+	_, echoed := got["payload"]
+	assert(t, !echoed, "Payload sent back to a client using a token")
+	token, _ = got["token"].(string)
+	session, err := decodeSessionToken(token)
+	ok(t, err)
+	equals(t, VectorClock{keyone: 1}, session.Clock())
+
+	// A payload sent with the token has to be readable
+	code, got = appRequest(t, app, http.MethodGet, rootURL+"/"+keyone, url.Values{"token": {token}, "payload": {"{nope"}}.Encode(), nil)
+	equals(t, http.StatusBadRequest, code)
+	equals(t, "Invalid payload", got["msg"])
+
+	// A token which has seen a newer version than we hold is out of date
+	newer := sessionToken{Keys: []sessionKey{{keyone, 5}}}.Encode()
+	code, got = appRequest(t, app, http.MethodGet, rootURL+"/"+keyone, url.Values{"token": {newer}}.Encode(), nil)
+	equals(t, http.StatusBadRequest, code)
+	equals(t, "Payload out of date", got["msg"])
+}
+
+func TestSessionTokenMovesClock(t *testing.T) {
+	app := &App{db: NewKVS(), view: *NewView(testMain, testMain), clock: NewHLC(testMain)}
+	ahead := time.Now().Add(10 * time.Second)
+	token := sessionToken{Seen: ahead, Keys: []sessionKey{{keyExists, 1}}}.Encode()
+	code, _ := appRequest(t, app, http.MethodPut, rootURL+"/"+keyone, url.Values{"val": {valone}, "token": {token}}.Encode(), nil)
+	equals(t, http.StatusOK, code)
+	assert(t, app.clock.Now().After(ahead), "Clock wasn't moved past the token's stamp")
+}
+
+func TestInvalidSessionTokenIsRejected(t *testing.T) {
+	app := &App{db: NewKVS(), view: *NewView(testMain, testMain)}
+	code, got := appRequest(t, app, http.MethodPut, rootURL+"/"+keyone, url.Values{"val": {valone}, "token": {"nope!"}}.Encode(), nil)
+	equals(t, http.StatusBadRequest, code)
+	equals(t, "Invalid session token", got["msg"])
+}
@@ -0,0 +1,155 @@
+// siblings.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines sibling values, an opt-in alternative to last-writer-wins. With SIBLINGS=true
+// every write becomes a sibling carrying a version vector over the nodes which took
+// writes for the key. A write made without seeing another is concurrent with it, and
+// both are kept, instead of one being dropped because of its timestamp. A GET returns
+// every sibling with the merged vector as a causal context, and a PUT sending that
+// context back replaces all the siblings it covers with its own value, which is how a
+// client merges them.
+//
+// Entries written without siblings are resolved exactly as before, so the two kinds of
+// entry can meet during gossip and the plain one is judged by resolveConflict.
+//
+
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// A Sibling is one of the concurrent values of a key
+type Sibling struct {
+	Value     string
+	Timestamp time.Time
+	Clock     VectorClock // Version vector over the nodes which wrote this value or the ones it replaced
+}
+
+// siblingContext returns the causal context of an entry, covering all its siblings
+func siblingContext(e KeyEntry) VectorClock {
+	context := NewVectorClock()
+	for _, s := range e.GetSiblings() {
+		context = context.Merge(s.Clock)
+	}
+	return context
+}
+
+// sortSiblings puts siblings in a fixed order, oldest first, so that two nodes holding
+// the same set agree on it
+func sortSiblings(siblings []Sibling) {
+	sort.Slice(siblings, func(i, j int) bool {
+		a, b := siblings[i], siblings[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		if a.Value != b.Value {
+			return a.Value < b.Value
+		}
+		return string(a.Clock.EncodeBinary()) < string(b.Clock.EncodeBinary())
+	})
+}
+
+// pruneSiblings drops every sibling another one has seen, and any duplicates
+func pruneSiblings(siblings []Sibling) []Sibling {
+	var kept []Sibling
+	for i, s := range siblings {
+		covered := false
+		for j, t := range siblings {
+			if i == j {
+				continue
+			}
+			// A sibling is covered by a newer one, or by an earlier copy of itself
+			if order := t.Clock.Compare(s.Clock); order == ClockAfter || (order == ClockEqual && j < i) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			kept = append(kept, s)
+		}
+	}
+	sortSiblings(kept)
+	return kept
+}
+
+// sameSiblings returns true if two sorted sets of siblings are the same
+func sameSiblings(a []Sibling, b []Sibling) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Clock.Compare(b[i].Clock) != ClockEqual || a[i].Value != b[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+// setSiblings stores a set of siblings in an entry. The newest one also fills in the
+// entry's own value and timestamp, for anything which reads it as a single value.
+func setSiblings(e *Entry, siblings []Sibling) {
+	e.Siblings = siblings
+	if len(siblings) > 0 {
+		newest := siblings[len(siblings)-1]
+		e.Value = newest.Value
+		e.Timestamp = newest.Timestamp
+	}
+}
+
+// addSibling writes a value into an entry as node. Every sibling the client's context
+// covers is replaced, and the rest are kept alongside the new value.
+func addSibling(e *Entry, node string, context VectorClock, val string, ts time.Time) {
+	clock := context.Copy()
+	counter := context[node]
+	var kept []Sibling
+	for _, s := range e.Siblings {
+		if s.Clock[node] > counter {
+			counter = s.Clock[node]
+		}
+		if !context.Descends(s.Clock) {
+			kept = append(kept, s)
+		}
+	}
+	// The new value gets a counter nobody has used for this node yet
+	clock[node] = counter + 1
+	kept = append(kept, Sibling{Value: val, Timestamp: ts, Clock: clock})
+	sortSiblings(kept)
+	setSiblings(e, kept)
+}
+
+// mergeVersions combines Alice's version of a key with Bob's. If both hold siblings
+// the result is every sibling neither has seen superseded; otherwise it's whichever of
+// the two resolveConflict picks. It returns the result and true if it differs from Bob's.
+func mergeVersions(alice KeyEntry, bob KeyEntry) (KeyEntry, bool) {
+	if bob == nil {
+		return alice, true
+	}
+	if len(alice.GetSiblings()) == 0 || len(bob.GetSiblings()) == 0 || !alice.Alive() || !bob.Alive() {
+		if resolveConflict(alice, bob) {
+			return alice, true
+		}
+		return bob, false
+	}
+
+	all := append(append([]Sibling(nil), alice.GetSiblings()...), bob.GetSiblings()...)
+	siblings := pruneSiblings(all)
+	if sameSiblings(siblings, bob.GetSiblings()) {
+		return bob, false
+	}
+
+	merged := toEntry(bob)
+	merged.Clock = bob.GetClock().Merge(alice.GetClock())
+	if alice.GetVersion() > merged.Version {
+		merged.Version = alice.GetVersion()
+	}
+	setSiblings(&merged, siblings)
+	return &merged, true
+}
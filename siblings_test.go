@@ -0,0 +1,134 @@
+// siblings_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for sibling values
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+)
+
+// siblingValues returns the values of an entry's siblings, sorted
+func siblingValues(e KeyEntry) []string {
+	var values []string
+	for _, s := range e.GetSiblings() {
+		values = append(values, s.Value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+func TestAddSiblingKeepsConcurrentWrites(t *testing.T) {
+	var e Entry
+	ts := time.Now()
+	addSibling(&e, viewExist, nil, valone, ts)
+	addSibling(&e, viewNotExist, nil, valtwo, ts.Add(time.Second))
+	equals(t, []string{valone, valtwo}, siblingValues(&e))
+	equals(t, valtwo, e.Value)
+
+	// Writing with the context of both replaces them
+	addSibling(&e, viewExist, siblingContext(&e), "merged", ts.Add(2*time.Second))
+	equals(t, []string{"merged"}, siblingValues(&e))
+	equals(t, VectorClock{viewExist: 2, viewNotExist: 1}, siblingContext(&e))
+}
+
+func TestAddSiblingWithPartialContext(t *testing.T) {
+	var e Entry
+	ts := time.Now()
+	addSibling(&e, viewExist, nil, valone, ts)
+	seen := siblingContext(&e)
+	addSibling(&e, viewNotExist, nil, valtwo, ts)
+
+	// Only the sibling the client had read is replaced
+	addSibling(&e, viewExist, seen, "three", ts)
+	equals(t, []string{valtwo, "three"}, siblingValues(&e))
+}
+
+func TestMergeVersionsUnionsSiblings(t *testing.T) {
+	ts := time.Now()
+	alice := &Entry{Version: 1, Clock: VectorClock{keyone: 1}}
+	addSibling(alice, viewExist, nil, valone, ts)
+	bob := &Entry{Version: 1, Clock: VectorClock{keyone: 1}}
+	addSibling(bob, viewNotExist, nil, valtwo, ts)
+
+	merged, changed := mergeVersions(alice, bob)
+	assert(t, changed, "Merging a new sibling didn't change Bob's version")
+	equals(t, []string{valone, valtwo}, siblingValues(merged))
+
+	// Merging again changes nothing
+	_, changed = mergeVersions(alice, merged)
+	assert(t, !changed, "Merging a sibling Bob already has changed his version")
+
+	// A version which replaced both wins outright
+	carol := toEntry(merged)
+	addSibling(&carol, viewExist, siblingContext(merged), "merged", ts)
+	result, changed := mergeVersions(merged, &carol)
+	assert(t, !changed, "Old siblings came back after being replaced")
+	equals(t, []string{"merged"}, siblingValues(result))
+}
+
+func TestMergeVersionsFallsBackWithoutSiblings(t *testing.T) {
+	ts := time.Now()
+	alice := NewEntry(ts.Add(time.Second), VectorClock{keyone: 1}, valone, 1)
+	bob := NewEntry(ts, VectorClock{keyone: 1}, valtwo, 1)
+	winner, changed := mergeVersions(alice, bob)
+	assert(t, changed, "Later write didn't win")
+	equals(t, valone, winner.GetValue())
+}
+
+func TestKVSPutSibling(t *testing.T) {
+	k := NewKVS()
+	stored := k.PutSibling(keyone, valone, time.Now(), VectorClock{}, nil, viewExist, never)
+	assert(t, stored, "PutSibling failed")
+	k.PutSibling(keyone, valtwo, time.Now(), VectorClock{}, nil, viewNotExist, never)
+
+	eg := k.GetEntryGlob(timeGlob{List: map[string]time.Time{keyone: {}}})
+	e := eg.Keys[keyone]
+	equals(t, []string{valone, valtwo}, siblingValues(&e))
+	equals(t, 2, e.Version)
+
+	k.PutSibling(keyone, "merged", time.Now(), VectorClock{}, siblingContext(&e), viewExist, never)
+	eg = k.GetEntryGlob(timeGlob{List: map[string]time.Time{keyone: {}}})
+	e = eg.Keys[keyone]
+	equals(t, []string{"merged"}, siblingValues(&e))
+}
+
+func TestGetHandlerReturnsSiblingsAndPutCollapsesThem(t *testing.T) {
+	k := NewKVS()
+	app := &App{db: k, view: *NewView(testMain, testMain), siblings: true}
+
+	// Two writes from nodes which hadn't seen each other
+	k.PutSibling(keyone, valone, time.Now(), VectorClock{}, nil, viewExist, never)
+	k.PutSibling(keyone, valtwo, time.Now(), VectorClock{}, nil, viewNotExist, never)
+
+	_, got := appRequest(t, app, http.MethodGet, rootURL+"/"+keyone, "", nil)
+	equals(t, "Success", got["result"])
+	equals(t, []interface{}{valone, valtwo}, got["siblings"])
+	context, err := json.Marshal(got["context"])
+	ok(t, err)
+
+	_, got = appRequest(t, app, http.MethodPut, rootURL+"/"+keyone, url.Values{"val": {"merged"}, "context": {string(context)}}.Encode(), nil)
+	equals(t, []interface{}{"merged"}, got["siblings"])
+
+	_, got = appRequest(t, app, http.MethodGet, rootURL+"/"+keyone, "", nil)
+	equals(t, "merged", got["value"])
+	equals(t, []interface{}{"merged"}, got["siblings"])
+}
+
+func TestPutHandlerRejectsInvalidContext(t *testing.T) {
+	app := &App{db: NewKVS(), view: *NewView(testMain, testMain), siblings: true}
+	_, got := appRequest(t, app, http.MethodPut, rootURL+"/"+keyone, url.Values{"val": {valone}, "context": {"{nope"}}.Encode(), nil)
+	equals(t, "Invalid causal context", got["msg"])
+}
@@ -0,0 +1,288 @@
+// snapshot.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines point-in-time snapshots of the KVS. A snapshot holds every entry in the
+// db as of the moment a new log segment was started, so on restart the KVS only
+// needs to load the newest snapshot and replay the segments written after it.
+//
+// A snapshot file (snap-00000042.snap, named for the first segment it doesn't
+// cover) is laid out as:
+//
+//     [8 byte magic and format version]
+//     [frame: snapshotHeader]
+//     [frame: snapshotRecord] ... one per key
+//     [frame: snapshotFooter]
+//
+// using the same length and checksum framing as the log. A snapshot without its
+// footer, or with a damaged frame, is ignored in favour of an older one.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	snapshotFormat  = "snap-%08d.snap" // Snapshot file names inside the data directory
+	snapshotVersion = 1                // Bumped whenever the layout of a snapshot changes
+)
+
+// snapshotMagic starts every snapshot file; the last byte is the format version
+var snapshotMagic = []byte{'K', 'V', 'S', 'S', 'N', 'A', 'P', snapshotVersion}
+
+// snapshotHeader describes the snapshot that follows it
+type snapshotHeader struct {
+	Version int       // Format version, matches the magic
+	Seq     uint64    // First log segment not covered by this snapshot
+	Taken   time.Time // When the snapshot was started
+	Count   int       // Number of records that follow
+}
+
+// snapshotRecord holds a single key and every field of its entry
+type snapshotRecord struct {
+	Key   string
+	Entry Entry
+}
+
+// snapshotFooter marks the end of a complete snapshot
+type snapshotFooter struct {
+	Count int // Must match the header
+}
+
+// Snapshot writes a point-in-time copy of the db to disk and then removes the log
+// segments and snapshots it replaces. The db is only locked long enough to copy the
+// entries; readers are never blocked and writers wait only for the copy, not the dump.
+func (k *KVS) Snapshot() error {
+	if k.wal == nil {
+		return nil
+	}
+
+	// Holding the read lock keeps writers out, so starting a new segment here gives
+	// us a clean cut: everything before it is in the copy, everything after is logged.
+	k.mutex.RLock()
+	seq, err := k.wal.Rotate()
+	if err != nil {
+		k.mutex.RUnlock()
+		return err
+	}
+	entries := make(map[string]Entry, k.db.Len())
+	err = k.db.Ascend("", "", func(key string, e KeyEntry) bool {
+		entries[key] = copyEntry(toEntry(e))
+		return true
+	})
+	k.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	log.Println("Writing snapshot", seq, "with", len(entries), "entries")
+	err = writeSnapshot(k.wal.dir, seq, entries)
+	if err != nil {
+		return err
+	}
+
+	// The snapshot is safely on disk so the older history can go
+	err = k.wal.RemoveBefore(seq)
+	if err != nil {
+		return err
+	}
+	return removeSnapshotsBefore(k.wal.dir, seq)
+}
+
+// SnapshotLoop takes a snapshot every interval, forever
+func (k *KVS) SnapshotLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		err := k.Snapshot()
+		if err != nil {
+			log.Println("Error taking snapshot: ", err)
+		}
+	}
+}
+
+// writeSnapshot writes the entries out as snapshot seq. The file is written under a
+// temporary name and renamed once it has been synced, so a crash never leaves a
+// half-written snapshot with a real name.
+func writeSnapshot(dir string, seq uint64, entries map[string]Entry) error {
+	path := filepath.Join(dir, fmt.Sprintf(snapshotFormat, seq))
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Creating snapshot "+tmp+" failed")
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	_, err = w.Write(snapshotMagic)
+	if err != nil {
+		return errors.Wrap(err, "Writing snapshot failed")
+	}
+
+	header := snapshotHeader{Version: snapshotVersion, Seq: seq, Taken: time.Now(), Count: len(entries)}
+	err = writeFrame(w, header)
+	if err != nil {
+		return err
+	}
+	for key, e := range entries {
+		err = writeFrame(w, snapshotRecord{Key: key, Entry: e})
+		if err != nil {
+			return err
+		}
+	}
+	err = writeFrame(w, snapshotFooter{Count: len(entries)})
+	if err != nil {
+		return err
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return errors.Wrap(err, "Flushing snapshot failed")
+	}
+	err = f.Sync()
+	if err != nil {
+		return errors.Wrap(err, "Syncing snapshot failed")
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return errors.Wrap(err, "Renaming snapshot failed")
+	}
+
+	// Sync the directory too, otherwise the rename itself might not survive a crash
+	return syncDir(dir)
+}
+
+// syncDir syncs a directory to disk, so the files renamed into it stay renamed after a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "Opening directory "+dir+" failed")
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil {
+		return errors.Wrap(err, "Syncing directory "+dir+" failed")
+	}
+	return nil
+}
+
+// writeFrame encodes v as a single frame on w
+func writeFrame(w io.Writer, v interface{}) error {
+	frame, err := encodeFrame(v)
+	if err != nil {
+		return errors.Wrapf(err, "Encode failed for struct: %#v", v)
+	}
+	_, err = w.Write(frame)
+	if err != nil {
+		return errors.Wrap(err, "Writing snapshot failed")
+	}
+	return nil
+}
+
+// readSnapshot loads a snapshot file, returning the segment it stops at and its
+// entries. It returns an error if the file is incomplete or damaged in any way.
+func readSnapshot(path string) (uint64, map[string]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "Opening snapshot "+path+" failed")
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	magic := make([]byte, len(snapshotMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil || !bytes.Equal(magic, snapshotMagic) {
+		return 0, nil, errors.New("Snapshot " + path + " has an unknown format")
+	}
+
+	var header snapshotHeader
+	_, err = readFrame(r, &header)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "Reading snapshot header failed")
+	}
+
+	entries := make(map[string]Entry, header.Count)
+	for i := 0; i < header.Count; i++ {
+		var rec snapshotRecord
+		_, err = readFrame(r, &rec)
+		if err != nil {
+			return 0, nil, errors.Wrap(err, "Reading snapshot record failed")
+		}
+		normalizeEntry(&rec.Entry)
+		entries[rec.Key] = rec.Entry
+	}
+
+	var footer snapshotFooter
+	_, err = readFrame(r, &footer)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "Reading snapshot footer failed")
+	}
+	if footer.Count != header.Count {
+		return 0, nil, errors.New("Snapshot " + path + " footer doesn't match its header")
+	}
+	return header.Seq, entries, nil
+}
+
+// loadLatestSnapshot returns the newest snapshot in dir which can be read in full.
+// If there isn't one it returns segment 0 and no entries, meaning the whole log
+// needs to be replayed.
+func loadLatestSnapshot(dir string) (uint64, map[string]Entry, error) {
+	snaps, err := listSegments(dir, snapshotFormat)
+	if err != nil {
+		return 0, nil, err
+	}
+	for i := len(snaps) - 1; i >= 0; i-- {
+		path := filepath.Join(dir, fmt.Sprintf(snapshotFormat, snaps[i]))
+		seq, entries, err := readSnapshot(path)
+		if err != nil {
+			log.Println("Skipping snapshot: ", err)
+			continue
+		}
+		log.Println("Loaded snapshot", seq, "with", len(entries), "entries")
+		return seq, entries, nil
+	}
+	return 0, map[string]Entry{}, nil
+}
+
+// removeSnapshotsBefore deletes every snapshot older than seq
+func removeSnapshotsBefore(dir string, seq uint64) error {
+	snaps, err := listSegments(dir, snapshotFormat)
+	if err != nil {
+		return err
+	}
+	for _, s := range snaps {
+		if s >= seq {
+			break
+		}
+		err = os.Remove(filepath.Join(dir, fmt.Sprintf(snapshotFormat, s)))
+		if err != nil {
+			return errors.Wrap(err, "Removing snapshot failed")
+		}
+	}
+	return nil
+}
+
+// copyEntry returns an Entry which shares no maps with the original
+func copyEntry(e Entry) Entry {
+	e.Clock = e.Clock.Copy()
+	if e.DVV.Context != nil {
+		e.DVV.Context = e.DVV.Context.Copy()
+	}
+	return e
+}
@@ -0,0 +1,131 @@
+// snapshot_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for KVS snapshots
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Opens a log in dir and restores a KVS from it
+func restoredKVS(t *testing.T, dir string) (*KVS, *WAL) {
+	w, err := OpenWAL(dir)
+	ok(t, err)
+	k := NewKVS()
+	ok(t, k.Restore(w))
+	return k, w
+}
+
+func TestSnapshotRoundTripsEveryField(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	entries := map[string]Entry{
+		keyone:    *NewEntry(time.Now(), VectorClock{keyone: 2, keyExists: 1}, valone, 2),
+		keyExists: {Version: 3, Timestamp: time.Now(), Clock: VectorClock{keyExists: 3}, Tombstone: true},
+	}
+	ok(t, writeSnapshot(dir, 7, entries))
+
+	seq, got, err := readSnapshot(filepath.Join(dir, fmt.Sprintf(snapshotFormat, 7)))
+	ok(t, err)
+	equals(t, uint64(7), seq)
+	equals(t, len(entries), len(got))
+	for key, want := range entries {
+		equals(t, want.Value, got[key].Value)
+		equals(t, want.Version, got[key].Version)
+		equals(t, want.Clock, got[key].Clock)
+		equals(t, want.Tombstone, got[key].Tombstone)
+		assert(t, want.Timestamp.Equal(got[key].Timestamp), "Timestamp for %s didn't survive the snapshot", key)
+	}
+}
+
+func TestSnapshotTruncatesLog(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	k, w := restoredKVS(t, dir)
+	k.Put(keyone, valone, time.Now(), VectorClock{keyone: 1})
+	ok(t, k.Snapshot())
+	k.Put(keyone, valtwo, time.Now(), VectorClock{keyone: 2})
+	ok(t, k.Snapshot())
+	ok(t, w.Close())
+
+	segs, err := listSegments(dir, walSegmentFormat)
+	ok(t, err)
+	equals(t, []uint64{3}, segs)
+	snaps, err := listSegments(dir, snapshotFormat)
+	ok(t, err)
+	equals(t, []uint64{3}, snaps)
+}
+
+func TestRestoreReplaysTailAfterSnapshot(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	k, w := restoredKVS(t, dir)
+	k.Put(keyone, valone, time.Now(), VectorClock{keyone: 1})
+	k.Put(keyExists, valExists, time.Now(), VectorClock{keyExists: 1})
+	ok(t, k.Snapshot())
+	k.Put(keyone, valtwo, time.Now(), VectorClock{keyone: 2})
+	k.Delete(keyExists, time.Now(), VectorClock{keyExists: 1})
+	ok(t, w.Close())
+
+	r, w := restoredKVS(t, dir)
+	defer w.Close()
+	one, _ := r.db.Get(keyone)
+	equals(t, valtwo, one.GetValue())
+	equals(t, 2, one.GetVersion())
+	deleted, _ := r.db.Get(keyExists)
+	assert(t, !deleted.Alive(), "Tombstone logged after the snapshot was lost")
+}
+
+func TestRestoreSkipsDamagedSnapshot(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	k, w := restoredKVS(t, dir)
+	k.Put(keyone, valone, time.Now(), VectorClock{keyone: 1})
+	ok(t, k.Snapshot())
+	ok(t, w.Close())
+
+	// A newer snapshot which was cut short should be passed over for the good one
+	path := filepath.Join(dir, fmt.Sprintf(snapshotFormat, 9))
+	ok(t, ioutil.WriteFile(path, snapshotMagic, 0644))
+
+	seq, entries, err := loadLatestSnapshot(dir)
+	ok(t, err)
+	equals(t, uint64(2), seq)
+	equals(t, valone, entries[keyone].Value)
+}
+
+func TestSnapshotWithoutWALDoesNothing(t *testing.T) {
+	k := NewKVS()
+	ok(t, k.Snapshot())
+	_, err := os.Stat(fmt.Sprintf(snapshotFormat, 0))
+	assert(t, os.IsNotExist(err), "Snapshot written without a log")
+}
+
+func TestConfigRefusesSnapshotIntervalThatIsntPositive(t *testing.T) {
+	for _, interval := range []string{"0", "-1m"} {
+		t.Setenv("SNAPSHOT_INTERVAL", interval)
+		_, err := LoadConfig()
+		assert(t, err != nil, "SNAPSHOT_INTERVAL=%s was accepted", interval)
+	}
+	t.Setenv("SNAPSHOT_INTERVAL", "1m")
+	c, err := LoadConfig()
+	ok(t, err)
+	equals(t, time.Minute, c.SnapshotInterval)
+}
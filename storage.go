@@ -0,0 +1,129 @@
+// storage.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines the StorageEngine interface the KVS keeps its entries in, along with the
+// in-memory engine. The KVS takes care of versions, clocks and locking; an engine
+// only has to store entries by key and hand them back in key order.
+//
+
+package main
+
+import (
+	"sort"
+)
+
+// StorageEngine is the low-level store underneath the KVS
+type StorageEngine interface {
+
+	// Get returns the entry stored for a key, and false if there isn't one
+	Get(string) (KeyEntry, bool)
+
+	// Put stores an entry for a key, replacing whatever was there
+	Put(string, KeyEntry) error
+
+	// Remove drops a key from the store entirely. This is not a delete; deletes are tombstones.
+	Remove(string) error
+
+	// Batch applies a group of puts and removes all at once
+	Batch([]batchOp) error
+
+	// Ascend calls the function for each key in [start, end) in ascending order until it returns
+	// false. An empty end means there is no upper bound.
+	Ascend(string, string, func(string, KeyEntry) bool) error
+
+	// Len returns the number of keys stored
+	Len() int
+
+	// Close releases anything the engine has open
+	Close() error
+}
+
+// A batchOp is a single write within a StorageEngine batch
+type batchOp struct {
+	Key    string
+	Entry  KeyEntry // The entry to put, ignored if Remove is set
+	Remove bool     // True to remove the key instead
+}
+
+// memoryEngine is a StorageEngine which holds everything in a map, with a sorted
+// slice of the keys alongside it for ordered iteration
+type memoryEngine struct {
+	entries map[string]KeyEntry
+	keys    []string // Always sorted
+}
+
+// NewMemoryEngine returns an empty in-memory engine
+func NewMemoryEngine() *memoryEngine {
+	return &memoryEngine{entries: make(map[string]KeyEntry)}
+}
+
+// Get returns the entry for a key
+func (m *memoryEngine) Get(key string) (KeyEntry, bool) {
+	e, ok := m.entries[key]
+	return e, ok
+}
+
+// Put stores the entry itself, so later changes to it through the KeyEntry methods
+// are seen by the engine without another Put
+func (m *memoryEngine) Put(key string, e KeyEntry) error {
+	if _, ok := m.entries[key]; !ok {
+		i := sort.SearchStrings(m.keys, key)
+		m.keys = append(m.keys, "")
+		copy(m.keys[i+1:], m.keys[i:])
+		m.keys[i] = key
+	}
+	m.entries[key] = e
+	return nil
+}
+
+// Remove drops a key from the map and the key list
+func (m *memoryEngine) Remove(key string) error {
+	if _, ok := m.entries[key]; ok {
+		i := sort.SearchStrings(m.keys, key)
+		m.keys = append(m.keys[:i], m.keys[i+1:]...)
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+// Batch applies each op in turn; nothing can fail part way for an in-memory engine
+func (m *memoryEngine) Batch(ops []batchOp) error {
+	for _, op := range ops {
+		if op.Remove {
+			m.Remove(op.Key)
+		} else {
+			m.Put(op.Key, op.Entry)
+		}
+	}
+	return nil
+}
+
+// Ascend walks the sorted key list
+func (m *memoryEngine) Ascend(start string, end string, fn func(string, KeyEntry) bool) error {
+	for i := sort.SearchStrings(m.keys, start); i < len(m.keys); i++ {
+		key := m.keys[i]
+		if end != "" && key >= end {
+			break
+		}
+		if !fn(key, m.entries[key]) {
+			break
+		}
+	}
+	return nil
+}
+
+// Len returns the number of keys in the map
+func (m *memoryEngine) Len() int {
+	return len(m.entries)
+}
+
+// Close does nothing for an in-memory engine
+func (m *memoryEngine) Close() error {
+	return nil
+}
@@ -0,0 +1,154 @@
+// storage_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for the storage engines
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Collects the keys an engine visits between start and end
+func ascendKeys(t *testing.T, e StorageEngine, start string, end string) []string {
+	var keys []string
+	ok(t, e.Ascend(start, end, func(key string, _ KeyEntry) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	return keys
+}
+
+func TestEnginesAscendInKeyOrder(t *testing.T) {
+	for name, newEngine := range testEngines {
+		t.Run(name, func(t *testing.T) {
+			e, cleanup := newEngine(t)
+			defer cleanup()
+			for _, key := range []string{"d", "b", "e", "a", "c"} {
+				ok(t, e.Put(key, NewEntry(time.Now(), nil, key, 1)))
+			}
+			equals(t, []string{"a", "b", "c", "d", "e"}, ascendKeys(t, e, "", ""))
+			equals(t, []string{"b", "c"}, ascendKeys(t, e, "b", "d"))
+			equals(t, 5, e.Len())
+		})
+	}
+}
+
+func TestEnginesRemoveDropsKey(t *testing.T) {
+	for name, newEngine := range testEngines {
+		t.Run(name, func(t *testing.T) {
+			e, cleanup := newEngine(t)
+			defer cleanup()
+			ok(t, e.Put("a", NewEntry(time.Now(), nil, valone, 1)))
+			ok(t, e.Put("b", NewEntry(time.Now(), nil, valtwo, 1)))
+			ok(t, e.Put("c", NewEntry(time.Now(), nil, valtwo, 1)))
+			ok(t, e.Remove("b"))
+			_, found := e.Get("b")
+			assert(t, !found, "Removed key still found")
+			equals(t, []string{"a", "c"}, ascendKeys(t, e, "", ""))
+		})
+	}
+}
+
+func TestEnginesBatchAppliesEveryOp(t *testing.T) {
+	for name, newEngine := range testEngines {
+		t.Run(name, func(t *testing.T) {
+			e, cleanup := newEngine(t)
+			defer cleanup()
+			ok(t, e.Put("a", NewEntry(time.Now(), nil, valone, 1)))
+			ok(t, e.Batch([]batchOp{
+				{Key: "a", Remove: true},
+				{Key: "b", Entry: NewEntry(time.Now(), nil, valtwo, 1)},
+			}))
+			equals(t, []string{"b"}, ascendKeys(t, e, "", ""))
+		})
+	}
+}
+
+func TestLSMEngineReopenKeepsEntries(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	// Enough keys to flush several tables and trigger a merge, with some still in the memtable
+	e, err := openLSMEngine(dir, 3)
+	ok(t, err)
+	for i := 0; i < 20; i++ {
+		ok(t, e.Put(fmt.Sprintf("key%02d", i), NewEntry(time.Now(), VectorClock{"x": i}, fmt.Sprint(i), i+1)))
+	}
+	ok(t, e.Remove("key05"))
+	ok(t, e.Close())
+	assert(t, len(e.tables) <= lsmMaxTables, "Tables were never merged")
+
+	r, err := openLSMEngine(dir, 3)
+	ok(t, err)
+	defer r.Close()
+	equals(t, 19, r.Len())
+	_, found := r.Get("key05")
+	assert(t, !found, "Removed key came back after reopening")
+	got, found := r.Get("key17")
+	assert(t, found, "Key lost after reopening")
+	equals(t, "17", got.GetValue())
+	equals(t, 18, got.GetVersion())
+	equals(t, VectorClock{"x": 17}, got.GetClock())
+}
+
+func TestLSMEngineIgnoresTablesMissingFromManifest(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	e, err := openLSMEngine(dir, 1)
+	ok(t, err)
+	ok(t, e.Put("a", NewEntry(time.Now(), nil, valone, 1)))
+	ok(t, e.Close())
+
+	// A table written by a flush which never made it into the manifest
+	l := &lsmEngine{dir: dir, nextSeq: 50}
+	ghost, err := l.writeTable([]lsmRecord{{Key: "ghost", Entry: *NewEntry(time.Now(), nil, valtwo, 1)}})
+	ok(t, err)
+	ghost.file.Close()
+
+	r, err := openLSMEngine(dir, 1)
+	ok(t, err)
+	defer r.Close()
+	_, found := r.Get("ghost")
+	assert(t, !found, "Orphaned table was loaded")
+	_, found = r.Get("a")
+	assert(t, found, "Live table was lost")
+}
+
+func TestLSMEngineWriteSurvivesFailedFlush(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	e, err := openLSMEngine(dir, 1)
+	ok(t, err)
+
+	// Nothing can be written where the new manifest goes, so the flush fails
+	blocker := filepath.Join(dir, lsmManifest+".tmp")
+	ok(t, os.Mkdir(blocker, 0755))
+	ok(t, e.Put("a", NewEntry(time.Now(), nil, valone, 1)))
+	got, found := e.Get("a")
+	assert(t, found, "Write was lost when its flush failed")
+	equals(t, valone, got.GetValue())
+	equals(t, 0, len(e.tables))
+
+	// Once the flush can be made the next write makes it
+	ok(t, os.Remove(blocker))
+	ok(t, e.Put("b", NewEntry(time.Now(), nil, valtwo, 1)))
+	equals(t, 1, len(e.tables))
+	ok(t, e.Close())
+
+	r, err := openLSMEngine(dir, 1)
+	ok(t, err)
+	defer r.Close()
+	equals(t, 2, r.Len())
+}
@@ -0,0 +1,449 @@
+// swim.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines a SWIM-style failure detector over the members of the view. Once every
+// protocol period a node pings one member, going round the view in a shuffled order.
+// If there is no ack it asks k other members to ping the target on its behalf
+// (ping-req), and if none of them hear back either the target becomes suspect.
+// Suspects which don't refute the suspicion within the suspect timeout are declared
+// dead. A node refutes a suspicion about itself by bumping its incarnation number and
+// announcing that it's alive, and a higher incarnation always wins.
+//
+// Changes in state aren't sent on their own. They are piggybacked on the pings and
+// acks the protocol is sending anyway, each one a few times more than log(n) so it
+// reaches everybody.
+//
+// Every message also says which members the sender is still streaming a new member's
+// share to. That's current state rather than news, so it isn't retransmitted: each
+// node keeps the latest list it heard from each sender, which lets any of them report
+// a member as joining, not just the node doing the sending.
+//
+
+package main
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memberState is what a node currently believes about a member
+type memberState int
+
+const (
+	stateAlive   memberState = iota // Answering pings
+	stateSuspect                    // Missed a probe, waiting to be refuted
+	stateDead                       // Suspected for too long
+)
+
+// String names the state for /view
+func (s memberState) String() string {
+	switch s {
+	case stateAlive:
+		return "alive"
+	case stateSuspect:
+		return "suspect"
+	}
+	return "dead"
+}
+
+const (
+	swimMaxPiggyback = 8 // Most updates carried by one message
+	swimRetransmit   = 3 // Multiplier of log(n) for how many times an update is sent
+)
+
+// A swimUpdate is a piece of membership news carried on a ping or ack
+type swimUpdate struct {
+	Addr        string
+	State       memberState
+	Incarnation uint64
+}
+
+// A swimMessage is a ping or an ack, with whatever news the sender has to spread
+type swimMessage struct {
+	From    string
+	Updates []swimUpdate
+	Joining []string // Members the sender is still sending their share of the data
+}
+
+// A swimPingReq asks a member to ping Target for the sender
+type swimPingReq struct {
+	Target string
+	Msg    swimMessage
+}
+
+// A swimAck answers a ping-req, saying whether the target acked
+type swimAck struct {
+	Ok  bool
+	Msg swimMessage
+}
+
+// member is what we know about one node in the view
+type member struct {
+	State       memberState
+	Incarnation uint64
+	since       time.Time // When the member entered its current state
+}
+
+// broadcast is an update waiting to be piggybacked, with the number of times it has been sent
+type broadcast struct {
+	update swimUpdate
+	sent   int
+}
+
+// Membership runs the failure detector and tracks the state of every member
+type Membership struct {
+	me             string
+	view           View
+	members        map[string]*member
+	incarnation    uint64       // Our own incarnation number
+	broadcasts     []*broadcast // News waiting to be spread
+	order          []string     // Members left to probe this round
+	k              int          // Members asked to ping-req a target
+	period         time.Duration
+	suspectTimeout time.Duration
+
+	ping      func(ip string, msg swimMessage) (swimMessage, error)
+	pingReq   func(via string, target string, msg swimMessage) (swimAck, error)
+	onAlive   func(string)        // Called whenever a member is heard from
+	streaming func() []string     // Members we're sending their share of the data
+	joining   map[string][]string // The latest streaming list heard from each member
+	mutex     sync.Mutex
+}
+
+// NewMembership creates a failure detector over the view. It probes one member every
+// period, asks k others for help when a probe fails, and declares suspects dead after
+// suspectTimeout.
+func NewMembership(v View, period time.Duration, suspectTimeout time.Duration, k int) *Membership {
+	m := &Membership{
+		me:             v.Primary(),
+		view:           v,
+		members:        make(map[string]*member),
+		k:              k,
+		period:         period,
+		suspectTimeout: suspectTimeout,
+		onAlive:        func(string) {},
+		streaming:      func() []string { return nil },
+		joining:        make(map[string][]string),
+	}
+	timeout := period / 2
+	m.ping = func(ip string, msg swimMessage) (swimMessage, error) {
+		return sendPing(ip, msg, timeout)
+	}
+	m.pingReq = func(via string, target string, msg swimMessage) (swimAck, error) {
+		return sendPingReq(via, target, msg, period)
+	}
+	m.sync()
+	return m
+}
+
+// sync adds members which have joined the view and forgets ones which have left it
+func (m *Membership) sync() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	inView := make(map[string]bool)
+	for _, addr := range m.view.List() {
+		inView[addr] = true
+		if _, ok := m.members[addr]; !ok && addr != m.me {
+			m.members[addr] = &member{State: stateAlive, since: time.Now()}
+		}
+	}
+	for addr := range m.members {
+		if !inView[addr] {
+			delete(m.members, addr)
+			delete(m.joining, addr)
+		}
+	}
+}
+
+// Run probes a member every protocol period, forever
+func (m *Membership) Run() {
+	log.Println("Failure detector starts, probing every", m.period)
+	for {
+		time.Sleep(m.period)
+		m.sync()
+		target := m.nextTarget()
+		if target != "" {
+			m.probe(target)
+		}
+		m.expire(time.Now())
+	}
+}
+
+// nextTarget returns the next member to probe. Every member which isn't dead is probed
+// once per round, in a new random order each round.
+func (m *Membership) nextTarget() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for {
+		if len(m.order) == 0 {
+			for addr := range m.members {
+				m.order = append(m.order, addr)
+			}
+			if len(m.order) == 0 {
+				return ""
+			}
+			rand.Shuffle(len(m.order), func(i, j int) {
+				m.order[i], m.order[j] = m.order[j], m.order[i]
+			})
+		}
+		target := m.order[0]
+		m.order = m.order[1:]
+		if mem, ok := m.members[target]; ok && mem.State != stateDead {
+			return target
+		}
+		if m.allDead() {
+			return ""
+		}
+	}
+}
+
+// allDead returns true if there is nobody left worth probing. The lock must be held.
+func (m *Membership) allDead() bool {
+	for _, mem := range m.members {
+		if mem.State != stateDead {
+			return false
+		}
+	}
+	return true
+}
+
+// probe pings a member, falling back to ping-reqs through k others, and suspects it if
+// nobody hears from it
+func (m *Membership) probe(target string) {
+	ack, err := m.ping(target, m.outgoing())
+	if err == nil {
+		m.Receive(ack)
+		m.heardFrom(target)
+		return
+	}
+	log.Println("No ack from " + target + ", asking for indirect probes")
+
+	helpers := m.randomMembers(m.k, target)
+	acks := make(chan bool, len(helpers))
+	for _, via := range helpers {
+		go func(via string) {
+			reply, err := m.pingReq(via, target, m.outgoing())
+			if err != nil {
+				acks <- false
+				return
+			}
+			m.Receive(reply.Msg)
+			acks <- reply.Ok
+		}(via)
+	}
+	for range helpers {
+		if <-acks {
+			m.heardFrom(target)
+			return
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if mem, ok := m.members[target]; ok && mem.State == stateAlive {
+		log.Println("Suspecting " + target)
+		m.setState(target, mem, stateSuspect, mem.Incarnation)
+	}
+}
+
+// heardFrom is called when a member answers, directly or through another member
+func (m *Membership) heardFrom(addr string) {
+	m.onAlive(addr)
+}
+
+// expire declares dead every suspect which hasn't refuted the suspicion in time
+func (m *Membership) expire(now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for addr, mem := range m.members {
+		if mem.State == stateSuspect && now.Sub(mem.since) >= m.suspectTimeout {
+			log.Println("Declaring " + addr + " dead")
+			m.setState(addr, mem, stateDead, mem.Incarnation)
+		}
+	}
+}
+
+// setState moves a member to a new state and queues the news to be spread. The lock
+// must be held.
+func (m *Membership) setState(addr string, mem *member, state memberState, inc uint64) {
+	mem.State = state
+	mem.Incarnation = inc
+	mem.since = time.Now()
+	m.queue(swimUpdate{Addr: addr, State: state, Incarnation: inc})
+}
+
+// queue adds an update to be piggybacked, replacing older news about the same member.
+// The lock must be held.
+func (m *Membership) queue(u swimUpdate) {
+	for i, b := range m.broadcasts {
+		if b.update.Addr == u.Addr {
+			m.broadcasts = append(m.broadcasts[:i], m.broadcasts[i+1:]...)
+			break
+		}
+	}
+	m.broadcasts = append(m.broadcasts, &broadcast{update: u})
+}
+
+// outgoing builds a message carrying the least-sent news, dropping news which has been
+// sent often enough
+func (m *Membership) outgoing() swimMessage {
+	streaming := m.streaming()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	limit := swimRetransmit * int(math.Ceil(math.Log2(float64(len(m.members)+2))))
+	sort.SliceStable(m.broadcasts, func(i, j int) bool {
+		return m.broadcasts[i].sent < m.broadcasts[j].sent
+	})
+	msg := swimMessage{From: m.me, Joining: streaming}
+	for _, b := range m.broadcasts {
+		if len(msg.Updates) == swimMaxPiggyback {
+			break
+		}
+		msg.Updates = append(msg.Updates, b.update)
+		b.sent++
+	}
+	kept := m.broadcasts[:0]
+	for _, b := range m.broadcasts {
+		if b.sent < limit {
+			kept = append(kept, b)
+		}
+	}
+	m.broadcasts = kept
+	return msg
+}
+
+// Receive applies the news carried by a ping or ack. The sender is obviously alive.
+func (m *Membership) Receive(msg swimMessage) {
+	m.mutex.Lock()
+	if mem, ok := m.members[msg.From]; ok && mem.State != stateAlive {
+		m.setState(msg.From, mem, stateAlive, mem.Incarnation)
+	}
+	if _, ok := m.members[msg.From]; ok {
+		m.joining[msg.From] = msg.Joining
+	}
+	for _, u := range msg.Updates {
+		m.apply(u)
+	}
+	m.mutex.Unlock()
+}
+
+// apply merges one update into our state, following the SWIM ordering: news with a
+// higher incarnation wins, and at the same incarnation suspect beats alive and dead
+// beats both. The lock must be held.
+func (m *Membership) apply(u swimUpdate) {
+	if u.Addr == m.me {
+		// Somebody thinks we're in trouble, so refute it with a new incarnation
+		if u.State != stateAlive && u.Incarnation >= m.incarnation {
+			m.incarnation = u.Incarnation + 1
+			log.Println("Refuting suspicion with incarnation", m.incarnation)
+			m.queue(swimUpdate{Addr: m.me, State: stateAlive, Incarnation: m.incarnation})
+		}
+		return
+	}
+
+	mem, ok := m.members[u.Addr]
+	if !ok {
+		// Only members of the view are tracked
+		return
+	}
+	newer := u.Incarnation > mem.Incarnation
+	same := u.Incarnation == mem.Incarnation
+	switch u.State {
+	case stateAlive:
+		if newer {
+			m.setState(u.Addr, mem, stateAlive, u.Incarnation)
+		}
+	case stateSuspect:
+		if newer || (same && mem.State == stateAlive) {
+			m.setState(u.Addr, mem, stateSuspect, u.Incarnation)
+		}
+	case stateDead:
+		if mem.State != stateDead && (newer || same) {
+			m.setState(u.Addr, mem, stateDead, u.Incarnation)
+		}
+	}
+}
+
+// randomMembers returns up to n members which aren't dead, leaving out exclude
+func (m *Membership) randomMembers(n int, exclude string) []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var live []string
+	for addr, mem := range m.members {
+		if mem.State != stateDead && addr != exclude {
+			live = append(live, addr)
+		}
+	}
+	rand.Shuffle(len(live), func(i, j int) { live[i], live[j] = live[j], live[i] })
+	if len(live) > n {
+		live = live[:n]
+	}
+	return live
+}
+
+// Random returns up to n members to gossip with, skipping the dead ones
+func (m *Membership) Random(n int) []string {
+	m.sync()
+	return m.randomMembers(n, "")
+}
+
+// States returns what we believe about every member, including ourselves
+func (m *Membership) States() map[string]member {
+	m.sync()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	out := make(map[string]member, len(m.members)+1)
+	for addr, mem := range m.members {
+		out[addr] = *mem
+	}
+	out[m.me] = member{State: stateAlive, Incarnation: m.incarnation}
+	return out
+}
+
+// IsDead returns true if the member has been declared dead
+func (m *Membership) IsDead(addr string) bool {
+	if m == nil {
+		return false
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	mem, ok := m.members[addr]
+	return ok && mem.State == stateDead
+}
+
+// Joining returns true if any member which isn't dead, ourselves included, last said it
+// was still sending addr its share of the data
+func (m *Membership) Joining(addr string) bool {
+	if m == nil {
+		return false
+	}
+	for _, target := range m.streaming() {
+		if target == addr {
+			return true
+		}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for from, targets := range m.joining {
+		if mem, ok := m.members[from]; ok && mem.State == stateDead {
+			continue
+		}
+		for _, target := range targets {
+			if target == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+// swim_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for the SWIM failure detector
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Builds a failure detector over the test view where only the nodes in up answer, directly or indirectly
+func stubMembership(up map[string]bool) *Membership {
+	m := NewMembership(NewView(testMain, testView), time.Second, time.Minute, 2)
+	m.ping = func(ip string, msg swimMessage) (swimMessage, error) {
+		if up[ip] {
+			return swimMessage{From: ip}, nil
+		}
+		return swimMessage{}, errors.New("No ack")
+	}
+	m.pingReq = func(via string, target string, msg swimMessage) (swimAck, error) {
+		if !up[via] {
+			return swimAck{}, errors.New("No ack")
+		}
+		return swimAck{Ok: up[target], Msg: swimMessage{From: via}}, nil
+	}
+	return m
+}
+
+func TestSwimSuspectsThenKillsSilentMember(t *testing.T) {
+	m := stubMembership(map[string]bool{viewExist: true})
+	down := "176.32.164.10:8084"
+
+	m.probe(down)
+	equals(t, stateSuspect, m.States()[down].State)
+
+	// Still within the suspect timeout
+	m.expire(time.Now())
+	equals(t, stateSuspect, m.States()[down].State)
+
+	m.expire(time.Now().Add(time.Hour))
+	equals(t, stateDead, m.States()[down].State)
+	assert(t, m.IsDead(down), "Dead member not reported dead")
+}
+
+func TestSwimIndirectAckKeepsMemberAlive(t *testing.T) {
+	m := stubMembership(map[string]bool{viewExist: true})
+	target := "176.32.164.10:8084"
+	heard := ""
+	m.onAlive = func(addr string) { heard = addr }
+
+	// The direct ping fails, but the helper reaches the target
+	m.ping = func(ip string, msg swimMessage) (swimMessage, error) {
+		return swimMessage{}, errors.New("No ack")
+	}
+	m.pingReq = func(via string, tgt string, msg swimMessage) (swimAck, error) {
+		return swimAck{Ok: tgt == target, Msg: swimMessage{From: via}}, nil
+	}
+	m.probe(target)
+	equals(t, stateAlive, m.States()[target].State)
+	equals(t, target, heard)
+}
+
+func TestSwimRefutesSuspicionOfItself(t *testing.T) {
+	m := stubMembership(nil)
+	m.Receive(swimMessage{From: viewExist, Updates: []swimUpdate{{Addr: testMain, State: stateSuspect, Incarnation: 0}}})
+	equals(t, uint64(1), m.States()[testMain].Incarnation)
+
+	msg := m.outgoing()
+	equals(t, []swimUpdate{{Addr: testMain, State: stateAlive, Incarnation: 1}}, msg.Updates)
+}
+
+func TestSwimHigherIncarnationWins(t *testing.T) {
+	m := stubMembership(nil)
+	m.Receive(swimMessage{From: testMain, Updates: []swimUpdate{{Addr: viewExist, State: stateSuspect, Incarnation: 2}}})
+	equals(t, stateSuspect, m.States()[viewExist].State)
+
+	// Stale news of it being alive is ignored, newer news isn't
+	m.Receive(swimMessage{From: testMain, Updates: []swimUpdate{{Addr: viewExist, State: stateAlive, Incarnation: 2}}})
+	equals(t, stateSuspect, m.States()[viewExist].State)
+	m.Receive(swimMessage{From: testMain, Updates: []swimUpdate{{Addr: viewExist, State: stateAlive, Incarnation: 3}}})
+	equals(t, stateAlive, m.States()[viewExist].State)
+	equals(t, uint64(3), m.States()[viewExist].Incarnation)
+}
+
+func TestSwimUpdatesStopAfterEnoughSends(t *testing.T) {
+	m := stubMembership(nil)
+	m.Receive(swimMessage{From: testMain, Updates: []swimUpdate{{Addr: viewExist, State: stateDead, Incarnation: 0}}})
+	sends := 0
+	for i := 0; i < 100 && len(m.outgoing().Updates) > 0; i++ {
+		sends++
+	}
+	assert(t, sends > 1 && sends < 100, "Update sent %d times", sends)
+}
+
+func TestSwimGossipSkipsDeadMembers(t *testing.T) {
+	m := stubMembership(nil)
+	down := "176.32.164.10:8084"
+	m.Receive(swimMessage{From: testMain, Updates: []swimUpdate{{Addr: down, State: stateDead, Incarnation: 0}}})
+	g := GossipVals{view: NewView(testMain, testView), members: m}
+	for i := 0; i < 20; i++ {
+		for _, peer := range g.gossipees(2) {
+			assert(t, peer != down, "Gossiped with a dead member")
+		}
+	}
+}
+
+func TestViewGetReportsMemberStates(t *testing.T) {
+	m := stubMembership(nil)
+	m.Receive(swimMessage{From: testMain, Updates: []swimUpdate{{Addr: viewExist, State: stateSuspect, Incarnation: 4}}})
+	app := App{db: &testKVS, view: *NewView(testMain, testView), members: m}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, view, nil)
+	ok(t, err)
+	app.ViewGetHandler(recorder, req)
+
+	var gotBody struct {
+		Members map[string]struct {
+			State       string
+			Incarnation uint64
+		}
+	}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+	equals(t, 3, len(gotBody.Members))
+	equals(t, "alive", gotBody.Members[testMain].State)
+	equals(t, "suspect", gotBody.Members[viewExist].State)
+	equals(t, uint64(4), gotBody.Members[viewExist].Incarnation)
+}
+
+func TestViewGetReportsJoiningFromAnotherNodesTransfer(t *testing.T) {
+	m := stubMembership(nil)
+	app := App{db: &testKVS, view: *NewView(testMain, testView), members: m}
+	joiner := "176.32.164.10:8084"
+	stateOf := func() string {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, view, nil)
+		ok(t, err)
+		app.ViewGetHandler(recorder, req)
+		var gotBody struct {
+			Members map[string]struct{ State string }
+		}
+		ok(t, json.Unmarshal(recorder.Body.Bytes(), &gotBody))
+		return gotBody.Members[joiner].State
+	}
+
+	// We aren't sending it anything, but another member says it is
+	m.Receive(swimMessage{From: viewExist, Joining: []string{joiner}})
+	equals(t, "joining", stateOf())
+
+	// Once the sender says it has caught up the member is just alive
+	m.Receive(swimMessage{From: viewExist})
+	equals(t, "alive", stateOf())
+
+	// A sender which has died can't keep a member joining forever
+	m.Receive(swimMessage{From: viewExist, Joining: []string{joiner}})
+	m.Receive(swimMessage{From: testMain, Updates: []swimUpdate{{Addr: viewExist, State: stateDead, Incarnation: 0}}})
+	equals(t, "alive", stateOf())
+}
+
+func TestSwimMessagesCarryOurTransfers(t *testing.T) {
+	m := stubMembership(nil)
+	m.streaming = func() []string { return []string{viewExist} }
+	equals(t, []string{viewExist}, m.outgoing().Joining)
+	assert(t, m.Joining(viewExist), "Member we're streaming to isn't joining")
+}
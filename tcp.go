@@ -31,12 +31,14 @@ import (
 
 // A timeGlob is a map of keys to timestamps and lets the gossip module figure out which ones need to be updated
 type timeGlob struct {
-	List map[string]time.Time
+	List  map[string]time.Time
+	Epoch uint64 // The sender's view epoch
 }
 
 // An entryGlob is a map of keys to entries which allowes the gossip module to enter into conflict resolution and update the required keys
 type entryGlob struct {
-	Keys map[string]Entry
+	Keys  map[string]Entry
+	Epoch uint64 // The sender's view epoch
 }
 
 // Open connects to a TCP Address.
@@ -54,6 +56,60 @@ func Open(addr string) (*bufio.ReadWriter, error) {
 	return bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
 }
 
+// openConn connects to a peer like Open does, but gives up once the timeout has passed.
+// The connection is returned as well so the caller can close it when it's done.
+func openConn(addr string, timeout time.Duration) (net.Conn, *bufio.ReadWriter, error) {
+	s := strings.Split(addr, ":")[0] + port
+	log.Println("Dial " + s)
+	conn, err := net.DialTimeout("tcp", s, timeout)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Dialing "+addr+" failed")
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+// A replicaWrite carries an entry from a quorum coordinator to one of the key's replicas
+type replicaWrite struct {
+	Key   string
+	Entry Entry
+	Epoch uint64 // The coordinator's view epoch
+}
+
+// A replicaEntry is a replica's answer to a quorum read
+type replicaEntry struct {
+	Found bool
+	Entry Entry
+}
+
+// A merkleRequest asks a peer for the hashes of some nodes on one level of its Merkle tree
+type merkleRequest struct {
+	Epoch uint64 // The asker's view epoch
+	Level int
+	Nodes []int
+}
+
+// A merkleReply carries the requested hashes, or says the asker's view is out of date
+type merkleReply struct {
+	Stale  bool      // The asker is behind, so no hashes were sent
+	View   viewEntry // Our current view
+	Hashes []uint64
+}
+
+// errStaleEpoch is returned when gossip is refused because one side's view is out of date
+var errStaleEpoch = errors.New("Gossip refused, view epochs differ")
+
+// refuses returns true if entries sent from a view epoch older than ours have to be
+// turned away. A node which missed a view change may still be sending keys to the
+// owners they had before it.
+func (e *Endpoint) refuses(epoch uint64, what string) bool {
+	if epoch < e.gossip.views.Epoch() {
+		log.Println("Refusing", what, "from view epoch", epoch)
+		return true
+	}
+	return false
+}
+
 // HandleFunc is a function that handles an incoming command.
 // It receives the open connection wrapped in a `ReadWriter` interface.
 type HandleFunc func(*bufio.ReadWriter)
@@ -156,8 +212,14 @@ func (e *Endpoint) handleTimeGob(rw *bufio.ReadWriter) {
 
 	log.Printf("Decoding timeGlob: %#v\n", data)
 
-	// Pass the data glob to the gossip module and get the result
-	data = e.gossip.ClockPrune(data)
+	// Pass the data glob to the gossip module and get the result. A sender with an
+	// older view gets nothing back but our epoch, which tells it so.
+	if e.refuses(data.Epoch, "timeGlob") {
+		data = timeGlob{List: map[string]time.Time{}}
+	} else {
+		data = e.gossip.ClockPrune(data)
+	}
+	data.Epoch = e.gossip.views.Epoch()
 
 	// Create an encoder on the stream
 	enc := gob.NewEncoder(rw)
@@ -190,6 +252,9 @@ func (e *Endpoint) handleEntryGob(rw *bufio.ReadWriter) {
 	}
 
 	log.Println("Decoding entryGlob: ", data)
+	if e.refuses(data.Epoch, "entryGlob") {
+		return
+	}
 	log.Println("Updating KVS")
 	e.gossip.UpdateKVS(data)
 	// Print the complexData struct and the nested one, too, to prove
@@ -198,7 +263,7 @@ func (e *Endpoint) handleEntryGob(rw *bufio.ReadWriter) {
 }
 
 func (e *Endpoint) handleViewGob(rw *bufio.ReadWriter) {
-	var data []string
+	var data viewEntry
 	dec := gob.NewDecoder(rw)
 	log.Println("Decoding viewGob data")
 	err := dec.Decode(&data)
@@ -207,9 +272,7 @@ func (e *Endpoint) handleViewGob(rw *bufio.ReadWriter) {
 		return
 	}
 
-	log.Println("Updating viewList - old views: " + e.gossip.view.String())
-	e.gossip.UpdateViews(data)
-	log.Println("Views updated: ", data)
+	e.gossip.LearnView(data)
 }
 
 func (e *Endpoint) handleHelp(rw *bufio.ReadWriter) {
@@ -217,6 +280,263 @@ func (e *Endpoint) handleHelp(rw *bufio.ReadWriter) {
 	wakeGossip = true
 }
 
+// handleReplicate stores an entry sent by a quorum coordinator or replayed as a hint,
+// unless we already have a newer version, and acknowledges it either way. An entry sent
+// from an older view epoch is refused.
+func (e *Endpoint) handleReplicate(rw *bufio.ReadWriter) {
+	log.Println("Receive replica write")
+	var data replicaWrite
+	dec := gob.NewDecoder(rw)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Println("Error decoding GOB data:", err)
+		return
+	}
+	normalizeEntry(&data.Entry)
+
+	ack := !e.refuses(data.Epoch, "replica write")
+	if ack {
+		e.gossip.MergeEntry(data.Key, &data.Entry)
+	}
+
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(ack)
+	if err != nil {
+		log.Println("Encode failed for replica ack")
+	}
+	err = rw.Flush()
+	if err != nil {
+		log.Println("Flush failed.")
+	}
+}
+
+// handleTransfer applies a batch of keys streamed to us after a view change and
+// acknowledges it, so the sender can move on to the next batch. A batch sent from an
+// older view epoch is refused.
+func (e *Endpoint) handleTransfer(rw *bufio.ReadWriter) {
+	var data entryGlob
+	dec := gob.NewDecoder(rw)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Println("Error decoding GOB data:", err)
+		return
+	}
+	log.Println("Receive", len(data.Keys), "rebalanced keys")
+	ack := !e.refuses(data.Epoch, "transfer")
+	if ack {
+		e.gossip.UpdateKVS(data)
+	}
+
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(ack)
+	if err != nil {
+		log.Println("Encode failed for transfer ack")
+	}
+	err = rw.Flush()
+	if err != nil {
+		log.Println("Flush failed.")
+	}
+}
+
+// handleTombstones takes tombstones offered by a peer's collector and acks the ones we
+// hold, or hold something newer than, once they've been merged
+func (e *Endpoint) handleTombstones(rw *bufio.ReadWriter) {
+	var data entryGlob
+	dec := gob.NewDecoder(rw)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Println("Error decoding GOB data:", err)
+		return
+	}
+	log.Println("Receive", len(data.Keys), "tombstones to ack")
+	var acked []string
+	for key, entry := range data.Keys {
+		entry := entry
+		e.gossip.MergeEntry(key, &entry)
+		if e.gossip.kvs.Seen(key, &entry) {
+			acked = append(acked, key)
+		}
+	}
+
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(acked)
+	if err != nil {
+		log.Println("Encode failed for tombstone acks")
+	}
+	err = rw.Flush()
+	if err != nil {
+		log.Println("Flush failed.")
+	}
+}
+
+// handleRead returns our entry for a key to a quorum coordinator
+func (e *Endpoint) handleRead(rw *bufio.ReadWriter) {
+	log.Println("Receive replica read")
+	var key string
+	dec := gob.NewDecoder(rw)
+	err := dec.Decode(&key)
+	if err != nil {
+		log.Println("Error decoding GOB data:", err)
+		return
+	}
+
+	var data replicaEntry
+	eg := e.gossip.kvs.GetEntryGlob(timeGlob{List: map[string]time.Time{key: {}}})
+	data.Entry, data.Found = eg.Keys[key]
+
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(data)
+	if err != nil {
+		log.Println("Encode failed for struct: ", data)
+	}
+	err = rw.Flush()
+	if err != nil {
+		log.Println("Flush failed.")
+	}
+}
+
+// handleScan returns the entries we hold in a range to a scan coordinator
+func (e *Endpoint) handleScan(rw *bufio.ReadWriter) {
+	log.Println("Receive scan")
+	var req scanRequest
+	dec := gob.NewDecoder(rw)
+	err := dec.Decode(&req)
+	if err != nil {
+		log.Println("Error decoding GOB data:", err)
+		return
+	}
+
+	var data scanReply
+	data.Entries, data.More = e.gossip.kvs.Scan(req.Start, req.End, req.Limit)
+
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(data)
+	if err != nil {
+		log.Println("Encode failed for scan reply")
+	}
+	err = rw.Flush()
+	if err != nil {
+		log.Println("Flush failed.")
+	}
+}
+
+// handleMerkle returns the hashes of the requested nodes in our Merkle tree. Gossip from
+// a node with an older view is refused, and it's sent our view instead.
+func (e *Endpoint) handleMerkle(rw *bufio.ReadWriter) {
+	var req merkleRequest
+	dec := gob.NewDecoder(rw)
+	err := dec.Decode(&req)
+	if err != nil {
+		log.Println("Error decoding GOB data:", err)
+		return
+	}
+
+	reply := merkleReply{View: e.gossip.views.Current()}
+	if req.Epoch < reply.View.Epoch {
+		log.Println("Refusing gossip from view epoch", req.Epoch)
+		reply.Stale = true
+	} else {
+		reply.Hashes = e.gossip.kvs.MerkleTree().Hashes(req.Level, req.Nodes)
+	}
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(reply)
+	if err != nil {
+		log.Println("Encode failed for Merkle hashes")
+	}
+	err = rw.Flush()
+	if err != nil {
+		log.Println("Flush failed.")
+	}
+}
+
+// handlePing answers a failure detector ping with an ack carrying our own news
+func (e *Endpoint) handlePing(rw *bufio.ReadWriter) {
+	var msg swimMessage
+	dec := gob.NewDecoder(rw)
+	err := dec.Decode(&msg)
+	if err != nil {
+		log.Println("Error decoding GOB data:", err)
+		return
+	}
+	e.gossip.members.Receive(msg)
+
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(e.gossip.members.outgoing())
+	if err != nil {
+		log.Println("Encode failed for ack")
+	}
+	err = rw.Flush()
+	if err != nil {
+		log.Println("Flush failed.")
+	}
+}
+
+// handlePingReq pings a member on behalf of another and reports whether it acked
+func (e *Endpoint) handlePingReq(rw *bufio.ReadWriter) {
+	var req swimPingReq
+	dec := gob.NewDecoder(rw)
+	err := dec.Decode(&req)
+	if err != nil {
+		log.Println("Error decoding GOB data:", err)
+		return
+	}
+	m := e.gossip.members
+	m.Receive(req.Msg)
+
+	var ack swimAck
+	reply, err := m.ping(req.Target, m.outgoing())
+	if err == nil {
+		m.Receive(reply)
+		ack.Ok = true
+	}
+	ack.Msg = m.outgoing()
+
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(ack)
+	if err != nil {
+		log.Println("Encode failed for ping-req ack")
+	}
+	err = rw.Flush()
+	if err != nil {
+		log.Println("Flush failed.")
+	}
+}
+
+// handlePrepare answers phase one of a view change proposal
+func (e *Endpoint) handlePrepare(rw *bufio.ReadWriter) {
+	e.handlePaxos(rw, e.gossip.views.Prepare)
+}
+
+// handleAccept answers phase two of a view change proposal
+func (e *Endpoint) handleAccept(rw *bufio.ReadWriter) {
+	e.handlePaxos(rw, e.gossip.views.Accept)
+}
+
+// handlePaxos decodes a request for the membership log and sends back its reply
+func (e *Endpoint) handlePaxos(rw *bufio.ReadWriter, f func(paxosRequest) paxosReply) {
+	var req paxosRequest
+	dec := gob.NewDecoder(rw)
+	err := dec.Decode(&req)
+	if err != nil {
+		log.Println("Error decoding GOB data:", err)
+		return
+	}
+	if e.gossip.views == nil {
+		log.Println("No membership log, ignoring view change proposal")
+		return
+	}
+
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(f(req))
+	if err != nil {
+		log.Println("Encode failed for Paxos reply")
+	}
+	err = rw.Flush()
+	if err != nil {
+		log.Println("Flush failed.")
+	}
+}
+
 // client is called if the app is called with -connect=`ip addr`.
 func sendTimeGlob(ip string, tg timeGlob) (*timeGlob, error) {
 	// Open a connection to the server.
@@ -254,6 +574,9 @@ func sendTimeGlob(ip string, tg timeGlob) (*timeGlob, error) {
 		log.Println("Error decoding GOB data:", err)
 		return nil, err
 	}
+	if out.Epoch > tg.Epoch {
+		return nil, errStaleEpoch
+	}
 
 	return &out, nil
 }
@@ -289,7 +612,8 @@ func sendEntryGlob(ip string, eg entryGlob) error {
 	return nil
 }
 
-func sendViewList(ip string, v []string) error {
+// sendViewList tells a peer about a view
+func sendViewList(ip string, v viewEntry) error {
 	rw, err := Open(ip)
 	if err != nil {
 		return errors.Wrap(err, "Client: failed to open connection to "+ip)
@@ -301,10 +625,10 @@ func sendViewList(ip string, v []string) error {
 		return errors.Wrap(err, "Could not write view data ("+strconv.Itoa(n)+" bytes written)")
 	}
 
-	log.Println("Encoding view []string")
+	log.Println("Encoding view from epoch", v.Epoch)
 	err = enc.Encode(v)
 	if err != nil {
-		return errors.Wrapf(err, "Encode failed for slice: %#v", v)
+		return errors.Wrapf(err, "Encode failed for view: %#v", v)
 
 	}
 	log.Println("Flushing buffer")
@@ -331,6 +655,343 @@ func askForHelp(ip string) error {
 	return err
 }
 
+// sendReplica sends an entry written in the given view epoch to a replica and waits for
+// it to be acknowledged
+func sendReplica(ip string, key string, e Entry, epoch uint64, timeout time.Duration) error {
+	conn, rw, err := openConn(ip, timeout)
+	if err != nil {
+		return errors.Wrap(err, "Client: Failed to open connection to "+ip)
+	}
+	defer conn.Close()
+
+	log.Println("Sending command initialization: 'replicate'")
+	n, err := rw.WriteString("replicate\n")
+	if err != nil {
+		return errors.Wrap(err, "Could not write GOB data ("+strconv.Itoa(n)+" bytes written)")
+	}
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(replicaWrite{Key: key, Entry: e, Epoch: epoch})
+	if err != nil {
+		return errors.Wrapf(err, "Encode failed for entry: %#v", e)
+	}
+	err = rw.Flush()
+	if err != nil {
+		return errors.Wrap(err, "Flush failed.")
+	}
+
+	var ack bool
+	dec := gob.NewDecoder(rw)
+	err = dec.Decode(&ack)
+	if err != nil {
+		return errors.Wrap(err, "No ack from "+ip)
+	}
+	if !ack {
+		return errors.Wrap(errStaleEpoch, ip+" refused the write")
+	}
+	return nil
+}
+
+// sendTransfer streams a batch of keys to their new owner and waits for it to be applied
+func sendTransfer(ip string, eg entryGlob, timeout time.Duration) error {
+	conn, rw, err := openConn(ip, timeout)
+	if err != nil {
+		return errors.Wrap(err, "Client: Failed to open connection to "+ip)
+	}
+	defer conn.Close()
+
+	n, err := rw.WriteString("transfer\n")
+	if err != nil {
+		return errors.Wrap(err, "Could not write GOB data ("+strconv.Itoa(n)+" bytes written)")
+	}
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(eg)
+	if err != nil {
+		return errors.Wrap(err, "Encode failed for transfer batch")
+	}
+	err = rw.Flush()
+	if err != nil {
+		return errors.Wrap(err, "Flush failed.")
+	}
+
+	var ack bool
+	dec := gob.NewDecoder(rw)
+	err = dec.Decode(&ack)
+	if err != nil {
+		return errors.Wrap(err, "No transfer ack from "+ip)
+	}
+	if !ack {
+		return errors.Wrap(errStaleEpoch, ip+" refused the transfer")
+	}
+	return nil
+}
+
+// sendTombstones offers tombstones to a peer and returns the keys it acked
+func sendTombstones(ip string, eg entryGlob, timeout time.Duration) ([]string, error) {
+	conn, rw, err := openConn(ip, timeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "Client: Failed to open connection to "+ip)
+	}
+	defer conn.Close()
+
+	n, err := rw.WriteString("tombstones\n")
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not write GOB data ("+strconv.Itoa(n)+" bytes written)")
+	}
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(eg)
+	if err != nil {
+		return nil, errors.Wrap(err, "Encode failed for tombstones")
+	}
+	err = rw.Flush()
+	if err != nil {
+		return nil, errors.Wrap(err, "Flush failed.")
+	}
+
+	var acked []string
+	dec := gob.NewDecoder(rw)
+	err = dec.Decode(&acked)
+	if err != nil {
+		return nil, errors.Wrap(err, "No tombstone acks from "+ip)
+	}
+	return acked, nil
+}
+
+// readReplica asks a replica for its entry for a key. It returns nil if the replica
+// doesn't have one.
+func readReplica(ip string, key string, timeout time.Duration) (*Entry, error) {
+	conn, rw, err := openConn(ip, timeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "Client: Failed to open connection to "+ip)
+	}
+	defer conn.Close()
+
+	log.Println("Sending command initialization: 'read'")
+	n, err := rw.WriteString("read\n")
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not write GOB data ("+strconv.Itoa(n)+" bytes written)")
+	}
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Encode failed for key "+key)
+	}
+	err = rw.Flush()
+	if err != nil {
+		return nil, errors.Wrap(err, "Flush failed.")
+	}
+
+	var out replicaEntry
+	dec := gob.NewDecoder(rw)
+	err = dec.Decode(&out)
+	if err != nil {
+		return nil, errors.Wrap(err, "No reply from "+ip)
+	}
+	if !out.Found {
+		return nil, nil
+	}
+	normalizeEntry(&out.Entry)
+	return &out.Entry, nil
+}
+
+// sendScan asks a node for the entries it holds in a range
+func sendScan(ip string, req scanRequest, timeout time.Duration) (scanReply, error) {
+	var out scanReply
+	conn, rw, err := openConn(ip, timeout)
+	if err != nil {
+		return out, errors.Wrap(err, "Client: Failed to open connection to "+ip)
+	}
+	defer conn.Close()
+
+	log.Println("Sending command initialization: 'scan'")
+	n, err := rw.WriteString("scan\n")
+	if err != nil {
+		return out, errors.Wrap(err, "Could not write GOB data ("+strconv.Itoa(n)+" bytes written)")
+	}
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(req)
+	if err != nil {
+		return out, errors.Wrapf(err, "Encode failed for struct: %#v", req)
+	}
+	err = rw.Flush()
+	if err != nil {
+		return out, errors.Wrap(err, "Flush failed.")
+	}
+
+	dec := gob.NewDecoder(rw)
+	err = dec.Decode(&out)
+	if err != nil {
+		return out, errors.Wrap(err, "No reply from "+ip)
+	}
+	for i := range out.Entries {
+		normalizeEntry(&out.Entries[i].Entry)
+	}
+	return out, nil
+}
+
+// sendMerkleDiff compares our Merkle tree with a peer's and returns the leaves where they differ
+func sendMerkleDiff(ip string, t *MerkleTree, views *ViewLog) ([]int, error) {
+	conn, rw, err := openConn(ip, gossipTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "Client: Failed to open connection to "+ip)
+	}
+	defer conn.Close()
+	return merkleDiff(rw, t, views)
+}
+
+// merkleDiff walks down our Merkle tree and the one at the other end of the connection
+// together. Only the children of nodes whose hashes differ are asked for, so nothing is
+// sent about the parts of the key space the two agree on. It returns the differing leaves.
+//
+// Both sides have to be on the same view epoch. If the peer is ahead we adopt its view,
+// and if it's behind we send it ours, and either way errStaleEpoch is returned.
+func merkleDiff(rw *bufio.ReadWriter, t *MerkleTree, views *ViewLog) ([]int, error) {
+	epoch := views.Epoch()
+	nodes := []int{0}
+	for level := 0; ; level++ {
+		n, err := rw.WriteString("merkle\n")
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not write GOB data ("+strconv.Itoa(n)+" bytes written)")
+		}
+		enc := gob.NewEncoder(rw)
+		err = enc.Encode(merkleRequest{Epoch: epoch, Level: level, Nodes: nodes})
+		if err != nil {
+			return nil, errors.Wrap(err, "Encode failed for Merkle request")
+		}
+		err = rw.Flush()
+		if err != nil {
+			return nil, errors.Wrap(err, "Flush failed.")
+		}
+
+		var reply merkleReply
+		dec := gob.NewDecoder(rw)
+		err = dec.Decode(&reply)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error decoding Merkle hashes")
+		}
+		if reply.Stale {
+			views.Learn(reply.View)
+			return nil, errStaleEpoch
+		}
+		if reply.View.Epoch < epoch {
+			return nil, errStaleEpoch
+		}
+		theirs := reply.Hashes
+		if len(theirs) != len(nodes) {
+			return nil, errors.Errorf("Asked for %d Merkle hashes, got %d", len(nodes), len(theirs))
+		}
+
+		ours := t.Hashes(level, nodes)
+		var differ []int
+		for i, n := range nodes {
+			if ours[i] != theirs[i] {
+				differ = append(differ, n)
+			}
+		}
+		if level == merkleDepth || len(differ) == 0 {
+			return differ, nil
+		}
+
+		// Look at both halves of every node that didn't match
+		nodes = make([]int, 0, 2*len(differ))
+		for _, n := range differ {
+			nodes = append(nodes, 2*n, 2*n+1)
+		}
+	}
+}
+
+// sendPaxos sends a prepare or accept to a member of the view and returns its reply
+func sendPaxos(ip string, cmd string, req paxosRequest, timeout time.Duration) (paxosReply, error) {
+	var reply paxosReply
+	conn, rw, err := openConn(ip, timeout)
+	if err != nil {
+		return reply, errors.Wrap(err, "Client: Failed to open connection to "+ip)
+	}
+	defer conn.Close()
+
+	n, err := rw.WriteString(cmd + "\n")
+	if err != nil {
+		return reply, errors.Wrap(err, "Could not write GOB data ("+strconv.Itoa(n)+" bytes written)")
+	}
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(req)
+	if err != nil {
+		return reply, errors.Wrap(err, "Encode failed for "+cmd)
+	}
+	err = rw.Flush()
+	if err != nil {
+		return reply, errors.Wrap(err, "Flush failed.")
+	}
+
+	dec := gob.NewDecoder(rw)
+	err = dec.Decode(&reply)
+	if err != nil {
+		return reply, errors.Wrap(err, "No "+cmd+" reply from "+ip)
+	}
+	return reply, nil
+}
+
+// sendPing pings a member and returns its ack
+func sendPing(ip string, msg swimMessage, timeout time.Duration) (swimMessage, error) {
+	var ack swimMessage
+	conn, rw, err := openConn(ip, timeout)
+	if err != nil {
+		return ack, errors.Wrap(err, "Client: Failed to open connection to "+ip)
+	}
+	defer conn.Close()
+
+	n, err := rw.WriteString("ping\n")
+	if err != nil {
+		return ack, errors.Wrap(err, "Could not write GOB data ("+strconv.Itoa(n)+" bytes written)")
+	}
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(msg)
+	if err != nil {
+		return ack, errors.Wrap(err, "Encode failed for ping")
+	}
+	err = rw.Flush()
+	if err != nil {
+		return ack, errors.Wrap(err, "Flush failed.")
+	}
+
+	dec := gob.NewDecoder(rw)
+	err = dec.Decode(&ack)
+	if err != nil {
+		return ack, errors.Wrap(err, "No ack from "+ip)
+	}
+	return ack, nil
+}
+
+// sendPingReq asks via to ping target for us
+func sendPingReq(via string, target string, msg swimMessage, timeout time.Duration) (swimAck, error) {
+	var ack swimAck
+	conn, rw, err := openConn(via, timeout)
+	if err != nil {
+		return ack, errors.Wrap(err, "Client: Failed to open connection to "+via)
+	}
+	defer conn.Close()
+
+	n, err := rw.WriteString("pingreq\n")
+	if err != nil {
+		return ack, errors.Wrap(err, "Could not write GOB data ("+strconv.Itoa(n)+" bytes written)")
+	}
+	enc := gob.NewEncoder(rw)
+	err = enc.Encode(swimPingReq{Target: target, Msg: msg})
+	if err != nil {
+		return ack, errors.Wrap(err, "Encode failed for ping-req")
+	}
+	err = rw.Flush()
+	if err != nil {
+		return ack, errors.Wrap(err, "Flush failed.")
+	}
+
+	dec := gob.NewDecoder(rw)
+	err = dec.Decode(&ack)
+	if err != nil {
+		return ack, errors.Wrap(err, "No ping-req ack from "+via)
+	}
+	return ack, nil
+}
+
 // server listens for incoming requests and dispatches them to
 // registered handler functions.
 func server(a App, g GossipVals) {
@@ -363,6 +1024,23 @@ func server(a App, g GossipVals) {
 	endpoint.AddHandleFunc("view", endpoint.handleViewGob)
 	// Add HandleHelp
 	endpoint.AddHandleFunc("help", endpoint.handleHelp)
+	// Add the quorum handlers
+	endpoint.AddHandleFunc("replicate", endpoint.handleReplicate)
+	endpoint.AddHandleFunc("read", endpoint.handleRead)
+	// Add HandleScan for range scans
+	endpoint.AddHandleFunc("scan", endpoint.handleScan)
+	// Add HandleMerkle
+	endpoint.AddHandleFunc("merkle", endpoint.handleMerkle)
+	// Add the failure detector handlers
+	endpoint.AddHandleFunc("ping", endpoint.handlePing)
+	endpoint.AddHandleFunc("pingreq", endpoint.handlePingReq)
+	// Add HandleTransfer for rebalancing
+	endpoint.AddHandleFunc("transfer", endpoint.handleTransfer)
+	// Add HandleTombstones for tombstone collection
+	endpoint.AddHandleFunc("tombstones", endpoint.handleTombstones)
+	// Add the membership log handlers
+	endpoint.AddHandleFunc("prepare", endpoint.handlePrepare)
+	endpoint.AddHandleFunc("accept", endpoint.handleAccept)
 
 	endpoint.listener = tcpl
 	endpoint.gossip = g
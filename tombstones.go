@@ -0,0 +1,340 @@
+// tombstones.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines tombstone garbage collection. A delete leaves a tombstone so that replicas
+// still holding the old value learn about it, but once every replica has it there's no
+// need to keep gossiping it. The collector offers each tombstone to the members of the
+// current view which store the key, and they ack it once they hold it or anything newer.
+// A tombstone every one of them has acked is collected, and so is one older than the
+// grace period, however many acks it has.
+//
+// A collected tombstone leaves the db, and with it every timeGlob and Merkle tree, but
+// a small record of it is buried in the graveyard. Nothing older than a grave is ever
+// stored again, so a peer which lagged behind can't bring the key back by gossiping its
+// old value, and a new write of the key is ordered after the delete it follows. A grave
+// is dropped once every member has acked it and it has been buried for the grace period.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	gcInterval    = 10 * time.Second // How often tombstones are offered and collected
+	gcBatch       = 500              // Tombstones offered to a peer at once
+	graveyardName = "graveyard.gob"  // File holding the graves in the data directory
+)
+
+// A grave is a collected tombstone
+type grave struct {
+	Entry     Entry
+	Collected time.Time
+}
+
+// Graveyard keeps the tombstones which have been collected
+type Graveyard struct {
+	path   string // Where the graves are saved, empty to keep them in memory only
+	graves map[string]grave
+	mutex  sync.Mutex
+}
+
+// NewGraveyard creates a graveyard which is only kept in memory
+func NewGraveyard() *Graveyard {
+	return &Graveyard{graves: make(map[string]grave)}
+}
+
+// OpenGraveyard opens the graveyard saved in dir, creating the directory if needed
+func OpenGraveyard(dir string) (*Graveyard, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "Creating data directory failed")
+	}
+	g := NewGraveyard()
+	g.path = filepath.Join(dir, graveyardName)
+	data, err := ioutil.ReadFile(g.path)
+	if os.IsNotExist(err) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Reading graveyard failed")
+	}
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&g.graves)
+	if err != nil {
+		return nil, errors.Wrap(err, "Decoding graveyard failed")
+	}
+	for key, gr := range g.graves {
+		normalizeEntry(&gr.Entry)
+		g.graves[key] = gr
+	}
+	log.Println("Loaded", len(g.graves), "collected tombstones")
+	return g, nil
+}
+
+// save writes the graves to disk. The lock must be held.
+func (g *Graveyard) save() error {
+	if g.path == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(g.graves)
+	if err != nil {
+		return errors.Wrap(err, "Encoding graveyard failed")
+	}
+	err = writeFileSync(g.path+".tmp", buf.Bytes())
+	if err != nil {
+		return err
+	}
+	err = os.Rename(g.path+".tmp", g.path)
+	if err != nil {
+		return errors.Wrap(err, "Renaming graveyard failed")
+	}
+	return nil
+}
+
+// Get returns the collected tombstone of a key
+func (g *Graveyard) Get(key string) (Entry, bool) {
+	if g == nil {
+		return Entry{}, false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	gr, ok := g.graves[key]
+	return gr.Entry, ok
+}
+
+// List returns every grave
+func (g *Graveyard) List() map[string]grave {
+	out := make(map[string]grave)
+	if g == nil {
+		return out
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for key, gr := range g.graves {
+		out[key] = gr
+	}
+	return out
+}
+
+// Bury records tombstones as collected. They're on disk by the time it returns.
+func (g *Graveyard) Bury(tombs map[string]Entry, now time.Time) error {
+	if g == nil || len(tombs) == 0 {
+		return nil
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for key, e := range tombs {
+		g.graves[key] = grave{Entry: copyEntry(e), Collected: now}
+	}
+	return g.save()
+}
+
+// Forget drops graves which are no longer needed
+func (g *Graveyard) Forget(keys []string) error {
+	if g == nil || len(keys) == 0 {
+		return nil
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, key := range keys {
+		delete(g.graves, key)
+	}
+	return g.save()
+}
+
+// tombstoneAcks is the set of peers known to hold one version of a tombstone
+type tombstoneAcks struct {
+	timestamp time.Time
+	peers     map[string]bool
+}
+
+// Collector offers tombstones to the other replicas and collects them once it's safe
+type Collector struct {
+	me    string
+	view  View
+	ring  *Ring // nil means every node stores every key
+	kvs   *KVS
+	grace time.Duration
+	acks  map[string]tombstoneAcks
+	mutex sync.Mutex
+
+	send func(ip string, eg entryGlob) ([]string, error) // Offers tombstones and returns the keys acked
+	now  func() time.Time
+}
+
+// NewCollector creates a collector for the tombstones in our KVS
+func NewCollector(v View, ring *Ring, k *KVS, grace time.Duration, timeout time.Duration) *Collector {
+	return &Collector{
+		me:    v.Primary(),
+		view:  v,
+		ring:  ring,
+		kvs:   k,
+		grace: grace,
+		acks:  make(map[string]tombstoneAcks),
+		send: func(ip string, eg entryGlob) ([]string, error) {
+			return sendTombstones(ip, eg, timeout)
+		},
+		now: time.Now,
+	}
+}
+
+// Run collects tombstones forever
+func (c *Collector) Run() {
+	for {
+		time.Sleep(gcInterval)
+		c.collect()
+	}
+}
+
+// owners returns the other members of the view which store a key
+func (c *Collector) owners(key string) []string {
+	var nodes []string
+	if c.ring == nil {
+		nodes = c.view.List()
+	} else {
+		nodes = c.ring.PreferenceList(key)
+	}
+	var out []string
+	for _, n := range nodes {
+		if n != c.me {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// hasAcked returns true if peer holds this version of the tombstone. The lock must be held.
+func (c *Collector) hasAcked(key string, e Entry, peer string) bool {
+	a, ok := c.acks[key]
+	return ok && a.timestamp.Equal(e.Timestamp) && a.peers[peer]
+}
+
+// allAcked returns true if every owner of a key holds this version of its tombstone
+func (c *Collector) allAcked(key string, e Entry) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, peer := range c.owners(key) {
+		if !c.hasAcked(key, e, peer) {
+			return false
+		}
+	}
+	return true
+}
+
+// record notes the tombstones a peer acked
+func (c *Collector) record(peer string, eg entryGlob, acked []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, key := range acked {
+		e, ok := eg.Keys[key]
+		if !ok {
+			continue
+		}
+		a := c.acks[key]
+		if a.peers == nil || !a.timestamp.Equal(e.Timestamp) {
+			a = tombstoneAcks{timestamp: e.Timestamp, peers: make(map[string]bool)}
+		}
+		a.peers[peer] = true
+		c.acks[key] = a
+	}
+}
+
+// offer sends each owner the tombstones and graves it hasn't acked yet
+func (c *Collector) offer(tombs map[string]Entry) {
+	pending := make(map[string]entryGlob)
+	c.mutex.Lock()
+	for key, e := range tombs {
+		for _, peer := range c.owners(key) {
+			if c.hasAcked(key, e, peer) {
+				continue
+			}
+			eg, ok := pending[peer]
+			if !ok {
+				eg = entryGlob{Keys: make(map[string]Entry)}
+				pending[peer] = eg
+			}
+			if len(eg.Keys) < gcBatch {
+				eg.Keys[key] = e
+			}
+		}
+	}
+	c.mutex.Unlock()
+
+	for peer, eg := range pending {
+		acked, err := c.send(peer, eg)
+		if err != nil {
+			log.Println("Error offering tombstones to "+peer+": ", err)
+			continue
+		}
+		c.record(peer, eg, acked)
+	}
+}
+
+// collect offers the tombstones around, collects the ones which are safe to drop and
+// forgets the graves which aren't needed any more
+func (c *Collector) collect() {
+	tombs := c.kvs.Tombstones()
+	graves := c.kvs.graves.List()
+	offered := make(map[string]Entry, len(tombs)+len(graves))
+	for key, e := range tombs {
+		offered[key] = e
+	}
+	for key, gr := range graves {
+		if _, ok := offered[key]; !ok {
+			offered[key] = gr.Entry
+		}
+	}
+	c.offer(offered)
+
+	now := c.now()
+	ready := make(map[string]Entry)
+	for key, e := range tombs {
+		if c.allAcked(key, e) || now.Sub(e.Timestamp) > c.grace {
+			ready[key] = e
+		}
+	}
+	if n := c.kvs.Collect(ready, now); n > 0 {
+		log.Println("Collected", n, "tombstones")
+		metrics.Add(metricTombstonesCollected, int64(n))
+	}
+
+	var forget []string
+	for key, gr := range graves {
+		if now.Sub(gr.Collected) > c.grace && c.allAcked(key, gr.Entry) {
+			forget = append(forget, key)
+		}
+	}
+	err := c.kvs.graves.Forget(forget)
+	if err != nil {
+		log.Println("Error forgetting graves: ", err)
+		return
+	}
+	// Acks for tombstones which were forgotten or written over aren't needed any more
+	c.mutex.Lock()
+	for _, key := range forget {
+		delete(offered, key)
+	}
+	for key := range c.acks {
+		if _, ok := offered[key]; !ok {
+			delete(c.acks, key)
+		}
+	}
+	c.mutex.Unlock()
+}
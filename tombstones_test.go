@@ -0,0 +1,154 @@
+// tombstones_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for tombstone collection
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Creates a KVS holding a tombstone for keyone, and a collector for it whose peers ack
+// whatever ack returns true for
+func testCollector(v View, ack func(ip string) bool) (*Collector, *KVS, Entry) {
+	k := NewKVS()
+	k.graves = NewGraveyard()
+	k.Put(keyone, valone, time.Now(), VectorClock{})
+	k.Delete(keyone, time.Now(), VectorClock{keyone: 1})
+	c := NewCollector(v, nil, k, time.Hour, time.Second)
+	c.send = func(ip string, eg entryGlob) ([]string, error) {
+		var acked []string
+		if ack(ip) {
+			for key := range eg.Keys {
+				acked = append(acked, key)
+			}
+		}
+		return acked, nil
+	}
+	return c, k, k.Tombstones()[keyone]
+}
+
+func TestCollectorWaitsForEveryAck(t *testing.T) {
+	v := NewView(testMain, testMain+","+viewExist+","+viewNotExist)
+	acking := map[string]bool{viewExist: true}
+	c, k, _ := testCollector(v, func(ip string) bool { return acking[ip] })
+
+	c.collect()
+	equals(t, 1, len(k.Tombstones()))
+
+	// Once the last member has it too, the tombstone goes
+	acking[viewNotExist] = true
+	c.collect()
+	equals(t, 0, len(k.Tombstones()))
+	_, buried := k.graves.Get(keyone)
+	assert(t, buried, "Collected tombstone wasn't buried")
+	equals(t, 0, len(k.GetTimeGlob().List))
+}
+
+func TestCollectorCollectsAfterGracePeriod(t *testing.T) {
+	v := NewView(testMain, testMain+","+viewExist)
+	c, k, _ := testCollector(v, func(string) bool { return false })
+	c.collect()
+	equals(t, 1, len(k.Tombstones()))
+
+	c.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	c.collect()
+	equals(t, 0, len(k.Tombstones()))
+
+	// The grave stays until every member has acked it
+	c.now = func() time.Time { return time.Now().Add(4 * time.Hour) }
+	c.collect()
+	_, buried := k.graves.Get(keyone)
+	assert(t, buried, "Grave forgotten before anyone acked it")
+	c.send = func(ip string, eg entryGlob) ([]string, error) { return []string{keyone}, nil }
+	c.collect()
+	_, buried = k.graves.Get(keyone)
+	assert(t, !buried, "Grave kept after every member acked it")
+}
+
+func TestCollectedKeyDoesNotComeBack(t *testing.T) {
+	v := NewView(testMain, testMain+","+viewExist)
+	c, k, tomb := testCollector(v, func(string) bool { return true })
+	c.collect()
+
+	// A lagging peer still has the value from before the delete
+	old := NewEntry(tomb.Timestamp.Add(-time.Second), VectorClock{keyone: 1}, valone, 1)
+	k.OverwriteEntry(keyone, old)
+	alive, _ := k.Contains(keyone)
+	assert(t, !alive, "Deleted key came back from gossip")
+	assert(t, k.Seen(keyone, &tomb), "Collected tombstone not counted as seen")
+
+	// A new write comes after the delete, even on a replica still holding the tombstone
+	k.Put(keyone, valtwo, time.Now(), VectorClock{keyone: 3})
+	alive, version := k.Contains(keyone)
+	assert(t, alive, "Key couldn't be written again after its tombstone was collected")
+	equals(t, 1, version)
+	e := k.GetEntryGlob(timeGlob{List: map[string]time.Time{keyone: {}}}).Keys[keyone]
+	assert(t, resolveConflict(&e, &tomb), "New write lost to the tombstone it follows")
+}
+
+func TestQuorumReadOfCollectedKeyStaysDeleted(t *testing.T) {
+	v := NewView(testMain, testMain+","+viewExist)
+	c, k, tomb := testCollector(v, func(string) bool { return true })
+	c.collect()
+
+	// A replica which missed the delete answers the read with the old value
+	repaired := make(chan Entry, 2)
+	app := &App{db: k, view: *v, quorum: stubQuorum(func(ip string, key string, e Entry) error {
+		repaired <- e
+		return nil
+	}, func(ip string, key string) (*Entry, error) {
+		return NewEntry(tomb.Timestamp.Add(-time.Second), VectorClock{keyone: 1}, valone, 1), nil
+	})}
+
+	merged, _, err := app.readQuorum(keyone, 2, true)
+	ok(t, err)
+	assert(t, !merged.Alive(), "Deleted key came back from a quorum read")
+	e := <-repaired
+	assert(t, e.Tombstone, "Read repair sent the lagging replica a live value")
+}
+
+func TestGraveyardPersists(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	g, err := OpenGraveyard(dir)
+	ok(t, err)
+	tomb := *NewEntry(time.Now().Round(0), VectorClock{keyone: 2}, "", 2)
+	tomb.Tombstone = true
+	ok(t, g.Bury(map[string]Entry{keyone: tomb}, time.Now()))
+
+	g, err = OpenGraveyard(dir)
+	ok(t, err)
+	got, found := g.Get(keyone)
+	assert(t, found, "Grave lost on reopening")
+	equals(t, tomb.Clock, got.Clock)
+	assert(t, !got.Alive(), "Grave came back alive")
+}
+
+func TestRestoreDoesNotReplayCollectedTombstones(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	w, err := OpenWAL(dir)
+	ok(t, err)
+	k := NewKVS()
+	ok(t, k.Restore(w))
+	k.Put(keyone, valone, time.Now(), VectorClock{})
+	k.Delete(keyone, time.Now(), VectorClock{keyone: 1})
+	equals(t, 1, k.Collect(k.Tombstones(), time.Now()))
+	w.Close()
+
+	w, err = OpenWAL(dir)
+	ok(t, err)
+	defer w.Close()
+	k = NewKVS()
+	ok(t, k.Restore(w))
+	equals(t, 0, len(k.GetTimeGlob().List))
+}
@@ -0,0 +1,164 @@
+// ttl.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines per-key expiry. A PUT may send a "ttl", either a number of seconds or a
+// duration such as "90s", and the entry it writes expires that long after it was
+// stamped. From then on the key reads as deleted, and a sweeper turns the entry into a
+// tombstone.
+//
+// Every replica sweeps on its own, so the tombstone for an expired entry is built from
+// nothing but the entry itself: the version and per-key clock are bumped, the dot is
+// advanced for expiryNode rather than any real replica, and the timestamp is left as it
+// was. Replicas sweeping the same entry therefore make the same tombstone and agree on
+// it without a word. A real write made on top of the entry is stamped later than the
+// entry was, so it beats the tombstone even when the two meet as concurrent versions.
+//
+
+package main
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	expirySweepInterval = time.Second               // How often expired entries are turned into tombstones
+	expiryNode          = "~expired"                // Names the writes made by expiry in dotted version vectors
+	maxTTL              = 10 * 365 * 24 * time.Hour // Longest TTL a client may ask for
+)
+
+// never is the expiry of an entry without a TTL
+var never time.Time
+
+// errInvalidTTL is returned for a TTL which isn't a positive duration
+var errInvalidTTL = errors.New("Invalid TTL")
+
+// parseTTL reads a TTL sent by a client, in seconds or as a duration. A number of
+// seconds is checked before it's converted, since converting one which isn't finite or
+// doesn't fit in a Duration gives a different answer on every platform.
+func parseTTL(s string) (time.Duration, error) {
+	var ttl time.Duration
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(n) || n <= 0 || n > maxTTL.Seconds() {
+			return 0, errInvalidTTL
+		}
+		ttl = time.Duration(n * float64(time.Second))
+	} else if d, err := time.ParseDuration(s); err == nil {
+		ttl = d
+	} else {
+		return 0, errInvalidTTL
+	}
+	if ttl <= 0 || ttl > maxTTL {
+		return 0, errInvalidTTL
+	}
+	return ttl, nil
+}
+
+// expiresAt returns when an entry stamped at ts with the given TTL expires, or the zero
+// time if it has no TTL
+func expiresAt(ts time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return ts.Add(ttl)
+}
+
+// expired returns true if an entry's TTL has run out
+func expired(e KeyEntry, now time.Time) bool {
+	exp := e.GetExpires()
+	return !exp.IsZero() && !now.Before(exp)
+}
+
+// live returns true if an entry holds a value which hasn't been deleted or expired
+func live(e KeyEntry, now time.Time) bool {
+	return e != nil && e.Alive() && !expired(e, now)
+}
+
+// remainingTTL returns the whole seconds, rounded up, left before an entry expires,
+// and false if it never does
+func remainingTTL(e KeyEntry, now time.Time) (int, bool) {
+	exp := e.GetExpires()
+	if exp.IsZero() {
+		return 0, false
+	}
+	left := exp.Sub(now).Seconds()
+	if left < 0 {
+		left = 0
+	}
+	return int(math.Ceil(left)), true
+}
+
+// expiryTombstone returns the tombstone an expired entry becomes, the same on every replica
+func expiryTombstone(key string, e KeyEntry) Entry {
+	t := toEntry(e)
+	t.Value = ""
+	t.Tombstone = true
+	t.Siblings = nil
+	t.Expires = time.Time{}
+	t.Batch = BatchTag{}
+	t.Version++
+	t.Clock = e.GetClock().Copy()
+	t.Clock[key] = t.Version
+	if !t.DVV.IsZero() {
+		t.DVV = t.DVV.Advance(expiryNode, t.DVV.Vector()[expiryNode]+1)
+	}
+	return t
+}
+
+// SweepExpired turns every expired entry into a tombstone and returns how many it found
+func (k *KVS) SweepExpired(now time.Time) int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	due := make(map[string]Entry)
+	k.db.Ascend("", "", func(key string, e KeyEntry) bool {
+		if e.Alive() && expired(e, now) {
+			due[key] = expiryTombstone(key, e)
+		}
+		return true
+	})
+	for key, t := range due {
+		t := t
+		if !k.store(walDelete, key, &t) {
+			log.Println("Error storing tombstone for expired key " + key)
+		}
+	}
+	if len(due) > 0 {
+		wakeGossip = true
+	}
+	return len(due)
+}
+
+// ExpiryLoop sweeps expired entries forever
+func (k *KVS) ExpiryLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if n := k.SweepExpired(time.Now()); n > 0 {
+			log.Println("Expired", n, "keys")
+		}
+	}
+}
+
+// addTTL puts the seconds left before a key expires into a response, if it has a TTL.
+// The entry is read locally unless one is given.
+func (app *App) addTTL(resp map[string]interface{}, key string, e KeyEntry) {
+	if e == nil {
+		local, ok := app.localEntry(key)
+		if !ok {
+			return
+		}
+		e = &local
+	}
+	if left, ok := remainingTTL(e, time.Now()); ok {
+		resp["ttl"] = left
+	}
+}
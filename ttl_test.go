@@ -0,0 +1,117 @@
+// ttl_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for per-key expiry
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseTTL(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"30":  30 * time.Second,
+		"1.5": 1500 * time.Millisecond,
+		"90s": 90 * time.Second,
+		"2m":  2 * time.Minute,
+	} {
+		got, err := parseTTL(s)
+		ok(t, err)
+		equals(t, want, got)
+	}
+	for _, bad := range []string{"0", "-5", "-1s", "soon", "NaN", "Inf", "-Inf", "1e300", "100000h"} {
+		_, err := parseTTL(bad)
+		equals(t, errInvalidTTL, err)
+	}
+}
+
+func TestExpiredKeyReadsAsDeleted(t *testing.T) {
+	k := NewKVS()
+	k.PutExpiring(keyone, valone, time.Now(), VectorClock{}, time.Now().Add(-time.Second))
+
+	alive, version := k.Contains(keyone)
+	assert(t, !alive, "Expired key is still alive")
+	equals(t, 1, version)
+	val, _ := k.Get(keyone, VectorClock{})
+	equals(t, "", val)
+	assert(t, !k.Delete(keyone, time.Now(), VectorClock{}), "Expired key was deleted")
+
+	// Writing it again makes a new value which doesn't expire
+	k.Put(keyone, valtwo, time.Now(), VectorClock{keyone: 2})
+	alive, _ = k.Contains(keyone)
+	assert(t, alive, "Key written after expiring isn't alive")
+	val, _ = k.Get(keyone, VectorClock{})
+	equals(t, valtwo, val)
+}
+
+func TestReplicasSweepToTheSameTombstone(t *testing.T) {
+	alice, bob := nodeKVS(testMain), nodeKVS(viewExist)
+	alice.PutExpiring(keyone, valone, time.Now(), VectorClock{}, time.Now().Add(time.Second))
+	e := *entryOf(alice, keyone)
+	bob.OverwriteEntry(keyone, entryOf(alice, keyone))
+
+	later := time.Now().Add(2 * time.Second)
+	equals(t, 1, alice.SweepExpired(later))
+	equals(t, 1, bob.SweepExpired(later))
+	equals(t, 0, alice.SweepExpired(later))
+
+	a, b := *entryOf(alice, keyone), *entryOf(bob, keyone)
+	assert(t, !a.Alive(), "Sweep didn't leave a tombstone")
+	equals(t, a, b)
+	equals(t, 2, a.Version)
+	equals(t, 2, a.Clock[keyone])
+	equals(t, ClockAfter, compareVersions(&a, &e))
+}
+
+func TestWriteBeatsExpiryTombstone(t *testing.T) {
+	alice, bob := nodeKVS(testMain), nodeKVS(viewExist)
+	alice.PutExpiring(keyone, valone, time.Now(), VectorClock{}, time.Now().Add(time.Second))
+	bob.OverwriteEntry(keyone, entryOf(alice, keyone))
+
+	// Bob writes over the value just before it would have expired, while alice sweeps it
+	bob.Put(keyone, valtwo, time.Now(), VectorClock{keyone: 1})
+	alice.SweepExpired(time.Now().Add(2 * time.Second))
+	write, tomb := entryOf(bob, keyone), entryOf(alice, keyone)
+
+	assert(t, resolveConflict(write, tomb), "Tombstone from expiry beat a later write")
+	assert(t, !resolveConflict(tomb, write), "Tombstone from expiry beat a later write")
+}
+
+func TestGetIncludesRemainingTTL(t *testing.T) {
+	app := &App{db: NewKVS(), view: *NewView(testMain, testMain)}
+	code, _ := appRequest(t, app, http.MethodPut, rootURL+"/"+keyone, url.Values{"val": {valone}, "ttl": {"90s"}}.Encode(), nil)
+	equals(t, http.StatusOK, code)
+
+	code, got := appRequest(t, app, http.MethodGet, rootURL+"/"+keyone, "", nil)
+	equals(t, http.StatusOK, code)
+	equals(t, float64(90), got["ttl"])
+
+	code, got = appRequest(t, app, http.MethodPut, rootURL+"/"+keyone, url.Values{"val": {valone}, "ttl": {"never"}}.Encode(), nil)
+	equals(t, http.StatusBadRequest, code)
+	equals(t, "Invalid TTL", got["msg"])
+}
+
+func TestTTLRunsFromTheWriteStamp(t *testing.T) {
+	// The clock has seen a stamp from a node whose clock runs ahead of ours
+	clock := NewHLC(testMain)
+	clock.Observe(time.Now().Add(30 * time.Second))
+	k := NewKVS()
+	k.clock = clock
+	app := &App{db: k, view: *NewView(testMain, testMain), clock: clock}
+
+	code, _ := appRequest(t, app, http.MethodPut, rootURL+"/"+keyone, url.Values{"val": {valone}, "ttl": {"90s"}}.Encode(), nil)
+	equals(t, http.StatusOK, code)
+	e, _ := app.localEntry(keyone)
+	life := e.Expires.Sub(e.Timestamp)
+	assert(t, life > 90*time.Second-time.Millisecond && life <= 90*time.Second, "Key lives for %v after its stamp", life)
+}
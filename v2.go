@@ -0,0 +1,534 @@
+// v2.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines version 2 of the key API at /v2/kv/{key}. It does what the /keyValue-store
+// routes do, and those stay as they are for the clients already using them, but it takes
+// JSON bodies instead of forms:
+//
+//     PUT    /v2/kv/{key}  {"value": "...", "payload": {...}, "ttl": "60s", "context": {...}}
+//     GET    /v2/kv/{key}
+//     DELETE /v2/kv/{key}  {"payload": {...}}
+//
+// Values are binary safe. A value sent with "encoding": "base64" is decoded before it's
+// stored, and a value which isn't valid UTF-8 comes back base64 encoded, as does every
+// value when ?encoding=base64 is asked for, with "encoding" saying which it is. A PUT may
+// send the raw value as application/octet-stream instead, and a GET which accepts
+// application/octet-stream gets the raw value back. Without a JSON body the payload goes
+// in the X-Payload header or ?payload=, and the TTL and context in ?ttl= and ?context=.
+// Conditions go in the If-Match and If-None-Match headers, and every answer about a key
+// carries its version as an ETag which If-Match takes back as it is.
+//
+// Every failure is answered with an error object holding a machine-readable code,
+// alongside the client's payload, and a malformed request never stops the node:
+//
+//     {"error": {"code": "payload_out_of_date", "message": "Payload out of date"}, "payload": {...}}
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const (
+	apiMaxBody     = 2 * maxVal  // Largest body read, enough for a base64 encoded value
+	payloadHeader  = "X-Payload" // Carries the payload when the body doesn't
+	encodingUTF8   = "utf-8"     // A value sent as it is
+	encodingBase64 = "base64"    // A value sent base64 encoded
+	mediaJSON      = "application/json"
+	mediaOctets    = "application/octet-stream"
+)
+
+var (
+	// errInvalidBody is returned for a body which can't be read
+	errInvalidBody = errors.New("Invalid request body")
+
+	// errInvalidPayload is returned for a payload which isn't a vector clock
+	errInvalidPayload = errors.New("Invalid payload")
+
+	// errInvalidContext is returned for a causal context which isn't a vector clock
+	errInvalidContext = errors.New("Invalid causal context")
+
+	// errInvalidValue is returned for a value which can't be decoded
+	errInvalidValue = errors.New("Invalid value")
+
+	// errInvalidKey is returned for a key which is too long
+	errInvalidKey = errors.New("Key not valid")
+
+	// errValueTooLarge is returned for a value over maxVal
+	errValueTooLarge = errors.New("Object too large. Size limit is 1MB")
+
+	// errUnsupportedMedia is returned for a body in a format other than JSON or raw bytes
+	errUnsupportedMedia = errors.New("Unsupported content type")
+
+	// errPayloadOutOfDate is returned when the client has seen a newer version than ours
+	errPayloadOutOfDate = errors.New("Payload out of date")
+
+	// errKeyNotFound is returned for a key which doesn't exist
+	errKeyNotFound = errors.New("Key does not exist")
+
+	// errQuorumFailed is returned when too few replicas answered for any reason but time
+	errQuorumFailed = errors.New("Quorum not reached")
+)
+
+// apiCode is how a failure is reported to a v2 client
+type apiCode struct {
+	status int
+	code   string
+}
+
+// apiCodes gives the status and code for each error a v2 request can fail with.
+// Anything else is an internal error.
+var apiCodes = map[error]apiCode{
+	errInvalidBody:         {http.StatusBadRequest, "invalid_body"},
+	errInvalidPayload:      {http.StatusBadRequest, "invalid_payload"},
+	errInvalidContext:      {http.StatusBadRequest, "invalid_context"},
+	errInvalidValue:        {http.StatusBadRequest, "invalid_value"},
+	errInvalidKey:          {http.StatusBadRequest, "invalid_key"},
+	errInvalidTTL:          {http.StatusBadRequest, "invalid_ttl"},
+	errInvalidPrecondition: {http.StatusBadRequest, "invalid_precondition"},
+	errPayloadOutOfDate:    {http.StatusBadRequest, "payload_out_of_date"},
+	errKeyNotFound:         {http.StatusNotFound, "not_found"},
+	errPreconditionFailed:  {http.StatusPreconditionFailed, "precondition_failed"},
+	errValueTooLarge:       {http.StatusRequestEntityTooLarge, "value_too_large"},
+	errUnsupportedMedia:    {http.StatusUnsupportedMediaType, "unsupported_media_type"},
+	errWriteFailed:         {http.StatusInternalServerError, "write_failed"},
+	errQuorumFailed:        {http.StatusServiceUnavailable, "quorum_failed"},
+	errQuorumTimeout:       {http.StatusGatewayTimeout, "quorum_timeout"},
+	errNoCoordinator:       {http.StatusServiceUnavailable, "coordinator_unavailable"},
+}
+
+// apiBody is a v2 request body
+type apiBody struct {
+	Value    *string         `json:"value"`
+	Encoding string          `json:"encoding"`
+	Payload  json.RawMessage `json:"payload"`
+	TTL      json.RawMessage `json:"ttl"` // Seconds or a duration string
+	Context  json.RawMessage `json:"context"`
+}
+
+// apiRequest is what a v2 request asks for, wherever in the request it was sent
+type apiRequest struct {
+	value    string
+	hasValue bool
+	payload  VectorClock
+	context  VectorClock
+	ttl      time.Duration
+	cond     Precondition
+}
+
+// parseAPIRequest reads a v2 request. The payload is an empty clock rather than nil
+// whatever goes wrong, so it can always be sent back.
+func parseAPIRequest(r *http.Request) (apiRequest, error) {
+	req := apiRequest{payload: NewVectorClock()}
+	q := r.URL.Query()
+	payload := r.Header.Get(payloadHeader)
+	if payload == "" {
+		payload = q.Get("payload")
+	}
+	context := q.Get("context")
+	ttl := q.Get("ttl")
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, apiMaxBody+1))
+		if err != nil {
+			return req, errors.Wrap(errInvalidBody, err.Error())
+		}
+		if len(body) > apiMaxBody {
+			return req, errValueTooLarge
+		}
+	}
+	if len(body) > 0 {
+		media, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch {
+		case media == mediaOctets:
+			req.value, req.hasValue = string(body), true
+		case media == mediaJSON || strings.HasSuffix(media, "+json"):
+			var b apiBody
+			if err := json.Unmarshal(body, &b); err != nil {
+				return req, errors.Wrap(errInvalidBody, err.Error())
+			}
+			if b.Value != nil {
+				value, err := decodeValue(*b.Value, b.Encoding)
+				if err != nil {
+					return req, err
+				}
+				req.value, req.hasValue = value, true
+			}
+			if len(b.Payload) > 0 {
+				payload = string(b.Payload)
+			}
+			if len(b.Context) > 0 {
+				context = string(b.Context)
+			}
+			if len(b.TTL) > 0 {
+				ttl = strings.Trim(string(b.TTL), `"`)
+			}
+		default:
+			return req, errors.Wrap(errUnsupportedMedia, "Send "+mediaJSON+" or "+mediaOctets)
+		}
+	}
+
+	var err error
+	if payload != "" && payload != "null" {
+		if json.Unmarshal([]byte(payload), &req.payload) != nil || req.payload == nil {
+			req.payload = NewVectorClock()
+			return req, errInvalidPayload
+		}
+	}
+	if context != "" && context != "null" && json.Unmarshal([]byte(context), &req.context) != nil {
+		return req, errInvalidContext
+	}
+	if ttl != "" && ttl != "null" {
+		if req.ttl, err = parseTTL(ttl); err != nil {
+			return req, err
+		}
+	}
+	req.cond, err = requestPrecondition(r, nil)
+	return req, err
+}
+
+// peekAPIRequest is parseAPIRequest for a request which may yet be passed on to another
+// node. The body is put back afterwards so it can be sent on whole.
+func peekAPIRequest(r *http.Request) (apiRequest, error) {
+	if r.Body == nil {
+		return parseAPIRequest(r)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return apiRequest{payload: NewVectorClock()}, errors.Wrap(errInvalidBody, err.Error())
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req, err := parseAPIRequest(r)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return req, err
+}
+
+// decodeValue returns the value sent in a JSON body in the given encoding
+func decodeValue(value string, encoding string) (string, error) {
+	switch encoding {
+	case "", encodingUTF8:
+		return value, nil
+	case encodingBase64:
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", errors.Wrap(errInvalidValue, "Value isn't base64")
+		}
+		return string(b), nil
+	}
+	return "", errors.Wrap(errInvalidValue, "Unknown encoding "+encoding)
+}
+
+// encodeValues returns values as they're put in a v2 response, and the encoding they're
+// in. They're all base64 encoded if the client asked for it or any isn't valid UTF-8.
+func encodeValues(r *http.Request, values ...string) ([]string, string) {
+	encoding := encodingUTF8
+	if r.URL.Query().Get("encoding") == encodingBase64 {
+		encoding = encodingBase64
+	}
+	for _, v := range values {
+		if !utf8.ValidString(v) {
+			encoding = encodingBase64
+		}
+	}
+	if encoding == encodingUTF8 {
+		return values, encoding
+	}
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = base64.StdEncoding.EncodeToString([]byte(v))
+	}
+	return out, encoding
+}
+
+// checkKey returns an error for a key which can't be stored
+func checkKey(key string) error {
+	if len(key) > maxKey {
+		return errors.Wrapf(errInvalidKey, "Keys are at most %d characters", maxKey)
+	}
+	return nil
+}
+
+// quorumError files an error from a quorum request under the code the client is given
+func quorumError(err error) error {
+	if errors.Cause(err) == errQuorumTimeout {
+		return err
+	}
+	return errors.Wrap(errQuorumFailed, err.Error())
+}
+
+// apiRespond writes a v2 response
+func apiRespond(w http.ResponseWriter, status int, resp map[string]interface{}) {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		log.Println("ERROR: Failed to marshal JSON response: ", err)
+		status = http.StatusInternalServerError // code 500
+		body = []byte(`{"error":{"code":"internal_error","message":"Failed to encode response"}}`)
+	}
+	w.Header().Set("Content-Type", mediaJSON)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// apiError writes the error object for a failed v2 request. Any details are added to it.
+func apiError(w http.ResponseWriter, err error, payload VectorClock, details map[string]interface{}) {
+	log.Println("ERROR: v2 request failed: ", err)
+	c, ok := apiCodes[errors.Cause(err)]
+	if !ok {
+		c = apiCode{http.StatusInternalServerError, "internal_error"}
+	}
+	obj := map[string]interface{}{
+		"code":    c.code,
+		"message": errors.Cause(err).Error(),
+	}
+	if detail := err.Error(); detail != obj["message"] {
+		obj["detail"] = detail
+	}
+	for k, v := range details {
+		obj[k] = v
+	}
+	apiRespond(w, c.status, map[string]interface{}{
+		"error":   obj,
+		"payload": payload,
+	})
+}
+
+// apiWriteFailure is writeFailure for v2. A client whose condition failed is sent the
+// version it failed against, and the payload to read it with.
+func (app *App) apiWriteFailure(w http.ResponseWriter, err error, key string, payload VectorClock) {
+	var details map[string]interface{}
+	if errors.Cause(err) == errPreconditionFailed {
+		_, version := app.db.Contains(key)
+		details = map[string]interface{}{"version": version}
+		payload = payload.Merge(app.db.GetClock(key))
+	}
+	apiError(w, err, payload, details)
+}
+
+// setETag puts a key's version in the response headers
+func setETag(w http.ResponseWriter, version int) {
+	w.Header().Set("ETag", strconv.Quote(strconv.Itoa(version)))
+}
+
+// addAPISiblings is addSiblings with the siblings encoded as the value is
+func (app *App) addAPISiblings(r *http.Request, resp map[string]interface{}, key string, e KeyEntry) {
+	app.addSiblings(resp, key, e)
+	if sibs, ok := resp["siblings"].([]string); ok {
+		resp["siblings"], resp["siblings_encoding"] = encodeValues(r, sibs...)
+	}
+}
+
+// V2GetHandler responds to GET requests on /v2/kv/{key} with the value of the key
+func (app *App) V2GetHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling v2 GET request")
+	key := mux.Vars(r)["subject"]
+
+	// Keys this node doesn't store are handled by a node that does
+	if app.forward(w, r, key) {
+		return
+	}
+	req, err := parseAPIRequest(r)
+	if err != nil {
+		apiError(w, err, req.payload, nil)
+		return
+	}
+
+	// If the client asked for R > 1, answer with the newest version any of the R replicas has
+	var e KeyEntry
+	alive, version := app.db.Contains(key)
+	if want := app.quorum.ReadSize(r); want > 1 {
+		merged, replies, err := app.readQuorum(key, want, app.quorum.ReadRepair(r))
+		if err != nil {
+			apiError(w, quorumError(err), req.payload, map[string]interface{}{"replicas": replies, "required": want})
+			return
+		}
+		e, alive, version = merged, false, 0
+		if merged != nil {
+			alive, version = live(merged, time.Now()), merged.GetVersion()
+		}
+	} else if local, ok := app.localEntry(key); ok {
+		e = &local
+	}
+	// The key may have expired or been deleted since Contains looked at it
+	if e == nil || !live(e, time.Now()) {
+		alive = false
+	}
+
+	// Showing a version older than the client has seen would break causality
+	if version < req.payload[key] {
+		apiError(w, errPayloadOutOfDate, req.payload, nil)
+		return
+	}
+	if !alive {
+		apiError(w, errKeyNotFound, req.payload, nil)
+		return
+	}
+	payload := req.payload.Merge(e.GetClock())
+	setETag(w, version)
+
+	// A client which wants the bare value gets it with the payload in a header
+	if accept := r.Header.Get("Accept"); strings.Contains(accept, mediaOctets) && !strings.Contains(accept, mediaJSON) {
+		p, _ := json.Marshal(payload)
+		w.Header().Set(payloadHeader, string(p))
+		w.Header().Set("Content-Type", mediaOctets)
+		w.WriteHeader(http.StatusOK) // code 200
+		w.Write([]byte(e.GetValue()))
+		return
+	}
+
+	values, encoding := encodeValues(r, e.GetValue())
+	resp := map[string]interface{}{
+		"key":      key,
+		"value":    values[0],
+		"encoding": encoding,
+		"version":  version,
+		"payload":  payload,
+	}
+	app.addTTL(resp, key, e)
+	app.addAPISiblings(r, resp, key, e)
+	apiRespond(w, http.StatusOK, resp) // code 200
+}
+
+// V2PutHandler responds to PUT requests on /v2/kv/{key} by storing the value sent. It
+// answers 201 for a key which didn't exist and 200 for one it replaced.
+func (app *App) V2PutHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling v2 PUT request")
+	key := mux.Vars(r)["subject"]
+
+	// A conditional write is checked by the key's coordinator, and keys this node
+	// doesn't store are handled by a node that does. The request is read first, so
+	// even one which can't be passed on is answered with the client's payload.
+	req, err := peekAPIRequest(r)
+	if relayed, cerr := app.coordinate(w, r, key); cerr != nil {
+		apiError(w, cerr, req.payload, nil)
+		return
+	} else if relayed || app.forward(w, r, key) {
+		return
+	}
+	if err == nil && !req.hasValue {
+		err = errors.Wrap(errInvalidBody, "Value is missing")
+	}
+	if err == nil {
+		err = checkKey(key)
+	}
+	if err == nil && len(req.value) > maxVal {
+		err = errValueTooLarge
+	}
+	if err != nil {
+		apiError(w, err, req.payload, nil)
+		return
+	}
+
+	// A key the client can't be shown is one it doesn't know exists, as for the v1 PUT
+	alive, version := app.db.Contains(key)
+	replaced := alive && req.payload[key] <= version
+	now := app.clock.Now()
+	newPayload := req.payload.Copy()
+	newPayload[key] = version + 1
+	err = app.store(key, req.value, now, newPayload, req.context, expiresAt(now, req.ttl), req.cond)
+	if err != nil {
+		app.apiWriteFailure(w, err, key, req.payload)
+		return
+	}
+
+	// If the client asked for W > 1, the write only succeeds once enough replicas have it
+	if want := app.quorum.WriteSize(r); want > 1 {
+		acks, err := app.writeQuorum(key, want)
+		if err != nil {
+			apiError(w, quorumError(err), req.payload, map[string]interface{}{"replicas": acks, "required": want})
+			return
+		}
+	}
+
+	e, _ := app.localEntry(key)
+	setETag(w, e.Version)
+	resp := map[string]interface{}{
+		"key":      key,
+		"version":  e.Version,
+		"replaced": replaced,
+		"payload":  req.payload.Merge(e.Clock),
+	}
+	app.addTTL(resp, key, &e)
+	app.addAPISiblings(r, resp, key, &e)
+	status := http.StatusCreated // code 201
+	if replaced {
+		status = http.StatusOK // code 200
+	}
+	apiRespond(w, status, resp)
+}
+
+// V2DeleteHandler responds to DELETE requests on /v2/kv/{key} by deleting the key
+func (app *App) V2DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling v2 DELETE request")
+	key := mux.Vars(r)["subject"]
+
+	// A conditional delete is checked by the key's coordinator, and keys this node
+	// doesn't store are handled by a node that does. The request is read first, so
+	// even one which can't be passed on is answered with the client's payload.
+	req, err := peekAPIRequest(r)
+	if relayed, cerr := app.coordinate(w, r, key); cerr != nil {
+		apiError(w, cerr, req.payload, nil)
+		return
+	} else if relayed || app.forward(w, r, key) {
+		return
+	}
+	if err != nil {
+		apiError(w, err, req.payload, nil)
+		return
+	}
+
+	alive, version := app.db.Contains(key)
+	if version < req.payload[key] {
+		apiError(w, errPayloadOutOfDate, req.payload, nil)
+		return
+	}
+	if !alive {
+		apiError(w, errKeyNotFound, req.payload, nil)
+		return
+	}
+
+	// Delete it, if the client's condition holds
+	if err := app.db.DeleteIf(key, app.clock.Now(), req.payload, req.cond); err != nil {
+		app.apiWriteFailure(w, err, key, req.payload)
+		return
+	}
+
+	// If the client asked for W > 1, the delete only succeeds once enough replicas have it
+	if want := app.quorum.WriteSize(r); want > 1 {
+		acks, err := app.writeQuorum(key, want)
+		if err != nil {
+			apiError(w, quorumError(err), req.payload, map[string]interface{}{"replicas": acks, "required": want})
+			return
+		}
+	}
+
+	e, _ := app.localEntry(key)
+	setETag(w, e.Version)
+	apiRespond(w, http.StatusOK, map[string]interface{}{ // code 200
+		"key":     key,
+		"version": e.Version,
+		"payload": req.payload.Merge(e.Clock),
+	})
+}
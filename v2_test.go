@@ -0,0 +1,204 @@
+// v2_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for version 2 of the key API
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// apiCall sends a v2 request and returns the response
+func apiCall(t *testing.T, router *mux.Router, method string, target string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, target, body)
+	ok(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// apiDecode decodes a v2 JSON response
+func apiDecode(t *testing.T, recorder *httptest.ResponseRecorder) map[string]interface{} {
+	equals(t, mediaJSON, recorder.Header().Get("Content-Type"))
+	var got map[string]interface{}
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &got))
+	return got
+}
+
+// apiErrorCode returns the code of the error in a v2 response
+func apiErrorCode(t *testing.T, recorder *httptest.ResponseRecorder) string {
+	obj, isError := apiDecode(t, recorder)["error"].(map[string]interface{})
+	assert(t, isError, "No error object in the response")
+	return obj["code"].(string)
+}
+
+func TestParseAPIRequest(t *testing.T) {
+	jsonHeader := http.Header{"Content-Type": {mediaJSON}}
+	body := `{"value": "AP8=", "encoding": "base64", "payload": {"a": 2}, "ttl": 30}`
+	r := httptest.NewRequest(http.MethodPut, "/v2/kv/a", strings.NewReader(body))
+	r.Header = jsonHeader
+	req, err := parseAPIRequest(r)
+	ok(t, err)
+	equals(t, "\x00\xff", req.value)
+	equals(t, VectorClock{"a": 2}, req.payload)
+	equals(t, 30.0, req.ttl.Seconds())
+
+	// Raw bytes take the payload from the header
+	r = httptest.NewRequest(http.MethodPut, "/v2/kv/a?ttl=1m", strings.NewReader("\x00raw"))
+	r.Header = http.Header{"Content-Type": {mediaOctets}, payloadHeader: {`{"b": 1}`}}
+	req, err = parseAPIRequest(r)
+	ok(t, err)
+	assert(t, req.hasValue && req.value == "\x00raw", "Raw value not read")
+	equals(t, VectorClock{"b": 1}, req.payload)
+
+	for body, want := range map[string]error{
+		`{"value": "x", "payload": "lots"}`:     errInvalidPayload,
+		`{"value": "x", "encoding": "rot13"}`:   errInvalidValue,
+		`{"value": "x", "ttl": "soon"}`:         errInvalidTTL,
+		`{"value": "x", "context": [1]}`:        errInvalidContext,
+		`{"value": "x"`:                         errInvalidBody,
+		`{"value": "!!", "encoding": "base64"}`: errInvalidValue,
+	} {
+		r = httptest.NewRequest(http.MethodPut, "/v2/kv/a", strings.NewReader(body))
+		r.Header = jsonHeader
+		req, err = parseAPIRequest(r)
+		equals(t, want, errors.Cause(err))
+		assert(t, req.payload != nil, "No payload to send back with the error")
+	}
+
+	r = httptest.NewRequest(http.MethodPut, "/v2/kv/a", strings.NewReader("val=x"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = parseAPIRequest(r)
+	equals(t, errUnsupportedMedia, errors.Cause(err))
+}
+
+func TestEncodeValues(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/v2/kv/a", nil)
+	values, encoding := encodeValues(r, "plain", "text")
+	equals(t, encodingUTF8, encoding)
+	equals(t, []string{"plain", "text"}, values)
+
+	// One value which isn't UTF-8 puts them all in base64
+	values, encoding = encodeValues(r, "plain", "\xff")
+	equals(t, encodingBase64, encoding)
+	equals(t, []string{"cGxhaW4=", "/w=="}, values)
+
+	r = httptest.NewRequest(http.MethodGet, "/v2/kv/a?encoding=base64", nil)
+	_, encoding = encodeValues(r, "plain")
+	equals(t, encodingBase64, encoding)
+}
+
+func TestV2Handlers(t *testing.T) {
+	app := &App{db: NewKVS(), view: *NewView(testMain, testMain)}
+	router := mux.NewRouter()
+	router.HandleFunc(apiKey, app.V2PutHandler).Methods(http.MethodPut)
+	router.HandleFunc(apiKey, app.V2GetHandler).Methods(http.MethodGet)
+	router.HandleFunc(apiKey, app.V2DeleteHandler).Methods(http.MethodDelete)
+	target := "/v2/kv/" + url.PathEscape(keyone)
+	jsonHeader := http.Header{"Content-Type": {mediaJSON}}
+
+	rec := apiCall(t, router, http.MethodPut, target, strings.NewReader(`{"value": "`+valone+`"}`), jsonHeader)
+	equals(t, http.StatusCreated, rec.Code)
+	equals(t, `"1"`, rec.Header().Get("ETag"))
+	got := apiDecode(t, rec)
+	equals(t, false, got["replaced"])
+	equals(t, map[string]interface{}{keyone: float64(1)}, got["payload"])
+
+	// A binary value goes in raw and comes back out raw, or in base64 as JSON
+	header := http.Header{"Content-Type": {mediaOctets}, payloadHeader: {`{"` + keyone + `": 1}`}}
+	rec = apiCall(t, router, http.MethodPut, target, strings.NewReader("\x00\xff"), header)
+	equals(t, http.StatusOK, rec.Code)
+	equals(t, true, apiDecode(t, rec)["replaced"])
+
+	rec = apiCall(t, router, http.MethodGet, target, nil, http.Header{"Accept": {mediaOctets}})
+	equals(t, http.StatusOK, rec.Code)
+	equals(t, "\x00\xff", rec.Body.String())
+	equals(t, `{"`+keyone+`":2}`, rec.Header().Get(payloadHeader))
+
+	got = apiDecode(t, apiCall(t, router, http.MethodGet, target, nil, nil))
+	equals(t, "AP8=", got["value"])
+	equals(t, encodingBase64, got["encoding"])
+	equals(t, float64(2), got["version"])
+
+	// Errors come back as objects with codes
+	rec = apiCall(t, router, http.MethodPut, target, strings.NewReader(`{"value": "x"}`), http.Header{"Content-Type": {mediaJSON}, "If-Match": {`"1"`}})
+	equals(t, http.StatusPreconditionFailed, rec.Code)
+	equals(t, "precondition_failed", apiErrorCode(t, rec))
+
+	rec = apiCall(t, router, http.MethodGet, target+"?payload="+url.QueryEscape(`{"`+keyone+`": 5}`), nil, nil)
+	equals(t, http.StatusBadRequest, rec.Code)
+	equals(t, "payload_out_of_date", apiErrorCode(t, rec))
+
+	rec = apiCall(t, router, http.MethodPut, target, strings.NewReader(`{"val": "x"}`), jsonHeader)
+	equals(t, http.StatusBadRequest, rec.Code)
+	equals(t, "invalid_body", apiErrorCode(t, rec))
+
+	rec = apiCall(t, router, http.MethodPut, "/v2/kv/"+strings.Repeat("k", maxKey+1), strings.NewReader(`{"value": "x"}`), jsonHeader)
+	equals(t, "invalid_key", apiErrorCode(t, rec))
+
+	rec = apiCall(t, router, http.MethodDelete, target, strings.NewReader(`{"payload": {"`+keyone+`": 2}}`), jsonHeader)
+	equals(t, http.StatusOK, rec.Code)
+	equals(t, float64(3), apiDecode(t, rec)["version"])
+
+	rec = apiCall(t, router, http.MethodGet, target, nil, nil)
+	equals(t, http.StatusNotFound, rec.Code)
+	equals(t, "not_found", apiErrorCode(t, rec))
+}
+
+// goneKVS is a KVS whose keys all disappear between Contains and reading them
+type goneKVS struct {
+	*KVS
+}
+
+func (k goneKVS) Contains(key string) (bool, int) {
+	return true, 1
+}
+
+func TestV2GetOfKeyGoneSinceContains(t *testing.T) {
+	app := &App{db: goneKVS{NewKVS()}, view: *NewView(testMain, testMain)}
+	router := mux.NewRouter()
+	router.HandleFunc(apiKey, app.V2GetHandler).Methods(http.MethodGet)
+
+	rec := apiCall(t, router, http.MethodGet, "/v2/kv/"+url.PathEscape(keyone), nil, nil)
+	equals(t, http.StatusNotFound, rec.Code)
+	equals(t, "not_found", apiErrorCode(t, rec))
+}
+
+func TestV2WriteWithoutItsCoordinatorCarriesThePayload(t *testing.T) {
+	app := &App{db: NewKVS(), view: *NewView(testMain, testMain+",127.0.0.1:1")}
+	router := mux.NewRouter()
+	router.HandleFunc(apiKey, app.V2PutHandler).Methods(http.MethodPut)
+	router.HandleFunc(apiKey, app.V2DeleteHandler).Methods(http.MethodDelete)
+	target := "/v2/kv/" + url.PathEscape(keyone)
+	header := http.Header{"Content-Type": {mediaJSON}, "If-None-Match": {"*"}}
+	want := map[string]interface{}{keyone: float64(3)}
+
+	rec := apiCall(t, router, http.MethodPut, target, strings.NewReader(`{"value": "`+valone+`", "payload": {"`+keyone+`": 3}}`), header)
+	equals(t, http.StatusServiceUnavailable, rec.Code)
+	equals(t, "coordinator_unavailable", apiErrorCode(t, rec))
+	equals(t, want, apiDecode(t, rec)["payload"])
+
+	header = http.Header{payloadHeader: {`{"` + keyone + `": 3}`}, "If-Match": {"*"}}
+	rec = apiCall(t, router, http.MethodDelete, target, nil, header)
+	equals(t, http.StatusServiceUnavailable, rec.Code)
+	equals(t, want, apiDecode(t, rec)["payload"])
+}
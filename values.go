@@ -12,13 +12,41 @@
 
 package main
 
+import (
+	"sync/atomic"
+	"time"
+)
+
 const (
 	// These control the REST API
 	rootURL   = "/keyValue-store" // We hang the router off this
 	port      = ":8080"           // This is used for the TCP module
 	search    = "/search"
 	view      = "/view"
+	admin     = "/admin" // Operational endpoints, not part of the KVS API
 	keySuffix = "/{subject}"
+	batch     = "/_batch"          // Multi-key writes, under rootURL
+	mget      = "/_mget"           // Multi-key reads, under rootURL
+	watch     = "/_watch"          // Change feed, under rootURL
+	apiKey    = "/v2/kv/{subject}" // Version 2 of the key API
+
+	// Set on requests passed between nodes so they are never forwarded twice
+	forwardedHeader = "X-Forwarded-By"
+
+	// Set on conditional writes passed to the node which coordinates their key
+	coordinatedHeader = "X-Coordinated-By"
+
+	// Defaults for partitioning the keys with the ring
+	defaultVnodes = 64 // Points on the ring per node
+
+	// How long a quorum coordinator waits for the other replicas by default
+	defaultQuorumTimeout = 2 * time.Second
+
+	// How long a gossip exchange with a peer may take
+	gossipTimeout = 5 * time.Second
+
+	// Suspicion level at which the phi-accrual detector avoids a peer by default
+	defaultPhiThreshold = 8.0
 
 	// Maximum input restrictions
 	maxVal = 1048576 // 1 megabyte
@@ -47,7 +75,7 @@ const (
 )
 
 // These values are used throughout the app and are initially set in main
-var myIP string     // set as environment variable IP_PORT
-var wakeGossip bool // If true, we wake up during the heartbeat loop
-var needHelp bool   // If this is true, we haven't heard anything in a while
-var viewChange bool // If this is true, we need to communicate a view change
+var myIP string            // set as environment variable IP_PORT
+var wakeGossip bool        // If true, we wake up during the heartbeat loop
+var needHelp bool          // If this is true, we haven't heard anything in a while
+var viewChange atomic.Bool // If this is true, we need to communicate a view change
@@ -0,0 +1,209 @@
+// vclock.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines the vector clock used for causal payloads and sibling contexts. A clock maps
+// each key or node to a counter, and a missing entry counts as zero. Two clocks are
+// ordered when one has seen everything the other has, and concurrent otherwise.
+//
+// The clock is still a map underneath, so it travels in JSON and gob exactly as the
+// plain map it replaced did and data already on disk reads back unchanged. Its binary
+// encoding is deliberately not called MarshalBinary, since gob would pick that up and
+// switch formats.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// VectorClock is a counter for each key or node a value has seen
+type VectorClock map[string]int
+
+// Ordering is the result of comparing two vector clocks
+type Ordering int
+
+const (
+	ClockBefore     Ordering = iota - 1 // Every counter is at most the other clock's, and one is less
+	ClockEqual                          // The clocks are the same
+	ClockAfter                          // Every counter is at least the other clock's, and one is more
+	ClockConcurrent                     // Each clock has a counter ahead of the other
+)
+
+// String returns the name of the ordering
+func (o Ordering) String() string {
+	switch o {
+	case ClockBefore:
+		return "before"
+	case ClockEqual:
+		return "equal"
+	case ClockAfter:
+		return "after"
+	}
+	return "concurrent"
+}
+
+// NewVectorClock creates an empty clock
+func NewVectorClock() VectorClock {
+	return make(VectorClock)
+}
+
+// Copy returns a clock which shares nothing with the original. The copy of a nil clock
+// is empty rather than nil.
+func (c VectorClock) Copy() VectorClock {
+	out := make(VectorClock, len(c))
+	for k, v := range c {
+		out[k] = v
+	}
+	return out
+}
+
+// Compare returns how c is ordered against other
+func (c VectorClock) Compare(other VectorClock) Ordering {
+	ahead, behind := false, false
+	for k, v := range c {
+		if v > other[k] {
+			ahead = true
+		} else if v < other[k] {
+			behind = true
+		}
+	}
+	for k, v := range other {
+		if _, ok := c[k]; !ok && v > 0 {
+			behind = true
+		}
+	}
+	switch {
+	case ahead && behind:
+		return ClockConcurrent
+	case ahead:
+		return ClockAfter
+	case behind:
+		return ClockBefore
+	}
+	return ClockEqual
+}
+
+// Descends returns true if c has seen everything other has
+func (c VectorClock) Descends(other VectorClock) bool {
+	for k, v := range other {
+		if c[k] < v {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge returns a new clock holding the larger counter from each. Neither clock is changed.
+func (c VectorClock) Merge(other VectorClock) VectorClock {
+	out := c.Copy()
+	for k, v := range other {
+		if out[k] < v {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// Increment returns a copy of the clock with the counter for k advanced by one
+func (c VectorClock) Increment(k string) VectorClock {
+	out := c.Copy()
+	out[k]++
+	return out
+}
+
+// keys returns the keys of the clock in order
+func (c VectorClock) keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MarshalJSON encodes the clock as a JSON object. A nil clock is an empty object, which
+// is what clients have always been sent.
+func (c VectorClock) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]int(c.Copy()))
+}
+
+// UnmarshalJSON decodes a clock from a JSON object. Counters are numbers, and any
+// fraction a client sends is dropped. null leaves the clock unchanged.
+func (c *VectorClock) UnmarshalJSON(data []byte) error {
+	var raw map[string]float64
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return errors.Wrap(err, "Decoding vector clock failed")
+	}
+	if raw == nil {
+		return nil
+	}
+	out := make(VectorClock, len(raw))
+	for k, v := range raw {
+		out[k] = int(v)
+	}
+	*c = out
+	return nil
+}
+
+// EncodeBinary returns a compact encoding of the clock with its keys in order, so equal
+// clocks always encode to the same bytes
+func (c VectorClock) EncodeBinary() []byte {
+	var buf bytes.Buffer
+	scratch := make([]byte, binary.MaxVarintLen64)
+	put := func(n int64) {
+		buf.Write(scratch[:binary.PutVarint(scratch, n)])
+	}
+	keys := c.keys()
+	put(int64(len(keys)))
+	for _, k := range keys {
+		put(int64(len(k)))
+		buf.WriteString(k)
+		put(int64(c[k]))
+	}
+	return buf.Bytes()
+}
+
+// DecodeVectorClock decodes a clock written by EncodeBinary
+func DecodeVectorClock(data []byte) (VectorClock, error) {
+	r := bytes.NewReader(data)
+	n, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "Reading vector clock length failed")
+	}
+	if n < 0 || n > int64(len(data)) {
+		return nil, errors.Errorf("Invalid vector clock length %d", n)
+	}
+	c := make(VectorClock, n)
+	for i := int64(0); i < n; i++ {
+		size, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "Reading vector clock key failed")
+		}
+		if size < 0 || size > int64(r.Len()) {
+			return nil, errors.Errorf("Invalid vector clock key length %d", size)
+		}
+		key := make([]byte, size)
+		r.Read(key)
+		v, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "Reading vector clock counter failed")
+		}
+		c[string(key)] = int(v)
+	}
+	if r.Len() > 0 {
+		return nil, errors.Errorf("%d bytes left over after vector clock", r.Len())
+	}
+	return c, nil
+}
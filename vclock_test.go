@@ -0,0 +1,126 @@
+// vclock_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit and property tests for vector clocks
+
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// Generate builds a random clock over a handful of nodes, so that generated clocks
+// share keys often enough to be ordered as well as concurrent
+func (VectorClock) Generate(r *rand.Rand, size int) reflect.Value {
+	nodes := []string{keyone, keyExists, viewExist, viewNotExist, testMain}
+	c := NewVectorClock()
+	for _, n := range nodes {
+		if r.Intn(2) == 0 {
+			c[n] = r.Intn(4)
+		}
+	}
+	return reflect.ValueOf(c)
+}
+
+// checkProperty runs a property over random clocks
+func checkProperty(t *testing.T, f interface{}) {
+	ok(t, quick.Check(f, &quick.Config{MaxCount: 500}))
+}
+
+func TestVectorClockCompare(t *testing.T) {
+	a := VectorClock{keyone: 1, keyExists: 2}
+	equals(t, ClockEqual, a.Compare(a.Copy()))
+	equals(t, ClockAfter, a.Compare(VectorClock{keyone: 1}))
+	equals(t, ClockBefore, VectorClock{keyone: 1}.Compare(a))
+	equals(t, ClockConcurrent, a.Compare(VectorClock{keyone: 2}))
+	equals(t, ClockEqual, VectorClock{keyone: 0}.Compare(nil))
+	equals(t, "concurrent", ClockConcurrent.String())
+}
+
+func TestVectorClockMergeLeavesInputsAlone(t *testing.T) {
+	client := VectorClock{keyone: 1}
+	server := VectorClock{keyone: 2, keyExists: 1}
+	merged := client.Merge(server)
+	equals(t, VectorClock{keyone: 2, keyExists: 1}, merged)
+	equals(t, VectorClock{keyone: 1}, client)
+
+	// Merging with nothing on either side is a copy
+	merged = VectorClock(nil).Merge(server)
+	merged[keyone] = 5
+	equals(t, 2, server[keyone])
+	equals(t, client, client.Merge(nil))
+}
+
+func TestVectorClockMergeProperties(t *testing.T) {
+	checkProperty(t, func(a, b VectorClock) bool {
+		return a.Merge(b).Compare(b.Merge(a)) == ClockEqual
+	})
+	checkProperty(t, func(a, b, c VectorClock) bool {
+		return a.Merge(b).Merge(c).Compare(a.Merge(b.Merge(c))) == ClockEqual
+	})
+	checkProperty(t, func(a VectorClock) bool {
+		return a.Merge(a).Compare(a) == ClockEqual
+	})
+	checkProperty(t, func(a, b VectorClock) bool {
+		m := a.Merge(b)
+		return m.Descends(a) && m.Descends(b)
+	})
+}
+
+func TestVectorClockCompareProperties(t *testing.T) {
+	opposite := map[Ordering]Ordering{
+		ClockBefore:     ClockAfter,
+		ClockAfter:      ClockBefore,
+		ClockEqual:      ClockEqual,
+		ClockConcurrent: ClockConcurrent,
+	}
+	checkProperty(t, func(a, b VectorClock) bool {
+		return opposite[a.Compare(b)] == b.Compare(a)
+	})
+	checkProperty(t, func(a, b VectorClock) bool {
+		order := a.Compare(b)
+		return a.Descends(b) == (order == ClockAfter || order == ClockEqual)
+	})
+	checkProperty(t, func(a VectorClock) bool {
+		return a.Increment(keyone).Compare(a) == ClockAfter
+	})
+}
+
+func TestVectorClockBinaryRoundTrip(t *testing.T) {
+	checkProperty(t, func(a VectorClock) bool {
+		got, err := DecodeVectorClock(a.EncodeBinary())
+		return err == nil && reflect.DeepEqual(a, got)
+	})
+
+	_, err := DecodeVectorClock([]byte{0x04, 0x02})
+	assert(t, err != nil, "Decoded a truncated clock")
+}
+
+func TestVectorClockJSONRoundTrip(t *testing.T) {
+	checkProperty(t, func(a VectorClock) bool {
+		data, err := json.Marshal(a)
+		if err != nil {
+			return false
+		}
+		var got VectorClock
+		return json.Unmarshal(data, &got) == nil && reflect.DeepEqual(a, got)
+	})
+
+	// Clients have always sent plain objects of numbers
+	var c VectorClock
+	ok(t, json.Unmarshal([]byte(`{"a": 3, "b": 1.0}`), &c))
+	equals(t, VectorClock{"a": 3, "b": 1}, c)
+	data, err := json.Marshal(VectorClock(nil))
+	ok(t, err)
+	equals(t, "{}", string(data))
+}
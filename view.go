@@ -7,7 +7,10 @@
 // Annie Shen       ashen7
 // Victoria Tran    vilatran
 //
-// Defines an interface and struct for maintaining the view of the system.
+// Defines an interface and struct for maintaining the view of the system. The view is
+// changed by the view log, gossip and the HTTP handlers while the rest of the node reads
+// it, so every method takes the view's lock. Copies of a viewList share the lock along
+// with the map, so they stay safe to use side by side.
 //
 
 package main
@@ -15,6 +18,7 @@ package main
 import (
 	"sort"
 	"strings"
+	"sync"
 )
 
 // A View maintains a list of IP:Port pairs as its view of the system configuration and implements methods for modifying it
@@ -51,11 +55,31 @@ type View interface {
 type viewList struct {
 	views   map[string]string // This is a map because it gives O(1) lookups
 	primary string            // This is the server we're actually on
+	mutex   *sync.RWMutex     // Guards views, shared by every copy of the viewList
+}
+
+// lock takes the view's lock for writing and returns the function which releases it
+func (v *viewList) lock() func() {
+	if v.mutex == nil {
+		return func() {}
+	}
+	v.mutex.Lock()
+	return v.mutex.Unlock
+}
+
+// rlock takes the view's lock for reading and returns the function which releases it
+func (v *viewList) rlock() func() {
+	if v.mutex == nil {
+		return func() {}
+	}
+	v.mutex.RLock()
+	return v.mutex.RUnlock
 }
 
 // List spits out a byte slice
 func (v *viewList) List() []string {
 	if v != nil {
+		defer v.rlock()()
 		var s []string
 		for k := range v.views {
 			s = append(s, k)
@@ -68,10 +92,11 @@ func (v *viewList) List() []string {
 // Overwrite simply replaces the view list
 func (v *viewList) Overwrite(n []string) {
 	if v != nil && v.views != nil {
+		defer v.lock()()
 		diff := false
 		if len(n) == len(v.views) {
 			for _, val := range n {
-				if !v.Contains(val) {
+				if _, ok := v.views[val]; !ok {
 					diff = true
 				}
 			}
@@ -85,7 +110,7 @@ func (v *viewList) Overwrite(n []string) {
 			for _, k := range n {
 				v.views[k] = k
 			}
-			viewChange = true
+			viewChange.Store(true)
 		}
 	}
 }
@@ -93,6 +118,7 @@ func (v *viewList) Overwrite(n []string) {
 // Count returns the number of elements in the view list
 func (v *viewList) Count() int {
 	if v != nil {
+		defer v.rlock()()
 		return len(v.views)
 	}
 	return 0
@@ -101,6 +127,7 @@ func (v *viewList) Count() int {
 // Contains returns true if the viewList contains a particular item
 func (v *viewList) Contains(item string) bool {
 	if v != nil {
+		defer v.rlock()()
 		_, ok := v.views[item]
 		return ok
 	}
@@ -110,8 +137,9 @@ func (v *viewList) Contains(item string) bool {
 // Remove deletes an item from the view
 func (v *viewList) Remove(item string) bool {
 	if v != nil {
+		defer v.lock()()
 		delete(v.views, item)
-		viewChange = true
+		viewChange.Store(true)
 		return true
 	}
 	return false
@@ -120,8 +148,9 @@ func (v *viewList) Remove(item string) bool {
 // Add inserts an item into the view
 func (v *viewList) Add(item string) bool {
 	if v != nil {
+		defer v.lock()()
 		v.views[item] = item
-		viewChange = true
+		viewChange.Store(true)
 		return true
 	}
 	return false
@@ -130,6 +159,7 @@ func (v *viewList) Add(item string) bool {
 // Random picks up to N random elements and returns them as a slice (up to because it'll max out at the number of items available)
 func (v *viewList) Random(n int) []string {
 	if v != nil {
+		defer v.rlock()()
 		var m int
 		// The limit here is len()-1 because we don't want to return the primary
 		if len(v.views)-1 > n {
@@ -160,6 +190,7 @@ func (v *viewList) Primary() string {
 // String converts the view into a comma-separated string
 func (v *viewList) String() string {
 	if v != nil {
+		defer v.rlock()()
 		var items []string
 		for _, k := range v.views {
 			items = append(items, k)
@@ -193,6 +224,7 @@ func NewView(main string, input string) *viewList {
 	list := viewList{
 		views:   v,
 		primary: main,
+		mutex:   &sync.RWMutex{},
 	}
 	return &list
 }
@@ -118,7 +118,7 @@ func TestOverwriteWorks(t *testing.T) {
 		m[s] = s
 	}
 	v.Overwrite(newTestView)
-	assert(t, viewChange, "Overwrite did not set viewChange")
+	assert(t, viewChange.Load(), "Overwrite did not set viewChange")
 	equals(t, m, v.views)
 
 	// Test that the 'diff' check works
@@ -129,7 +129,7 @@ func TestOverwriteWorks(t *testing.T) {
 	}
 
 	v.Overwrite(newTestView)
-	assert(t, viewChange, "Overwrite did not set viewChange")
+	assert(t, viewChange.Load(), "Overwrite did not set viewChange")
 	equals(t, n, v.views)
 }
 
@@ -0,0 +1,473 @@
+// viewlog.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines the membership log, which numbers views in epochs and agrees on each one with
+// Paxos. Every epoch is its own Paxos instance, decided by the members of the view from
+// the epoch before it. A node wanting to add or remove a member proposes the next
+// epoch's member list: it gets promises from a majority of the current members
+// (prepare), asks them to accept the value (accept), and once a majority have, tells
+// the old and new members what was chosen (learn). If some other proposal got there
+// first, the proposer learns that view and tries its change again on top of it, so
+// two admins changing the view at the same time both get their change in, one after
+// the other.
+//
+// Acceptor state and the latest view are written to disk before they are acted on,
+// so a node which restarts keeps its promises and its epoch.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	viewLogFile     = "views.json" // Where the membership log keeps its state
+	viewMaxAttempts = 5            // Rounds a proposer tries before giving up
+)
+
+// errViewUnchanged is returned when a proposal wouldn't change the view
+var errViewUnchanged = errors.New("View already has that membership")
+
+// viewOp is the kind of change being proposed
+type viewOp int
+
+const (
+	viewAdd    viewOp = iota // Add a member
+	viewRemove               // Remove a member
+)
+
+// A ballot orders the proposals within an epoch, with ties broken by the proposer's address
+type ballot struct {
+	N    uint64
+	Node string
+}
+
+// less returns true if b was issued before o
+func (b ballot) less(o ballot) bool {
+	return b.N < o.N || (b.N == o.N && b.Node < o.Node)
+}
+
+// A viewEntry is the membership chosen for an epoch
+type viewEntry struct {
+	Epoch   uint64   `json:"epoch"`
+	Members []string `json:"members"`
+}
+
+// acceptorState is what an acceptor has promised and accepted for one epoch
+type acceptorState struct {
+	Promised ballot     `json:"promised"`
+	Accepted ballot     `json:"accepted"`
+	Value    *viewEntry `json:"value"`
+}
+
+// A paxosRequest is a prepare or accept sent to an acceptor
+type paxosRequest struct {
+	Epoch  uint64
+	Ballot ballot
+	Value  viewEntry
+}
+
+// A paxosReply is an acceptor's answer. Every reply carries the acceptor's latest view,
+// so a proposer that has fallen behind finds out.
+type paxosReply struct {
+	Ok       bool
+	Promised ballot     // Highest ballot the acceptor has promised, when it refuses
+	Accepted ballot     // Ballot of the value the acceptor has already accepted, if any
+	Value    *viewEntry // That value
+	Current  viewEntry  // The acceptor's latest view
+}
+
+// viewLogState is the part of the log kept on disk
+type viewLogState struct {
+	Current   viewEntry                 `json:"current"`
+	Acceptors map[uint64]*acceptorState `json:"acceptors"`
+	Ballot    uint64                    `json:"ballot"`
+}
+
+// ViewLog agrees on and records the view for every epoch
+type ViewLog struct {
+	view     View
+	me       string
+	path     string
+	state    viewLogState
+	mutex    sync.Mutex // Protects state
+	proposer sync.Mutex // Only one proposal from this node at a time
+
+	send    func(ip string, cmd string, req paxosRequest) (paxosReply, error) // Calls a remote acceptor
+	tell    func(ip string, e viewEntry) error                                // Tells a node a view was chosen
+	onLearn func(e viewEntry)                                                 // Called once a new view has been learned
+}
+
+// OpenViewLog loads the membership log kept in dir. If there is no log yet, the
+// starting view becomes epoch 0. Otherwise the view is replaced by the latest one in
+// the log.
+func OpenViewLog(v View, dir string, timeout time.Duration) (*ViewLog, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "Creating data directory "+dir+" failed")
+	}
+	l := &ViewLog{
+		view: v,
+		me:   v.Primary(),
+		path: filepath.Join(dir, viewLogFile),
+		send: func(ip string, cmd string, req paxosRequest) (paxosReply, error) {
+			return sendPaxos(ip, cmd, req, timeout)
+		},
+		tell: func(ip string, e viewEntry) error {
+			return sendViewList(ip, e)
+		},
+	}
+	l.state.Acceptors = make(map[uint64]*acceptorState)
+
+	data, err := ioutil.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		l.state.Current = viewEntry{Epoch: 0, Members: sortedMembers(v.List())}
+		return l, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Reading "+l.path+" failed")
+	}
+	err = json.Unmarshal(data, &l.state)
+	if err != nil {
+		return nil, errors.Wrap(err, "Decoding "+l.path+" failed")
+	}
+	if l.state.Acceptors == nil {
+		l.state.Acceptors = make(map[uint64]*acceptorState)
+	}
+	log.Println("Restored view from epoch", l.state.Current.Epoch)
+	v.Overwrite(l.state.Current.Members)
+	return l, nil
+}
+
+// sortedMembers returns a sorted copy of a member list
+func sortedMembers(members []string) []string {
+	out := append([]string(nil), members...)
+	sort.Strings(out)
+	return out
+}
+
+// persist writes the log's state to disk. The lock must be held.
+func (l *ViewLog) persist() error {
+	data, err := json.Marshal(l.state)
+	if err != nil {
+		return errors.Wrap(err, "Encoding view log failed")
+	}
+	err = writeFileSync(l.path+".tmp", data)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(l.path+".tmp", l.path)
+	if err != nil {
+		return errors.Wrap(err, "Renaming view log failed")
+	}
+	return nil
+}
+
+// Epoch returns the epoch of the current view
+func (l *ViewLog) Epoch() uint64 {
+	if l == nil {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.state.Current.Epoch
+}
+
+// Current returns the current view
+func (l *ViewLog) Current() viewEntry {
+	if l == nil {
+		return viewEntry{}
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.state.Current
+}
+
+// acceptor returns the acceptor state for an epoch, creating it if needed. The lock
+// must be held.
+func (l *ViewLog) acceptor(epoch uint64) *acceptorState {
+	s, ok := l.state.Acceptors[epoch]
+	if !ok {
+		s = &acceptorState{}
+		l.state.Acceptors[epoch] = s
+	}
+	return s
+}
+
+// Prepare is phase one of Paxos on the acceptor. It promises to ignore any ballot
+// lower than the one given, and reports any value already accepted for the epoch.
+func (l *ViewLog) Prepare(req paxosRequest) paxosReply {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	reply := paxosReply{Current: l.state.Current}
+	if req.Epoch <= l.state.Current.Epoch {
+		// That epoch has already been decided
+		return reply
+	}
+	l.observe(req.Ballot)
+	s := l.acceptor(req.Epoch)
+	if req.Ballot.less(s.Promised) {
+		reply.Promised = s.Promised
+		return reply
+	}
+	s.Promised = req.Ballot
+	err := l.persist()
+	if err != nil {
+		log.Println("Error saving promise: ", err)
+		return reply
+	}
+	reply.Ok = true
+	reply.Accepted = s.Accepted
+	reply.Value = s.Value
+	return reply
+}
+
+// Accept is phase two of Paxos on the acceptor. It accepts the value unless it has
+// promised a higher ballot since.
+func (l *ViewLog) Accept(req paxosRequest) paxosReply {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	reply := paxosReply{Current: l.state.Current}
+	if req.Epoch <= l.state.Current.Epoch {
+		return reply
+	}
+	l.observe(req.Ballot)
+	s := l.acceptor(req.Epoch)
+	if req.Ballot.less(s.Promised) {
+		reply.Promised = s.Promised
+		return reply
+	}
+	value := req.Value
+	s.Promised = req.Ballot
+	s.Accepted = req.Ballot
+	s.Value = &value
+	err := l.persist()
+	if err != nil {
+		log.Println("Error saving accepted value: ", err)
+		return reply
+	}
+	reply.Ok = true
+	return reply
+}
+
+// observe notes a ballot number so our next proposal goes higher. The lock must be held.
+func (l *ViewLog) observe(b ballot) {
+	if b.N > l.state.Ballot {
+		l.state.Ballot = b.N
+	}
+}
+
+// nextBallot returns a ballot higher than any this node has seen
+func (l *ViewLog) nextBallot() ballot {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.state.Ballot++
+	return ballot{N: l.state.Ballot, Node: l.me}
+}
+
+// Learn adopts a chosen view if it's newer than ours, and returns false if it isn't
+func (l *ViewLog) Learn(e viewEntry) bool {
+	if l == nil {
+		return false
+	}
+	l.mutex.Lock()
+	if e.Epoch <= l.state.Current.Epoch {
+		l.mutex.Unlock()
+		return false
+	}
+	log.Println("Moving to view epoch", e.Epoch, ":", e.Members)
+	l.state.Current = viewEntry{Epoch: e.Epoch, Members: sortedMembers(e.Members)}
+	for epoch := range l.state.Acceptors {
+		if epoch <= e.Epoch {
+			delete(l.state.Acceptors, epoch)
+		}
+	}
+	err := l.persist()
+	if err != nil {
+		log.Println("Error saving view: ", err)
+	}
+	l.view.Overwrite(e.Members)
+	// Make sure gossip passes the new view on even if our member list didn't change
+	viewChange.Store(true)
+	cur := l.state.Current
+	l.mutex.Unlock()
+
+	// Outside the lock, so the hook can ask for the view
+	if l.onLearn != nil {
+		l.onLearn(cur)
+	}
+	return true
+}
+
+// call sends a request to an acceptor, which may be this node
+func (l *ViewLog) call(ip string, cmd string, req paxosRequest) (paxosReply, error) {
+	if ip == l.me {
+		if cmd == "prepare" {
+			return l.Prepare(req), nil
+		}
+		return l.Accept(req), nil
+	}
+	return l.send(ip, cmd, req)
+}
+
+// broadcast sends a request to every acceptor at once and returns the replies which came back
+func (l *ViewLog) broadcast(acceptors []string, cmd string, req paxosRequest) []paxosReply {
+	results := make(chan *paxosReply, len(acceptors))
+	for _, ip := range acceptors {
+		go func(ip string) {
+			reply, err := l.call(ip, cmd, req)
+			if err != nil {
+				log.Println("No "+cmd+" reply from "+ip+": ", err)
+				results <- nil
+				return
+			}
+			results <- &reply
+		}(ip)
+	}
+	var replies []paxosReply
+	for range acceptors {
+		if r := <-results; r != nil {
+			replies = append(replies, *r)
+		}
+	}
+	return replies
+}
+
+// changeMembers applies a change to a member list, returning false if it changes nothing
+func changeMembers(members []string, op viewOp, node string) ([]string, bool) {
+	var out []string
+	found := false
+	for _, m := range members {
+		if m == node {
+			found = true
+			if op == viewRemove {
+				continue
+			}
+		}
+		out = append(out, m)
+	}
+	if op == viewAdd && !found {
+		out = append(out, node)
+	}
+	changed := (op == viewAdd) != found
+	return sortedMembers(out), changed
+}
+
+// Propose adds or removes a member by agreeing on the next epoch with a majority of the
+// current members. It returns the view the change ended up in, or errViewUnchanged if
+// the view already had the requested membership.
+func (l *ViewLog) Propose(op viewOp, node string) (viewEntry, error) {
+	l.proposer.Lock()
+	defer l.proposer.Unlock()
+
+	for attempt := 0; attempt < viewMaxAttempts; attempt++ {
+		if attempt > 0 {
+			// Back off a random amount so competing proposers don't keep colliding
+			time.Sleep(time.Duration(rand.Intn(100*attempt)) * time.Millisecond)
+		}
+		cur := l.Current()
+		members, changed := changeMembers(cur.Members, op, node)
+		if !changed {
+			return cur, errViewUnchanged
+		}
+		value := viewEntry{Epoch: cur.Epoch + 1, Members: members}
+		acceptors := cur.Members
+		majority := len(acceptors)/2 + 1
+		b := l.nextBallot()
+
+		// Phase one: collect promises, and find out if a value was already accepted
+		promises := 0
+		var prior *paxosReply
+		behind := false
+		for _, r := range l.broadcast(acceptors, "prepare", paxosRequest{Epoch: value.Epoch, Ballot: b}) {
+			r := r
+			if r.Current.Epoch >= value.Epoch {
+				behind = l.Learn(r.Current) || behind
+			}
+			if !r.Ok {
+				l.mutex.Lock()
+				l.observe(r.Promised)
+				l.mutex.Unlock()
+				continue
+			}
+			promises++
+			if r.Value != nil && (prior == nil || prior.Accepted.less(r.Accepted)) {
+				prior = &r
+			}
+		}
+		if behind {
+			log.Println("View moved on while proposing, trying again at the new epoch")
+			continue
+		}
+		if promises < majority {
+			log.Println("Only", promises, "of", majority, "promises for epoch", value.Epoch)
+			continue
+		}
+
+		// A value some acceptor already took has to be the one we push through
+		proposal := value
+		if prior != nil {
+			proposal = *prior.Value
+		}
+
+		// Phase two: get a majority to accept it
+		accepts := 0
+		for _, r := range l.broadcast(acceptors, "accept", paxosRequest{Epoch: value.Epoch, Ballot: b, Value: proposal}) {
+			if r.Ok {
+				accepts++
+			}
+		}
+		if accepts < majority {
+			log.Println("Only", accepts, "of", majority, "accepts for epoch", value.Epoch)
+			continue
+		}
+
+		// It's chosen, so tell everybody in the old and new views
+		l.Learn(proposal)
+		l.announce(proposal, acceptors)
+
+		// An acceptor may hold our own value from an earlier attempt of ours, or from
+		// another proposer making the same change, and then this call did make it
+		if prior == nil || strings.Join(proposal.Members, ",") == strings.Join(value.Members, ",") {
+			return proposal, nil
+		}
+		// That epoch went to somebody else's change, so go again on top of it
+	}
+	return l.Current(), errors.Errorf("No agreement on a new view after %d attempts", viewMaxAttempts)
+}
+
+// announce tells the members of the old and new views which view was chosen. Anybody
+// who misses it will hear about it through gossip.
+func (l *ViewLog) announce(e viewEntry, old []string) {
+	told := map[string]bool{l.me: true}
+	for _, ip := range append(append([]string(nil), old...), e.Members...) {
+		if told[ip] {
+			continue
+		}
+		told[ip] = true
+		go func(ip string) {
+			err := l.tell(ip, e)
+			if err != nil {
+				log.Println("Error announcing view to "+ip+": ", err)
+			}
+		}(ip)
+	}
+}
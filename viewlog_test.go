@@ -0,0 +1,281 @@
+// viewlog_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for the membership log
+
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var viewLogNodes = []string{"10.0.0.20:8080", "10.0.0.21:8080", "10.0.0.22:8080"}
+
+// A viewLogCluster is a set of membership logs which call each other directly
+type viewLogCluster struct {
+	logs  map[string]*ViewLog
+	down  map[string]bool
+	mutex sync.Mutex
+}
+
+// Opens a membership log for each node, all starting from the same view
+func newViewLogCluster(t *testing.T, dir string) *viewLogCluster {
+	c := &viewLogCluster{logs: make(map[string]*ViewLog), down: make(map[string]bool)}
+	for _, node := range viewLogNodes {
+		l, err := OpenViewLog(NewView(node, strings.Join(viewLogNodes, ",")), filepath.Join(dir, node), time.Second)
+		ok(t, err)
+		c.wire(l)
+		c.logs[node] = l
+	}
+	return c
+}
+
+// wire points a log's calls at the rest of the cluster
+func (c *viewLogCluster) wire(l *ViewLog) {
+	l.send = func(ip string, cmd string, req paxosRequest) (paxosReply, error) {
+		peer := c.peer(ip)
+		if peer == nil {
+			return paxosReply{}, errors.New("Can't reach " + ip)
+		}
+		if cmd == "prepare" {
+			return peer.Prepare(req), nil
+		}
+		return peer.Accept(req), nil
+	}
+	l.tell = func(ip string, e viewEntry) error {
+		peer := c.peer(ip)
+		if peer == nil {
+			return errors.New("Can't reach " + ip)
+		}
+		peer.Learn(e)
+		return nil
+	}
+}
+
+// peer returns the log for a node, or nil if it's down or doesn't exist
+func (c *viewLogCluster) peer(ip string) *ViewLog {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.down[ip] {
+		return nil
+	}
+	return c.logs[ip]
+}
+
+// setDown cuts a node off from the rest
+func (c *viewLogCluster) setDown(ip string) {
+	c.mutex.Lock()
+	c.down[ip] = true
+	c.mutex.Unlock()
+}
+
+// settle waits for the announcements to land and returns the view each node ended up with
+func (c *viewLogCluster) settle(epoch uint64) map[string]viewEntry {
+	deadline := time.Now().Add(2 * time.Second)
+	out := make(map[string]viewEntry)
+	for {
+		done := true
+		for node, l := range c.logs {
+			out[node] = l.Current()
+			if out[node].Epoch < epoch && c.peer(node) != nil {
+				done = false
+			}
+		}
+		if done || time.Now().After(deadline) {
+			return out
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// withMembers returns the starting nodes plus any others, sorted
+func withMembers(extra ...string) []string {
+	out := append(append([]string(nil), viewLogNodes...), extra...)
+	sort.Strings(out)
+	return out
+}
+
+func TestViewLogAgreesOnViewChange(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	c := newViewLogCluster(t, dir)
+
+	e, err := c.logs[viewLogNodes[0]].Propose(viewAdd, "10.0.0.23:8080")
+	ok(t, err)
+	want := viewEntry{Epoch: 1, Members: withMembers("10.0.0.23:8080")}
+	equals(t, want, e)
+	for node, got := range c.settle(1) {
+		equals(t, want, got)
+		assert(t, c.logs[node].view.Contains("10.0.0.23:8080"), node+" didn't add the new member to its view")
+	}
+
+	_, err = c.logs[viewLogNodes[1]].Propose(viewAdd, "10.0.0.23:8080")
+	equals(t, errViewUnchanged, err)
+}
+
+func TestViewLogNeedsMajority(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	c := newViewLogCluster(t, dir)
+
+	// Two of three is still a majority
+	c.setDown(viewLogNodes[2])
+	_, err := c.logs[viewLogNodes[0]].Propose(viewRemove, viewLogNodes[2])
+	ok(t, err)
+	equals(t, uint64(1), c.settle(1)[viewLogNodes[1]].Epoch)
+
+	// One of two isn't
+	c.setDown(viewLogNodes[1])
+	_, err = c.logs[viewLogNodes[0]].Propose(viewAdd, "10.0.0.23:8080")
+	assert(t, err != nil, "View changed without a majority")
+	equals(t, uint64(1), c.logs[viewLogNodes[0]].Epoch())
+}
+
+func TestViewLogConcurrentChangesBothLand(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	c := newViewLogCluster(t, dir)
+
+	errs := make(chan error, 2)
+	for i, node := range []string{"10.0.0.23:8080", "10.0.0.24:8080"} {
+		go func(proposer *ViewLog, node string) {
+			_, err := proposer.Propose(viewAdd, node)
+			errs <- err
+		}(c.logs[viewLogNodes[i]], node)
+	}
+	ok(t, <-errs)
+	ok(t, <-errs)
+
+	want := viewEntry{Epoch: 2, Members: withMembers("10.0.0.23:8080", "10.0.0.24:8080")}
+	for _, got := range c.settle(2) {
+		equals(t, want, got)
+	}
+}
+
+func TestViewLogProposalFinishingOurOwnChangeSucceeds(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	c := newViewLogCluster(t, dir)
+
+	// An acceptor already took the very change we're about to propose
+	want := viewEntry{Epoch: 1, Members: withMembers("10.0.0.23:8080")}
+	b := ballot{N: 0, Node: viewLogNodes[2]}
+	acceptor := c.logs[viewLogNodes[1]]
+	assert(t, acceptor.Prepare(paxosRequest{Epoch: 1, Ballot: b}).Ok, "Acceptor didn't promise")
+	assert(t, acceptor.Accept(paxosRequest{Epoch: 1, Ballot: b, Value: want}).Ok, "Acceptor didn't accept")
+
+	e, err := c.logs[viewLogNodes[0]].Propose(viewAdd, "10.0.0.23:8080")
+	ok(t, err)
+	equals(t, want, e)
+}
+
+func TestViewLogIgnoresOlderEpochs(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	c := newViewLogCluster(t, dir)
+	l := c.logs[viewLogNodes[0]]
+
+	_, err := l.Propose(viewRemove, viewLogNodes[2])
+	ok(t, err)
+	assert(t, !l.Learn(viewEntry{Epoch: 1, Members: viewLogNodes}), "Learned a view from the same epoch")
+	assert(t, !l.Learn(viewEntry{Epoch: 0, Members: viewLogNodes}), "Learned a view from an older epoch")
+	equals(t, withMembers()[:2], l.Current().Members)
+
+	// Proposals for a decided epoch are refused, and told the current view
+	reply := l.Prepare(paxosRequest{Epoch: 1, Ballot: ballot{N: 100, Node: viewLogNodes[1]}})
+	assert(t, !reply.Ok, "Promised for an epoch which has been decided")
+	equals(t, l.Current(), reply.Current)
+}
+
+func TestViewLogSurvivesRestart(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	c := newViewLogCluster(t, dir)
+	_, err := c.logs[viewLogNodes[0]].Propose(viewAdd, "10.0.0.23:8080")
+	ok(t, err)
+
+	// A node restarted with its old VIEW comes back on the agreed one
+	v := NewView(viewLogNodes[0], strings.Join(viewLogNodes, ","))
+	l, err := OpenViewLog(v, filepath.Join(dir, viewLogNodes[0]), time.Second)
+	ok(t, err)
+	equals(t, uint64(1), l.Epoch())
+	assert(t, v.Contains("10.0.0.23:8080"), "Restored view is missing the new member")
+}
+
+func TestMerkleGossipRefusesOlderEpoch(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	c := newViewLogCluster(t, dir)
+	alice := c.logs[viewLogNodes[0]]
+	bob := c.logs[viewLogNodes[1]]
+
+	// Bob moves on to epoch 1 while Alice is away
+	c.setDown(viewLogNodes[0])
+	_, err := bob.Propose(viewRemove, viewLogNodes[2])
+	ok(t, err)
+
+	kvs := filledKVS(10, time.Now())
+	client, _ := merklePeerWithViews(kvs, bob)
+	_, err = merkleDiff(client, kvs.MerkleTree(), alice)
+	equals(t, errStaleEpoch, err)
+	equals(t, bob.Current(), alice.Current())
+
+	// Now that they agree, gossip goes ahead
+	leaves, err := merkleDiff(client, kvs.MerkleTree(), alice)
+	ok(t, err)
+	equals(t, 0, len(leaves))
+}
+
+func TestReplicaWritesFromOlderEpochAreRefused(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	c := newViewLogCluster(t, dir)
+	bob := c.logs[viewLogNodes[1]]
+	_, err := bob.Propose(viewRemove, viewLogNodes[2])
+	ok(t, err)
+
+	kvs := NewKVS()
+	e := NewEndpoint()
+	e.gossip = GossipVals{kvs: kvs, views: bob}
+	e.AddHandleFunc("replicate", e.handleReplicate)
+	replicate := func(epoch uint64) bool {
+		client, server := net.Pipe()
+		defer client.Close()
+		go e.handleMessages(server)
+		rw := bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
+		_, err := rw.WriteString("replicate\n")
+		ok(t, err)
+		entry := *NewEntry(time.Now(), VectorClock{keyone: 1}, valone, 1)
+		ok(t, gob.NewEncoder(rw).Encode(replicaWrite{Key: keyone, Entry: entry, Epoch: epoch}))
+		ok(t, rw.Flush())
+		var ack bool
+		ok(t, gob.NewDecoder(rw).Decode(&ack))
+		return ack
+	}
+
+	// A coordinator which missed the view change may be writing to a node which no
+	// longer stores the key
+	assert(t, !replicate(0), "Write from an older epoch was acked")
+	alive, _ := kvs.Contains(keyone)
+	assert(t, !alive, "Write from an older epoch was stored")
+
+	assert(t, replicate(1), "Write from the current epoch was refused")
+	alive, _ = kvs.Contains(keyone)
+	assert(t, alive, "Write from the current epoch wasn't stored")
+}
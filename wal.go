@@ -0,0 +1,346 @@
+// wal.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines a write-ahead log for the KVS. Every change to the db is appended to the
+// log and fsync'd before the write is acknowledged, so that a restarted node can
+// rebuild its versions, clocks and tombstones by replaying the log.
+//
+// The log is split into numbered segment files (wal-00000001.log, ...). Taking a
+// snapshot starts a new segment, and once the snapshot is on disk every segment
+// before it can be thrown away.
+//
+// Each record on disk is framed as:
+//
+//     [4 byte length][4 byte CRC32 of the payload][payload]
+//
+// where the payload is a gob-encoded walRecord. The CRC lets replay detect a record
+// which was only partially written when the process died.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// walOp identifies the kind of change a log record describes
+type walOp byte
+
+const (
+	walPut       walOp = iota + 1 // A client write through Put()
+	walDelete                     // A client delete through Delete()
+	walOverwrite                  // An entry received through gossip
+	walCollect                    // A tombstone removed by the collector
+	walBatch                      // A group of changes made together, held in Batch
+)
+
+const (
+	walSegmentFormat = "wal-%08d.log" // Segment file names inside the data directory
+	walHeaderSize    = 8              // Length and checksum preceding each record
+	walMaxRecord     = 64 << 20       // Anything claiming to be bigger than this is garbage
+)
+
+// errTornFrame is returned by readFrame when a frame is incomplete or fails its checksum
+var errTornFrame = errors.New("torn or corrupt frame")
+
+// A walRecord is a single change to the KVS. It holds the whole entry as it stood
+// after the change, so replaying a record is just a matter of storing the entry again.
+type walRecord struct {
+	Op    walOp
+	Key   string
+	Entry Entry
+	Batch []walRecord // The changes in a walBatch record
+}
+
+// WAL is an append-only log of walRecords backed by segment files in a directory
+type WAL struct {
+	dir   string     // Directory holding the segments (and snapshots)
+	seq   uint64     // Number of the segment currently being appended to
+	file  *os.File   // The open segment, positioned at the end
+	mutex sync.Mutex // Serializes appends and rotations
+}
+
+// OpenWAL opens the log inside the given directory, creating both if needed. New
+// records are appended to the highest-numbered segment already present.
+func OpenWAL(dir string) (*WAL, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "Creating data directory "+dir+" failed")
+	}
+	segs, err := listSegments(dir, walSegmentFormat)
+	if err != nil {
+		return nil, err
+	}
+	var seq uint64 = 1
+	if len(segs) > 0 {
+		seq = segs[len(segs)-1]
+	}
+	w := &WAL{dir: dir}
+	err = w.openSegment(seq)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// openSegment makes the given segment the one being appended to
+func (w *WAL) openSegment(seq uint64) error {
+	path := w.segmentPath(seq)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Opening log "+path+" failed")
+	}
+	// Appends always go to the end, even if the log is never replayed
+	_, err = f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "Seeking to end of log "+path+" failed")
+	}
+	w.seq = seq
+	w.file = f
+	return nil
+}
+
+// segmentPath returns the file name for a segment number
+func (w *WAL) segmentPath(seq uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf(walSegmentFormat, seq))
+}
+
+// Append writes a record to the end of the log and syncs it to disk before returning
+func (w *WAL) Append(rec walRecord) error {
+	frame, err := encodeFrame(rec)
+	if err != nil {
+		return errors.Wrapf(err, "Encode failed for record: %#v", rec)
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	_, err = w.file.Write(frame)
+	if err != nil {
+		return errors.Wrap(err, "Writing to log failed")
+	}
+	err = w.file.Sync()
+	if err != nil {
+		return errors.Wrap(err, "Syncing log failed")
+	}
+	return nil
+}
+
+// Rotate closes the current segment and starts a new one. It returns the number of
+// the new segment; everything logged from now on is in that segment or a later one.
+func (w *WAL) Rotate() (uint64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	err := w.file.Close()
+	if err != nil {
+		return 0, errors.Wrap(err, "Closing log segment failed")
+	}
+	err = w.openSegment(w.seq + 1)
+	if err != nil {
+		return 0, err
+	}
+	return w.seq, nil
+}
+
+// RemoveBefore deletes every segment numbered lower than seq
+func (w *WAL) RemoveBefore(seq uint64) error {
+	segs, err := listSegments(w.dir, walSegmentFormat)
+	if err != nil {
+		return err
+	}
+	for _, s := range segs {
+		if s >= seq {
+			break
+		}
+		log.Println("Removing log segment", s)
+		err = os.Remove(w.segmentPath(s))
+		if err != nil {
+			return errors.Wrap(err, "Removing log segment failed")
+		}
+	}
+	return nil
+}
+
+// Replay reads every segment numbered from seq onwards and hands each record to
+// apply, in the order they were written. A torn record at the end of the last segment
+// is what a crash in the middle of Append looks like, so that segment is truncated
+// there without an error. Anything else which can't be read, a torn record in an
+// earlier segment or one which passes its checksum but won't decode, would leave a gap
+// in the history, so replay stops with an error and the log is left as it is. It
+// returns the number of records applied.
+func (w *WAL) Replay(seq uint64, apply func(walRecord)) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	segs, err := listSegments(w.dir, walSegmentFormat)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i, s := range segs {
+		if s < seq {
+			continue
+		}
+		n, err := w.replaySegment(s, i == len(segs)-1, apply)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// replaySegment replays a single segment file, truncating a torn tail if it's the last
+func (w *WAL) replaySegment(seq uint64, last bool, apply func(walRecord)) (int, error) {
+	path := w.segmentPath(seq)
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, errors.Wrap(err, "Opening log "+path+" failed")
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	count := 0
+	var offset int64 // End of the last good record
+	for {
+		var rec walRecord
+		n, err := readFrame(r, &rec)
+		if err == io.EOF {
+			break
+		}
+		if err == errTornFrame && last {
+			log.Println("Torn record at the end of log segment", seq, "at offset", offset)
+			break
+		}
+		if err != nil {
+			return count, errors.Wrapf(err, "Bad record in log segment %d at offset %d", seq, offset)
+		}
+		normalizeEntry(&rec.Entry)
+		for i := range rec.Batch {
+			normalizeEntry(&rec.Batch[i].Entry)
+		}
+		apply(rec)
+		count++
+		offset += n
+	}
+
+	// Drop anything after the last good record so new appends follow it directly
+	err = f.Truncate(offset)
+	if err != nil {
+		return count, errors.Wrap(err, "Truncating log failed")
+	}
+	if seq == w.seq {
+		_, err = w.file.Seek(offset, io.SeekStart)
+		if err != nil {
+			return count, errors.Wrap(err, "Seeking to end of log failed")
+		}
+	}
+	return count, nil
+}
+
+// Close closes the current segment
+func (w *WAL) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.file.Close()
+}
+
+// encodeFrame gob-encodes v on its own and wraps it in a length and checksum header
+func encodeFrame(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	payload := buf.Bytes()
+
+	frame := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[walHeaderSize:], payload)
+	return frame, nil
+}
+
+// readFrame reads one frame written by encodeFrame and decodes it into v. It returns
+// the number of bytes the frame took up, io.EOF if there was nothing left to read,
+// or errTornFrame if the frame was cut short or damaged.
+func readFrame(r io.Reader, v interface{}) (int64, error) {
+	header := make([]byte, walHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, errTornFrame
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	if size > walMaxRecord {
+		return 0, errTornFrame
+	}
+
+	payload := make([]byte, size)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return 0, errTornFrame
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return 0, errTornFrame
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(payload)).Decode(v)
+	if err != nil {
+		return 0, errors.Wrap(err, "Decoding frame failed")
+	}
+	return int64(walHeaderSize) + int64(size), nil
+}
+
+// normalizeEntry fixes up an entry read back from disk. Gob leaves empty maps out
+// entirely, but the KVS expects every entry to have one.
+func normalizeEntry(e *Entry) {
+	if e.Clock == nil {
+		e.Clock = make(VectorClock)
+	}
+}
+
+// listSegments returns the numbers of the files in dir matching format, in ascending order
+func listSegments(dir string, format string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "Reading data directory "+dir+" failed")
+	}
+	var segs []uint64
+	for _, f := range files {
+		var seq uint64
+		n, err := fmt.Sscanf(f.Name(), format, &seq)
+		if err != nil || n != 1 || fmt.Sprintf(format, seq) != f.Name() {
+			continue
+		}
+		segs = append(segs, seq)
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	return segs, nil
+}
@@ -0,0 +1,221 @@
+// wal_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for the write-ahead log
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Makes a scratch directory for a log and returns it with a cleanup func
+func tempDataDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "wal")
+	ok(t, err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestWALReplayReturnsAppendedRecords(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	w, err := OpenWAL(dir)
+	ok(t, err)
+	first := walRecord{Op: walPut, Key: keyone, Entry: *NewEntry(time.Now(), VectorClock{keyone: 1}, valone, 1)}
+	second := walRecord{Op: walPut, Key: keyExists, Entry: *NewEntry(time.Now(), VectorClock{keyExists: 1}, valExists, 1)}
+	ok(t, w.Append(first))
+	ok(t, w.Append(second))
+	ok(t, w.Close())
+
+	w, err = OpenWAL(dir)
+	ok(t, err)
+	defer w.Close()
+	var got []walRecord
+	n, err := w.Replay(0, func(rec walRecord) { got = append(got, rec) })
+	ok(t, err)
+	equals(t, 2, n)
+	equals(t, first.Key, got[0].Key)
+	equals(t, second.Key, got[1].Key)
+	equals(t, first.Entry.Clock, got[0].Entry.Clock)
+	assert(t, first.Entry.Timestamp.Equal(got[0].Entry.Timestamp), "Timestamp didn't survive the log")
+}
+
+func TestWALReplayTruncatesTornRecord(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	w, err := OpenWAL(dir)
+	ok(t, err)
+	ok(t, w.Append(walRecord{Op: walPut, Key: keyone, Entry: *NewEntry(time.Now(), nil, valone, 1)}))
+	ok(t, w.Close())
+
+	// Simulate a crash partway through writing a second record
+	path := w.segmentPath(1)
+	good, err := os.Stat(path)
+	ok(t, err)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	ok(t, err)
+	_, err = f.Write([]byte{0, 0, 1, 0, 0xde, 0xad})
+	ok(t, err)
+	f.Close()
+
+	w, err = OpenWAL(dir)
+	ok(t, err)
+	defer w.Close()
+	n, err := w.Replay(0, func(rec walRecord) {})
+	ok(t, err)
+	equals(t, 1, n)
+
+	after, err := os.Stat(path)
+	ok(t, err)
+	equals(t, good.Size(), after.Size())
+}
+
+func TestWALReplayRefusesToSkipRecords(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	w, err := OpenWAL(dir)
+	ok(t, err)
+	ok(t, w.Append(walRecord{Op: walPut, Key: keyone, Entry: *NewEntry(time.Now(), nil, valone, 1)}))
+	ok(t, w.Close())
+
+	// A frame which passes its checksum but isn't a record, then a good record after it
+	bad, err := encodeFrame("not a record")
+	ok(t, err)
+	f, err := os.OpenFile(w.segmentPath(1), os.O_APPEND|os.O_WRONLY, 0644)
+	ok(t, err)
+	_, err = f.Write(bad)
+	ok(t, err)
+	f.Close()
+	w, err = OpenWAL(dir)
+	ok(t, err)
+	ok(t, w.Append(walRecord{Op: walPut, Key: keyExists, Entry: *NewEntry(time.Now(), nil, valExists, 1)}))
+	ok(t, w.Close())
+	before, err := os.Stat(w.segmentPath(1))
+	ok(t, err)
+
+	w, err = OpenWAL(dir)
+	ok(t, err)
+	_, err = w.Replay(0, func(rec walRecord) {})
+	assert(t, err != nil, "Replay skipped a record which wouldn't decode")
+	after, err := os.Stat(w.segmentPath(1))
+	ok(t, err)
+	equals(t, before.Size(), after.Size())
+	ok(t, w.Close())
+}
+
+func TestWALReplayRefusesTornRecordBeforeTheLastSegment(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	w, err := OpenWAL(dir)
+	ok(t, err)
+	ok(t, w.Append(walRecord{Op: walPut, Key: keyone, Entry: *NewEntry(time.Now(), nil, valone, 1)}))
+	_, err = w.Rotate()
+	ok(t, err)
+	f, err := os.OpenFile(w.segmentPath(1), os.O_APPEND|os.O_WRONLY, 0644)
+	ok(t, err)
+	_, err = f.Write([]byte{0, 0, 1, 0, 0xde, 0xad})
+	ok(t, err)
+	f.Close()
+	ok(t, w.Append(walRecord{Op: walPut, Key: keyExists, Entry: *NewEntry(time.Now(), nil, valExists, 1)}))
+	ok(t, w.Close())
+
+	w, err = OpenWAL(dir)
+	ok(t, err)
+	defer w.Close()
+	_, err = w.Replay(0, func(rec walRecord) {})
+	assert(t, err != nil, "Replay carried on past a torn record in an earlier segment")
+}
+
+func TestWALReplayNormalizesBatchedEntries(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	w, err := OpenWAL(dir)
+	ok(t, err)
+	defer w.Close()
+	batch := []walRecord{{Op: walPut, Key: keyone, Entry: *NewEntry(time.Now(), VectorClock{}, valone, 1)}}
+	ok(t, w.Append(walRecord{Op: walBatch, Batch: batch}))
+
+	var got walRecord
+	_, err = w.Replay(0, func(rec walRecord) { got = rec })
+	ok(t, err)
+	equals(t, 1, len(got.Batch))
+	assert(t, got.Batch[0].Entry.Clock != nil, "Batched entry came back without a clock")
+}
+
+func TestKVSRestoreRebuildsEntries(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+
+	w, err := OpenWAL(dir)
+	ok(t, err)
+	k := NewKVS()
+	ok(t, k.Restore(w))
+
+	k.Put(keyone, valone, time.Now(), VectorClock{keyone: 1})
+	k.Put(keyone, valtwo, time.Now(), VectorClock{keyone: 2})
+	k.Put(keyExists, valExists, time.Now(), VectorClock{keyExists: 1})
+	k.Delete(keyExists, time.Now(), VectorClock{keyExists: 1})
+	gossiped := NewEntry(time.Now(), VectorClock{keyNotExists: 4}, valNotExists, 4)
+	k.OverwriteEntry(keyNotExists, gossiped)
+	ok(t, w.Close())
+
+	// A fresh store built from the same log should look exactly the same
+	w, err = OpenWAL(dir)
+	ok(t, err)
+	defer w.Close()
+	r := NewKVS()
+	ok(t, r.Restore(w))
+
+	for _, key := range []string{keyone, keyExists, keyNotExists} {
+		w, _ := k.db.Get(key)
+		g, _ := r.db.Get(key)
+		want := toEntry(w)
+		got := toEntry(g)
+		equals(t, want.Value, got.Value)
+		equals(t, want.Version, got.Version)
+		equals(t, want.Clock, got.Clock)
+		equals(t, want.Tombstone, got.Tombstone)
+		assert(t, want.Timestamp.Equal(got.Timestamp), "Timestamp for %s didn't survive the log", key)
+	}
+}
+
+func TestKVSWithoutWALDoesntLog(t *testing.T) {
+	k := NewKVS()
+	assert(t, k.Put(keyone, valone, time.Now(), nil), "Put failed without a log")
+	e, _ := k.db.Get(keyone)
+	assert(t, k.store(walPut, keyone, e), "store failed without a log")
+}
+
+func TestFailedAppendChangesNothing(t *testing.T) {
+	dir, cleanup := tempDataDir(t)
+	defer cleanup()
+	w, err := OpenWAL(dir)
+	ok(t, err)
+	k := NewKVS()
+	ok(t, k.Restore(w))
+	assert(t, k.Put(keyone, valone, time.Now(), VectorClock{}), "Put failed with a working log")
+
+	// With the log gone nothing can be made durable, so nothing may be seen either
+	w.Close()
+	assert(t, !k.Put(keyone, valtwo, time.Now(), VectorClock{keyone: 1}), "Put succeeded without a log")
+	val, _ := k.Get(keyone, VectorClock{})
+	equals(t, valone, val)
+	assert(t, !k.Delete(keyone, time.Now(), VectorClock{keyone: 1}), "Delete succeeded without a log")
+	alive, version := k.Contains(keyone)
+	assert(t, alive, "Failed delete was seen")
+	equals(t, 1, version)
+}
@@ -0,0 +1,337 @@
+// watch.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson     lelawson
+// Pete Wilcox         pcwilcox
+// Annie Shen          ashen7
+// Victoria Tran       vilatran
+//
+// Defines the change feed. Every change the KVS stores, whether a client wrote it here
+// or gossip brought it in, is published to the feed as an event holding the key's new
+// value, version and clock, whether it's a tombstone, and where it came from. A GET on
+// /keyValue-store/_watch streams the events for the keys starting with ?prefix= as
+// Server-Sent Events, or as one JSON object per line if the client asks for JSON with
+// ?format=json or its Accept header.
+//
+// Each event carries a cursor. The feed keeps the last WATCH_BACKLOG events, so a client
+// which reconnects with the cursor of the last event it saw, in ?cursor= or the
+// Last-Event-ID header that EventSource sends, gets every event it missed before the
+// live ones. A cursor the backlog no longer reaches, or one from before the node
+// restarted, can't be resumed from: the stream starts with a reset event instead, and
+// the client has to assume anything may have changed.
+//
+// A client too slow to keep up with the feed is cut off rather than holding up writes,
+// and resumes from its last cursor like any other reconnect. The feed only sees the
+// keys this node stores, so with the ring partitioning the keys a client watches a
+// node holding each part of the prefix it cares about.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultWatchBacklog = 10000            // Events kept for clients resuming a watch
+	watchBuffer         = 256              // Events a watcher may fall behind by before it's cut off
+	watchKeepalive      = 15 * time.Second // How often an idle stream is sent something
+)
+
+// Sources of the changes published to the feed
+const (
+	sourceLocal  = "local"  // A write made on this node
+	sourceGossip = "gossip" // An entry received from another node
+)
+
+var (
+	// errInvalidCursor is returned for a cursor which isn't one the feed hands out
+	errInvalidCursor = errors.New("Invalid cursor")
+
+	// errCursorExpired is returned for a cursor whose events are no longer kept
+	errCursorExpired = errors.New("Cursor expired")
+
+	// errNoFeed is returned when changes aren't being published
+	errNoFeed = errors.New("Watch unavailable")
+)
+
+// watchEvent is a message on a watch stream
+type watchEvent struct {
+	Type   string `json:"type"` // "change", "reset" or "heartbeat"
+	Cursor string `json:"cursor,omitempty"`
+	*watchChange
+}
+
+// watchChange describes the change a "change" event was published for
+type watchChange struct {
+	Key       string      `json:"key"`
+	Value     string      `json:"value"`
+	Version   int         `json:"version"`
+	Clock     VectorClock `json:"clock"`
+	Tombstone bool        `json:"tombstone"`
+	Source    string      `json:"source"` // sourceLocal or sourceGossip
+}
+
+// Watcher receives the events for the keys starting with its prefix
+type Watcher struct {
+	prefix string
+	events chan watchEvent // Closed when the watcher is cut off or unsubscribed
+}
+
+// Feed publishes the changes stored in the KVS to the watchers subscribed to them
+type Feed struct {
+	epoch    string       // Tells this run's cursors from an earlier run's
+	seq      uint64       // Position of the last event published
+	backlog  []watchEvent // The newest events, event n at n % len(backlog)
+	watchers map[*Watcher]bool
+	mutex    sync.Mutex
+}
+
+// NewFeed returns a feed which keeps the given number of events for resuming watches
+func NewFeed(size int) *Feed {
+	if size < 1 {
+		size = 1
+	}
+	return &Feed{
+		epoch:    strconv.FormatInt(time.Now().UnixNano(), 36),
+		backlog:  make([]watchEvent, size),
+		watchers: make(map[*Watcher]bool),
+	}
+}
+
+// cursor returns the cursor for the event at seq
+func (f *Feed) cursor(seq uint64) string {
+	return f.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// position returns the feed position a cursor stands for. An empty cursor stands for
+// the present.
+func (f *Feed) position(cursor string) (uint64, error) {
+	if cursor == "" {
+		return f.seq, nil
+	}
+	i := strings.LastIndex(cursor, "-")
+	if i < 0 {
+		return 0, errInvalidCursor
+	}
+	seq, err := strconv.ParseUint(cursor[i+1:], 10, 64)
+	if err != nil {
+		return 0, errInvalidCursor
+	}
+	if cursor[:i] != f.epoch {
+		return f.seq, errCursorExpired
+	}
+	if seq > f.seq {
+		return 0, errInvalidCursor
+	}
+	if f.seq-seq > uint64(len(f.backlog)) {
+		return f.seq, errCursorExpired
+	}
+	return seq, nil
+}
+
+// Publish adds a change stored in the KVS to the feed. It's called while holding the
+// KVS write lock, so events are published in the order the changes were made, and it
+// never waits on a watcher.
+func (f *Feed) Publish(op walOp, key string, e KeyEntry) {
+	if f == nil {
+		return
+	}
+	source := sourceLocal
+	if op == walOverwrite {
+		source = sourceGossip
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.seq++
+	ev := watchEvent{Type: "change", Cursor: f.cursor(f.seq), watchChange: &watchChange{
+		Key:       key,
+		Value:     e.GetValue(),
+		Version:   e.GetVersion(),
+		Clock:     e.GetClock().Copy(),
+		Tombstone: !e.Alive(),
+		Source:    source,
+	}}
+	f.backlog[f.seq%uint64(len(f.backlog))] = ev
+	for w := range f.watchers {
+		if !strings.HasPrefix(key, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- ev:
+		default:
+			log.Println("Cutting off a watcher which fell behind the feed")
+			f.drop(w)
+		}
+	}
+}
+
+// Subscribe starts a watch on the keys starting with prefix. It returns the events
+// after the cursor still to be sent, and a watcher which receives the ones published
+// from now on. If the cursor can't be resumed from, the error says so and the watch
+// starts from the present with a reset event.
+func (f *Feed) Subscribe(prefix string, cursor string) ([]watchEvent, *Watcher, error) {
+	if f == nil {
+		return nil, nil, errNoFeed
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	from, err := f.position(cursor)
+	if err == errInvalidCursor {
+		return nil, nil, err
+	}
+	var missed []watchEvent
+	if err == errCursorExpired {
+		missed = append(missed, watchEvent{Type: "reset", Cursor: f.cursor(from)})
+	}
+	for seq := from + 1; seq <= f.seq; seq++ {
+		ev := f.backlog[seq%uint64(len(f.backlog))]
+		if ev.watchChange != nil && strings.HasPrefix(ev.Key, prefix) {
+			missed = append(missed, ev)
+		}
+	}
+	w := &Watcher{prefix: prefix, events: make(chan watchEvent, watchBuffer)}
+	f.watchers[w] = true
+	return missed, w, err
+}
+
+// Unsubscribe stops a watch
+func (f *Feed) Unsubscribe(w *Watcher) {
+	if f == nil {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.drop(w)
+}
+
+// drop removes a watcher and closes its channel. It must be called while holding the
+// feed's lock.
+func (f *Feed) drop(w *Watcher) {
+	if f.watchers[w] {
+		delete(f.watchers, w)
+		close(w.events)
+	}
+}
+
+// watchStream writes events to a watch response in the format the client asked for
+type watchStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	sse     bool // Server-Sent Events, otherwise a JSON object per line
+}
+
+// send writes an event to the stream and flushes it to the client
+func (s watchStream) send(ev watchEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if !s.sse {
+		_, err = fmt.Fprintf(s.w, "%s\n", body)
+	} else if ev.Type == "heartbeat" {
+		_, err = fmt.Fprint(s.w, ": keepalive\n\n")
+	} else {
+		_, err = fmt.Fprintf(s.w, "id: %s\nevent: %s\ndata: %s\n\n", ev.Cursor, ev.Type, body)
+	}
+	s.flusher.Flush()
+	return err
+}
+
+// wantsJSON returns true if a watch asks for a JSON object per line
+func wantsJSON(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "json"
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "json") && !strings.Contains(accept, "text/event-stream")
+}
+
+// WatchHandler responds to GET requests on the /keyValue-store/_watch endpoint by
+// streaming the changes to the keys under a prefix until the client goes away
+func (app *App) WatchHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling watch request")
+	q := r.URL.Query()
+	cursor := q.Get("cursor")
+	if cursor == "" {
+		cursor = r.Header.Get("Last-Event-ID")
+	}
+
+	flusher, canFlush := w.(http.Flusher)
+	if !canFlush {
+		app.watchError(w, http.StatusInternalServerError, errors.New("Streaming unsupported"))
+		return
+	}
+	missed, watcher, err := app.feed.Subscribe(q.Get("prefix"), cursor)
+	switch err {
+	case nil, errCursorExpired:
+	case errNoFeed:
+		app.watchError(w, http.StatusServiceUnavailable, err) // code 503
+		return
+	default:
+		app.watchError(w, http.StatusBadRequest, err) // code 400
+		return
+	}
+	defer app.feed.Unsubscribe(watcher)
+
+	s := watchStream{w: w, flusher: flusher, sse: !wantsJSON(r)}
+	if s.sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK) // code 200
+	flusher.Flush()
+
+	if err == errCursorExpired {
+		log.Println("Watch cursor can't be resumed from: ", cursor)
+	}
+	for _, ev := range missed {
+		if s.send(ev) != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(watchKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev, ok := <-watcher.events:
+			if !ok {
+				return
+			}
+			err = s.send(ev)
+		case <-ticker.C:
+			err = s.send(watchEvent{Type: "heartbeat"})
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			log.Println("Ending watch: ", err)
+			return
+		}
+	}
+}
+
+// watchError rejects a watch before any events are sent
+func (app *App) watchError(w http.ResponseWriter, code int, err error) {
+	log.Println("ERROR: Rejecting watch: ", err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	body, _ := json.Marshal(map[string]interface{}{
+		"result": "Error",
+		"msg":    err.Error(),
+	})
+	w.Write(body)
+}
@@ -0,0 +1,144 @@
+// watch_test.go
+//
+// CMPS 128 Fall 2018
+//
+// Lawrence Lawson   lelawson
+// Pete Wilcox       pcwilcox
+// Annie Shen        ashen7
+// Victoria Tran     vilatran
+//
+// Unit tests for the change feed
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// watchedKVS returns a KVS publishing to a feed which keeps size events
+func watchedKVS(size int) *KVS {
+	k := NewKVS()
+	k.feed = NewFeed(size)
+	return k
+}
+
+func TestFeedPublishesChanges(t *testing.T) {
+	k := watchedKVS(10)
+	_, w, err := k.feed.Subscribe("K", "")
+	ok(t, err)
+
+	k.Put(keyone, valone, time.Now(), VectorClock{})
+	k.Put("other", valone, time.Now(), VectorClock{})
+	k.Delete(keyone, time.Now(), VectorClock{})
+	k.OverwriteEntry(keyExists, NewEntry(time.Now(), VectorClock{keyExists: 3}, valExists, 3))
+
+	ev := <-w.events
+	equals(t, watchChange{Key: keyone, Value: valone, Version: 1, Clock: VectorClock{}, Source: sourceLocal}, *ev.watchChange)
+	ev = <-w.events
+	assert(t, ev.Key == keyone && ev.Tombstone, "Delete wasn't published as a tombstone")
+	ev = <-w.events
+	equals(t, keyExists, ev.Key)
+	equals(t, sourceGossip, ev.Source)
+	equals(t, 0, len(w.events))
+}
+
+func TestFeedResumesFromCursor(t *testing.T) {
+	k := watchedKVS(3)
+	for _, val := range []string{"a", "b", "c", "d"} {
+		k.Put(keyone, val, time.Now(), VectorClock{})
+	}
+
+	missed, _, err := k.feed.Subscribe("", k.feed.cursor(2))
+	ok(t, err)
+	equals(t, 2, len(missed))
+	equals(t, "c", missed[0].Value)
+	equals(t, k.feed.cursor(4), missed[1].Cursor)
+
+	// Event 1 has fallen out of the backlog, and so has every event of an earlier run
+	for _, cursor := range []string{k.feed.cursor(0), "earlier-3"} {
+		missed, _, err = k.feed.Subscribe("", cursor)
+		equals(t, errCursorExpired, err)
+		equals(t, []watchEvent{{Type: "reset", Cursor: k.feed.cursor(4)}}, missed)
+	}
+
+	for _, cursor := range []string{"nonsense", k.feed.cursor(5)} {
+		_, _, err = k.feed.Subscribe("", cursor)
+		equals(t, errInvalidCursor, err)
+	}
+}
+
+func TestFeedCutsOffSlowWatcher(t *testing.T) {
+	k := watchedKVS(10)
+	_, w, err := k.feed.Subscribe("", "")
+	ok(t, err)
+	for i := 0; i <= watchBuffer; i++ {
+		k.Put(keyone, valone, time.Now(), VectorClock{})
+	}
+	n := 0
+	for range w.events {
+		n++
+	}
+	equals(t, watchBuffer, n)
+	k.feed.Unsubscribe(w)
+}
+
+func TestWatchHandlerStreams(t *testing.T) {
+	k := watchedKVS(10)
+	app := &App{db: k, view: *NewView(testMain, testMain), feed: k.feed}
+	router := mux.NewRouter()
+	router.HandleFunc(rootURL+watch, app.WatchHandler).Methods(http.MethodGet)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	k.Put(keyone, valone, time.Now(), VectorClock{})
+	req, err := http.NewRequest(http.MethodGet, server.URL+rootURL+watch+"?prefix=K", nil)
+	ok(t, err)
+	req.Header.Set("Last-Event-ID", k.feed.cursor(0))
+	resp, err := http.DefaultClient.Do(req)
+	ok(t, err)
+	defer resp.Body.Close()
+	equals(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// The event from before the watch is sent first, then the ones made during it
+	k.Put("other", valone, time.Now(), VectorClock{})
+	k.Put(keyExists, valExists, time.Now(), VectorClock{})
+	lines := bufio.NewReader(resp.Body)
+	for _, want := range []string{keyone, keyExists} {
+		var frame []string
+		for {
+			line, err := lines.ReadString('\n')
+			ok(t, err)
+			if line == "\n" {
+				break
+			}
+			frame = append(frame, strings.TrimSpace(line))
+		}
+		equals(t, 3, len(frame))
+		equals(t, "event: change", frame[1])
+		var ev map[string]interface{}
+		ok(t, json.Unmarshal([]byte(strings.TrimPrefix(frame[2], "data: ")), &ev))
+		equals(t, want, ev["key"])
+		equals(t, "id: "+ev["cursor"].(string), frame[0])
+	}
+}
+
+func TestWatchHandlerRejectsBadCursor(t *testing.T) {
+	app := &App{db: NewKVS(), view: *NewView(testMain, testMain), feed: NewFeed(10)}
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, rootURL+watch+"?format=json&cursor=nonsense", nil)
+	ok(t, err)
+	app.WatchHandler(recorder, req)
+	equals(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	(&App{}).WatchHandler(recorder, req)
+	equals(t, http.StatusServiceUnavailable, recorder.Code)
+}